@@ -3,11 +3,14 @@ package benchmark
 import (
 	"fmt"
 	"kv_projects/conf"
+	"kv_projects/data"
 	"kv_projects/db"
 	"kv_projects/errs"
+	"kv_projects/index"
 	"kv_projects/utils"
 	"math/rand"
 	"path/filepath"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -42,6 +45,40 @@ func BenchmarkPut(b *testing.B) {
 	}
 }
 
+// 写入 128 字节的小记录，对比活跃文件是否使用写缓冲区的性能
+func BenchmarkPutSmall(b *testing.B) {
+	benchmarkPutSmall(b, false)
+}
+
+func BenchmarkPutSmallBuffered(b *testing.B) {
+	benchmarkPutSmall(b, true)
+}
+
+func benchmarkPutSmall(b *testing.B, bufferedWrite bool) {
+	opts := conf.DefaultOptions
+	opts.DataFileSize = 32 * 1024 * 1024
+	opts.DirPath = filepath.Join("./temp", fmt.Sprintf("bitcask-go-small-%v", bufferedWrite))
+	opts.BufferedWrite = bufferedWrite
+	smallDB, err := db.Open(opts)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer func() {
+		_ = smallDB.Close()
+	}()
+	value := utils.GetTestValue(128)
+
+	b.ResetTimer()
+	b.ReportAllocs()
+
+	for i := 0; i < b.N; i++ {
+		err := smallDB.Put(utils.GetTestKey(i), value)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
 func BenchmarkGet(b *testing.B) {
 	for i := 0; i < 10000; i++ {
 		_ = Db.Put(utils.GetTestKey(i), utils.GetTestValue(1024))
@@ -59,6 +96,30 @@ func BenchmarkGet(b *testing.B) {
 	}
 }
 
+// 每次批量读取 500 个 key
+func BenchmarkMultiGet(b *testing.B) {
+	for i := 0; i < 10000; i++ {
+		_ = Db.Put(utils.GetTestKey(i), utils.GetTestValue(1024))
+	}
+
+	rand.Seed(time.Now().UnixNano())
+	keys := make([][]byte, 500)
+	b.ResetTimer()
+	b.ReportAllocs()
+
+	for i := 0; i < b.N; i++ {
+		for j := range keys {
+			keys[j] = utils.GetTestKey(rand.Intn(10000))
+		}
+		_, errList := Db.MultiGet(keys)
+		for _, err := range errList {
+			if err != nil && err != errs.ErrKeyNotFound {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
 func BenchmarkDelete(b *testing.B) {
 	for i := 0; i < 10000; i++ {
 		_ = Db.Put(utils.GetTestKey(i), utils.GetTestValue(1024))
@@ -75,3 +136,95 @@ func BenchmarkDelete(b *testing.B) {
 		}
 	}
 }
+
+// 参与对比的索引类型
+var indexTypes = []struct {
+	name string
+	tp   index.IndexType
+}{
+	{"BTree", index.Btree},
+	{"ART", index.ART},
+	{"BPTree", index.BPTree},
+	{"Hash", index.Hash},
+	{"SkipList", index.SkipList},
+}
+
+// 并发写入不同的 key，对比各个索引在并发写入下的表现
+func BenchmarkIndex_ParallelPut(b *testing.B) {
+	for _, it := range indexTypes {
+		b.Run(it.name, func(b *testing.B) {
+			indexer, err := index.NewIndexer(it.tp, b.TempDir(), false, 0, nil)
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer indexer.Close()
+
+			var seq int64
+			b.ResetTimer()
+			b.ReportAllocs()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					i := atomic.AddInt64(&seq, 1)
+					indexer.Put(utils.GetTestKey(int(i)), &data.LogRecordPos{Fid: 1, Offset: i})
+				}
+			})
+		})
+	}
+}
+
+// 预先写入一批 key 后并发随机读取
+func BenchmarkIndex_ParallelGet(b *testing.B) {
+	const keyCount = 100000
+	for _, it := range indexTypes {
+		b.Run(it.name, func(b *testing.B) {
+			indexer, err := index.NewIndexer(it.tp, b.TempDir(), false, 0, nil)
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer indexer.Close()
+			for i := 0; i < keyCount; i++ {
+				indexer.Put(utils.GetTestKey(i), &data.LogRecordPos{Fid: 1, Offset: int64(i)})
+			}
+
+			b.ResetTimer()
+			b.ReportAllocs()
+			b.RunParallel(func(pb *testing.PB) {
+				r := rand.New(rand.NewSource(time.Now().UnixNano()))
+				for pb.Next() {
+					indexer.Get(utils.GetTestKey(r.Intn(keyCount)))
+				}
+			})
+		})
+	}
+}
+
+// 并发读写混合，每 10 次操作中有 1 次写入
+func BenchmarkIndex_ParallelMixed(b *testing.B) {
+	const keyCount = 100000
+	for _, it := range indexTypes {
+		b.Run(it.name, func(b *testing.B) {
+			indexer, err := index.NewIndexer(it.tp, b.TempDir(), false, 0, nil)
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer indexer.Close()
+			for i := 0; i < keyCount; i++ {
+				indexer.Put(utils.GetTestKey(i), &data.LogRecordPos{Fid: 1, Offset: int64(i)})
+			}
+
+			b.ResetTimer()
+			b.ReportAllocs()
+			b.RunParallel(func(pb *testing.PB) {
+				r := rand.New(rand.NewSource(time.Now().UnixNano()))
+				for pb.Next() {
+					key := utils.GetTestKey(r.Intn(keyCount))
+					if r.Intn(10) == 0 {
+						indexer.Put(key, &data.LogRecordPos{Fid: 2, Offset: 1})
+					} else {
+						indexer.Get(key)
+					}
+				}
+			})
+		})
+	}
+}
@@ -0,0 +1,145 @@
+package cache
+
+import (
+	"container/list"
+	"kv_projects/data"
+	"sync"
+	"sync/atomic"
+)
+
+// 分片数量，降低并发读取时锁的竞争
+const shardNum = 16
+
+// 每个缓存项除 value 以外额外占用的内存估算值（链表节点、map 项等）
+const entryOverhead = 64
+
+// 缓存的 key，由数据所在的文件 id 和偏移量组成
+// 数据的位置一旦改变（Put 覆盖写、merge 重写），旧位置的缓存自然不会再被访问，最终被淘汰
+type posKey struct {
+	fid    uint32
+	offset int64
+}
+
+type entry struct {
+	key   posKey
+	value []byte
+}
+
+// ValueCache
+// @Description: 按照数据位置缓存解码后的 value，分片 LRU，总内存受 capacity 限制
+type ValueCache struct {
+	shards [shardNum]*lruShard
+	hits   uint64 // 命中次数
+	misses uint64 // 未命中次数
+}
+
+type lruShard struct {
+	mu       sync.Mutex
+	capacity int64 // 当前分片可以使用的最大字节数
+	used     int64 // 当前分片已经使用的字节数
+	ll       *list.List
+	items    map[posKey]*list.Element
+}
+
+/**
+ * NewValueCache
+ * @Description: 初始化 value 缓存
+ * @param capacity 缓存可以使用的最大字节数
+ * @return *ValueCache
+ */
+func NewValueCache(capacity int64) *ValueCache {
+	c := &ValueCache{}
+	for i := range c.shards {
+		c.shards[i] = &lruShard{
+			capacity: capacity / shardNum,
+			ll:       list.New(),
+			items:    make(map[posKey]*list.Element),
+		}
+	}
+	return c
+}
+
+func (c *ValueCache) shard(key posKey) *lruShard {
+	// 同一个文件中相邻的数据分散到不同的分片
+	h := uint64(key.fid)*0x9E3779B97F4A7C15 ^ uint64(key.offset)*0xC2B2AE3D27D4EB4F
+	return c.shards[h>>60]
+}
+
+/**
+ * Get
+ * @Description: 根据数据位置取出缓存的 value，返回的切片由缓存持有，调用方不能修改
+ * @receiver c
+ * @param pos
+ * @return []byte
+ * @return bool
+ */
+func (c *ValueCache) Get(pos *data.LogRecordPos) ([]byte, bool) {
+	key := posKey{fid: pos.Fid, offset: pos.Offset}
+	s := c.shard(key)
+	s.mu.Lock()
+	elem, ok := s.items[key]
+	if ok {
+		s.ll.MoveToFront(elem)
+	}
+	s.mu.Unlock()
+	if !ok {
+		atomic.AddUint64(&c.misses, 1)
+		return nil, false
+	}
+	atomic.AddUint64(&c.hits, 1)
+	return elem.Value.(*entry).value, true
+}
+
+/**
+ * Put
+ * @Description: 缓存数据位置对应的 value，超出容量时淘汰最久未访问的数据
+ * @receiver c
+ * @param pos
+ * @param value
+ */
+func (c *ValueCache) Put(pos *data.LogRecordPos, value []byte) {
+	key := posKey{fid: pos.Fid, offset: pos.Offset}
+	s := c.shard(key)
+	cost := int64(len(value)) + entryOverhead
+	// 单条数据超过分片容量，不进行缓存
+	if cost > s.capacity {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// 同一个位置的数据不会改变，已经存在则无需更新
+	if elem, ok := s.items[key]; ok {
+		s.ll.MoveToFront(elem)
+		return
+	}
+	s.items[key] = s.ll.PushFront(&entry{key: key, value: value})
+	s.used += cost
+	for s.used > s.capacity {
+		oldest := s.ll.Back()
+		e := oldest.Value.(*entry)
+		s.ll.Remove(oldest)
+		delete(s.items, e.key)
+		s.used -= int64(len(e.value)) + entryOverhead
+	}
+}
+
+// Hits 返回缓存命中次数
+func (c *ValueCache) Hits() uint64 {
+	return atomic.LoadUint64(&c.hits)
+}
+
+// Misses 返回缓存未命中次数
+func (c *ValueCache) Misses() uint64 {
+	return atomic.LoadUint64(&c.misses)
+}
+
+// Size 返回缓存当前占用的字节数
+func (c *ValueCache) Size() int64 {
+	var size int64
+	for _, s := range c.shards {
+		s.mu.Lock()
+		size += s.used
+		s.mu.Unlock()
+	}
+	return size
+}
@@ -0,0 +1,49 @@
+package cache
+
+import (
+	"github.com/stretchr/testify/assert"
+	"kv_projects/data"
+	"testing"
+)
+
+func TestValueCache_PutGet(t *testing.T) {
+	c := NewValueCache(1024 * 1024)
+
+	pos := &data.LogRecordPos{Fid: 1, Offset: 100}
+	val, ok := c.Get(pos)
+	assert.False(t, ok)
+	assert.Nil(t, val)
+
+	c.Put(pos, []byte("value-1"))
+	val, ok = c.Get(pos)
+	assert.True(t, ok)
+	assert.Equal(t, []byte("value-1"), val)
+
+	// 同一个 key 的新位置不会命中旧位置的缓存
+	val, ok = c.Get(&data.LogRecordPos{Fid: 1, Offset: 200})
+	assert.False(t, ok)
+	assert.Nil(t, val)
+
+	assert.Equal(t, uint64(1), c.Hits())
+	assert.Equal(t, uint64(2), c.Misses())
+}
+
+func TestValueCache_Evict(t *testing.T) {
+	// 每个分片只能容纳很少的数据
+	c := NewValueCache(shardNum * (entryOverhead + 10) * 2)
+
+	for i := 0; i < 1000; i++ {
+		c.Put(&data.LogRecordPos{Fid: 1, Offset: int64(i)}, []byte("0123456789"))
+	}
+	assert.True(t, c.Size() <= shardNum*(entryOverhead+10)*2)
+
+	// 最后写入的数据一定还在缓存中
+	val, ok := c.Get(&data.LogRecordPos{Fid: 1, Offset: 999})
+	assert.True(t, ok)
+	assert.Equal(t, []byte("0123456789"), val)
+
+	// 超过分片容量的数据不会被缓存
+	c.Put(&data.LogRecordPos{Fid: 2, Offset: 0}, make([]byte, 1024))
+	_, ok = c.Get(&data.LogRecordPos{Fid: 2, Offset: 0})
+	assert.False(t, ok)
+}
@@ -1,6 +1,8 @@
 package conf
 
 import (
+	"kv_projects/dump"
+	"kv_projects/fio"
 	"kv_projects/index"
 	"os"
 )
@@ -26,10 +28,54 @@ type Options struct {
 	// 指定启动时是否使用MMap进行加载
 	MMapAtStartUp bool
 
+	// 旧数据文件在整个运行期间是否一直使用 MMap 读取，开启后可以使用 GetFunc 零拷贝读取数据
+	MMapSealedFiles bool
+
+	// 活跃文件是否使用带写缓冲区的 IO，小记录合并后写入文件。
+	// 没有开启 SyncWrite 时，进程崩溃会丢失缓冲区中还没有写入文件的数据
+	BufferedWrite bool
+
+	// 活跃文件是否使用可读写的 mmap，打开时预先分配 DataFileSize 大小的空间，写入直接拷贝到映射的内存中。
+	// 不能和 BufferedWrite 同时开启
+	MMapWrite bool
+
+	// 使用直接 IO 的场景，可以组合，为 0 时不使用。直接 IO 不经过页缓存，避免大量顺序读写挤掉热点数据；
+	// 文件系统不支持时退化为标准文件 IO
+	DirectIO DirectIOUsage
+
 	// 进行 merge 的阈值
 	DataFileMergeRatio float32
+
+	// value 读缓存可以使用的最大字节数，为 0 时不开启缓存
+	ValueCacheSize int64
+
+	// B+ 树索引使用的布隆过滤器误判率，为 0 时不使用布隆过滤器
+	BloomFalsePositiveRate float64
+
+	// 同时打开的旧数据文件数量上限，超出时关闭最久没有读取的文件，为 0 时不限制
+	MaxOpenFiles int
+
+	// 两阶段提交协调者的日志目录，启动时根据其中的提交决定处理上次没有完成的跨实例事务，
+	// 通过 FileSystem 读取，协调者需要和数据库使用同一个文件系统
+	TxnCoordinatorDir string
+
+	// 数据目录所在的文件系统，为 nil 时使用操作系统的文件系统。
+	// 使用 fio.MemFileSystem 时数据全部保存在内存中，只能使用 Btree、ART 等内存索引，mmap 和直接 IO 等选项不起作用
+	FileSystem fio.FileSystem
 }
 
+// DirectIOUsage 使用直接 IO 的场景
+type DirectIOUsage uint8
+
+const (
+	// merge 读取旧文件以及写入新文件时使用直接 IO
+	DirectIOMerge DirectIOUsage = 1 << iota
+	// 备份读取文件时使用直接 IO
+	DirectIOBackup
+	// 所有数据文件的读写以及 merge 和备份都使用直接 IO，此时不能使用 mmap 和写缓冲区，启动时也不会使用 mmap 加载
+	DirectIOAll
+)
+
 // 用户初始化迭代器时，传入的配置
 type IteratorOptions struct {
 	// 遍历前缀为指定值的 key，默认为空
@@ -41,18 +87,59 @@ type IteratorOptions struct {
 type WriteBatchOptions struct {
 	// 事务操作中一个批次可以存放数据的最大值
 	MaxBatchNum uint
+	// 一个批次暂存数据（key 和 value）的最大字节数，为 0 时不限制
+	MaxBatchSize int64
 	// 提交事务时，是否进行 sync 持久化
 	SyncWrites bool
 }
 
+// 导出数据时传入的配置
+type ExportOptions struct {
+	// 导出的格式，默认为带校验值的二进制格式
+	Format dump.Format
+	// 只导出前缀为指定值的 key，默认为空
+	Prefix []byte
+	// 只导出大于等于 Start 的 key，为空时不限制
+	Start []byte
+	// 只导出小于 End 的 key，为空时不限制
+	End []byte
+}
+
+// 导入数据时传入的配置
+type ImportOptions struct {
+	// 导入数据的格式
+	Format dump.Format
+	// 只导入前缀为指定值的 key，默认为空
+	Prefix []byte
+	// 只导入大于等于 Start 的 key，为空时不限制
+	Start []byte
+	// 只导入小于 End 的 key，为空时不限制
+	End []byte
+	// 并行写入的协程数，相同的 key 总是由同一个协程按顺序写入
+	Parallelism int
+	// 每个批次提交的记录数
+	BatchNum uint
+	// 每个批次提交时，是否进行 sync 持久化
+	SyncWrites bool
+}
+
 var DefaultOptions = Options{
-	DirPath:            os.TempDir(),
-	DataFileSize:       256 * 1024 * 1024, // 256MB
-	BytesPerSync:       0,
-	SyncWrite:          false,
-	IndexType:          index.Btree,
-	MMapAtStartUp:      true,
-	DataFileMergeRatio: 0.5, // 当无效数据占据总数据的一般时开始merge
+	DirPath:                os.TempDir(),
+	DataFileSize:           256 * 1024 * 1024, // 256MB
+	BytesPerSync:           0,
+	SyncWrite:              false,
+	IndexType:              index.Btree,
+	MMapAtStartUp:          true,
+	MMapSealedFiles:        false,
+	BufferedWrite:          false,
+	MMapWrite:              false,
+	DirectIO:               0,
+	DataFileMergeRatio:     0.5, // 当无效数据占据总数据的一般时开始merge
+	ValueCacheSize:         0,
+	BloomFalsePositiveRate: 0.01,
+	MaxOpenFiles:           0,
+	TxnCoordinatorDir:      "",
+	FileSystem:             nil,
 }
 
 // 用户迭代器默认配置
@@ -61,6 +148,23 @@ var DefaultIteratorOptions = IteratorOptions{
 	Reverse: false,
 }
 var DefaultWriteBatchOptions = WriteBatchOptions{
-	MaxBatchNum: 10000,
-	SyncWrites:  true,
+	MaxBatchNum:  10000,
+	MaxBatchSize: 0,
+	SyncWrites:   true,
+}
+
+var DefaultExportOptions = ExportOptions{
+	Format: dump.Binary,
+	Prefix: nil,
+	Start:  nil,
+	End:    nil,
+}
+var DefaultImportOptions = ImportOptions{
+	Format:      dump.Binary,
+	Prefix:      nil,
+	Start:       nil,
+	End:         nil,
+	Parallelism: 4,
+	BatchNum:    1000,
+	SyncWrites:  false,
 }
@@ -1,12 +1,16 @@
 package data
 
 import (
+	"container/list"
+	"encoding/binary"
 	"fmt"
+	"hash"
 	"hash/crc32"
 	"io"
 	"kv_projects/errs"
 	"kv_projects/fio"
 	"path/filepath"
+	"sync/atomic"
 )
 
 // 约定数据存储在以.data为后缀的文件内
@@ -15,18 +19,69 @@ const (
 	HintFileName          = "hint-index"
 	MergeFinishedFileName = "merge-finished"
 	SeqNoFileName         = "seq-no"
+	IndexSnapshotFileName = "index-snapshot"
+	PreparedTxnFileName   = "txn-prepared"
+	CoordinatorFileName   = "txn-coordinator"
 )
 
 type DataFile struct {
 	FileId      uint32        // 当前文件的id
 	WriteOffset int64         // 文件写到的位置
 	IOManager   fio.IOManager // 管理文件读写操作
+
+	fs           fio.FileSystem // 文件所在的文件系统
+	fileName     string
+	ioType       fio.FileIOType
+	preallocSize int64 // 活跃文件预先分配的大小，只有可读写的 mmap 使用
+	refs         int32 // 引用计数，打开时为 1，由数据库实例持有，迭代器等需要长时间使用文件时额外增加引用
+	obsolete     int32 // 文件已经被 merge 替换，最后一个引用释放时删除
+
+	table *FileTable    // 管理文件句柄的句柄表，为 nil 时句柄一直保持打开
+	elem  *list.Element // 在句柄表中的位置，句柄关闭时为 nil，由句柄表的锁保护
+	pins  int32         // 正在使用句柄的读取操作数量，由句柄表的锁保护
 }
 
 // 打开新的数据文件
-func OpenDataFile(dirPath string, fileId uint32, ioType fio.FileIOType) (*DataFile, error) {
+func OpenDataFile(fsys fio.FileSystem, dirPath string, fileId uint32, ioType fio.FileIOType) (*DataFile, error) {
+	fileName := GetDataFileName(dirPath, fileId)
+	return newDataFile(fsys, fileName, fileId, ioType, 0)
+}
+
+/**
+ * OpenActiveDataFile
+ * @Description: 打开活跃文件，使用可读写的 mmap 时预先分配 preallocSize 大小的空间，之后切换 IO 类型时同样使用
+ * @param fsys
+ * @param dirPath
+ * @param fileId
+ * @param ioType
+ * @param preallocSize
+ * @return *DataFile
+ * @return error
+ */
+func OpenActiveDataFile(fsys fio.FileSystem, dirPath string, fileId uint32, ioType fio.FileIOType, preallocSize int64) (*DataFile, error) {
 	fileName := GetDataFileName(dirPath, fileId)
-	return newDataFile(fileName, fileId, ioType)
+	return newDataFile(fsys, fileName, fileId, ioType, preallocSize)
+}
+
+/**
+ * OpenSealedDataFile
+ * @Description: 打开旧数据文件，文件交给句柄表管理，第一次读取时才真正打开
+ * @param fsys
+ * @param dirPath
+ * @param fileId
+ * @param ioType
+ * @param table
+ * @return *DataFile
+ */
+func OpenSealedDataFile(fsys fio.FileSystem, dirPath string, fileId uint32, ioType fio.FileIOType, table *FileTable) *DataFile {
+	return &DataFile{
+		FileId:   fileId,
+		fs:       fsys,
+		fileName: GetDataFileName(dirPath, fileId),
+		ioType:   ioType,
+		refs:     1,
+		table:    table,
+	}
 }
 
 func GetDataFileName(dirPath string, fileId uint32) string {
@@ -34,50 +89,140 @@ func GetDataFileName(dirPath string, fileId uint32) string {
 }
 
 // 打开 hint 文件
-func OpenHintFile(dirPath string) (*DataFile, error) {
+func OpenHintFile(fsys fio.FileSystem, dirPath string) (*DataFile, error) {
 	fileName := filepath.Join(dirPath, HintFileName)
-	return newDataFile(fileName, 0, fio.StandardIoManager)
+	return newDataFile(fsys, fileName, 0, fio.StandardIoManager, 0)
 }
 
 // 打开标识事务序列号的文件
-func OpenSeqNoFile(dirPath string) (*DataFile, error) {
+func OpenSeqNoFile(fsys fio.FileSystem, dirPath string) (*DataFile, error) {
 	fileName := filepath.Join(dirPath, SeqNoFileName)
-	return newDataFile(fileName, 0, fio.StandardIoManager)
+	return newDataFile(fsys, fileName, 0, fio.StandardIoManager, 0)
 }
 
 // 打开标识 merge 完成文件
-func OpenMergeFinishedFile(dirPath string) (*DataFile, error) {
+func OpenMergeFinishedFile(fsys fio.FileSystem, dirPath string) (*DataFile, error) {
 	fileName := filepath.Join(dirPath, MergeFinishedFileName)
-	return newDataFile(fileName, 0, fio.StandardIoManager)
+	return newDataFile(fsys, fileName, 0, fio.StandardIoManager, 0)
+}
+
+// 打开记录两阶段提交中已经准备的事务的文件
+func OpenPreparedTxnFile(fsys fio.FileSystem, dirPath string) (*DataFile, error) {
+	fileName := filepath.Join(dirPath, PreparedTxnFileName)
+	return newDataFile(fsys, fileName, 0, fio.StandardIoManager, 0)
 }
 
-func newDataFile(fileName string, fileId uint32, ioType fio.FileIOType) (*DataFile, error) {
+// 打开两阶段提交协调者的日志文件
+func OpenCoordinatorFile(fsys fio.FileSystem, dirPath string) (*DataFile, error) {
+	fileName := filepath.Join(dirPath, CoordinatorFileName)
+	return newDataFile(fsys, fileName, 0, fio.StandardIoManager, 0)
+}
+
+func newDataFile(fsys fio.FileSystem, fileName string, fileId uint32, ioType fio.FileIOType, preallocSize int64) (*DataFile, error) {
 	// 初始化 IOManager 管理器接口
-	ioManager, err := fio.NewIOManager(fileName, ioType)
+	ioManager, err := fio.NewIOManager(fsys, fileName, ioType, preallocSize)
 	if err != nil {
 		return nil, err
 	}
 	return &DataFile{
-		FileId:      fileId,
-		WriteOffset: 0,
-		IOManager:   ioManager,
+		FileId:       fileId,
+		WriteOffset:  0,
+		IOManager:    ioManager,
+		fs:           fsys,
+		fileName:     fileName,
+		ioType:       ioType,
+		preallocSize: preallocSize,
+		refs:         1,
 	}, nil
 }
 
+// Ref 增加一个引用，引用释放之前文件不会被关闭
+func (df *DataFile) Ref() {
+	atomic.AddInt32(&df.refs, 1)
+}
+
+/**
+ * Unref
+ * @Description: 释放一个引用，最后一个引用释放时关闭文件，文件已经被标记为废弃时同时删除
+ * @receiver df
+ * @return error
+ */
+func (df *DataFile) Unref() error {
+	if atomic.AddInt32(&df.refs, -1) != 0 {
+		return nil
+	}
+	if err := df.Close(); err != nil {
+		return err
+	}
+	if atomic.LoadInt32(&df.obsolete) == 1 {
+		return df.fs.Remove(df.fileName)
+	}
+	return nil
+}
+
+// MarkObsolete 标记文件已经被 merge 替换，不再属于数据库
+func (df *DataFile) MarkObsolete() {
+	atomic.StoreInt32(&df.obsolete, 1)
+}
+
+/**
+ * Acquire
+ * @Description: 打开文件句柄并保证在 Release 之前不会被句柄表淘汰，
+ * 使用 ReadLogRecordNoCopy 返回的数据期间需要一直持有
+ * @receiver df
+ * @return error
+ */
+func (df *DataFile) Acquire() error {
+	if df.table == nil {
+		return nil
+	}
+	return df.table.acquire(df)
+}
+
+// Release 释放 Acquire 持有的句柄
+func (df *DataFile) Release() {
+	if df.table != nil {
+		df.table.release(df)
+	}
+}
+
 // 文件持久化操作
 func (df *DataFile) Sync() error {
+	if err := df.Acquire(); err != nil {
+		return err
+	}
+	defer df.Release()
 	return df.IOManager.Sync()
 }
 
+// 获取文件大小
+func (df *DataFile) Size() (int64, error) {
+	if err := df.Acquire(); err != nil {
+		return 0, err
+	}
+	defer df.Release()
+	return df.IOManager.Size()
+}
+
 // 关闭文件
 func (df *DataFile) Close() error {
+	if df.table != nil {
+		return df.table.close(df)
+	}
 	return df.IOManager.Close()
 }
 
-// 文件写入操作
+// 文件写入操作。只写入一部分时截掉这部分数据，否则之后的记录写在它后面，记录的位置都不正确；
+// 截断也失败时按照实际写入的长度更新偏移量
 func (df *DataFile) Write(buf []byte) error {
 	write, err := df.IOManager.Write(buf)
 	if err != nil {
+		if write > 0 {
+			if truncateErr := df.Truncate(df.WriteOffset); truncateErr != nil {
+				df.WriteOffset += int64(write)
+				return fmt.Errorf("%w (failed to discard the partial write: %v)", err, truncateErr)
+			}
+		}
 		return err
 	}
 	// 更新偏移量
@@ -95,28 +240,33 @@ func (df *DataFile) Write(buf []byte) error {
  * @return error
  */
 func (df *DataFile) ReadLogRecord(offset int64) (*LogRecord, int64, error) {
-	fileSize, err := df.IOManager.Size()
-	if err != nil {
+	return df.readLogRecord(offset, false)
+}
+
+/**
+ * ReadLogRecordNoCopy
+ * @Description: 和 ReadLogRecord 相同，但是 IOManager 支持 fio.SliceReader 时，
+ * 返回的 Key 和 Value 直接引用映射的内存，只在文件关闭前有效，且不能被修改；
+ * 文件由句柄表管理时，调用方需要在使用数据期间持有 Acquire
+ * @receiver df
+ * @param offset
+ * @return *LogRecord
+ * @return int64
+ * @return error
+ */
+func (df *DataFile) ReadLogRecordNoCopy(offset int64) (*LogRecord, int64, error) {
+	return df.readLogRecord(offset, true)
+}
+
+func (df *DataFile) readLogRecord(offset int64, noCopy bool) (*LogRecord, int64, error) {
+	if err := df.Acquire(); err != nil {
 		return nil, 0, err
 	}
-	// 如果读取的最大 header 长度超过文件的长度，直接读取到文件末尾即可
-	var headerBytes int64 = maxLogRecordHeaderSize
-	if offset+maxLogRecordHeaderSize > fileSize {
-		headerBytes = fileSize - offset
-	}
-
-	headerBuf, err := df.ReadNBytes(headerBytes, offset)
+	defer df.Release()
+	header, headerNotCRC, headerSize, err := df.readLogRecordHeader(offset)
 	if err != nil {
 		return nil, 0, err
 	}
-	header, headerSize := DecoderLogRecord(headerBuf)
-	// 表示读到文件末尾，直接返回EOF
-	if header == nil {
-		return nil, 0, io.EOF
-	}
-	if header.crc == 0 && header.keySize == 0 && header.valueSize == 0 {
-		return nil, 0, io.EOF
-	}
 	// 取出对应的 key 和 value 的长度
 	keySize, valueSize := int64(header.keySize), int64(header.valueSize)
 
@@ -125,7 +275,12 @@ func (df *DataFile) ReadLogRecord(offset int64) (*LogRecord, int64, error) {
 	var logRecord = &LogRecord{Type: header.recordType}
 	// 开始读取真实的数据
 	if keySize > 0 || valueSize > 0 {
-		kvBuff, err := df.ReadNBytes(keySize+valueSize, offset+headerSize)
+		var kvBuff []byte
+		if noCopy {
+			kvBuff, err = df.sliceNBytes(keySize+valueSize, offset+headerSize)
+		} else {
+			kvBuff, err = df.ReadNBytes(keySize+valueSize, offset+headerSize)
+		}
 		if err != nil {
 			return nil, 0, err
 		}
@@ -133,14 +288,233 @@ func (df *DataFile) ReadLogRecord(offset int64) (*LogRecord, int64, error) {
 		logRecord.Value = kvBuff[keySize:]
 	}
 
+	expectedCRC, logrecordSize, err := df.expectedCRC(header, offset, logrecordSize)
+	if err != nil {
+		return nil, 0, err
+	}
+	if header.recordType == LogRecordStreamed {
+		logRecord.Type = LogRecordNormal
+	}
+
 	// 校验数据的有效性 获取 除 crc 以外的内容计算校验值，与原本crc进行比较
-	crc := GetLogRecordCRC(logRecord, headerBuf[crc32.Size:headerSize])
-	if crc != header.crc {
+	crc := GetLogRecordCRC(logRecord, headerNotCRC)
+	if crc != expectedCRC {
+		return nil, 0, errs.ErrInvalidCRC
+	}
+	return logRecord, logrecordSize, nil
+}
+
+/**
+ * ReadLogRecordKey
+ * @Description: 和 ReadLogRecord 相同，但是返回的记录不包含 value。value 分块读取并计算校验值，
+ * 不会整体读入内存，用于启动时构建索引、merge 等只需要 key 和记录长度的场景
+ * @receiver df
+ * @param offset
+ * @return *LogRecord Value 为 nil
+ * @return int64, 代表整个 logRecord的长度
+ * @return error
+ */
+func (df *DataFile) ReadLogRecordKey(offset int64) (*LogRecord, int64, error) {
+	if err := df.Acquire(); err != nil {
+		return nil, 0, err
+	}
+	defer df.Release()
+	header, headerNotCRC, headerSize, err := df.readLogRecordHeader(offset)
+	if err != nil {
+		return nil, 0, err
+	}
+	keySize, valueSize := int64(header.keySize), int64(header.valueSize)
+	var logRecord = &LogRecord{Type: header.recordType}
+	if keySize > 0 {
+		if logRecord.Key, err = df.ReadNBytes(keySize, offset+headerSize); err != nil {
+			return nil, 0, err
+		}
+	}
+	crc := crc32.NewIEEE()
+	crc.Write(headerNotCRC)
+	crc.Write(logRecord.Key)
+	if err := df.updateCRC(crc, offset+headerSize+keySize, valueSize); err != nil {
+		return nil, 0, err
+	}
+
+	expectedCRC, logrecordSize, err := df.expectedCRC(header, offset, headerSize+keySize+valueSize)
+	if err != nil {
+		return nil, 0, err
+	}
+	if header.recordType == LogRecordStreamed {
+		logRecord.Type = LogRecordNormal
+	}
+	if crc.Sum32() != expectedCRC {
 		return nil, 0, errs.ErrInvalidCRC
 	}
 	return logRecord, logrecordSize, nil
 }
 
+/**
+ * readLogRecordHeader
+ * @Description: 读取并解码 offset 位置记录的 header，调用方需要持有 Acquire
+ * @receiver df
+ * @param offset
+ * @return *LogRecordHeader
+ * @return []byte header 中除 crc 以外的部分，用于计算校验值，可能引用映射的内存
+ * @return int64 header 的长度
+ * @return error 读到文件末尾时返回 io.EOF
+ */
+func (df *DataFile) readLogRecordHeader(offset int64) (*LogRecordHeader, []byte, int64, error) {
+	fileSize, err := df.IOManager.Size()
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	// 如果读取的最大 header 长度超过文件的长度，直接读取到文件末尾即可
+	var headerBytes int64 = maxLogRecordHeaderSize
+	if offset+maxLogRecordHeaderSize > fileSize {
+		headerBytes = fileSize - offset
+	}
+
+	// header 只用于解码，不会被返回给调用方，可以直接引用映射的内存
+	headerBuf, err := df.sliceNBytes(headerBytes, offset)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	header, headerSize := DecoderLogRecord(headerBuf)
+	// 表示读到文件末尾，直接返回EOF
+	if header == nil {
+		return nil, nil, 0, io.EOF
+	}
+	// 全为 0 的 header 只会出现在可读写 mmap 预分配的文件末尾，之后的内容也必须全部为 0，否则是数据损坏
+	if header.crc == 0 && header.keySize == 0 && header.valueSize == 0 {
+		zeroTail, err := df.isZeroTail(offset, fileSize)
+		if err != nil {
+			return nil, nil, 0, err
+		}
+		if zeroTail {
+			return nil, nil, 0, io.EOF
+		}
+		return nil, nil, 0, errs.ErrInvalidCRC
+	}
+	return header, headerBuf[crc32.Size:headerSize], headerSize, nil
+}
+
+// 返回记录的校验值和总长度，流式写入的记录校验值在 value 之后，总长度包含末尾的校验值，调用方需要持有 Acquire
+func (df *DataFile) expectedCRC(header *LogRecordHeader, offset, size int64) (uint32, int64, error) {
+	if header.recordType != LogRecordStreamed {
+		return header.crc, size, nil
+	}
+	trailer, err := df.ReadNBytes(crc32.Size, offset+size)
+	if err != nil {
+		return 0, 0, err
+	}
+	return binary.LittleEndian.Uint32(trailer), size + crc32.Size, nil
+}
+
+// 分块读取 [offset, offset+n) 的内容累加到 crc 中，不会整体读入内存，调用方需要持有 Acquire
+func (df *DataFile) updateCRC(crc hash.Hash32, offset, n int64) error {
+	sr, isSlice := df.IOManager.(fio.SliceReader)
+	var buf []byte
+	if !isSlice {
+		buf = make([]byte, min(n, StreamChunkSize))
+	}
+	for n > 0 {
+		size := min(n, StreamChunkSize)
+		var chunk []byte
+		var err error
+		if isSlice {
+			chunk, err = sr.Slice(size, offset)
+		} else {
+			chunk = buf[:size]
+			_, err = df.IOManager.Read(chunk, offset)
+		}
+		if err != nil {
+			return err
+		}
+		crc.Write(chunk)
+		offset += size
+		n -= size
+	}
+	return nil
+}
+
+// 判断 [offset, fileSize) 范围内的内容是否全部为 0，调用方需要持有 Acquire
+func (df *DataFile) isZeroTail(offset, fileSize int64) (bool, error) {
+	const chunkSize = 64 * 1024
+	for offset < fileSize {
+		n := min(int64(chunkSize), fileSize-offset)
+		buf, err := df.sliceNBytes(n, offset)
+		if err != nil {
+			return false, err
+		}
+		for _, b := range buf {
+			if b != 0 {
+				return false, nil
+			}
+		}
+		offset += n
+	}
+	return true, nil
+}
+
+/**
+ * LastRecordEnd
+ * @Description: 返回文件中最后一条记录的结束位置。文件末尾不为 0 时就是文件大小，
+ * 否则末尾可能是上次没有正常关闭时留下的预分配空间，需要从头遍历记录
+ * @receiver df
+ * @return int64
+ * @return error
+ */
+func (df *DataFile) LastRecordEnd() (int64, error) {
+	if err := df.Acquire(); err != nil {
+		return 0, err
+	}
+	defer df.Release()
+	fileSize, err := df.IOManager.Size()
+	if err != nil || fileSize == 0 {
+		return fileSize, err
+	}
+	last, err := df.ReadNBytes(1, fileSize-1)
+	if err != nil {
+		return 0, err
+	}
+	if last[0] != 0 {
+		return fileSize, nil
+	}
+	var offset int64 = 0
+	for {
+		_, size, err := df.ReadLogRecordKey(offset)
+		if err == io.EOF {
+			return offset, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+		offset += size
+	}
+}
+
+/**
+ * Truncate
+ * @Description: 丢弃 size 之后的数据，并更新写入位置。文件大小不超过 size 时不做处理
+ * @receiver df
+ * @param size
+ * @return error
+ */
+func (df *DataFile) Truncate(size int64) error {
+	fileSize, err := df.Size()
+	if err != nil {
+		return err
+	}
+	if fileSize > size {
+		truncater, ok := df.IOManager.(fio.Truncater)
+		if !ok {
+			return errs.ErrReadOnlyIOManager
+		}
+		if err := truncater.Truncate(size); err != nil {
+			return err
+		}
+	}
+	df.WriteOffset = size
+	return nil
+}
+
 /**
  * WriteHintFile
  * @Description: 将 key 和其对应的文件索引信息写入 Hint 索引文件
@@ -170,14 +544,18 @@ func (df *DataFile) WriteHintFile(key []byte, pos *LogRecordPos) error {
  * @return error
  */
 func (df *DataFile) SetIOManager(dirPath string, ioType fio.FileIOType) error {
+	if df.table != nil {
+		return df.table.reset(df, ioType)
+	}
 	if err := df.IOManager.Close(); err != nil {
 		return err
 	}
-	ioManager, err := fio.NewIOManager(GetDataFileName(dirPath, df.FileId), ioType)
+	ioManager, err := fio.NewIOManager(df.fs, GetDataFileName(dirPath, df.FileId), ioType, df.preallocSize)
 	if err != nil {
 		return err
 	}
 	df.IOManager = ioManager
+	df.ioType = ioType
 	return nil
 }
 
@@ -190,3 +568,11 @@ func (df *DataFile) ReadNBytes(n int64, offset int64) ([]byte, error) {
 	}
 	return b, nil
 }
+
+// 读取 n 个byte，IOManager 支持时直接返回映射内存的切片，不进行拷贝
+func (df *DataFile) sliceNBytes(n int64, offset int64) ([]byte, error) {
+	if sr, ok := df.IOManager.(fio.SliceReader); ok {
+		return sr.Slice(n, offset)
+	}
+	return df.ReadNBytes(n, offset)
+}
@@ -2,23 +2,26 @@ package data
 
 import (
 	"github.com/stretchr/testify/assert"
+	"io"
+	"kv_projects/errs"
 	"kv_projects/fio"
+	"os"
 	"testing"
 )
 
 func TestOpenDataFile(t *testing.T) {
-	openDataFile, err := OpenDataFile("./temp", 0, fio.StandardIoManager)
+	openDataFile, err := OpenDataFile(fio.OSFileSystem{}, "./temp", 0, fio.StandardIoManager)
 	assert.Nil(t, err)
 	assert.NotNil(t, openDataFile)
 
-	openDataFile1, err := OpenDataFile("./temp", 999, fio.StandardIoManager)
+	openDataFile1, err := OpenDataFile(fio.OSFileSystem{}, "./temp", 999, fio.StandardIoManager)
 	assert.Nil(t, err)
 	assert.NotNil(t, openDataFile1)
 
 }
 
 func TestDataFile_Write(t *testing.T) {
-	openDataFile, err := OpenDataFile("./temp", 0, fio.StandardIoManager)
+	openDataFile, err := OpenDataFile(fio.OSFileSystem{}, "./temp", 0, fio.StandardIoManager)
 	assert.Nil(t, err)
 	assert.NotNil(t, openDataFile)
 
@@ -33,8 +36,26 @@ func TestDataFile_Write(t *testing.T) {
 
 }
 
+func TestDataFile_WriteShort(t *testing.T) {
+	fsys := fio.NewFaultFileSystem(fio.NewMemFileSystem())
+	dataFile, err := openMemDataFile(fsys)
+	assert.Nil(t, err)
+	defer dataFile.Close()
+	assert.Nil(t, dataFile.Write([]byte("aaaa")))
+
+	// 只写入一部分时截掉写入的数据，之后的写入从原来的位置开始
+	fsys.FailWrite(1, true)
+	assert.Equal(t, errs.ErrInjectedFault, dataFile.Write([]byte("bbbb")))
+	assert.Equal(t, int64(4), dataFile.WriteOffset)
+	assert.Nil(t, dataFile.Write([]byte("cccc")))
+	assert.Equal(t, int64(8), dataFile.WriteOffset)
+	content, err := fio.ReadFile(fsys, dataFile.fileName)
+	assert.Nil(t, err)
+	assert.Equal(t, "aaaacccc", string(content))
+}
+
 func TestDataFile_Close(t *testing.T) {
-	openDataFile, err := OpenDataFile("./temp", 0, fio.StandardIoManager)
+	openDataFile, err := OpenDataFile(fio.OSFileSystem{}, "./temp", 0, fio.StandardIoManager)
 	assert.Nil(t, err)
 	assert.NotNil(t, openDataFile)
 
@@ -45,8 +66,31 @@ func TestDataFile_Close(t *testing.T) {
 	assert.Nil(t, err)
 }
 
+func TestDataFile_Unref(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "bitcask-go-unref")
+	defer os.RemoveAll(dir)
+	dataFile, err := OpenDataFile(fio.OSFileSystem{}, dir, 0, fio.StandardIoManager)
+	assert.Nil(t, err)
+	assert.Nil(t, dataFile.Write([]byte("aaaa")))
+
+	// 还有其他引用时不会关闭，也不会删除
+	dataFile.Ref()
+	dataFile.MarkObsolete()
+	assert.Nil(t, dataFile.Unref())
+	_, err = os.Stat(GetDataFileName(dir, 0))
+	assert.Nil(t, err)
+	b, err := dataFile.ReadNBytes(4, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("aaaa"), b)
+
+	// 最后一个引用释放时关闭并删除
+	assert.Nil(t, dataFile.Unref())
+	_, err = os.Stat(GetDataFileName(dir, 0))
+	assert.True(t, os.IsNotExist(err))
+}
+
 func TestDataFile_Sync(t *testing.T) {
-	openDataFile, err := OpenDataFile("./temp", 0, fio.StandardIoManager)
+	openDataFile, err := OpenDataFile(fio.OSFileSystem{}, "./temp", 0, fio.StandardIoManager)
 	assert.Nil(t, err)
 	assert.NotNil(t, openDataFile)
 
@@ -58,7 +102,7 @@ func TestDataFile_Sync(t *testing.T) {
 }
 
 func TestDataFile_ReadLogRecord(t *testing.T) {
-	dataFile, err := OpenDataFile("./temp", 222, fio.StandardIoManager)
+	dataFile, err := OpenDataFile(fio.OSFileSystem{}, "./temp", 222, fio.StandardIoManager)
 	assert.Nil(t, err)
 	assert.NotNil(t, dataFile)
 
@@ -95,3 +139,82 @@ func TestDataFile_ReadLogRecord(t *testing.T) {
 	assert.Equal(t, size3, size4)
 
 }
+
+func TestDataFile_ReadLogRecordNoCopy(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "bitcask-go-datafile")
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	dataFile, err := OpenDataFile(fio.OSFileSystem{}, dir, 1, fio.StandardIoManager)
+	assert.Nil(t, err)
+
+	rec1 := &LogRecord{Key: []byte("name"), Value: []byte("bitcask kv go")}
+	buf1, size1 := EncoderLogRecord(rec1)
+	assert.Nil(t, dataFile.Write(buf1))
+	rec2 := &LogRecord{Key: []byte("name"), Type: LogRecordDeleted}
+	buf2, _ := EncoderLogRecord(rec2)
+	assert.Nil(t, dataFile.Write(buf2))
+	assert.Nil(t, dataFile.Close())
+
+	// 使用 mmap 打开后，读取的内容直接引用映射的内存
+	dataFile, err = OpenDataFile(fio.OSFileSystem{}, dir, 1, fio.MMapIoManager)
+	assert.Nil(t, err)
+	defer func() {
+		_ = dataFile.Close()
+	}()
+	readRec1, readSize1, err := dataFile.ReadLogRecordNoCopy(0)
+	assert.Nil(t, err)
+	assert.Equal(t, rec1, readRec1)
+	assert.Equal(t, size1, readSize1)
+
+	readRec2, _, err := dataFile.ReadLogRecordNoCopy(readSize1)
+	assert.Nil(t, err)
+	assert.Equal(t, LogRecordDeleted, readRec2.Type)
+
+	// 拷贝读取的结果和零拷贝读取的结果一致
+	copyRec1, _, err := dataFile.ReadLogRecord(0)
+	assert.Nil(t, err)
+	assert.Equal(t, readRec1, copyRec1)
+}
+
+// 可读写 mmap 预分配的空间全部为 0，读到这里表示文件结束
+func TestDataFile_PreallocatedTail(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "bitcask-go-prealloc")
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	dataFile, err := OpenActiveDataFile(fio.OSFileSystem{}, dir, 1, fio.MMapWriteIoManager, 4096)
+	assert.Nil(t, err)
+	rec := &LogRecord{Key: []byte("name"), Value: []byte("bitcask kv go")}
+	buf, size := EncoderLogRecord(rec)
+	assert.Nil(t, dataFile.Write(buf))
+	assert.Nil(t, dataFile.Sync())
+
+	// 模拟没有正常关闭，用标准文件 IO 打开时可以看到预分配的空间
+	sealed, err := OpenDataFile(fio.OSFileSystem{}, dir, 1, fio.StandardIoManager)
+	assert.Nil(t, err)
+	fileSize, err := sealed.Size()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(4096), fileSize)
+	_, _, err = sealed.ReadLogRecord(size)
+	assert.Equal(t, io.EOF, err)
+	end, err := sealed.LastRecordEnd()
+	assert.Nil(t, err)
+	assert.Equal(t, size, end)
+
+	// 全为 0 的 header 之后还有数据时是数据损坏
+	f, err := os.OpenFile(GetDataFileName(dir, 1), os.O_RDWR, 0644)
+	assert.Nil(t, err)
+	_, err = f.WriteAt([]byte{1}, 4000)
+	assert.Nil(t, err)
+	assert.Nil(t, f.Close())
+	_, _, err = sealed.ReadLogRecord(size)
+	assert.Equal(t, errs.ErrInvalidCRC, err)
+	assert.Nil(t, sealed.Close())
+
+	// 关闭时截断为实际写入的大小
+	assert.Nil(t, dataFile.Close())
+	info, err := os.Stat(GetDataFileName(dir, 1))
+	assert.Nil(t, err)
+	assert.Equal(t, size, info.Size())
+}
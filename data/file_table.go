@@ -0,0 +1,133 @@
+package data
+
+import (
+	"container/list"
+	"kv_projects/fio"
+	"sync"
+)
+
+// FileTable
+// @Description: 旧数据文件的句柄表，按照 LRU 限制同时打开的文件数量，被淘汰的文件在下次读取时重新打开
+type FileTable struct {
+	mu        sync.Mutex
+	capacity  int        // 最多同时打开的文件数量，为 0 时不限制
+	ll        *list.List // 已经打开的文件，最近使用的在前面
+	evictions uint64     // 被淘汰关闭的次数
+}
+
+/**
+ * NewFileTable
+ * @Description: 初始化句柄表
+ * @param capacity 最多同时打开的文件数量，为 0 时不限制
+ * @return *FileTable
+ */
+func NewFileTable(capacity int) *FileTable {
+	return &FileTable{
+		capacity: capacity,
+		ll:       list.New(),
+	}
+}
+
+/**
+ * Add
+ * @Description: 将数据文件交给句柄表管理，之后文件的句柄可能被淘汰，读取时按需重新打开。
+ * 活跃文件转为旧文件时使用，调用方需要保证此时没有其他协程在读取该文件
+ * @receiver t
+ * @param df
+ */
+func (t *FileTable) Add(df *DataFile) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	df.table = t
+	if df.IOManager != nil {
+		df.elem = t.ll.PushFront(df)
+	}
+	t.evict()
+}
+
+// OpenFiles 返回当前打开的文件数量
+func (t *FileTable) OpenFiles() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.ll.Len()
+}
+
+// Evictions 返回文件被淘汰关闭的次数
+func (t *FileTable) Evictions() uint64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.evictions
+}
+
+// 打开文件的句柄并固定，固定期间不会被淘汰
+func (t *FileTable) acquire(df *DataFile) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if df.IOManager == nil {
+		ioManager, err := fio.NewIOManager(df.fs, df.fileName, df.ioType, df.preallocSize)
+		if err != nil {
+			return err
+		}
+		df.IOManager = ioManager
+		df.elem = t.ll.PushFront(df)
+	} else {
+		t.ll.MoveToFront(df.elem)
+	}
+	df.pins++
+	t.evict()
+	return nil
+}
+
+// 取消固定，固定期间超出的文件数量在这里淘汰
+func (t *FileTable) release(df *DataFile) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	df.pins--
+	t.evict()
+}
+
+// 关闭文件的句柄，并从句柄表中移除
+func (t *FileTable) close(df *DataFile) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if df.IOManager == nil {
+		return nil
+	}
+	return t.closeHandle(df)
+}
+
+// 切换文件的 IO 类型，已经打开的句柄先关闭，下次读取时使用新的类型打开
+func (t *FileTable) reset(df *DataFile, ioType fio.FileIOType) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	df.ioType = ioType
+	if df.IOManager == nil {
+		return nil
+	}
+	return t.closeHandle(df)
+}
+
+// 从最久没有使用的文件开始淘汰，正在被读取的文件跳过，所以打开的文件数量可能暂时超过上限，调用方必须持有锁
+func (t *FileTable) evict() {
+	if t.capacity <= 0 {
+		return
+	}
+	for elem := t.ll.Back(); elem != nil && t.ll.Len() > t.capacity; {
+		prev := elem.Prev()
+		df := elem.Value.(*DataFile)
+		if df.pins == 0 {
+			// 旧数据文件是只读的，关闭失败不会丢失数据，下次读取时重新打开即可
+			_ = t.closeHandle(df)
+			t.evictions++
+		}
+		elem = prev
+	}
+}
+
+func (t *FileTable) closeHandle(df *DataFile) error {
+	t.ll.Remove(df.elem)
+	df.elem = nil
+	err := df.IOManager.Close()
+	df.IOManager = nil
+	return err
+}
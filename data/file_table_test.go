@@ -0,0 +1,79 @@
+package data
+
+import (
+	"github.com/stretchr/testify/assert"
+	"kv_projects/fio"
+	"os"
+	"testing"
+)
+
+func TestFileTable_Evict(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "bitcask-go-file-table")
+	defer os.RemoveAll(dir)
+	table := NewFileTable(2)
+
+	var files []*DataFile
+	for i := 0; i < 4; i++ {
+		dataFile, err := OpenDataFile(fio.OSFileSystem{}, dir, uint32(i), fio.StandardIoManager)
+		assert.Nil(t, err)
+		record, _ := EncoderLogRecord(&LogRecord{Key: []byte("key"), Value: []byte("value")})
+		assert.Nil(t, dataFile.Write(record))
+		table.Add(dataFile)
+		files = append(files, dataFile)
+	}
+	// 超出上限的文件被关闭
+	assert.Equal(t, 2, table.OpenFiles())
+	assert.Equal(t, uint64(2), table.Evictions())
+	assert.Nil(t, files[0].IOManager)
+
+	// 被淘汰的文件读取时重新打开
+	for _, dataFile := range files {
+		logRecord, _, err := dataFile.ReadLogRecord(0)
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("value"), logRecord.Value)
+	}
+	assert.Equal(t, 2, table.OpenFiles())
+
+	// 正在使用的文件不会被淘汰
+	assert.Nil(t, files[0].Acquire())
+	for _, dataFile := range files[1:] {
+		_, _, err := dataFile.ReadLogRecord(0)
+		assert.Nil(t, err)
+	}
+	assert.NotNil(t, files[0].IOManager)
+	files[0].Release()
+	assert.Equal(t, 2, table.OpenFiles())
+
+	// 关闭之后从句柄表中移除
+	for _, dataFile := range files {
+		assert.Nil(t, dataFile.Close())
+	}
+	assert.Equal(t, 0, table.OpenFiles())
+}
+
+func TestFileTable_OpenSealedDataFile(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "bitcask-go-file-table-sealed")
+	defer os.RemoveAll(dir)
+	dataFile, err := OpenDataFile(fio.OSFileSystem{}, dir, 0, fio.StandardIoManager)
+	assert.Nil(t, err)
+	assert.Nil(t, dataFile.Write([]byte("aaaa")))
+	assert.Nil(t, dataFile.Close())
+
+	// 打开时不会占用句柄，第一次读取时才打开
+	table := NewFileTable(0)
+	sealed := OpenSealedDataFile(fio.OSFileSystem{}, dir, 0, fio.MMapIoManager, table)
+	assert.Equal(t, 0, table.OpenFiles())
+	size, err := sealed.Size()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(4), size)
+	assert.Equal(t, 1, table.OpenFiles())
+
+	// 切换 IO 类型时关闭句柄，下次读取时使用新的类型打开
+	assert.Nil(t, sealed.SetIOManager(dir, fio.StandardIoManager))
+	assert.Equal(t, 0, table.OpenFiles())
+	size, err = sealed.Size()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(4), size)
+	assert.Nil(t, sealed.Unref())
+	assert.Equal(t, 0, table.OpenFiles())
+}
@@ -3,6 +3,8 @@ package data
 import (
 	"encoding/binary"
 	"hash/crc32"
+	"kv_projects/errs"
+	"math"
 )
 
 // 墓碑值，标记文件是否被删除
@@ -14,6 +16,9 @@ const (
 	// 删除状态
 	LogRecordDeleted
 	LogRecordTxnFinished
+	// 流式写入的正常记录，写完 value 才能得到校验值，所以 header 中的 crc 为 0，校验值放在记录末尾。
+	// 读取之后和正常状态的记录相同
+	LogRecordStreamed
 )
 
 // 采用可变长编码
@@ -21,6 +26,28 @@ const (
 // 4 + 1 + 5 + 5
 const maxLogRecordHeaderSize = binary.MaxVarintLen32*2 + 5
 
+// MaxLogRecordSize 一条记录的最大长度，header 中以 varint32 保存 key 和 value 的长度，索引中以 uint32 保存整条记录的长度
+const MaxLogRecordSize = math.MaxUint32
+
+/**
+ * CheckLogRecordSize
+ * @Description: 检查 key 和 value 编码之后的记录长度是否超过限制
+ * @param keySize
+ * @param valueSize
+ * @return error
+ */
+func CheckLogRecordSize(keySize, valueSize int64) error {
+	// 按照最长的 header 和流式记录末尾的校验值计算
+	const maxPayload = MaxLogRecordSize - maxLogRecordHeaderSize - crc32.Size
+	if keySize > maxPayload {
+		return errs.ErrKeyTooLarge
+	}
+	if valueSize < 0 || keySize+valueSize > maxPayload {
+		return errs.ErrValueTooLarge
+	}
+	return nil
+}
+
 // LogRecord
 // @Description: 数据写入到文件的记录，类似日志的形式
 type LogRecord struct {
@@ -58,24 +85,15 @@ type TransactionLogRecord struct {
  * @return int64
  */
 func EncoderLogRecord(logRecord *LogRecord) ([]byte, int64) {
-	// 初始化 header 长度的 []byte
-	headerByte := make([]byte, maxLogRecordHeaderSize)
-
-	// crc 需要最后计算，先从第五个字节开始存数据
-	headerByte[4] = logRecord.Type
-
-	// 变长存储 key 和 value 的 size
-	var Index = 5
-	// 将编码后的结果写入从Index开始的headerByte字节切片中，并返回写入数据的长度
-	Index += binary.PutVarint(headerByte[Index:], int64(len(logRecord.Key)))
-	Index += binary.PutVarint(headerByte[Index:], int64(len(logRecord.Value)))
+	header := encodeLogRecordHeader(logRecord.Type, int64(len(logRecord.Key)), int64(len(logRecord.Value)))
+	Index := len(header)
 
 	// size 代表真实 header 的大小，及压缩keySize 和 valueSize 之后的长度
 	var size = Index + len(logRecord.Key) + len(logRecord.Value)
 
 	// 真实返回的编码后的结果
 	encoderLogRecord := make([]byte, size)
-	copy(encoderLogRecord[:Index], headerByte[:Index])
+	copy(encoderLogRecord[:Index], header)
 
 	// 因为 key 和 value 均为 []byte，所以采用copy
 	copy(encoderLogRecord[Index:], logRecord.Key)
@@ -90,6 +108,22 @@ func EncoderLogRecord(logRecord *LogRecord) ([]byte, int64) {
 	return encoderLogRecord, int64(size)
 }
 
+// 编码 header，crc 需要最后计算，先留空
+func encodeLogRecordHeader(recordType LogRecordType, keySize, valueSize int64) []byte {
+	// 初始化 header 长度的 []byte
+	headerByte := make([]byte, maxLogRecordHeaderSize)
+
+	// crc 需要最后计算，先从第五个字节开始存数据
+	headerByte[4] = recordType
+
+	// 变长存储 key 和 value 的 size
+	var Index = 5
+	// 将编码后的结果写入从Index开始的headerByte字节切片中，并返回写入数据的长度
+	Index += binary.PutVarint(headerByte[Index:], keySize)
+	Index += binary.PutVarint(headerByte[Index:], valueSize)
+	return headerByte[:Index]
+}
+
 /**
  * DecoderLogRecord
  * @Description: 对字节数组的 Header 信息进行解码
@@ -98,8 +132,8 @@ func EncoderLogRecord(logRecord *LogRecord) ([]byte, int64) {
  * @return int64 ， header的实际长度
  */
 func DecoderLogRecord(buf []byte) (*LogRecordHeader, int64) {
-	// 字节数小于crc长度，数据无效
-	if len(buf) < 4 {
+	// 字节数不足 crc 和类型的长度，数据无效
+	if len(buf) <= 4 {
 		return nil, 0
 	}
 
@@ -111,11 +145,18 @@ func DecoderLogRecord(buf []byte) (*LogRecordHeader, int64) {
 
 	// 读取 varint协议压缩的key 和 value 的size
 	var Index int = 5
+	// 无法解析出完整的 size，说明是文件末尾没有写完的记录
 	keySize, n := binary.Varint(buf[Index:])
+	if n <= 0 {
+		return nil, 0
+	}
 	header.keySize = uint32(keySize)
 	Index += n
 
 	valueSize, n := binary.Varint(buf[Index:])
+	if n <= 0 {
+		return nil, 0
+	}
 	header.valueSize = uint32(valueSize)
 	Index += n
 
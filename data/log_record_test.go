@@ -54,6 +54,15 @@ func TestDecoderLogRecord(t *testing.T) {
 	assert.Equal(t, uint32(4), decoderLogRecord.keySize)
 	assert.Equal(t, uint32(0), decoderLogRecord.valueSize)
 	assert.Equal(t, uint32(240712713), decoderLogRecord.crc)
+
+	// 文件末尾没有写完的 header
+	for i := 0; i < len(headerBuf1); i++ {
+		decoderLogRecord, n = DecoderLogRecord(headerBuf1[:i])
+		assert.Nil(t, decoderLogRecord)
+		assert.Equal(t, int64(0), n)
+	}
+	decoderLogRecord, _ = DecoderLogRecord([]byte{86, 238, 133, 193, 0, 8, 0x80})
+	assert.Nil(t, decoderLogRecord)
 }
 
 func TestGetLogRecordCRC(t *testing.T) {
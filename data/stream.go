@@ -0,0 +1,232 @@
+package data
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"kv_projects/errs"
+)
+
+// 流式读写 value 时每次读写的块大小
+const StreamChunkSize = 64 * 1024
+
+// StreamedLogRecordSize 返回流式写入的记录的总长度
+func StreamedLogRecordSize(keySize, valueSize int64) int64 {
+	return int64(len(encodeLogRecordHeader(LogRecordStreamed, keySize, valueSize))) + keySize + valueSize + crc32.Size
+}
+
+/**
+ * WriteStream
+ * @Description: 将 key 和 r 中 valueSize 字节的 value 作为一条记录写入文件，value 分块写入并增量计算校验值，
+ * 不需要把整个 value 放在内存中。r 中的数据不足或者写入失败时，截掉已经写入的部分，文件中不会留下不完整的记录
+ * @receiver df
+ * @param key
+ * @param r
+ * @param valueSize 调用方需要先通过 CheckLogRecordSize 检查
+ * @return error r 中的数据不足 valueSize 时返回 io.ErrUnexpectedEOF
+ */
+func (df *DataFile) WriteStream(key []byte, r io.Reader, valueSize int64) error {
+	startOffset := df.WriteOffset
+	header := encodeLogRecordHeader(LogRecordStreamed, int64(len(key)), valueSize)
+	crc := crc32.NewIEEE()
+	crc.Write(header[crc32.Size:])
+	crc.Write(key)
+	if err := df.Write(append(header, key...)); err != nil {
+		return df.discardFrom(startOffset, err)
+	}
+
+	chunk := make([]byte, min(valueSize, StreamChunkSize))
+	for remaining := valueSize; remaining > 0; {
+		n := min(remaining, int64(len(chunk)))
+		if _, err := io.ReadFull(r, chunk[:n]); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return df.discardFrom(startOffset, err)
+		}
+		crc.Write(chunk[:n])
+		if err := df.Write(chunk[:n]); err != nil {
+			return df.discardFrom(startOffset, err)
+		}
+		remaining -= n
+	}
+
+	trailer := binary.LittleEndian.AppendUint32(nil, crc.Sum32())
+	if err := df.Write(trailer); err != nil {
+		return df.discardFrom(startOffset, err)
+	}
+	return nil
+}
+
+/**
+ * WriteStreamFrom
+ * @Description: 将 vr 中剩下的 value 和 key 作为一条记录流式写入文件，vr 中的原记录校验失败时同样截掉已经写入的部分
+ * @receiver df
+ * @param key
+ * @param vr
+ * @return error
+ */
+func (df *DataFile) WriteStreamFrom(key []byte, vr *ValueReader) error {
+	startOffset := df.WriteOffset
+	if err := df.WriteStream(key, vr, vr.remaining); err != nil {
+		return err
+	}
+	// io.ReadFull 读够数据之后会忽略最后一次读取返回的错误，value 已经全部读完，再读一次得到校验结果
+	if _, err := vr.Read(nil); err != io.EOF {
+		return df.discardFrom(startOffset, err)
+	}
+	return nil
+}
+
+// 截掉 offset 之后写入的不完整记录，返回原来的错误
+func (df *DataFile) discardFrom(offset int64, err error) error {
+	if truncateErr := df.Truncate(offset); truncateErr != nil {
+		return fmt.Errorf("%w (failed to discard the partial record: %v)", err, truncateErr)
+	}
+	return err
+}
+
+// ValueReader
+// @Description: 流式读取一条记录的 value，读取的同时增量计算校验值，读到末尾时校验，不一致时返回 errs.ErrInvalidCRC
+type ValueReader struct {
+	df        *DataFile
+	size      int64 // value 的总长度
+	offset    int64 // 下一次读取的位置
+	remaining int64 // value 中还没有读取的字节数
+	streamed  bool
+	expected  uint32 // header 中的校验值，流式写入的记录读完 value 之后再从末尾读取
+	crc       hash.Hash32
+	err       error // 读到末尾或者出错之后一直返回该错误
+	closed    bool
+}
+
+/**
+ * OpenValueReader
+ * @Description: 打开 offset 位置记录的 value，读取期间文件不会被关闭，使用完之后需要调用 Close
+ * @receiver df
+ * @param offset
+ * @return *ValueReader
+ * @return error 记录已经被删除时返回 errs.ErrDataAlreadyDeleted
+ */
+func (df *DataFile) OpenValueReader(offset int64) (*ValueReader, error) {
+	if err := df.Acquire(); err != nil {
+		return nil, err
+	}
+	defer df.Release()
+	fileSize, err := df.IOManager.Size()
+	if err != nil {
+		return nil, err
+	}
+	if offset >= fileSize {
+		return nil, io.ErrUnexpectedEOF
+	}
+	headerBytes := min(int64(maxLogRecordHeaderSize), fileSize-offset)
+	headerBuf, err := df.ReadNBytes(headerBytes, offset)
+	if err != nil {
+		return nil, err
+	}
+	header, headerSize := DecoderLogRecord(headerBuf)
+	if header == nil {
+		return nil, io.ErrUnexpectedEOF
+	}
+	if header.recordType == LogRecordDeleted {
+		return nil, errs.ErrDataAlreadyDeleted
+	}
+	key, err := df.ReadNBytes(int64(header.keySize), offset+headerSize)
+	if err != nil {
+		return nil, err
+	}
+	crc := crc32.NewIEEE()
+	crc.Write(headerBuf[crc32.Size:headerSize])
+	crc.Write(key)
+
+	df.Ref()
+	return &ValueReader{
+		df:        df,
+		size:      int64(header.valueSize),
+		offset:    offset + headerSize + int64(header.keySize),
+		remaining: int64(header.valueSize),
+		streamed:  header.recordType == LogRecordStreamed,
+		expected:  header.crc,
+		crc:       crc,
+	}, nil
+}
+
+// Size 返回 value 的总长度
+func (vr *ValueReader) Size() int64 {
+	return vr.size
+}
+
+func (vr *ValueReader) Read(b []byte) (int, error) {
+	if vr.closed {
+		return 0, errs.ErrValueReaderClosed
+	}
+	if vr.err != nil {
+		return 0, vr.err
+	}
+	if vr.remaining == 0 {
+		vr.err = vr.verify()
+		return 0, vr.err
+	}
+	if int64(len(b)) > vr.remaining {
+		b = b[:vr.remaining]
+	}
+	if err := vr.df.Acquire(); err != nil {
+		return 0, err
+	}
+	n, err := vr.df.IOManager.Read(b, vr.offset)
+	vr.df.Release()
+	vr.crc.Write(b[:n])
+	vr.offset += int64(n)
+	vr.remaining -= int64(n)
+	if err == io.EOF && vr.remaining > 0 {
+		// 记录不完整
+		err = io.ErrUnexpectedEOF
+	} else if err == io.EOF || (err == nil && vr.remaining == 0) {
+		err = vr.verify()
+	}
+	vr.err = err
+	return n, err
+}
+
+// 读完 value 之后校验整条记录，校验通过时返回 io.EOF
+func (vr *ValueReader) verify() error {
+	expected := vr.expected
+	if vr.streamed {
+		trailer, err := vr.readTrailer()
+		if err != nil {
+			return err
+		}
+		expected = trailer
+	}
+	if vr.crc.Sum32() != expected {
+		return errs.ErrInvalidCRC
+	}
+	return io.EOF
+}
+
+func (vr *ValueReader) readTrailer() (uint32, error) {
+	if err := vr.df.Acquire(); err != nil {
+		return 0, err
+	}
+	defer vr.df.Release()
+	trailer, err := vr.df.ReadNBytes(crc32.Size, vr.offset)
+	if err == io.EOF {
+		return 0, io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return 0, err
+	}
+	return binary.LittleEndian.Uint32(trailer), nil
+}
+
+// Close 释放对文件的引用，可以重复调用
+func (vr *ValueReader) Close() error {
+	if vr.closed {
+		return nil
+	}
+	vr.closed = true
+	return vr.df.Unref()
+}
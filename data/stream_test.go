@@ -0,0 +1,192 @@
+package data
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"kv_projects/errs"
+	"kv_projects/fio"
+	"math/rand"
+	"testing"
+)
+
+func TestDataFile_WriteStream(t *testing.T) {
+	dataFile, err := openMemDataFile(fio.NewMemFileSystem())
+	assert.Nil(t, err)
+	defer dataFile.Close()
+
+	// value 跨越多个块
+	value := make([]byte, 3*StreamChunkSize+100)
+	rand.New(rand.NewSource(1)).Read(value)
+	err = dataFile.WriteStream([]byte("big"), bytes.NewReader(value), int64(len(value)))
+	assert.Nil(t, err)
+	size := StreamedLogRecordSize(3, int64(len(value)))
+	assert.Equal(t, size, dataFile.WriteOffset)
+
+	// 紧跟着一条普通记录
+	err = dataFile.Write(mustEncode(&LogRecord{Key: []byte("k"), Value: []byte("v"), Type: LogRecordNormal}))
+	assert.Nil(t, err)
+
+	// 整条读取时和普通记录一样
+	logRecord, n, err := dataFile.ReadLogRecord(0)
+	assert.Nil(t, err)
+	assert.Equal(t, size, n)
+	assert.Equal(t, LogRecordNormal, logRecord.Type)
+	assert.Equal(t, []byte("big"), logRecord.Key)
+	assert.Equal(t, value, logRecord.Value)
+	logRecord, _, err = dataFile.ReadLogRecord(n)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("v"), logRecord.Value)
+
+	// 只读取 key 时长度和类型相同，不包含 value
+	logRecord, keyOnlySize, err := dataFile.ReadLogRecordKey(0)
+	assert.Nil(t, err)
+	assert.Equal(t, size, keyOnlySize)
+	assert.Equal(t, LogRecordNormal, logRecord.Type)
+	assert.Equal(t, []byte("big"), logRecord.Key)
+	assert.Nil(t, logRecord.Value)
+	logRecord, _, err = dataFile.ReadLogRecordKey(n)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("k"), logRecord.Key)
+	_, _, err = dataFile.ReadLogRecordKey(dataFile.WriteOffset)
+	assert.Equal(t, io.EOF, err)
+
+	// 流式读取
+	valueReader, err := dataFile.OpenValueReader(0)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(len(value)), valueReader.Size())
+	got, err := io.ReadAll(valueReader)
+	assert.Nil(t, err)
+	assert.Equal(t, value, got)
+	assert.Nil(t, valueReader.Close())
+	assert.Nil(t, valueReader.Close())
+	_, err = valueReader.Read(make([]byte, 1))
+	assert.Equal(t, errs.ErrValueReaderClosed, err)
+
+	// 普通记录也可以流式读取
+	valueReader, err = dataFile.OpenValueReader(n)
+	assert.Nil(t, err)
+	got, err = io.ReadAll(valueReader)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("v"), got)
+	assert.Nil(t, valueReader.Close())
+}
+
+func TestDataFile_WriteStreamShortReader(t *testing.T) {
+	dataFile, err := openMemDataFile(fio.NewMemFileSystem())
+	assert.Nil(t, err)
+	defer dataFile.Close()
+
+	err = dataFile.Write(mustEncode(&LogRecord{Key: []byte("k"), Value: []byte("v"), Type: LogRecordNormal}))
+	assert.Nil(t, err)
+	offset := dataFile.WriteOffset
+
+	// r 中的数据不足，已经写入的部分被截掉
+	value := make([]byte, StreamChunkSize+10)
+	err = dataFile.WriteStream([]byte("big"), bytes.NewReader(value), int64(len(value))+1)
+	assert.Equal(t, io.ErrUnexpectedEOF, err)
+	assert.Equal(t, offset, dataFile.WriteOffset)
+	fileSize, err := dataFile.IOManager.Size()
+	assert.Nil(t, err)
+	assert.Equal(t, offset, fileSize)
+
+	_, _, err = dataFile.ReadLogRecord(offset)
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestDataFile_WriteStreamCorrupted(t *testing.T) {
+	fsys := fio.NewFaultFileSystem(fio.NewMemFileSystem())
+	dataFile, err := openMemDataFile(fsys)
+	assert.Nil(t, err)
+	defer dataFile.Close()
+
+	value := bytes.Repeat([]byte("a"), 2*StreamChunkSize)
+	err = dataFile.WriteStream([]byte("big"), bytes.NewReader(value), int64(len(value)))
+	assert.Nil(t, err)
+
+	// 修改 value 中间的一个字节，读完 value 之后才能发现
+	err = fsys.Corrupt(dataFile.fileName, StreamChunkSize)
+	assert.Nil(t, err)
+	valueReader, err := dataFile.OpenValueReader(0)
+	assert.Nil(t, err)
+	defer valueReader.Close()
+	got, err := io.ReadAll(valueReader)
+	assert.Equal(t, errs.ErrInvalidCRC, err)
+	assert.Equal(t, len(value), len(got))
+
+	_, _, err = dataFile.ReadLogRecord(0)
+	assert.Equal(t, errs.ErrInvalidCRC, err)
+	_, _, err = dataFile.ReadLogRecordKey(0)
+	assert.Equal(t, errs.ErrInvalidCRC, err)
+
+	// 复制损坏的记录时，已经写入的部分被截掉
+	dst, err := OpenDataFile(fsys, "/data", 1, fio.StandardIoManager)
+	assert.Nil(t, err)
+	defer dst.Close()
+	valueReader, err = dataFile.OpenValueReader(0)
+	assert.Nil(t, err)
+	defer valueReader.Close()
+	err = dst.WriteStreamFrom([]byte("copy"), valueReader)
+	assert.Equal(t, errs.ErrInvalidCRC, err)
+	assert.Equal(t, int64(0), dst.WriteOffset)
+}
+
+func TestDataFile_WriteStreamFrom(t *testing.T) {
+	fsys := fio.NewMemFileSystem()
+	src, err := openMemDataFile(fsys)
+	assert.Nil(t, err)
+	defer src.Close()
+	dst, err := OpenDataFile(fsys, "/data", 1, fio.StandardIoManager)
+	assert.Nil(t, err)
+	defer dst.Close()
+
+	value := make([]byte, 2*StreamChunkSize+7)
+	rand.New(rand.NewSource(2)).Read(value)
+	// 普通记录和流式写入的记录都可以复制
+	err = src.Write(mustEncode(&LogRecord{Key: []byte("k1"), Value: value, Type: LogRecordNormal}))
+	assert.Nil(t, err)
+	offset := src.WriteOffset
+	err = src.WriteStream([]byte("k2"), bytes.NewReader(value), int64(len(value)))
+	assert.Nil(t, err)
+
+	for _, srcOffset := range []int64{0, offset} {
+		dstOffset := dst.WriteOffset
+		valueReader, err := src.OpenValueReader(srcOffset)
+		assert.Nil(t, err)
+		err = dst.WriteStreamFrom([]byte("copy"), valueReader)
+		assert.Nil(t, err)
+		assert.Nil(t, valueReader.Close())
+
+		logRecord, size, err := dst.ReadLogRecord(dstOffset)
+		assert.Nil(t, err)
+		assert.Equal(t, StreamedLogRecordSize(4, int64(len(value))), size)
+		assert.Equal(t, []byte("copy"), logRecord.Key)
+		assert.Equal(t, value, logRecord.Value)
+	}
+}
+
+func TestCheckLogRecordSize(t *testing.T) {
+	assert.Nil(t, CheckLogRecordSize(10, 1024))
+	assert.Nil(t, CheckLogRecordSize(10, 0))
+	assert.Equal(t, errs.ErrValueTooLarge, CheckLogRecordSize(10, -1))
+	assert.Equal(t, errs.ErrValueTooLarge, CheckLogRecordSize(10, MaxLogRecordSize))
+	assert.Equal(t, errs.ErrKeyTooLarge, CheckLogRecordSize(MaxLogRecordSize, 0))
+
+	// 上限处的记录长度可以用 LogRecordPos.Size 表示
+	maxValue := int64(MaxLogRecordSize - maxLogRecordHeaderSize - 4 - 10)
+	assert.Nil(t, CheckLogRecordSize(10, maxValue))
+	assert.LessOrEqual(t, StreamedLogRecordSize(10, maxValue), int64(MaxLogRecordSize))
+	assert.Equal(t, errs.ErrValueTooLarge, CheckLogRecordSize(10, maxValue+1))
+}
+
+func mustEncode(logRecord *LogRecord) []byte {
+	encRecord, _ := EncoderLogRecord(logRecord)
+	return encRecord
+}
+
+func openMemDataFile(fsys fio.FileSystem) (*DataFile, error) {
+	if err := fsys.MkdirAll("/data", 0755); err != nil {
+		return nil, err
+	}
+	return OpenDataFile(fsys, "/data", 0, fio.StandardIoManager)
+}
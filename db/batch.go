@@ -1,6 +1,7 @@
 package db
 
 import (
+	"context"
 	"encoding/binary"
 	"kv_projects/conf"
 	"kv_projects/data"
@@ -23,14 +24,34 @@ type WriteBatch struct {
 	mu      *sync.Mutex
 	// 暂存用户数据
 	pendingWrites map[string]*data.LogRecord
+	// 暂存数据的总字节数
+	pendingSize int64
+	// 撤销日志，按顺序记录暂存区的每次修改，用于回滚到保存点
+	undoLog []undoEntry
+	// 撤销日志的编号，每条日志的编号都不同，用来判断保存点之前的日志是否被回滚过
+	undoSeq uint64
+	// 每次清空暂存区时递增，之前创建的保存点失效
+	generation uint64
+	// 批次持有的 key 锁，提交或回滚时释放
+	locks *KeyLocks
+}
+
+// 暂存区的一次修改，记录 key 修改之前暂存的数据，为 nil 表示之前没有暂存
+type undoEntry struct {
+	seq  uint64
+	key  string
+	prev *data.LogRecord
+}
+
+// Savepoint
+// @Description: 暂存区的一个状态，通过 RollbackTo 撤销之后的修改
+type Savepoint struct {
+	undoLen    int
+	lastSeq    uint64 // 保存点之前最后一条撤销日志的编号
+	generation uint64
 }
 
 func (db *DB) NewWriteBatch(opt *conf.WriteBatchOptions) *WriteBatch {
-	// 如果索引类型为 B+ 树，并且没有保存最新事务序列号的文件，报警告
-	// 正常关闭数据库时，会保存最新的事务序列号
-	if db.Options.IndexType == index.BPTree && !db.SeqNoFileExists && !db.IsInitial {
-		panic("cannot use write batch, seq no file not exists")
-	}
 	return &WriteBatch{
 		options:       opt,
 		db:            db,
@@ -49,8 +70,7 @@ func (wt *WriteBatch) Put(key, value []byte) error {
 
 	// 暂存 LogRecord
 	logRecord := &data.LogRecord{Key: key, Value: value}
-	wt.pendingWrites[string(key)] = logRecord
-	return nil
+	return wt.stage(string(key), logRecord)
 }
 
 func (wt *WriteBatch) Delete(key []byte) error {
@@ -61,31 +81,183 @@ func (wt *WriteBatch) Delete(key []byte) error {
 	defer wt.mu.Unlock()
 
 	// 传入需要删除的 key 本身在数据库中就不存在
-	logRecordPos := wt.db.Index.Get(key)
+	wt.db.Mutex.RLock()
+	logRecordPos, err := wt.db.Index.Get(key)
+	wt.db.Mutex.RUnlock()
+	if err != nil {
+		return err
+	}
 	if logRecordPos == nil {
 		if wt.pendingWrites[string(key)] != nil {
-			delete(wt.pendingWrites, string(key))
+			return wt.stage(string(key), nil)
 		}
 		return nil
 	}
 
 	// 暂存 LogRecord,标记 已删除
 	logRecord := &data.LogRecord{Key: key, Type: data.LogRecordDeleted}
-	wt.pendingWrites[string(key)] = logRecord
+	return wt.stage(string(key), logRecord)
+}
+
+/**
+ * stage
+ * @Description: 修改暂存区中 key 对应的数据并记录撤销日志，调用方必须持有锁
+ * @receiver wt
+ * @param key
+ * @param logRecord 为 nil 时从暂存区中移除 key
+ * @return error 超过批次的最大字节数时返回 errs.ErrExceedMaxBatchSize，暂存区不会被修改
+ */
+func (wt *WriteBatch) stage(key string, logRecord *data.LogRecord) error {
+	prev := wt.pendingWrites[key]
+	size := wt.pendingSize - pendingRecordSize(prev) + pendingRecordSize(logRecord)
+	if wt.options.MaxBatchSize > 0 && size > wt.options.MaxBatchSize {
+		return errs.ErrExceedMaxBatchSize
+	}
+	wt.undoSeq++
+	wt.undoLog = append(wt.undoLog, undoEntry{seq: wt.undoSeq, key: key, prev: prev})
+	wt.setPending(key, logRecord)
+	wt.pendingSize = size
 	return nil
 }
 
+func (wt *WriteBatch) setPending(key string, logRecord *data.LogRecord) {
+	if logRecord == nil {
+		delete(wt.pendingWrites, key)
+	} else {
+		wt.pendingWrites[key] = logRecord
+	}
+}
+
+// 暂存数据占用的字节数
+func pendingRecordSize(logRecord *data.LogRecord) int64 {
+	if logRecord == nil {
+		return 0
+	}
+	return int64(len(logRecord.Key) + len(logRecord.Value))
+}
+
+// Len 返回暂存区中 key 的数量
+func (wt *WriteBatch) Len() int {
+	wt.mu.Lock()
+	defer wt.mu.Unlock()
+	return len(wt.pendingWrites)
+}
+
+// Size 返回暂存数据（key 和 value）的总字节数
+func (wt *WriteBatch) Size() int64 {
+	wt.mu.Lock()
+	defer wt.mu.Unlock()
+	return wt.pendingSize
+}
+
+// Savepoint 创建一个保存点，之后可以通过 RollbackTo 撤销保存点之后暂存的修改
+func (wt *WriteBatch) Savepoint() Savepoint {
+	wt.mu.Lock()
+	defer wt.mu.Unlock()
+	sp := Savepoint{undoLen: len(wt.undoLog), generation: wt.generation}
+	if sp.undoLen > 0 {
+		sp.lastSeq = wt.undoLog[sp.undoLen-1].seq
+	}
+	return sp
+}
+
+/**
+ * RollbackTo
+ * @Description: 撤销保存点之后暂存的修改，保存点本身仍然有效，可以再次回滚；
+ * 回滚到更早的保存点之后，在其之后创建的保存点失效
+ * @receiver wt
+ * @param sp
+ * @return error 保存点已经失效（批次被提交或整体回滚过，或者已经回滚到更早的保存点）时返回 errs.ErrInvalidSavepoint
+ */
+func (wt *WriteBatch) RollbackTo(sp Savepoint) error {
+	wt.mu.Lock()
+	defer wt.mu.Unlock()
+	if sp.generation != wt.generation || sp.undoLen > len(wt.undoLog) {
+		return errs.ErrInvalidSavepoint
+	}
+	// 保存点之前的日志被回滚后又有新的修改，撤销日志的前缀已经不是创建保存点时的状态
+	if sp.undoLen > 0 && wt.undoLog[sp.undoLen-1].seq != sp.lastSeq {
+		return errs.ErrInvalidSavepoint
+	}
+	for i := len(wt.undoLog) - 1; i >= sp.undoLen; i-- {
+		entry := wt.undoLog[i]
+		wt.pendingSize += pendingRecordSize(entry.prev) - pendingRecordSize(wt.pendingWrites[entry.key])
+		wt.setPending(entry.key, entry.prev)
+	}
+	wt.undoLog = wt.undoLog[:sp.undoLen]
+	return nil
+}
+
+// Rollback 丢弃所有暂存的修改并释放持有的 key 锁，之前创建的保存点全部失效，批次可以继续使用
+func (wt *WriteBatch) Rollback() {
+	wt.mu.Lock()
+	defer wt.mu.Unlock()
+	wt.reset()
+}
+
+// 清空暂存区并释放持有的 key 锁，调用方必须持有锁
+func (wt *WriteBatch) reset() {
+	wt.pendingWrites = make(map[string]*data.LogRecord)
+	wt.pendingSize = 0
+	wt.undoLog = nil
+	wt.generation++
+	wt.unlockKeys()
+}
+
+// 释放批次持有的 key 锁，调用方必须持有锁
+func (wt *WriteBatch) unlockKeys() {
+	if wt.locks != nil {
+		wt.locks.Unlock()
+	}
+}
+
+/**
+ * LockKeys
+ * @Description: 获取一组 key 的排他锁，锁在批次提交（包括提交失败）或者调用 Rollback 时自动释放，
+ * 等待锁期间批次的其他操作会被阻塞
+ * @receiver wt
+ * @param ctx 取消或超时时停止等待
+ * @param keys
+ * @return error 形成死锁时返回 errs.ErrDeadlock，调用方应该 Rollback 之后重试
+ */
+func (wt *WriteBatch) LockKeys(ctx context.Context, keys ...[]byte) error {
+	wt.mu.Lock()
+	defer wt.mu.Unlock()
+	if wt.locks == nil {
+		wt.locks = wt.db.LockManager.NewKeyLocks()
+	}
+	return wt.locks.Lock(ctx, keys...)
+}
+
+// RLockKeys 获取一组 key 的共享锁，其他规则和 LockKeys 相同
+func (wt *WriteBatch) RLockKeys(ctx context.Context, keys ...[]byte) error {
+	wt.mu.Lock()
+	defer wt.mu.Unlock()
+	if wt.locks == nil {
+		wt.locks = wt.db.LockManager.NewKeyLocks()
+	}
+	return wt.locks.RLock(ctx, keys...)
+}
+
 /**
  * Commit
- * @Description: 提交事务，将暂存的数据写入数据文件，并更新内存索引
+ * @Description: 提交事务，将暂存的数据写入数据文件，并更新内存索引。无论提交是否成功都会释放批次持有的 key 锁，
+ * 提交失败时暂存的数据会保留，重试之前需要重新加锁
  * @receiver wt
  * @return error
  */
-func (wt *WriteBatch) Commit() error {
+func (wt *WriteBatch) Commit() (err error) {
 	wt.mu.Lock()
 	defer wt.mu.Unlock()
+	// 调用方在提交失败时通常直接返回错误，这里释放锁，避免其他批次一直等待
+	defer func() {
+		if err != nil {
+			wt.unlockKeys()
+		}
+	}()
 
 	if len(wt.pendingWrites) == 0 {
+		wt.reset()
 		return nil
 	}
 	if uint(len(wt.pendingWrites)) > wt.options.MaxBatchNum {
@@ -93,63 +265,128 @@ func (wt *WriteBatch) Commit() error {
 	}
 
 	// db 加锁 保证事务提交的 串行化
-	wt.db.Mutex.Lock()
-	defer wt.db.Mutex.Unlock()
+	wt.db.lock()
+	defer wt.db.unlock()
 
 	// 获取当前最新的事务序列号
 	seqNo := atomic.AddUint64(&wt.db.SeqNo, 1)
 
 	// 写数据到数据文件中
-	// 暂存数据，便于后面更新内存索引
-	positions := make(map[string]*data.LogRecordPos)
+	records, err := wt.appendPendingWrites(seqNo)
+	if err != nil {
+		return err
+	}
+
+	// 添加标识事务完成的标志
+	if err := wt.db.appendTxnFinished(seqNo); err != nil {
+		return err
+	}
+
+	// 根据配置项决定是否持久化
+	if wt.options.SyncWrites && wt.db.ActiveFile != nil {
+		if err := wt.db.ActiveFile.Sync(); err != nil {
+			return err
+		}
+	}
+
+	// 更新内存索引
+	if err := wt.db.applyTxnRecords(seqNo, records); err != nil {
+		return err
+	}
+
+	// 清空暂存的数据
+	wt.reset()
+	return nil
+}
+
+// 将暂存的数据带上事务序列号写入数据文件，返回写入的数据和位置，便于后面更新索引，调用方必须持有 db 的写锁
+func (wt *WriteBatch) appendPendingWrites(seqNo uint64) ([]*data.TransactionLogRecord, error) {
+	records := make([]*data.TransactionLogRecord, 0, len(wt.pendingWrites))
 	for _, record := range wt.pendingWrites {
-		// 前面已经加锁，此处不用加锁
 		logRecordPos, err := wt.db.appendLogRecord(&data.LogRecord{
 			Key:   logRecordKeyWithSeq(record.Key, seqNo),
 			Value: record.Value,
 			Type:  record.Type,
 		})
 		if err != nil {
-			return err
+			return nil, err
 		}
-		positions[string(record.Key)] = logRecordPos
+		records = append(records, &data.TransactionLogRecord{Record: record, Pos: logRecordPos})
 	}
+	return records, nil
+}
 
-	// 添加标识事务完成的标志
+// 写入事务完成的标志，调用方必须持有写锁
+func (db *DB) appendTxnFinished(seqNo uint64) error {
 	finishedRecord := &data.LogRecord{
 		Key:  logRecordKeyWithSeq(txnFinKey, seqNo),
 		Type: data.LogRecordTxnFinished,
 	}
-	_, err := wt.db.appendLogRecord(finishedRecord)
-	if err != nil {
-		return nil
-	}
+	_, err := db.appendLogRecord(finishedRecord)
+	return err
+}
 
-	// 根据配置项决定是否持久化
-	if wt.options.SyncWrites && wt.db.ActiveFile != nil {
-		if err := wt.db.ActiveFile.Sync(); err != nil {
-			return err
-		}
+// 用已经写入数据文件的事务数据更新索引，调用方必须持有写锁
+func (db *DB) applyTxnRecords(seqNo uint64, records []*data.TransactionLogRecord) error {
+	if bpt, ok := db.Index.(*index.BPlusTree); ok {
+		return db.updateBPTree(bpt, seqNo, records)
 	}
-
-	// 更新内存索引
-	for _, record := range wt.pendingWrites {
-		pos := positions[string(record.Key)]
+	for _, record := range records {
 		var oldValue *data.LogRecordPos
-		if record.Type == data.LogRecordNormal {
-			oldValue = wt.db.Index.Put(record.Key, pos)
+		var err error
+		if record.Record.Type == data.LogRecordNormal {
+			oldValue, err = db.Index.Put(record.Record.Key, record.Pos)
 		}
-		if record.Type == data.LogRecordDeleted {
-			oldValue, _ = wt.db.Index.Delete(record.Key)
+		if record.Record.Type == data.LogRecordDeleted {
+			oldValue, _, err = db.Index.Delete(record.Record.Key)
+		}
+		if err != nil {
+			return err
 		}
 		if oldValue != nil {
-			wt.db.ReclaimSize += int64(oldValue.Size)
+			db.addReclaimSize(int64(oldValue.Size))
 		}
-
 	}
+	return nil
+}
 
-	// 清空暂存的数据
-	wt.pendingWrites = make(map[string]*data.LogRecord)
+/**
+ * updateBPTree
+ * @Description: B+ 树索引在一个 bbolt 事务中更新整个批次的索引，并保存最新的事务序列号，
+ * 这样即使进程异常退出没有写入 seq-no 文件，重启后也能拿到正确的事务序列号
+ * @receiver db
+ * @param bpt
+ * @param seqNo
+ * @param records
+ * @return error
+ */
+func (db *DB) updateBPTree(bpt *index.BPlusTree, seqNo uint64, records []*data.TransactionLogRecord) error {
+	var reclaimSize int64
+	err := bpt.Update(func(txn *index.BPTreeTxn) error {
+		reclaimSize = 0
+		for _, record := range records {
+			var oldValue *data.LogRecordPos
+			var err error
+			if record.Record.Type == data.LogRecordNormal {
+				oldValue = txn.Get(record.Record.Key)
+				err = txn.Put(record.Record.Key, record.Pos)
+			}
+			if record.Record.Type == data.LogRecordDeleted {
+				oldValue, err = txn.Delete(record.Record.Key)
+			}
+			if err != nil {
+				return err
+			}
+			if oldValue != nil {
+				reclaimSize += int64(oldValue.Size)
+			}
+		}
+		return txn.SetSeqNo(seqNo)
+	})
+	if err != nil {
+		return err
+	}
+	db.addReclaimSize(reclaimSize)
 	return nil
 }
 
@@ -1,10 +1,17 @@
 package db
 
 import (
+	"bufio"
+	"fmt"
 	"github.com/stretchr/testify/assert"
 	"kv_projects/conf"
 	"kv_projects/errs"
+	"kv_projects/index"
 	"kv_projects/utils"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
 	"testing"
 )
 
@@ -97,3 +104,202 @@ func TestWriteBatch_Commit2(t *testing.T) {
 	assert.Equal(t, uint64(2), db2.SeqNo)
 
 }
+
+// 子进程中运行：不停地提交事务，每次提交成功后输出已提交的数量，直到被父进程杀掉
+func TestWriteBatch_CrashChild(t *testing.T) {
+	dir := os.Getenv("BITCASK_CRASH_DIR")
+	if dir == "" {
+		t.Skip("only run as child process")
+	}
+	opts := conf.DefaultOptions
+	opts.DirPath = dir
+	opts.IndexType = index.BPTree
+	db, err := Open(opts)
+	if err != nil {
+		panic(err)
+	}
+	for i := 0; ; i++ {
+		wb := db.NewWriteBatch(&conf.DefaultWriteBatchOptions)
+		_ = wb.Put(utils.GetTestKey(i), utils.GetTestValue(16))
+		if err := wb.Commit(); err != nil {
+			panic(err)
+		}
+		fmt.Printf("committed %d\n", i+1)
+	}
+}
+
+func TestWriteBatch_SeqNoAfterCrash(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "bitcask-go-batch-crash")
+	defer os.RemoveAll(dir)
+
+	cmd := exec.Command(os.Args[0], "-test.run", "^TestWriteBatch_CrashChild$", "-test.v")
+	cmd.Env = append(os.Environ(), "BITCASK_CRASH_DIR="+dir)
+	stdout, err := cmd.StdoutPipe()
+	assert.Nil(t, err)
+	assert.Nil(t, cmd.Start())
+
+	// 在两次提交之间杀掉子进程，不会调用 Close，也就不会写入 seq-no 文件
+	committed := 0
+	scanner := bufio.NewScanner(stdout)
+	for committed < 200 && scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "committed ") {
+			committed, _ = strconv.Atoi(strings.TrimPrefix(line, "committed "))
+		}
+	}
+	assert.Nil(t, cmd.Process.Kill())
+	_ = cmd.Wait()
+	assert.Equal(t, 200, committed)
+
+	opts := conf.DefaultOptions
+	opts.DirPath = dir
+	opts.IndexType = index.BPTree
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	assert.False(t, db.SeqNoFileExists)
+	assert.True(t, db.SeqNo >= uint64(committed))
+	for i := 0; i < committed; i++ {
+		_, err := db.Get(utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+
+	// 崩溃后可以继续使用事务，新的序列号不会和之前的重复
+	seqNo := db.SeqNo
+	wb := db.NewWriteBatch(&conf.DefaultWriteBatchOptions)
+	assert.Nil(t, wb.Put([]byte("after-crash"), []byte("value")))
+	assert.Nil(t, wb.Commit())
+	assert.Equal(t, seqNo+1, db.SeqNo)
+	assert.Nil(t, db.Close())
+}
+
+func TestWriteBatch_SeqNoReopen(t *testing.T) {
+	for _, tp := range []index.IndexType{index.Btree, index.BPTree} {
+		opts := conf.DefaultOptions
+		dir, _ := os.MkdirTemp("", "bitcask-go-batch-seq")
+		opts.DirPath = dir
+		opts.IndexType = tp
+
+		// 多次关闭重启，每次都要读到最新的序列号
+		for n := 1; n <= 3; n++ {
+			db, err := Open(opts)
+			assert.Nil(t, err)
+			assert.Equal(t, uint64(n-1), db.SeqNo)
+			wb := db.NewWriteBatch(&conf.DefaultWriteBatchOptions)
+			assert.Nil(t, wb.Put(utils.GetTestKey(n), utils.GetTestValue(10)))
+			assert.Nil(t, wb.Commit())
+			assert.Nil(t, db.Close())
+		}
+
+		db, err := Open(opts)
+		assert.Nil(t, err)
+		assert.Equal(t, uint64(3), db.SeqNo)
+		destroyDB(db)
+	}
+}
+
+func TestWriteBatch_Rollback(t *testing.T) {
+	opts := conf.DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-batch-rollback")
+	opts.DirPath = dir
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.Nil(t, db.Put(utils.GetTestKey(0), utils.GetTestValue(10)))
+
+	wb := db.NewWriteBatch(&conf.DefaultWriteBatchOptions)
+	assert.Nil(t, wb.Put(utils.GetTestKey(1), []byte("value-1")))
+	assert.Nil(t, wb.Delete(utils.GetTestKey(0)))
+	assert.Equal(t, 2, wb.Len())
+	assert.Equal(t, int64(len(utils.GetTestKey(1))+len("value-1")+len(utils.GetTestKey(0))), wb.Size())
+
+	// 整体回滚之后提交不会写入任何数据
+	wb.Rollback()
+	assert.Equal(t, 0, wb.Len())
+	assert.Equal(t, int64(0), wb.Size())
+	assert.Nil(t, wb.Commit())
+	_, err = db.Get(utils.GetTestKey(0))
+	assert.Nil(t, err)
+	_, err = db.Get(utils.GetTestKey(1))
+	assert.Equal(t, errs.ErrKeyNotFound, err)
+
+	// 回滚之后批次可以继续使用
+	assert.Nil(t, wb.Put(utils.GetTestKey(2), []byte("value-2")))
+	assert.Nil(t, wb.Commit())
+	val, err := db.Get(utils.GetTestKey(2))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("value-2"), val)
+}
+
+func TestWriteBatch_Savepoint(t *testing.T) {
+	opts := conf.DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-batch-savepoint")
+	opts.DirPath = dir
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.Nil(t, db.Put(utils.GetTestKey(0), []byte("value-0")))
+
+	wb := db.NewWriteBatch(&conf.DefaultWriteBatchOptions)
+	assert.Nil(t, wb.Put(utils.GetTestKey(1), []byte("value-1")))
+	sp1 := wb.Savepoint()
+	size := wb.Size()
+
+	assert.Nil(t, wb.Put(utils.GetTestKey(1), []byte("value-1-new")))
+	assert.Nil(t, wb.Put(utils.GetTestKey(2), []byte("value-2")))
+	sp2 := wb.Savepoint()
+	assert.Nil(t, wb.Delete(utils.GetTestKey(0)))
+	assert.Nil(t, wb.Delete(utils.GetTestKey(2)))
+	assert.Equal(t, 2, wb.Len())
+
+	// 回滚到 sp2，恢复 key-2 并撤销 key-0 的删除
+	assert.Nil(t, wb.RollbackTo(sp2))
+	assert.Equal(t, 2, wb.Len())
+	// 保存点可以重复回滚
+	assert.Nil(t, wb.RollbackTo(sp2))
+
+	// 回滚到 sp1 之后，sp2 失效
+	assert.Nil(t, wb.RollbackTo(sp1))
+	assert.Equal(t, 1, wb.Len())
+	assert.Equal(t, size, wb.Size())
+	assert.Nil(t, wb.Put(utils.GetTestKey(3), []byte("value-3")))
+	assert.Nil(t, wb.Put(utils.GetTestKey(4), []byte("value-4")))
+	assert.Nil(t, wb.Put(utils.GetTestKey(5), []byte("value-5")))
+	assert.Equal(t, errs.ErrInvalidSavepoint, wb.RollbackTo(sp2))
+
+	assert.Nil(t, wb.Commit())
+	// 提交之后保存点失效
+	assert.Equal(t, errs.ErrInvalidSavepoint, wb.RollbackTo(sp1))
+
+	check := map[int][]byte{0: []byte("value-0"), 1: []byte("value-1"), 3: []byte("value-3"), 4: []byte("value-4"), 5: []byte("value-5")}
+	for i, expected := range check {
+		val, err := db.Get(utils.GetTestKey(i))
+		assert.Nil(t, err)
+		assert.Equal(t, expected, val)
+	}
+	_, err = db.Get(utils.GetTestKey(2))
+	assert.Equal(t, errs.ErrKeyNotFound, err)
+}
+
+func TestWriteBatch_MaxBatchSize(t *testing.T) {
+	opts := conf.DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-batch-size")
+	opts.DirPath = dir
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	wbOpts := conf.DefaultWriteBatchOptions
+	wbOpts.MaxBatchSize = 100
+	wb := db.NewWriteBatch(&wbOpts)
+	assert.Nil(t, wb.Put([]byte("key"), make([]byte, 90)))
+	// 超过最大字节数时不会暂存
+	assert.Equal(t, errs.ErrExceedMaxBatchSize, wb.Put([]byte("key2"), make([]byte, 10)))
+	assert.Equal(t, 1, wb.Len())
+	assert.Equal(t, int64(93), wb.Size())
+	// 覆盖同一个 key 时按照新的数据计算
+	assert.Nil(t, wb.Put([]byte("key"), make([]byte, 10)))
+	assert.Nil(t, wb.Put([]byte("key2"), make([]byte, 10)))
+	assert.Equal(t, int64(27), wb.Size())
+	assert.Nil(t, wb.Commit())
+	assert.Equal(t, int64(0), wb.Size())
+}
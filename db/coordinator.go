@@ -0,0 +1,193 @@
+package db
+
+import (
+	"fmt"
+	"io"
+	"kv_projects/data"
+	"kv_projects/errs"
+	"kv_projects/fio"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Coordinator
+// @Description: 跨多个 DB 实例的两阶段提交协调者。所有参与者准备成功后，先在协调者日志中落盘提交决定，再依次提交；
+// 日志中没有提交决定的事务一律回滚。参与者重启时通过 conf.Options.TxnCoordinatorDir 读取同一个日志决定未结束的事务
+type Coordinator struct {
+	mu        sync.Mutex
+	logFile   *data.DataFile
+	lastTxnId uint64 // 已经使用过的最大事务 id
+}
+
+/**
+ * OpenCoordinator
+ * @Description: 打开协调者，日志目录不存在时创建
+ * @param fsys 日志所在的文件系统，为 nil 时使用 fio.OSFileSystem，需要和参与者的 conf.Options.FileSystem 一致
+ * @param dirPath 协调者日志所在的目录
+ * @return *Coordinator
+ * @return error
+ */
+func OpenCoordinator(fsys fio.FileSystem, dirPath string) (*Coordinator, error) {
+	if fsys == nil {
+		fsys = fio.OSFileSystem{}
+	}
+	if err := fsys.MkdirAll(dirPath, os.ModePerm); err != nil {
+		return nil, err
+	}
+	logFile, err := data.OpenCoordinatorFile(fsys, dirPath)
+	if err != nil {
+		return nil, err
+	}
+	committed, offset, err := scanCoordinatorLog(logFile)
+	if err == nil {
+		// 截掉上次异常退出时末尾不完整的记录，之后追加的提交决定才能被参与者读到
+		err = logFile.Truncate(offset)
+	}
+	if err != nil {
+		_ = logFile.Close()
+		return nil, err
+	}
+	c := &Coordinator{logFile: logFile}
+	for txnId := range committed {
+		if txnId > c.lastTxnId {
+			c.lastTxnId = txnId
+		}
+	}
+	return c, nil
+}
+
+/**
+ * Commit
+ * @Description: 原子地提交多个数据库实例上的批次，每个批次必须属于不同的数据库。
+ * 任何一个批次准备失败时回滚所有已经准备的批次；提交决定落盘之后，提交阶段的失败会在参与者重启时完成提交
+ * @receiver c
+ * @param batches
+ * @return error
+ */
+func (c *Coordinator) Commit(batches ...*WriteBatch) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.logFile == nil {
+		return errs.ErrCoordinatorClosed
+	}
+	txnId := c.nextTxnId()
+
+	// 准备阶段
+	for i, wb := range batches {
+		if err := wb.Prepare(txnId); err != nil {
+			c.abort(txnId, batches[:i])
+			return err
+		}
+	}
+
+	// 记录提交决定，落盘之后事务一定会提交。写入失败时截掉的记录可能已经落盘（例如 Sync 失败），不能回滚，
+	// 参与者保持准备状态，重启时根据日志统一处理
+	if err := c.logDecision(txnId); err != nil {
+		return err
+	}
+
+	// 提交阶段
+	var commitErr error
+	for _, wb := range batches {
+		if err := wb.db.CommitPrepared(txnId); err != nil && commitErr == nil {
+			commitErr = err
+		}
+	}
+	return commitErr
+}
+
+// 在日志中记录提交决定并落盘。失败时截掉写入的部分记录，否则之后追加的提交决定都读不到；
+// 截断也失败时关闭协调者，不再继续使用损坏的日志
+func (c *Coordinator) logDecision(txnId uint64) error {
+	record, _ := data.EncoderLogRecord(&data.LogRecord{
+		Key:  []byte(strconv.FormatUint(txnId, 10)),
+		Type: data.LogRecordTxnFinished,
+	})
+	offset := c.logFile.WriteOffset
+	err := c.logFile.Write(record)
+	if err == nil {
+		err = c.logFile.Sync()
+	}
+	if err == nil {
+		return nil
+	}
+	if truncateErr := c.logFile.Truncate(offset); truncateErr != nil {
+		_ = c.logFile.Close()
+		c.logFile = nil
+		return fmt.Errorf("%w (failed to discard the partial decision, coordinator closed: %v)", err, truncateErr)
+	}
+	return err
+}
+
+// 回滚已经准备的批次，失败的参与者在重启时会因为没有提交决定而回滚
+func (c *Coordinator) abort(txnId uint64, batches []*WriteBatch) {
+	for _, wb := range batches {
+		_ = wb.db.AbortPrepared(txnId)
+	}
+}
+
+// 分配新的事务 id。协调者异常退出时，已经准备但没有决定的事务 id 没有记录在日志中，
+// 使用当前时间保证重启之后不会复用这些 id
+func (c *Coordinator) nextTxnId() uint64 {
+	txnId := uint64(time.Now().UnixNano())
+	if txnId <= c.lastTxnId {
+		txnId = c.lastTxnId + 1
+	}
+	c.lastTxnId = txnId
+	return txnId
+}
+
+// Close 关闭协调者日志
+func (c *Coordinator) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.logFile == nil {
+		return nil
+	}
+	err := c.logFile.Close()
+	c.logFile = nil
+	return err
+}
+
+// 读取协调者日志中所有已经决定提交的事务 id
+func readCoordinatorDecisions(fsys fio.FileSystem, dirPath string) (map[uint64]bool, error) {
+	if _, err := fsys.Stat(filepath.Join(dirPath, data.CoordinatorFileName)); os.IsNotExist(err) {
+		return make(map[uint64]bool), nil
+	}
+	logFile, err := data.OpenCoordinatorFile(fsys, dirPath)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = logFile.Close()
+	}()
+
+	committed, _, err := scanCoordinatorLog(logFile)
+	return committed, err
+}
+
+// 遍历协调者日志，返回已经决定提交的事务 id 以及最后一条完整记录的结束位置
+func scanCoordinatorLog(logFile *data.DataFile) (map[uint64]bool, int64, error) {
+	committed := make(map[uint64]bool)
+	var offset int64 = 0
+	for {
+		logRecord, size, err := logFile.ReadLogRecord(offset)
+		if err != nil {
+			// 末尾不完整的记录说明提交决定没有落盘
+			if err == io.EOF || err == errs.ErrInvalidCRC {
+				break
+			}
+			return nil, 0, err
+		}
+		txnId, err := strconv.ParseUint(string(logRecord.Key), 10, 64)
+		if err != nil {
+			return nil, 0, errs.ErrDataDirectoryCorrupted
+		}
+		committed[txnId] = true
+		offset += size
+	}
+	return committed, offset, nil
+}
@@ -0,0 +1,205 @@
+package db
+
+import (
+	"github.com/stretchr/testify/assert"
+	"kv_projects/conf"
+	"kv_projects/data"
+	"kv_projects/errs"
+	"kv_projects/fio"
+	"kv_projects/utils"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func TestCoordinator_Commit(t *testing.T) {
+	coordinatorDir, _ := os.MkdirTemp("", "bitcask-go-coordinator")
+	defer os.RemoveAll(coordinatorDir)
+	var dbs []*DB
+	for i := 0; i < 2; i++ {
+		opts := conf.DefaultOptions
+		opts.DirPath, _ = os.MkdirTemp("", "bitcask-go-tenant")
+		opts.TxnCoordinatorDir = coordinatorDir
+		db, err := Open(opts)
+		assert.Nil(t, err)
+		defer destroyDB(db)
+		dbs = append(dbs, db)
+	}
+	coordinator, err := OpenCoordinator(nil, coordinatorDir)
+	assert.Nil(t, err)
+
+	// 两个实例上的修改同时生效
+	wb1 := dbs[0].NewWriteBatch(&conf.DefaultWriteBatchOptions)
+	assert.Nil(t, wb1.Put(utils.GetTestKey(1), []byte("tenant-0")))
+	wb2 := dbs[1].NewWriteBatch(&conf.DefaultWriteBatchOptions)
+	assert.Nil(t, wb2.Put(utils.GetTestKey(1), []byte("tenant-1")))
+	assert.Nil(t, coordinator.Commit(wb1, wb2))
+	for i, db := range dbs {
+		val, err := db.Get(utils.GetTestKey(1))
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("tenant-"+strconv.Itoa(i)), val)
+	}
+
+	// 一个实例准备失败时，另一个实例已经准备的修改被回滚
+	wb1 = dbs[0].NewWriteBatch(&conf.DefaultWriteBatchOptions)
+	assert.Nil(t, wb1.Put(utils.GetTestKey(2), []byte("value")))
+	wbOpts := conf.DefaultWriteBatchOptions
+	wbOpts.MaxBatchNum = 1
+	wb2 = dbs[1].NewWriteBatch(&wbOpts)
+	assert.Nil(t, wb2.Put(utils.GetTestKey(2), []byte("value")))
+	assert.Nil(t, wb2.Put(utils.GetTestKey(3), []byte("value")))
+	assert.Equal(t, errs.ErrExceedMaxBatchNum, coordinator.Commit(wb1, wb2))
+	for _, db := range dbs {
+		_, err := db.Get(utils.GetTestKey(2))
+		assert.Equal(t, errs.ErrKeyNotFound, err)
+		assert.Equal(t, 0, len(db.preparedTxns))
+	}
+	assert.Nil(t, coordinator.Close())
+
+	// 重新打开协调者，事务 id 不会重复
+	committed, err := readCoordinatorDecisions(fio.OSFileSystem{}, coordinatorDir)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(committed))
+	coordinator, err = OpenCoordinator(nil, coordinatorDir)
+	assert.Nil(t, err)
+	for txnId := range committed {
+		assert.True(t, coordinator.nextTxnId() > txnId)
+	}
+	assert.Nil(t, coordinator.Close())
+	_, err = os.Stat(filepath.Join(coordinatorDir, "txn-coordinator"))
+	assert.Nil(t, err)
+}
+
+// 协调者日志和参与者使用同一个文件系统，断电后根据已经持久化的提交决定恢复
+func TestCoordinator_FaultFileSystem(t *testing.T) {
+	fsys := fio.NewFaultFileSystem(fio.NewMemFileSystem())
+	coordinatorDir := filepath.Join(os.TempDir(), "bitcask-go-mem-coordinator")
+	openDBs := func() []*DB {
+		var dbs []*DB
+		for i := 0; i < 2; i++ {
+			opts := conf.DefaultOptions
+			opts.DirPath = filepath.Join(os.TempDir(), "bitcask-go-mem-tenant-"+strconv.Itoa(i))
+			opts.FileSystem = fsys
+			opts.TxnCoordinatorDir = coordinatorDir
+			db, err := Open(opts)
+			assert.Nil(t, err)
+			dbs = append(dbs, db)
+		}
+		return dbs
+	}
+	prepare := func(dbs []*DB, txnId uint64, key []byte) {
+		for _, db := range dbs {
+			wb := db.NewWriteBatch(&conf.DefaultWriteBatchOptions)
+			assert.Nil(t, wb.Put(key, []byte("value")))
+			assert.Nil(t, wb.Prepare(txnId))
+		}
+	}
+	rng := rand.New(rand.NewSource(1))
+
+	dbs := openDBs()
+	coordinator, err := OpenCoordinator(fsys, coordinatorDir)
+	assert.Nil(t, err)
+	// 日志写在传入的文件系统中，不在磁盘上
+	_, err = fsys.Stat(filepath.Join(coordinatorDir, data.CoordinatorFileName))
+	assert.Nil(t, err)
+	_, err = os.Stat(filepath.Join(coordinatorDir, data.CoordinatorFileName))
+	assert.True(t, os.IsNotExist(err))
+
+	// 提交决定落盘之后断电，重启时提交
+	prepare(dbs, coordinator.nextTxnId(), utils.GetTestKey(1))
+	assert.Nil(t, coordinator.logDecision(coordinator.lastTxnId))
+	assert.Nil(t, fsys.Crash(rng))
+	dbs = openDBs()
+	for _, db := range dbs {
+		val, err := db.Get(utils.GetTestKey(1))
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("value"), val)
+	}
+
+	// 提交决定只写入一部分时断电，重启时回滚
+	coordinator, err = OpenCoordinator(fsys, coordinatorDir)
+	assert.Nil(t, err)
+	prepare(dbs, coordinator.nextTxnId(), utils.GetTestKey(2))
+	fsys.FailWrite(1, true)
+	assert.Equal(t, errs.ErrInjectedFault, coordinator.logDecision(coordinator.lastTxnId))
+	assert.Nil(t, fsys.Crash(rng))
+	dbs = openDBs()
+	for _, db := range dbs {
+		_, err := db.Get(utils.GetTestKey(2))
+		assert.Equal(t, errs.ErrKeyNotFound, err)
+		assert.Equal(t, 0, len(db.preparedTxns))
+		val, err := db.Get(utils.GetTestKey(1))
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("value"), val)
+	}
+	committed, err := readCoordinatorDecisions(fsys, coordinatorDir)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(committed))
+	for _, db := range dbs {
+		assert.Nil(t, db.Close())
+	}
+}
+
+// 日志末尾不完整的提交决定被截掉，之后的提交决定仍然可以被参与者读到
+func TestCoordinator_TornDecision(t *testing.T) {
+	fsys := fio.NewFaultFileSystem(fio.NewMemFileSystem())
+	coordinatorDir := filepath.Join(os.TempDir(), "bitcask-go-mem-coordinator")
+	opts := conf.DefaultOptions
+	opts.DirPath = filepath.Join(os.TempDir(), "bitcask-go-mem-tenant")
+	opts.FileSystem = fsys
+	opts.TxnCoordinatorDir = coordinatorDir
+	prepare := func(db *DB, txnId uint64, key []byte) {
+		wb := db.NewWriteBatch(&conf.DefaultWriteBatchOptions)
+		assert.Nil(t, wb.Put(key, []byte("value")))
+		assert.Nil(t, wb.Prepare(txnId))
+	}
+
+	// 写入一半的提交决定之后断电
+	coordinator, err := OpenCoordinator(fsys, coordinatorDir)
+	assert.Nil(t, err)
+	record, _ := data.EncoderLogRecord(&data.LogRecord{
+		Key:  []byte(strconv.FormatUint(coordinator.nextTxnId(), 10)),
+		Type: data.LogRecordTxnFinished,
+	})
+	assert.Nil(t, coordinator.logFile.Write(record[:len(record)/2]))
+	assert.Nil(t, coordinator.logFile.Sync())
+	assert.Nil(t, fsys.Crash(nil))
+
+	// 重启之后提交新的事务，参与者在准备状态下断电，重启时提交
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	coordinator, err = OpenCoordinator(fsys, coordinatorDir)
+	assert.Nil(t, err)
+	prepare(db, coordinator.nextTxnId(), utils.GetTestKey(1))
+	assert.Nil(t, coordinator.logDecision(coordinator.lastTxnId))
+	assert.Nil(t, fsys.Crash(nil))
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	val, err := db.Get(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("value"), val)
+
+	// 写入提交决定失败之后继续运行，失败的部分记录被截掉，之后的提交决定仍然有效
+	coordinator, err = OpenCoordinator(fsys, coordinatorDir)
+	assert.Nil(t, err)
+	prepare(db, coordinator.nextTxnId(), utils.GetTestKey(2))
+	fsys.FailWrite(1, true)
+	assert.Equal(t, errs.ErrInjectedFault, coordinator.logDecision(coordinator.lastTxnId))
+	prepare(db, coordinator.nextTxnId(), utils.GetTestKey(3))
+	assert.Nil(t, coordinator.logDecision(coordinator.lastTxnId))
+	assert.Nil(t, fsys.Crash(nil))
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	_, err = db.Get(utils.GetTestKey(2))
+	assert.Equal(t, errs.ErrKeyNotFound, err)
+	val, err = db.Get(utils.GetTestKey(3))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("value"), val)
+	assert.Equal(t, 0, len(db.preparedTxns))
+	committed, err := readCoordinatorDecisions(fsys, coordinatorDir)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(committed))
+	assert.Nil(t, db.Close())
+}
@@ -0,0 +1,317 @@
+package db
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"kv_projects/conf"
+	"kv_projects/data"
+	"kv_projects/errs"
+	"kv_projects/fio"
+	"kv_projects/index"
+	"maps"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// 崩溃一致性测试中数据库应有的内容
+type crashModel map[string]string
+
+// crashHarness
+// @Description: 在故障注入文件系统上执行随机的 Put、Delete、WriteBatch、Merge 操作，中途注入写入失败，失败之后继续写入，再模拟断电，
+// 重新打开后和模型比较，验证 loadMergeFiles、loadIndexFromDataFile 以及索引快照、事务序列号的恢复流程。
+// B+ 树索引需要真实的文件，在磁盘上的临时目录中测试，额外注入 seq-no 文件的写入、重命名失败以及 bbolt meta 页损坏
+type crashHarness struct {
+	t    *testing.T
+	seed int64
+	rng  *rand.Rand
+	fs   *fio.FaultFileSystem
+	opts conf.Options
+	db   *DB
+	// 最后一个已经持久化的状态，以及之后每次操作完成后的状态，崩溃恢复后的数据必须等于其中之一
+	states []crashModel
+	// 最后一个操作只对应一个 B+ 树事务时，保存操作之前的状态和事务序列号，该事务的 meta 页损坏时回退到这里
+	undo      crashModel
+	undoSeqNo uint64
+	// 已经返回成功的最大事务序列号，B+ 树索引从 bbolt 和 seq-no 文件恢复时不能变小
+	seqNo uint64
+}
+
+func newCrashHarness(t *testing.T, seed int64, syncWrite bool) *crashHarness {
+	fsys := fio.NewFaultFileSystem(fio.NewMemFileSystem())
+	opts := conf.DefaultOptions
+	opts.DirPath = filepath.Join(os.TempDir(), "bitcask-go-crash")
+	opts.DataFileSize = 4 * 1024
+	opts.DataFileMergeRatio = 0
+	opts.SyncWrite = syncWrite
+	opts.IndexType = index.Btree
+	opts.FileSystem = fsys
+	return &crashHarness{
+		t:      t,
+		seed:   seed,
+		rng:    rand.New(rand.NewSource(seed)),
+		fs:     fsys,
+		opts:   opts,
+		states: []crashModel{{}},
+	}
+}
+
+// B+ 树索引的 bbolt 文件不经过 FaultFileSystem，断电时不会丢失没有持久化的数据，所以只测试同步写入
+func newBPTreeCrashHarness(t *testing.T, seed int64) *crashHarness {
+	h := newCrashHarness(t, seed, true)
+	h.fs = fio.NewFaultFileSystem(fio.OSFileSystem{})
+	h.opts.FileSystem = h.fs
+	h.opts.DirPath = t.TempDir()
+	h.opts.IndexType = index.BPTree
+	return h
+}
+
+// 打开数据库并检查恢复出来的数据
+func (h *crashHarness) open() {
+	db, err := Open(h.opts)
+	if err != nil {
+		h.t.Fatalf("seed %d: failed to reopen after crash: %v", h.seed, err)
+	}
+	h.db = db
+
+	actual := make(crashModel)
+	keys, err := db.ListKeys()
+	if err != nil {
+		h.t.Fatalf("seed %d: failed to list keys: %v", h.seed, err)
+	}
+	for _, key := range keys {
+		value, err := db.Get(key)
+		if err != nil {
+			h.t.Fatalf("seed %d: failed to get key %q: %v", h.seed, key, err)
+		}
+		actual[string(key)] = string(value)
+	}
+	if h.opts.IndexType == index.BPTree && db.SeqNo < h.seqNo {
+		h.t.Fatalf("seed %d: recovered seq no %d is less than the acknowledged %d", h.seed, db.SeqNo, h.seqNo)
+	}
+	h.undo = nil
+	for i := len(h.states) - 1; i >= 0; i-- {
+		if maps.Equal(actual, h.states[i]) {
+			h.states = []crashModel{h.states[i]}
+			return
+		}
+	}
+	h.t.Fatalf("seed %d (sync write %v, index %d): recovered %d keys, matching none of the %d possible states",
+		h.seed, h.opts.SyncWrite, h.opts.IndexType, len(actual), len(h.states))
+}
+
+// 随机执行一个操作，操作失败时返回错误，失败的操作写入的部分数据已经被截掉，不会生效
+func (h *crashHarness) step() error {
+	current := h.states[len(h.states)-1]
+	next := maps.Clone(current)
+	durable := h.opts.SyncWrite
+	indexTxn := true
+	seqNo := h.db.SeqNo
+	var err error
+	switch n := h.rng.Intn(100); {
+	case n < 20 && len(current) > 0:
+		key := h.existingKey(current)
+		delete(next, key)
+		err = h.db.Delete([]byte(key))
+	case n < 40:
+		wb := h.db.NewWriteBatch(&conf.WriteBatchOptions{MaxBatchNum: 100, SyncWrites: h.opts.SyncWrite})
+		for i := h.rng.Intn(5) + 1; i > 0 && err == nil; i-- {
+			if h.rng.Intn(3) == 0 && len(next) > 0 {
+				key := h.existingKey(next)
+				delete(next, key)
+				err = wb.Delete([]byte(key))
+			} else {
+				key, value := h.randomKey(), h.randomValue()
+				next[key] = value
+				err = wb.Put([]byte(key), []byte(value))
+			}
+		}
+		if err == nil {
+			err = wb.Commit()
+		}
+	case n < 45:
+		indexTxn = false
+		err = h.db.Merge()
+	case n < 50:
+		indexTxn = false
+		durable = true
+		err = h.db.Sync()
+	default:
+		key, value := h.randomKey(), h.randomValue()
+		next[key] = value
+		err = h.db.Put([]byte(key), []byte(value))
+	}
+	h.undo = nil
+	if err != nil {
+		return err
+	}
+	if indexTxn {
+		h.undo, h.undoSeqNo = current, seqNo
+	}
+	if durable {
+		h.states = []crashModel{next}
+		h.seqNo = h.db.SeqNo
+	} else {
+		h.states = append(h.states, next)
+	}
+	return nil
+}
+
+// 关闭或者模拟断电
+func (h *crashHarness) stop(crash bool) {
+	h.fs.FailWrite(0, false)
+	if !crash {
+		// 关闭时先写入临时文件再重命名保存索引快照或者 seq-no 文件，注入写入或者重命名失败，之后断电
+		switch h.rng.Intn(6) {
+		case 0:
+			h.fs.FailWrite(1, h.rng.Intn(2) == 0)
+		case 1:
+			h.fs.FailRename(1)
+		}
+		err := h.db.Close()
+		h.fs.FailWrite(0, false)
+		h.fs.FailRename(0)
+		if err == nil {
+			h.states = h.states[len(h.states)-1:]
+			return
+		}
+	}
+	// 一半的情况下断电前部分没有持久化的数据已经写入
+	var rng *rand.Rand
+	if h.rng.Intn(2) == 0 {
+		rng = h.rng
+	}
+	if err := h.fs.Crash(rng); err != nil {
+		h.t.Fatalf("seed %d: failed to crash: %v", h.seed, err)
+	}
+	h.release()
+	// 最后一个 B+ 树事务提交时断电，meta 页只写入了一部分，这个事务没有生效
+	if h.opts.IndexType == index.BPTree && h.undo != nil && h.rng.Intn(3) == 0 {
+		h.tearIndexMeta()
+		h.states = append(h.states, h.undo)
+		h.seqNo = h.undoSeqNo
+	}
+}
+
+// 模拟进程退出，关闭断电之前打开的文件，释放 bbolt 的文件锁
+func (h *crashHarness) release() {
+	_ = h.db.Index.Close()
+	for _, dataFile := range h.db.OlderFiles {
+		_ = dataFile.Close()
+	}
+	if h.db.ActiveFile != nil {
+		_ = h.db.ActiveFile.Close()
+	}
+}
+
+// 破坏 bbolt 中事务 id 较大的 meta 页，打开时回退到另一个 meta 页，也就是上一个事务的状态
+func (h *crashHarness) tearIndexMeta() {
+	fileName := filepath.Join(h.opts.DirPath, index.BtreeIndexFileName)
+	buf, err := fio.ReadFile(h.fs, fileName)
+	if err != nil {
+		h.t.Fatalf("seed %d: failed to read the b+ tree index: %v", h.seed, err)
+	}
+	// 每个 meta 页依次是 16 字节的页头，magic、version、pageSize、flags，16 字节的根 bucket，freelist、pgid 和 txid
+	const pageSizeOffset, txIdOffset = 24, 64
+	pageSize := int64(binary.LittleEndian.Uint32(buf[pageSizeOffset:]))
+	var offset int64 = txIdOffset
+	if binary.LittleEndian.Uint64(buf[pageSize+txIdOffset:]) > binary.LittleEndian.Uint64(buf[txIdOffset:]) {
+		offset += pageSize
+	}
+	if err := h.fs.Corrupt(fileName, offset); err != nil {
+		h.t.Fatalf("seed %d: failed to corrupt the b+ tree meta page: %v", h.seed, err)
+	}
+}
+
+func (h *crashHarness) run(rounds, ops int) {
+	for round := 0; round < rounds; round++ {
+		h.open()
+		if h.rng.Intn(2) == 0 {
+			h.fs.FailWrite(h.rng.Intn(ops)+1, h.rng.Intn(2) == 0)
+		}
+		// 操作失败之后继续写入，之前写入的部分数据不能影响之后的记录
+		failed := false
+		for i := 0; i < ops; i++ {
+			if h.step() != nil {
+				failed = true
+			}
+		}
+		h.stop(failed || h.rng.Intn(3) > 0)
+	}
+	h.open()
+	if err := h.db.Close(); err != nil {
+		h.t.Fatalf("seed %d: failed to close: %v", h.seed, err)
+	}
+}
+
+func (h *crashHarness) randomKey() string {
+	return fmt.Sprintf("key-%02d", h.rng.Intn(30))
+}
+
+func (h *crashHarness) randomValue() string {
+	value := make([]byte, h.rng.Intn(200)+1)
+	for i := range value {
+		value[i] = byte('a' + h.rng.Intn(26))
+	}
+	return string(value)
+}
+
+// 随机选取一个存在的 key，按照顺序选取保证同一个 seed 的结果相同
+func (h *crashHarness) existingKey(model crashModel) string {
+	for i := h.rng.Intn(30); ; i = (i + 1) % 30 {
+		key := fmt.Sprintf("key-%02d", i)
+		if _, ok := model[key]; ok {
+			return key
+		}
+	}
+}
+
+func TestDB_CrashRecovery(t *testing.T) {
+	for _, syncWrite := range []bool{true, false} {
+		for seed := int64(1); seed <= 30; seed++ {
+			newCrashHarness(t, seed, syncWrite).run(10, 80)
+		}
+	}
+}
+
+func TestDB_CrashRecoveryBPTree(t *testing.T) {
+	for seed := int64(1); seed <= 30; seed++ {
+		newBPTreeCrashHarness(t, seed).run(10, 80)
+	}
+}
+
+func TestDB_CrashCorruption(t *testing.T) {
+	fsys := fio.NewFaultFileSystem(fio.NewMemFileSystem())
+	opts := conf.DefaultOptions
+	opts.DirPath = filepath.Join(os.TempDir(), "bitcask-go-corruption")
+	opts.DataFileSize = 4 * 1024
+	opts.SyncWrite = true
+	opts.FileSystem = fsys
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	for i := 0; i < 500; i++ {
+		assert.Nil(t, db.Put([]byte(fmt.Sprintf("key-%03d", i)), []byte(fmt.Sprintf("value-%03d", i))))
+	}
+	assert.True(t, len(db.OlderFiles) > 0)
+	activeFileName := data.GetDataFileName(opts.DirPath, db.ActiveFile.FileId)
+	assert.Nil(t, db.Close())
+
+	// 旧文件中第一条记录的 value 损坏，读取时校验失败，其他数据不受影响
+	assert.Nil(t, fsys.Corrupt(data.GetDataFileName(opts.DirPath, 0), 20))
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	_, err = db.Get([]byte("key-000"))
+	assert.Equal(t, errs.ErrInvalidCRC, err)
+	value, err := db.Get([]byte("key-001"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("value-001"), value)
+
+	// 没有索引快照时需要遍历活跃文件，中间的记录损坏时不能当作文件末尾丢弃之后的数据
+	assert.Nil(t, fsys.Crash(nil))
+	assert.Nil(t, fsys.Remove(filepath.Join(opts.DirPath, data.IndexSnapshotFileName)))
+	assert.Nil(t, fsys.Corrupt(activeFileName, 20))
+	_, err = Open(opts)
+	assert.Equal(t, errs.ErrInvalidCRC, err)
+}
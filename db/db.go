@@ -1,22 +1,25 @@
 package db
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
-	"github.com/gofrs/flock"
 	"io"
+	"kv_projects/cache"
 	"kv_projects/conf"
 	"kv_projects/data"
 	"kv_projects/errs"
 	"kv_projects/fio"
 	"kv_projects/index"
 	"kv_projects/utils"
+	"math"
 	"os"
 	"path/filepath"
 	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 )
 
 const (
@@ -39,18 +42,34 @@ type DB struct {
 	SeqNoFileExists bool //标识存放全局事务序列号的文件是否存在
 	IsInitial       bool //标识是否是初始化数据库实例
 
-	FileLock    *flock.Flock //文件锁保证多个进程之间的互斥
-	BytesWrite  uint64       //标识当前所写的字节数
-	ReclaimSize int64        // 记录当前数据库中无效的字节数
+	FileLock    fio.FileLock //文件锁保证多个进程之间的互斥
+	BytesWrite  uint64       //标识当前所写的字节数，只能在持有写锁时修改
+	ReclaimSize int64        // 记录当前数据库中无效的字节数，只能通过 atomic 读写
+
+	ValueCache *cache.ValueCache // value 读缓存，没有开启时为 nil
+	FileTable  *data.FileTable   // 旧数据文件的句柄表，限制同时打开的文件数量
+
+	LockManager *LockManager // 事务使用的 key 级别悲观锁
+
+	preparedTxns    map[uint64]*preparedTxn // 两阶段提交中已经准备、还没有提交或回滚的事务
+	preparedTxnFile *data.DataFile          // 记录已准备事务的文件，第一次准备事务时打开
+
+	// 追加写入活跃文件时持有，和 Mutex 一起获取时先获取该锁。PutStream 读取调用方的数据期间只持有该锁，
+	// 其他写操作需要等待，读操作只需要 Mutex 的读锁，不受影响
+	appendMu sync.Mutex
 }
 
 // Stat
 // @Description: 存储引擎统计信息
 type Stat struct {
-	KeyNum      uint   // key的总数量
-	DataFileNum uint   // 文件总数
-	ReclaimSize int64  // 可以被merge回收的字节大小
-	DiskSize    uint64 // 数据目录所占磁盘大小,以字节为单位
+	KeyNum        uint   // key的总数量
+	DataFileNum   uint   // 文件总数
+	ReclaimSize   int64  // 可以被merge回收的字节大小
+	DiskSize      uint64 // 数据目录所占磁盘大小,以字节为单位
+	CacheHits     uint64 // value 读缓存命中次数
+	CacheMisses   uint64 // value 读缓存未命中次数
+	OpenFiles     uint   // 当前打开的旧数据文件数量
+	FileEvictions uint64 // 旧数据文件句柄被淘汰关闭的次数
 }
 
 func Open(options conf.Options) (*DB, error) {
@@ -59,21 +78,25 @@ func Open(options conf.Options) (*DB, error) {
 		return nil, err
 	}
 
+	if options.FileSystem == nil {
+		options.FileSystem = fio.OSFileSystem{}
+	}
+	fsys := options.FileSystem
+
 	var isInitial bool
 
 	// 对用户传入的路径进行判断，如果不存在则创建
-	if _, err := os.Stat(options.DirPath); os.IsNotExist(err) {
+	if _, err := fsys.Stat(options.DirPath); os.IsNotExist(err) {
 		isInitial = true
 		// os.ModePerm 创建文件夹权限 0777
-		if err := os.MkdirAll(options.DirPath, os.ModePerm); err != nil {
+		if err := fsys.MkdirAll(options.DirPath, os.ModePerm); err != nil {
 			return nil, err
 		}
 	}
 
 	//判断当前文件目录是否正在使用
-	fileLock := flock.New(filepath.Join(options.DirPath, FileLockName))
 	// 尝试获取文件锁，如果 db 实例在该文件夹已经启动，则 fold 为false，否则为true，保证一个文件夹只能启动一个db
-	hold, err := fileLock.TryLock()
+	fileLock, hold, err := fsys.TryLock(filepath.Join(options.DirPath, FileLockName))
 	if err != nil {
 		return nil, err
 	}
@@ -82,12 +105,17 @@ func Open(options conf.Options) (*DB, error) {
 	}
 
 	// 考虑目录存在，但是为空的情况，此时在该目录上初始化db，也需要将IsInitial设为 true
-	entries, err := os.ReadDir(options.DirPath)
+	// 文件锁在上面已经创建，不算在内
+	entries, err := fsys.ReadDir(options.DirPath)
 	if err != nil {
 		return nil, err
 	}
-	if len(entries) == 0 {
-		isInitial = true
+	isInitial = true
+	for _, entry := range entries {
+		if entry.Name() != FileLockName {
+			isInitial = false
+			break
+		}
 	}
 
 	// 定义一个 db 实例
@@ -95,9 +123,21 @@ func Open(options conf.Options) (*DB, error) {
 		Options:    options,
 		Mutex:      new(sync.RWMutex),
 		OlderFiles: make(map[uint32]*data.DataFile),
-		Index:      index.NewIndexer(options.IndexType, options.DirPath, options.SyncWrite),
 		IsInitial:  isInitial,
 		FileLock:   fileLock,
+		FileTable:  data.NewFileTable(options.MaxOpenFiles),
+
+		LockManager: NewLockManager(),
+
+		preparedTxns: make(map[uint64]*preparedTxn),
+	}
+	// 哈希索引需要读取数据文件校验 key，所以在 db 实例创建之后再初始化索引
+	if db.Index, err = db.newIndexer(); err != nil {
+		_ = fileLock.Unlock()
+		return nil, err
+	}
+	if options.ValueCacheSize > 0 {
+		db.ValueCache = cache.NewValueCache(options.ValueCacheSize)
 	}
 
 	// 加载 merge 数据目录,将 merge 后的新文件替换原来的旧文件
@@ -111,23 +151,30 @@ func Open(options conf.Options) (*DB, error) {
 	}
 
 	if options.IndexType != index.BPTree {
-		// 如果发生过 merge 必定会存在hint索引文件，直接从中加载数据即可
-		// 从 hint 文件加载索引
-		if err := db.loadIndexFromHintFile(); err != nil {
+		// 优先从上次关闭时保存的索引快照加载，只需要重放快照之后追加的记录
+		snapshot, err := db.loadIndexSnapshot()
+		if err != nil {
 			return nil, err
 		}
+		if snapshot == nil {
+			// 如果发生过 merge 必定会存在hint索引文件，直接从中加载数据即可
+			// 从 hint 文件加载索引
+			if err := db.loadIndexFromHintFile(); err != nil {
+				return nil, err
+			}
+		}
 
 		// 没有发生 merge 的数据文件，需要遍历文件加载索引
 		//构建内存索引
-		if err := db.loadIndexFromDataFile(); err != nil {
+		if err := db.loadIndexFromDataFile(snapshot); err != nil {
 			return nil, err
 		}
+	}
 
-		// 在db实例启动完成后，将ioManager重置为普通的Io
-		if db.Options.MMapAtStartUp {
-			if err := db.resetIoType(); err != nil {
-				return nil, err
-			}
+	// 在db实例启动完成后，将ioManager重置为普通的Io
+	if db.mmapAtStartUp() {
+		if err := db.resetIoType(); err != nil {
+			return nil, err
 		}
 	}
 	// B+ 树的索引保存在磁盘上，不需要加载到内存
@@ -135,46 +182,84 @@ func Open(options conf.Options) (*DB, error) {
 		if err := db.loadSeqNoFile(); err != nil {
 			return nil, err
 		}
-		// 获取当前活跃文件大小，更新活跃文件offset
+		// 获取当前活跃文件最后一条记录的位置，更新活跃文件offset
 		if db.ActiveFile != nil {
-			size, err := db.ActiveFile.IOManager.Size()
+			size, err := db.ActiveFile.LastRecordEnd()
 			if err != nil {
 				return nil, err
 			}
 			db.ActiveFile.WriteOffset = size
 		}
 	}
+	// 上次没有正常关闭时，可读写 mmap 预分配的空间还留在活跃文件末尾，截断到最后一条记录之后
+	if db.ActiveFile != nil {
+		if err := db.ActiveFile.Truncate(db.ActiveFile.WriteOffset); err != nil {
+			return nil, err
+		}
+	}
+
+	// 处理上次没有结束的两阶段提交事务
+	if err := db.recoverPreparedTxns(); err != nil {
+		// 数据已经加载完成，关闭数据库释放文件和目录锁，配置协调者日志之后可以重新打开
+		_ = db.Close()
+		return nil, err
+	}
 	return db, nil
 }
 
-// 初始化用户迭代器
-func (db *DB) NewUserIterator(options conf.IteratorOptions) *Iterator {
-	IndexIter := db.Index.Iterator(options.Reverse)
+// 初始化用户迭代器，索引类型不支持有序遍历时返回错误
+// 迭代器引用创建时的所有数据文件，遍历期间 merge 替换掉的旧文件在迭代器关闭之后才会被删除
+func (db *DB) NewUserIterator(options conf.IteratorOptions) (*Iterator, error) {
+	db.Mutex.RLock()
+	defer db.Mutex.RUnlock()
+	IndexIter, err := db.Index.Iterator(options.Reverse)
+	if err != nil {
+		return nil, err
+	}
+	files := make(map[uint32]*data.DataFile, len(db.OlderFiles)+1)
+	for fid, file := range db.OlderFiles {
+		file.Ref()
+		files[fid] = file
+	}
+	if db.ActiveFile != nil {
+		db.ActiveFile.Ref()
+		files[db.ActiveFile.FileId] = db.ActiveFile
+	}
 	return &Iterator{
 		IndexIter: IndexIter,
 		Db:        db,
 		Options:   options,
-	}
+		files:     files,
+	}, nil
 }
 
 // 获取所有的key
-func (db *DB) ListKeys() [][]byte {
-	iter := db.Index.Iterator(false)
+func (db *DB) ListKeys() ([][]byte, error) {
+	iter, err := db.Index.Iterator(false)
+	if err != nil {
+		return nil, err
+	}
 	defer iter.Close()
-	keys := make([][]byte, db.Index.Size())
-	var idx int
+	// 获取 Size 和创建迭代器之间可能有并发写入，所以这里只作为容量使用
+	size, err := db.Index.Size()
+	if err != nil {
+		return nil, err
+	}
+	keys := make([][]byte, 0, size)
 	for iter.Rewind(); iter.Valid(); iter.Next() {
-		keys[idx] = iter.Key()
-		idx++
+		keys = append(keys, iter.Key())
 	}
-	return keys
+	return keys, nil
 }
 
 // 获取所有数据，然后执行用户指定操作
 func (db *DB) Fold(fn func(key, value []byte) bool) error {
 	db.Mutex.RLock()
 	defer db.Mutex.RUnlock()
-	iter := db.Index.Iterator(false)
+	iter, err := db.Index.Iterator(false)
+	if err != nil {
+		return err
+	}
 	defer iter.Close()
 	for iter.Rewind(); iter.Valid(); iter.Next() {
 		// 读取数据
@@ -209,16 +294,27 @@ func (db *DB) Put(key []byte, value []byte) error {
 		Value: value,
 		Type:  data.LogRecordNormal,
 	}
+	if err := data.CheckLogRecordSize(int64(len(logRecord.Key)), int64(len(value))); err != nil {
+		return err
+	}
+
+	// 写数据和更新索引在同一把写锁内完成，保证读操作看到的索引和数据文件一致
+	db.lock()
+	defer db.unlock()
 
 	// 将数据写入到当前活跃数据文件
-	pos, err := db.appendLogRecordWithLock(logRecord)
+	pos, err := db.appendLogRecord(logRecord)
 	if err != nil {
 		return err
 	}
 
 	//更新内存索引
-	if oldValue := db.Index.Put(key, pos); oldValue != nil {
-		db.ReclaimSize += int64(oldValue.Size)
+	oldValue, err := db.Index.Put(key, pos)
+	if err != nil {
+		return err
+	}
+	if oldValue != nil {
+		db.addReclaimSize(int64(oldValue.Size))
 	}
 	return nil
 
@@ -233,14 +329,19 @@ func (db *DB) Put(key []byte, value []byte) error {
  * @return error
  */
 func (db *DB) Get(key []byte) ([]byte, error) {
-	db.Mutex.Lock()
-	defer db.Mutex.Unlock()
+	// 读操作只需要读锁，多个 Get 之间可以并行执行
+	// merge 安装新文件需要持有写锁，所以读取期间用到的数据文件不会被替换或关闭
+	db.Mutex.RLock()
+	defer db.Mutex.RUnlock()
 	//判断key是否为空
 	if len(key) == 0 {
 		return nil, errs.ErrKeyIsEmpty
 	}
 	// 从内存中，取出相应的key对应的索引信息
-	logRecordPos := db.Index.Get(key)
+	logRecordPos, err := db.Index.Get(key)
+	if err != nil {
+		return nil, err
+	}
 	// 没有取到对应数据，说明key不存在
 	if logRecordPos == nil {
 		return nil, errs.ErrKeyNotFound
@@ -256,8 +357,13 @@ func (db *DB) Delete(key []byte) error {
 		return errs.ErrKeyIsEmpty
 	}
 
+	db.lock()
+	defer db.unlock()
+
 	// 先判断 key 是否存在，如果不存在直接返回
-	if pos := db.Index.Get(key); pos == nil {
+	if pos, err := db.Index.Get(key); err != nil {
+		return err
+	} else if pos == nil {
 		return errs.ErrKeyNotFound
 	}
 
@@ -266,18 +372,21 @@ func (db *DB) Delete(key []byte) error {
 		Key:  logRecordKeyWithSeq(key, nonTransactionSeqNo),
 		Type: data.LogRecordDeleted}
 	// 添加该记录,删除的这条记录也可以看作可删除的数据
-	pos, err := db.appendLogRecordWithLock(logRecord)
+	pos, err := db.appendLogRecord(logRecord)
 	if err != nil {
 		return err
 	}
-	db.ReclaimSize += int64(pos.Size)
+	db.addReclaimSize(int64(pos.Size))
 	// 在内存索引中删除 key
-	oldValue, ok := db.Index.Delete(key)
+	oldValue, ok, err := db.Index.Delete(key)
+	if err != nil {
+		return err
+	}
 	if !ok {
 		return errs.ErrIndexUpdateFailed
 	}
 	if oldValue != nil {
-		db.ReclaimSize += int64(oldValue.Size)
+		db.addReclaimSize(int64(oldValue.Size))
 	}
 	return nil
 }
@@ -288,51 +397,50 @@ func (db *DB) Delete(key []byte) error {
  * @receiver db
  * @return error
  */
-func (db *DB) Close() error {
+func (db *DB) Close() (err error) {
 	defer func() {
-		// 将文件锁释放
-		if err := db.FileLock.Unlock(); err != nil {
-			panic(fmt.Sprintf("failed to unlock the directory, %v", err))
+		// 将文件锁释放，其他步骤已经出错时优先返回之前的错误
+		if unlockErr := db.FileLock.Unlock(); unlockErr != nil && err == nil {
+			err = fmt.Errorf("failed to unlock the directory: %w", unlockErr)
 		}
 	}()
 	if db.ActiveFile == nil {
 		return nil
 	}
-	db.Mutex.Lock()
-	defer db.Mutex.Unlock()
-	if err := db.Index.Close(); err != nil {
-		return err
-	}
-	// 保存当前的事务序列号， B+树模式下，获取不到最新的事务序列号
-	seqNoFile, err := data.OpenSeqNoFile(db.Options.DirPath)
-	if err != nil {
+	db.lock()
+	defer db.unlock()
+	// 关闭前持久化活跃文件，否则正常关闭之后断电仍然可能丢失数据，快照也会指向不存在的位置
+	if err := db.ActiveFile.Sync(); err != nil {
 		return err
 	}
-	// 将最新的事务序列号保存在特定文件中，取出时不用遍历所有文件
-	seqNoLogRecord := &data.LogRecord{
-		Key:   []byte(SeqNoKey),
-		Value: []byte(strconv.FormatUint(db.SeqNo, 10)),
+	// 保存内存索引的快照，下次启动时不需要重新遍历数据文件
+	// 还有已准备的事务时不保存，否则重启时快照之前的事务数据不会被重放，提交之后无法更新索引
+	if db.Options.IndexType != index.BPTree && len(db.preparedTxns) == 0 {
+		if err := db.writeIndexSnapshot(); err != nil {
+			return err
+		}
 	}
-
-	encoderLogRecord, _ := data.EncoderLogRecord(seqNoLogRecord)
-
-	if err := seqNoFile.Write(encoderLogRecord); err != nil {
+	if err := db.Index.Close(); err != nil {
 		return err
 	}
-	if err := seqNoFile.Sync(); err != nil {
+	// 保存当前的事务序列号， B+树模式下，获取不到最新的事务序列号
+	if err := db.saveSeqNo(); err != nil {
 		return err
 	}
-	if err := seqNoFile.Close(); err != nil {
-		return err
+	if db.preparedTxnFile != nil {
+		if err := db.preparedTxnFile.Close(); err != nil {
+			return err
+		}
+		db.preparedTxnFile = nil
 	}
-	// 关闭当前活跃文件
-	if err := db.ActiveFile.Close(); err != nil {
-		return nil
+	// 释放数据库持有的文件引用，没有被迭代器引用的文件会直接关闭
+	if err := db.ActiveFile.Unref(); err != nil {
+		return err
 	}
 
 	// 关闭旧的活跃文件
 	for _, oldFile := range db.OlderFiles {
-		if err := oldFile.Close(); err != nil {
+		if err := oldFile.Unref(); err != nil {
 			return err
 		}
 	}
@@ -346,11 +454,11 @@ func (db *DB) Close() error {
  * @return error
  */
 func (db *DB) Sync() error {
+	db.lock()
+	defer db.unlock()
 	if db.ActiveFile == nil {
 		return nil
 	}
-	db.Mutex.Lock()
-	defer db.Mutex.Unlock()
 	return db.ActiveFile.Sync()
 }
 
@@ -359,8 +467,9 @@ func (db *DB) Sync() error {
  * @Description: 返回数据库实例相关的统计信息
  * @receiver db
  * @return *Stat
+ * @return error
  */
-func (db *DB) Stat() *Stat {
+func (db *DB) Stat() (*Stat, error) {
 	db.Mutex.RLock()
 	defer db.Mutex.RUnlock()
 
@@ -368,16 +477,27 @@ func (db *DB) Stat() *Stat {
 	if db.ActiveFile != nil {
 		dataFiles += 1
 	}
-	dirSize, err := utils.DirSize(db.Options.DirPath)
+	dirSize, err := utils.DirSize(db.Options.FileSystem, db.Options.DirPath)
 	if err != nil {
-		panic(fmt.Sprintf("failed to get dir size : %v", err))
+		return nil, fmt.Errorf("failed to get dir size: %w", err)
 	}
-	return &Stat{
-		KeyNum:      uint(db.Index.Size()),
+	keyNum, err := db.Index.Size()
+	if err != nil {
+		return nil, err
+	}
+	stat := &Stat{
+		KeyNum:      uint(keyNum),
 		DataFileNum: dataFiles,
-		ReclaimSize: db.ReclaimSize,
+		ReclaimSize: atomic.LoadInt64(&db.ReclaimSize),
 		DiskSize:    dirSize,
 	}
+	stat.OpenFiles = uint(db.FileTable.OpenFiles())
+	stat.FileEvictions = db.FileTable.Evictions()
+	if db.ValueCache != nil {
+		stat.CacheHits = db.ValueCache.Hits()
+		stat.CacheMisses = db.ValueCache.Misses()
+	}
+	return stat, nil
 }
 
 /**
@@ -386,21 +506,133 @@ func (db *DB) Stat() *Stat {
  * @receiver db
  */
 func (db *DB) BackUp(destDir string) error {
+	// 等待正在进行的 PutStream 写完，否则会复制到不完整的记录
+	db.appendMu.Lock()
+	defer db.appendMu.Unlock()
 	db.Mutex.RLock()
 	defer db.Mutex.RUnlock()
+	// 活跃文件写缓冲区中的数据需要先写入文件
+	if db.ActiveFile != nil {
+		if err := db.ActiveFile.Sync(); err != nil {
+			return err
+		}
+	}
 	extends := []string{FileLockName}
-	return utils.CopyDir(db.Options.DirPath, destDir, extends)
+	// 备份顺序读取所有文件，使用直接 IO 时不经过页缓存
+	if db.useDirectIO(conf.DirectIOBackup) {
+		return utils.CopyDirWithReader(db.Options.FileSystem, db.Options.DirPath, destDir, extends, fio.ReadFileDirect)
+	}
+	return utils.CopyDir(db.Options.FileSystem, db.Options.DirPath, destDir, extends)
+}
+
+/**
+ * GetFunc
+ * @Description: 取出 key 对应的 value 并交给 fn 处理，旧数据文件使用 mmap 时不进行内存拷贝
+ * value 只在 fn 执行期间有效，fn 返回后不能再持有，也不能修改 value 的内容
+ * @receiver db
+ * @param key
+ * @param fn
+ * @return error
+ */
+func (db *DB) GetFunc(key []byte, fn func(value []byte) error) error {
+	db.Mutex.RLock()
+	defer db.Mutex.RUnlock()
+	if len(key) == 0 {
+		return errs.ErrKeyIsEmpty
+	}
+	logRecordPos, err := db.Index.Get(key)
+	if err != nil {
+		return err
+	}
+	if logRecordPos == nil {
+		return errs.ErrKeyNotFound
+	}
+	return db.viewValueByPosition(logRecordPos, fn)
+}
+
+/**
+ * MultiGet
+ * @Description: 批量读取多个 key，只获取一次读锁。先从索引中取出所有位置，再按文件分组、按偏移量排序后依次读取，
+ * 同一个文件中的数据顺序读取。返回的 value 和错误与 keys 的顺序一一对应，某个 key 读取失败不影响其他 key
+ * @receiver db
+ * @param keys
+ * @return [][]byte
+ * @return []error key 不存在时为 errs.ErrKeyNotFound
+ */
+func (db *DB) MultiGet(keys [][]byte) ([][]byte, []error) {
+	values := make([][]byte, len(keys))
+	readErrs := make([]error, len(keys))
+
+	db.Mutex.RLock()
+	defer db.Mutex.RUnlock()
+
+	// 待读取的数据位置，以及对应的 key 在 keys 中的下标
+	type readItem struct {
+		idx int
+		pos *data.LogRecordPos
+	}
+	items := make([]readItem, 0, len(keys))
+	for i, key := range keys {
+		if len(key) == 0 {
+			readErrs[i] = errs.ErrKeyIsEmpty
+			continue
+		}
+		logRecordPos, err := db.Index.Get(key)
+		if err != nil {
+			readErrs[i] = err
+			continue
+		}
+		if logRecordPos == nil {
+			readErrs[i] = errs.ErrKeyNotFound
+			continue
+		}
+		items = append(items, readItem{idx: i, pos: logRecordPos})
+	}
+
+	sort.Slice(items, func(i, j int) bool {
+		if items[i].pos.Fid != items[j].pos.Fid {
+			return items[i].pos.Fid < items[j].pos.Fid
+		}
+		return items[i].pos.Offset < items[j].pos.Offset
+	})
+
+	for start := 0; start < len(items); {
+		// 同一个文件的数据连续排列，读取期间一直持有文件句柄
+		end := start
+		for end < len(items) && items[end].pos.Fid == items[start].pos.Fid {
+			end++
+		}
+		dataFile := db.getDataFile(items[start].pos.Fid)
+		var err error
+		if dataFile != nil {
+			err = dataFile.Acquire()
+		}
+		for _, item := range items[start:end] {
+			if err != nil {
+				readErrs[item.idx] = err
+				continue
+			}
+			values[item.idx], readErrs[item.idx] = db.readValue(dataFile, item.pos)
+		}
+		if dataFile != nil && err == nil {
+			dataFile.Release()
+		}
+		start = end
+	}
+	return values, readErrs
 }
 
 func (db *DB) GetValueByPosition(logRecordPos *data.LogRecordPos) ([]byte, error) {
-	// 根据文件id 找到对应数据的位置
-	var dataFile *data.DataFile
-	// 文件 id 为当前活跃文件
-	if db.ActiveFile.FileId == logRecordPos.Fid {
-		dataFile = db.ActiveFile
-	} else {
-		// 不是活跃文件，根据文件id 在旧文件中找
-		dataFile = db.OlderFiles[logRecordPos.Fid]
+	return db.readValue(db.getDataFile(logRecordPos.Fid), logRecordPos)
+}
+
+// 从指定的数据文件中读取 value，dataFile 为 nil 时说明文件不存在
+func (db *DB) readValue(dataFile *data.DataFile, logRecordPos *data.LogRecordPos) ([]byte, error) {
+	// 先从读缓存中查找，缓存中的数据不能被调用方修改，所以返回拷贝
+	if db.ValueCache != nil {
+		if value, ok := db.ValueCache.Get(logRecordPos); ok {
+			return append([]byte(nil), value...), nil
+		}
 	}
 	if dataFile == nil {
 		return nil, errs.ErrDataFileNotFound
@@ -414,12 +646,103 @@ func (db *DB) GetValueByPosition(logRecordPos *data.LogRecordPos) ([]byte, error
 	if logRecord.Type == data.LogRecordDeleted {
 		return nil, errs.ErrDataAlreadyDeleted
 	}
+	if db.ValueCache != nil {
+		db.ValueCache.Put(logRecordPos, append([]byte(nil), logRecord.Value...))
+	}
 	return logRecord.Value, nil
 }
 
-func (db *DB) appendLogRecordWithLock(logRecord *data.LogRecord) (*data.LogRecordPos, error) {
+// 累加可以被 merge 回收的字节数，统计信息可能在持有读锁时被读取，所以使用原子操作
+func (db *DB) addReclaimSize(delta int64) {
+	atomic.AddInt64(&db.ReclaimSize, delta)
+}
+
+/**
+ * viewValueByPosition
+ * @Description: 根据位置读取 value 并交给 fn 处理，调用方必须持有读锁，保证 fn 执行期间文件不会被关闭
+ * @receiver db
+ * @param logRecordPos
+ * @param fn
+ * @return error
+ */
+func (db *DB) viewValueByPosition(logRecordPos *data.LogRecordPos, fn func(value []byte) error) error {
+	return db.viewValue(db.getDataFile(logRecordPos.Fid), logRecordPos, fn)
+}
+
+func (db *DB) viewValue(dataFile *data.DataFile, logRecordPos *data.LogRecordPos, fn func(value []byte) error) error {
+	if db.ValueCache != nil {
+		if value, ok := db.ValueCache.Get(logRecordPos); ok {
+			return fn(value)
+		}
+	}
+	if dataFile == nil {
+		return errs.ErrDataFileNotFound
+	}
+	// fn 执行期间 value 引用的内存必须有效，文件句柄不能被淘汰
+	if err := dataFile.Acquire(); err != nil {
+		return err
+	}
+	defer dataFile.Release()
+	logRecord, _, err := dataFile.ReadLogRecordNoCopy(logRecordPos.Offset)
+	if err != nil {
+		return err
+	}
+	if logRecord.Type == data.LogRecordDeleted {
+		return errs.ErrDataAlreadyDeleted
+	}
+	return fn(logRecord.Value)
+}
+
+/**
+ * keyMatchesPosition
+ * @Description: 校验 pos 位置上的数据是否属于 key，供哈希索引处理哈希冲突使用，调用方必须持有锁
+ * @receiver db
+ * @param key
+ * @param pos
+ * @return bool
+ * @return error 读取数据文件失败
+ */
+func (db *DB) keyMatchesPosition(key []byte, pos *data.LogRecordPos) (bool, error) {
+	dataFile := db.getDataFile(pos.Fid)
+	if dataFile == nil {
+		return false, errs.ErrDataFileNotFound
+	}
+	if err := dataFile.Acquire(); err != nil {
+		return false, err
+	}
+	defer dataFile.Release()
+	logRecord, _, err := dataFile.ReadLogRecordNoCopy(pos.Offset)
+	if err != nil {
+		return false, err
+	}
+	realKey, _ := parseLogRecordKey(logRecord.Key)
+	return bytes.Equal(realKey, key), nil
+}
+
+// 根据文件 id 找到对应的数据文件，调用方必须持有锁
+func (db *DB) getDataFile(fid uint32) *data.DataFile {
+	// 文件 id 为当前活跃文件
+	if db.ActiveFile != nil && db.ActiveFile.FileId == fid {
+		return db.ActiveFile
+	}
+	// 不是活跃文件，根据文件id 在旧文件中找
+	return db.OlderFiles[fid]
+}
+
+// 获取写锁，会等待正在进行的 PutStream 写完
+func (db *DB) lock() {
+	db.appendMu.Lock()
 	db.Mutex.Lock()
-	defer db.Mutex.Unlock()
+}
+
+func (db *DB) unlock() {
+	db.Mutex.Unlock()
+	db.appendMu.Unlock()
+}
+
+func (db *DB) appendLogRecordWithLock(logRecord *data.LogRecord) (*data.LogRecordPos, error) {
+	db.lock()
+	defer db.unlock()
 
 	return db.appendLogRecord(logRecord)
 }
@@ -432,42 +755,61 @@ func (db *DB) appendLogRecordWithLock(logRecord *data.LogRecord) (*data.LogRecor
  * @return error
  */
 func (db *DB) appendLogRecord(logRecord *data.LogRecord) (*data.LogRecordPos, error) {
+	// 将数据进行编码
+	encRecord, size := data.EncoderLogRecord(logRecord)
+	return db.appendToActiveFile(size, func(dataFile *data.DataFile) error {
+		return dataFile.Write(encRecord)
+	})
+}
+
+/**
+ * appendToActiveFile
+ * @Description: 为 size 大小的记录准备好活跃文件，由 write 写入之后根据配置进行持久化，返回文件索引信息，调用方必须持有写锁
+ * @receiver db
+ * @param size
+ * @param write 向活跃文件写入整条记录
+ * @return *data.LogRecordPos
+ * @return error
+ */
+func (db *DB) appendToActiveFile(size int64, write func(dataFile *data.DataFile) error) (*data.LogRecordPos, error) {
+	if err := db.prepareActiveFile(size); err != nil {
+		return nil, err
+	}
+	// 数据写入操作
+	writeOffset := db.ActiveFile.WriteOffset
+	if err := write(db.ActiveFile); err != nil {
+		return nil, err
+	}
+	return db.finishAppend(size, writeOffset)
+}
+
+// 保证活跃文件存在并且可以放下 size 大小的记录，切换活跃文件时会替换 IO 管理器，调用方必须持有写锁
+func (db *DB) prepareActiveFile(size int64) error {
 	//判断当前活跃文件，是否存在，数据库在没有写入时没有文件生成
 	// 不存在需要初始化一个活跃文件
 	if db.ActiveFile == nil {
 		if err := db.setActivateDataFile(); err != nil {
-			return nil, err
+			return err
 		}
 	}
 
-	// 将数据进行编码
-	encRecord, size := data.EncoderLogRecord(logRecord)
-
 	// 如果写入的数据到达活跃文件的阈值，则关闭活跃文件，打开新的活跃文件
 	if db.ActiveFile.WriteOffset+size > db.Options.DataFileSize {
-		// 先持久化活跃文件数据，即落盘
-		if err := db.ActiveFile.Sync(); err != nil {
-			return nil, err
+		// 先持久化活跃文件数据，并将该文件转换为旧数据文件
+		if err := db.sealActiveFile(); err != nil {
+			return err
 		}
 
-		// 将该文件转换为旧数据文件
-		db.OlderFiles[db.ActiveFile.FileId] = db.ActiveFile
-
-		//切记 落盘后将该文件的文件句柄关闭
-		//if err := db.OlderFiles[db.ActiveFile.FileId].Close(); err != nil {
-		//	return nil, err
-		//}
-
 		//打开新的数据文件
 		if err := db.setActivateDataFile(); err != nil {
-			return nil, err
+			return err
 		}
 	}
-	// 数据写入操作
-	writeOffset := db.ActiveFile.WriteOffset
-	if err := db.ActiveFile.Write(encRecord); err != nil {
-		return nil, err
-	}
+	return nil
+}
+
+// 记录已经写入活跃文件 writeOffset 位置，根据配置进行持久化，返回文件索引信息，调用方必须持有写锁
+func (db *DB) finishAppend(size int64, writeOffset int64) (*data.LogRecordPos, error) {
 	// 记录写入的字节数
 	db.BytesWrite += uint64(size)
 	var needSync = db.Options.SyncWrite
@@ -494,6 +836,30 @@ func (db *DB) appendLogRecord(logRecord *data.LogRecord) (*data.LogRecordPos, er
 	return pos, nil
 }
 
+/**
+ * sealActiveFile
+ * @Description: 将当前活跃文件持久化后转换为旧数据文件，在使用该方法前必须使用互斥锁
+ * @receiver db
+ * @return error
+ */
+func (db *DB) sealActiveFile() error {
+	if err := db.ActiveFile.Sync(); err != nil {
+		return err
+	}
+	// 旧数据文件不会再被修改，可以一直使用 mmap 读取。
+	// 活跃文件的写缓冲区和可读写的 mmap 不再需要，切换为标准文件 IO，可读写的 mmap 关闭时会截掉预分配的空间
+	sealedIOType := db.sealedFileIOType()
+	if sealedIOType != db.activeFileIOType() {
+		if err := db.ActiveFile.SetIOManager(db.Options.DirPath, sealedIOType); err != nil {
+			return err
+		}
+	}
+	// 旧数据文件交给句柄表管理，超出打开数量上限时关闭最久没有使用的文件
+	db.FileTable.Add(db.ActiveFile)
+	db.OlderFiles[db.ActiveFile.FileId] = db.ActiveFile
+	return nil
+}
+
 /**
  * setActivateDataFile
  * @Description: 设置当前活跃文件，在使用该方法前必须使用互斥锁
@@ -506,8 +872,53 @@ func (db *DB) setActivateDataFile() error {
 		// 数据文件新建时 id 自增
 		initialFileId = db.ActiveFile.FileId + 1
 	}
-	// 打开新的数据文件
-	dataFile, err := data.OpenDataFile(db.Options.DirPath, initialFileId, fio.StandardIoManager)
+	return db.openActiveDataFile(initialFileId)
+}
+
+// 数据目录是否在操作系统的文件系统中，其他文件系统没有真实的文件，不能使用直接 IO，也不需要检查磁盘空间
+func (db *DB) onOSFileSystem() bool {
+	_, ok := db.Options.FileSystem.(fio.OSFileSystem)
+	return ok
+}
+
+// 是否在 usage 场景下使用直接 IO
+func (db *DB) useDirectIO(usage conf.DirectIOUsage) bool {
+	return db.onOSFileSystem() && db.Options.DirectIO&(usage|conf.DirectIOAll) != 0
+}
+
+// 启动时是否使用 mmap 加载数据文件
+func (db *DB) mmapAtStartUp() bool {
+	return db.Options.MMapAtStartUp && db.Options.DirectIO&conf.DirectIOAll == 0
+}
+
+// 旧数据文件使用的 IO 类型
+func (db *DB) sealedFileIOType() fio.FileIOType {
+	if db.Options.DirectIO&conf.DirectIOAll != 0 {
+		return fio.DirectIoManager
+	}
+	if db.Options.MMapSealedFiles {
+		return fio.MMapIoManager
+	}
+	return fio.StandardIoManager
+}
+
+// 活跃文件使用的 IO 类型
+func (db *DB) activeFileIOType() fio.FileIOType {
+	if db.Options.DirectIO&conf.DirectIOAll != 0 {
+		return fio.DirectIoManager
+	}
+	if db.Options.BufferedWrite {
+		return fio.BufferedIoManager
+	}
+	if db.Options.MMapWrite {
+		return fio.MMapWriteIoManager
+	}
+	return fio.StandardIoManager
+}
+
+// 打开指定 id 的数据文件作为活跃文件，在使用该方法前必须使用互斥锁
+func (db *DB) openActiveDataFile(fileId uint32) error {
+	dataFile, err := data.OpenActiveDataFile(db.Options.FileSystem, db.Options.DirPath, fileId, db.activeFileIOType(), db.Options.DataFileSize)
 	if err != nil {
 		return err
 	}
@@ -517,7 +928,7 @@ func (db *DB) setActivateDataFile() error {
 
 func (db *DB) loadDataFile() error {
 	// 获取目录下的所有文件
-	dirEntries, err := os.ReadDir(db.Options.DirPath)
+	dirEntries, err := db.Options.FileSystem.ReadDir(db.Options.DirPath)
 	if err != nil {
 		return err
 	}
@@ -542,19 +953,24 @@ func (db *DB) loadDataFile() error {
 	db.FileIds = fileIds
 	// 遍历每个文件id,打开该文件
 	for i, fid := range fileIds {
-		ioType := fio.StandardIoManager
-		if db.Options.MMapAtStartUp {
-			ioType = fio.MMapIoManager
+		ioType := db.sealedFileIOType()
+		if i == len(fileIds)-1 {
+			ioType = db.activeFileIOType()
 		}
-		dataFile, err := data.OpenDataFile(db.Options.DirPath, uint32(fid), ioType)
-		if err != nil {
-			return err
+		// 启动时使用 mmap 加载，加载完成后在 resetIoType 中切换回来
+		if db.mmapAtStartUp() {
+			ioType = fio.MMapIoManager
 		}
 		// 最后一个文件为最新文件，即活跃文件
 		if i == len(fileIds)-1 {
+			dataFile, err := data.OpenActiveDataFile(db.Options.FileSystem, db.Options.DirPath, uint32(fid), ioType, db.Options.DataFileSize)
+			if err != nil {
+				return err
+			}
 			db.ActiveFile = dataFile
 		} else {
-			db.OlderFiles[uint32(fid)] = dataFile
+			// 旧数据文件在第一次读取时才打开
+			db.OlderFiles[uint32(fid)] = data.OpenSealedDataFile(db.Options.FileSystem, db.Options.DirPath, uint32(fid), ioType, db.FileTable)
 		}
 	}
 	return nil
@@ -565,7 +981,7 @@ func (db *DB) loadDataFile() error {
  * @Description: 从数据文件中加载索引，遍历所有记录并将其加载到内存索引
  * @receiver db
  */
-func (db *DB) loadIndexFromDataFile() error {
+func (db *DB) loadIndexFromDataFile(snapshot *indexSnapshotMeta) error {
 	// 没有文件，数据库为空
 	if len(db.FileIds) == 0 {
 		return nil
@@ -574,7 +990,7 @@ func (db *DB) loadIndexFromDataFile() error {
 	// 查看是否发生过 merge，如果发生过直接从未 merge 的文件加载索引
 	hasMerge, noMergeFileId := false, uint32(0)
 	mergeFileName := filepath.Join(db.Options.DirPath, data.MergeFinishedFileName)
-	if _, err := os.Stat(mergeFileName); err == nil {
+	if _, err := db.Options.FileSystem.Stat(mergeFileName); err == nil {
 		fid, err := db.getNoMergeFileId(db.Options.DirPath)
 		if err != nil {
 			return err
@@ -583,30 +999,43 @@ func (db *DB) loadIndexFromDataFile() error {
 		hasMerge = true
 	}
 
-	updateIndex := func(key []byte, tye data.LogRecordType, logRecordPos *data.LogRecordPos) {
+	updateIndex := func(key []byte, tye data.LogRecordType, logRecordPos *data.LogRecordPos) error {
 		var oldPos *data.LogRecordPos
+		var err error
 		if tye == data.LogRecordDeleted {
-			oldPos, _ = db.Index.Delete(key)
+			oldPos, _, err = db.Index.Delete(key)
 			// 当前标记key被删除的信息也是属于无用的信息
-			db.ReclaimSize += int64(logRecordPos.Size)
+			db.addReclaimSize(int64(logRecordPos.Size))
 		} else {
 			// 没有删除将key添加至内存索引
-			oldPos = db.Index.Put(key, logRecordPos)
+			oldPos, err = db.Index.Put(key, logRecordPos)
+		}
+		if err != nil {
+			return err
 		}
 		if oldPos != nil {
-			db.ReclaimSize += int64(oldPos.Size)
+			db.addReclaimSize(int64(oldPos.Size))
 		}
+		return nil
 	}
 	//暂存事务数据
 	transactionLogRecord := make(map[uint64][]*data.TransactionLogRecord)
 
 	var currenSeqNo = nonTransactionSeqNo
+	if snapshot != nil {
+		currenSeqNo = snapshot.seqNo
+		atomic.StoreInt64(&db.ReclaimSize, snapshot.reclaimSize)
+	}
 
 	// 遍历所有文件id，处理文件记录
 	for i, fid := range db.FileIds {
 		var fileId = uint32(fid)
 		// 如果已经发生 merge，小于noMergeFileId的文件索引已经通过 hint 文件加载
-		if hasMerge && fileId < noMergeFileId {
+		if snapshot == nil && hasMerge && fileId < noMergeFileId {
+			continue
+		}
+		// 快照之前的记录已经在快照中
+		if snapshot != nil && fileId < snapshot.fid {
 			continue
 		}
 		var dataFile *data.DataFile
@@ -620,8 +1049,12 @@ func (db *DB) loadIndexFromDataFile() error {
 
 		// 读取内容
 		var offset int64 = 0
+		if snapshot != nil && fileId == snapshot.fid {
+			offset = snapshot.offset
+		}
 		for {
-			logRecord, size, err := dataFile.ReadLogRecord(offset)
+			// 构建索引只需要 key 和记录的位置，不需要把 value 读入内存
+			logRecord, size, err := dataFile.ReadLogRecordKey(offset)
 			if err != nil {
 				// 读取到文件结尾
 				if err == io.EOF {
@@ -639,12 +1072,16 @@ func (db *DB) loadIndexFromDataFile() error {
 			realKey, seqNo := parseLogRecordKey(logRecord.Key)
 			if seqNo == nonTransactionSeqNo {
 				// 直接更新内存索引
-				updateIndex(realKey, logRecord.Type, logRecordPos)
+				if err := updateIndex(realKey, logRecord.Type, logRecordPos); err != nil {
+					return err
+				}
 			} else {
 				// Type 为事务完成标志，将暂存数据取出更新内存索引
 				if logRecord.Type == data.LogRecordTxnFinished {
 					for _, txnRecord := range transactionLogRecord[seqNo] {
-						updateIndex(txnRecord.Record.Key, txnRecord.Record.Type, txnRecord.Pos)
+						if err := updateIndex(txnRecord.Record.Key, txnRecord.Record.Type, txnRecord.Pos); err != nil {
+							return err
+						}
 					}
 					// 暂存的事务数据完成相应的操作后，将暂存数据删除
 					delete(transactionLogRecord, seqNo)
@@ -675,6 +1112,12 @@ func (db *DB) loadIndexFromDataFile() error {
 	return nil
 }
 
+// 根据配置创建索引
+func (db *DB) newIndexer() (index.Indexer, error) {
+	return index.NewIndexer(db.Options.IndexType, db.Options.DirPath, db.Options.SyncWrite,
+		db.Options.BloomFalsePositiveRate, db.keyMatchesPosition)
+}
+
 // 对用户的配置项进行校验
 func checkOptions(options conf.Options) error {
 	if options.DirPath == "" {
@@ -686,40 +1129,169 @@ func checkOptions(options conf.Options) error {
 	if options.DataFileMergeRatio < 0 || options.DataFileMergeRatio > 1 {
 		return errors.New("invalid merge ratio, must between 0 and 1")
 	}
+	if options.BloomFalsePositiveRate < 0 || options.BloomFalsePositiveRate >= 1 {
+		return errors.New("invalid bloom filter false positive rate, must between 0 and 1")
+	}
+	if options.BufferedWrite && options.MMapWrite {
+		return errors.New("buffered write and mmap write cannot be enabled at the same time")
+	}
+	if options.DirectIO&conf.DirectIOAll != 0 && (options.BufferedWrite || options.MMapWrite || options.MMapSealedFiles) {
+		return errors.New("direct io for all files cannot be used with buffered write or mmap")
+	}
+	// B+ 树索引使用 bbolt 在数据目录中保存索引文件，需要真实的文件
+	if options.FileSystem != nil && !fio.OnDisk(options.FileSystem) && options.IndexType == index.BPTree {
+		return errors.New("b+ tree index can only be used with the os file system")
+	}
+	if options.MaxOpenFiles < 0 {
+		return errors.New("max open files must not be negative")
+	}
+	// 哈希索引使用 32 位存储偏移量
+	if options.IndexType == index.Hash && options.DataFileSize > math.MaxUint32 {
+		return errors.New("data file size must not exceed 4GB when using hash index")
+	}
 	return nil
 }
 
 /**
- * loadSeqNoFile
- * @Description: 加载存放全局事务序列号的文件，拿到全局事务序列号
+ * saveSeqNo
+ * @Description: 将最新的事务序列号保存在特定文件中，取出时不用遍历所有文件
+ * 先写入临时文件再重命名，文件中始终只有一条完整的记录
  * @receiver db
  * @return error
  */
-func (db *DB) loadSeqNoFile() error {
-	fileName := filepath.Join(db.Options.DirPath, data.SeqNoFileName)
-	if _, err := os.Stat(fileName); os.IsNotExist(err) {
-		return nil
+func (db *DB) saveSeqNo() error {
+	seqNoLogRecord := &data.LogRecord{
+		Key:   []byte(SeqNoKey),
+		Value: []byte(strconv.FormatUint(db.SeqNo, 10)),
 	}
-	seqNoFile, err := data.OpenSeqNoFile(db.Options.DirPath)
+	encoderLogRecord, _ := data.EncoderLogRecord(seqNoLogRecord)
+
+	return db.writeFileAtomic(filepath.Join(db.Options.DirPath, data.SeqNoFileName), encoderLogRecord)
+}
+
+/**
+ * writeFileAtomic
+ * @Description: 先写入临时文件并持久化再重命名，崩溃时文件要么是原来的内容，要么是完整的新内容
+ * @receiver db
+ * @param fileName
+ * @param content
+ * @return error
+ */
+func (db *DB) writeFileAtomic(fileName string, content []byte) error {
+	tmpFileName := fileName + ".tmp"
+	file, err := db.Options.FileSystem.OpenFile(tmpFileName, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
 	if err != nil {
 		return err
 	}
-	defer func() {
-		_ = seqNoFile.Close()
-	}()
-	logRecord, _, err := seqNoFile.ReadLogRecord(0)
-	if err != nil {
+	if _, err := file.Write(content); err != nil {
+		_ = file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		_ = file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
 		return err
 	}
-	seqNo, err := strconv.ParseUint(string(logRecord.Value), 10, 64)
+	return db.Options.FileSystem.Rename(tmpFileName, fileName)
+}
+
+/**
+ * loadSeqNoFile
+ * @Description: 加载全局事务序列号。B+ 树索引每次提交事务时会把序列号和索引一起保存在 bbolt 中，
+ * 正常关闭时还会写入 seq-no 文件，两者取较大的值；都不存在时（旧版本的数据异常退出）遍历数据文件恢复
+ * @receiver db
+ * @return error
+ */
+func (db *DB) loadSeqNoFile() error {
+	seqNo, found, err := db.readSeqNoFile()
 	if err != nil {
 		return err
 	}
+	db.SeqNoFileExists = found
+	if bpt, ok := db.Index.(*index.BPlusTree); ok {
+		metaSeqNo, ok, err := bpt.SeqNo()
+		if err != nil {
+			return err
+		}
+		if ok {
+			found = true
+			if metaSeqNo > seqNo {
+				seqNo = metaSeqNo
+			}
+		}
+	}
+	if !found {
+		if seqNo, err = db.scanMaxSeqNo(); err != nil {
+			return err
+		}
+	}
 	db.SeqNo = seqNo
-	db.SeqNoFileExists = true
 	return nil
 }
 
+// 读取 seq-no 文件，旧版本每次关闭都会追加一条记录，所以取最后一条
+func (db *DB) readSeqNoFile() (uint64, bool, error) {
+	fileName := filepath.Join(db.Options.DirPath, data.SeqNoFileName)
+	if _, err := db.Options.FileSystem.Stat(fileName); os.IsNotExist(err) {
+		return 0, false, nil
+	}
+	seqNoFile, err := data.OpenSeqNoFile(db.Options.FileSystem, db.Options.DirPath)
+	if err != nil {
+		return 0, false, err
+	}
+	defer func() {
+		_ = seqNoFile.Close()
+	}()
+
+	var seqNo uint64
+	var found bool
+	var offset int64 = 0
+	for {
+		logRecord, size, err := seqNoFile.ReadLogRecord(offset)
+		if err != nil {
+			// 文件末尾不完整的记录忽略即可
+			if err == io.EOF || err == errs.ErrInvalidCRC {
+				break
+			}
+			return 0, false, err
+		}
+		if seqNo, err = strconv.ParseUint(string(logRecord.Value), 10, 64); err != nil {
+			return 0, false, err
+		}
+		found = true
+		offset += size
+	}
+	return seqNo, found, nil
+}
+
+// 遍历所有数据文件，找到最大的事务序列号
+func (db *DB) scanMaxSeqNo() (uint64, error) {
+	var maxSeqNo = nonTransactionSeqNo
+	for _, fid := range db.FileIds {
+		dataFile := db.getDataFile(uint32(fid))
+		if dataFile == nil {
+			continue
+		}
+		var offset int64 = 0
+		for {
+			logRecord, size, err := dataFile.ReadLogRecordKey(offset)
+			if err != nil {
+				if err == io.EOF {
+					break
+				}
+				return 0, err
+			}
+			if _, seqNo := parseLogRecordKey(logRecord.Key); seqNo > maxSeqNo {
+				maxSeqNo = seqNo
+			}
+			offset += size
+		}
+	}
+	return maxSeqNo, nil
+}
+
 /**
  * resetIoType
  * @Description:重置文件的IO类型为普通的类型
@@ -730,11 +1302,15 @@ func (db *DB) resetIoType() error {
 	if db.ActiveFile == nil {
 		return nil
 	}
-	if err := db.ActiveFile.SetIOManager(db.Options.DirPath, fio.StandardIoManager); err != nil {
+	if err := db.ActiveFile.SetIOManager(db.Options.DirPath, db.activeFileIOType()); err != nil {
 		return err
 	}
+	// 旧数据文件需要一直使用 mmap 时不用重置
+	if db.Options.MMapSealedFiles {
+		return nil
+	}
 	for _, oldDataFile := range db.OlderFiles {
-		if err := oldDataFile.SetIOManager(db.Options.DirPath, fio.StandardIoManager); err != nil {
+		if err := oldDataFile.SetIOManager(db.Options.DirPath, db.sealedFileIOType()); err != nil {
 			return err
 		}
 	}
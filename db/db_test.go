@@ -3,15 +3,25 @@ package db
 import (
 	"github.com/stretchr/testify/assert"
 	"kv_projects/conf"
+	"kv_projects/data"
 	"kv_projects/errs"
+	"kv_projects/fio"
+	"kv_projects/index"
 	"kv_projects/utils"
 	"os"
 	"path/filepath"
+	"sync"
 	"testing"
 	"time"
 )
 
 // 测试完成之后销毁 DB 数据目录
+func mustStat(t *testing.T, db *DB) *Stat {
+	stat, err := db.Stat()
+	assert.Nil(t, err)
+	return stat
+}
+
 func destroyDB(db *DB) {
 	if db != nil {
 		if db.ActiveFile != nil {
@@ -237,14 +247,18 @@ func TestDB_ListKeys(t *testing.T) {
 	 * 在这发生死锁的原因：put加上写锁，锁释放后。ListKeys会加读锁，但是没有释放，后面的put又加写锁造成死锁
 	 * 解决方案：在ListKeys方法里，将读锁释放
 	 */
-	assert.NotNil(t, db.ListKeys())
+	keys, err := db.ListKeys()
+	assert.Nil(t, err)
+	assert.NotNil(t, keys)
 	err = db.Put([]byte("aaa"), utils.GetTestValue(10))
 	assert.Nil(t, err)
 	err = db.Put([]byte("bbb"), utils.GetTestValue(10))
 	assert.Nil(t, err)
 	err = db.Put([]byte("ccc"), utils.GetTestValue(10))
 	assert.Nil(t, err)
-	for _, v := range db.ListKeys() {
+	keys, err = db.ListKeys()
+	assert.Nil(t, err)
+	for _, v := range keys {
 		t.Log(string(v))
 		assert.NotNil(t, v)
 	}
@@ -374,10 +388,34 @@ func TestDB_Stat(t *testing.T) {
 		assert.Nil(t, err)
 	}
 
-	stat := db.Stat()
+	stat, err := db.Stat()
+	assert.Nil(t, err)
 	t.Log(stat)
 }
 
+func TestDB_ReturnErrors(t *testing.T) {
+	opts := conf.DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-errors")
+	opts.DirPath = dir
+
+	// 未知的索引类型返回错误，并且释放文件锁
+	opts.IndexType = index.IndexType(100)
+	_, err := Open(opts)
+	assert.Equal(t, errs.ErrUnsupportedIndexType, err)
+
+	opts.IndexType = index.Btree
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	assert.Nil(t, db.Put(utils.GetTestKey(1), utils.GetTestValue(10)))
+
+	// 目录被删除后获取统计信息返回错误而不是 panic
+	assert.Nil(t, os.RemoveAll(dir))
+	_, err = db.Stat()
+	assert.NotNil(t, err)
+	_ = db.Close()
+	_ = os.RemoveAll(dir)
+}
+
 func TestDB_BackUp(t *testing.T) {
 	opts := conf.DefaultOptions
 	dir := filepath.Join("./temp", "bitcask-go-backup")
@@ -419,3 +457,537 @@ func TestDB_BackUp(t *testing.T) {
 		_ = db2.Close()
 	}()
 }
+
+// 并发读写压测，需要配合 go test -race 运行，校验读写锁和统计信息没有数据竞争
+func TestDB_ConcurrentReadWrite(t *testing.T) {
+	opts := conf.DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-concurrent")
+	opts.DirPath = dir
+	opts.DataFileSize = 1 * 1024 * 1024
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	for i := 0; i < 1000; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.GetTestValue(128))
+		assert.Nil(t, err)
+	}
+
+	var wg sync.WaitGroup
+	// 写协程：覆盖写和删除，同时会触发活跃文件的切换
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		// GetTestValue 使用的随机源不是并发安全的，提前生成
+		value := utils.GetTestValue(128)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				key := utils.GetTestKey(i)
+				if i%10 == w {
+					if err := db.Delete(key); err != nil && err != errs.ErrKeyNotFound {
+						t.Error(err)
+					}
+					continue
+				}
+				if err := db.Put(key, value); err != nil {
+					t.Error(err)
+				}
+			}
+		}(w)
+	}
+	// 读协程：并发读取、遍历和获取统计信息
+	for r := 0; r < 8; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				val, err := db.Get(utils.GetTestKey(i))
+				if err != nil && err != errs.ErrKeyNotFound {
+					t.Error(err)
+				}
+				if err == nil && len(val) == 0 {
+					t.Error("empty value")
+				}
+				if i%100 == 0 {
+					_, _ = db.ListKeys()
+					_, _ = db.Stat()
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	// 被删除和覆盖的数据都会累加到可回收的字节数中
+	stat, err := db.Stat()
+	assert.Nil(t, err)
+	assert.True(t, stat.ReclaimSize > 0)
+	keys, err := db.ListKeys()
+	assert.Nil(t, err)
+	assert.Equal(t, stat.KeyNum, uint(len(keys)))
+}
+
+func TestDB_ValueCache(t *testing.T) {
+	opts := conf.DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-cache")
+	opts.DirPath = dir
+	opts.ValueCacheSize = 1024 * 1024
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	val1 := utils.GetTestValue(128)
+	err = db.Put(utils.GetTestKey(1), val1)
+	assert.Nil(t, err)
+
+	// 第一次读取未命中，之后的读取命中缓存
+	for i := 0; i < 3; i++ {
+		val, err := db.Get(utils.GetTestKey(1))
+		assert.Nil(t, err)
+		assert.Equal(t, val1, val)
+	}
+	stat, err := db.Stat()
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(2), stat.CacheHits)
+	assert.Equal(t, uint64(1), stat.CacheMisses)
+
+	// 修改返回值不会影响缓存中的数据
+	val, _ := db.Get(utils.GetTestKey(1))
+	val[0] = 'x'
+	val, _ = db.Get(utils.GetTestKey(1))
+	assert.Equal(t, val1, val)
+
+	// 覆盖写之后数据位置改变，读到的是新的值
+	val2 := utils.GetTestValue(128)
+	err = db.Put(utils.GetTestKey(1), val2)
+	assert.Nil(t, err)
+	val, err = db.Get(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, val2, val)
+}
+
+func TestDB_GetFunc(t *testing.T) {
+	opts := conf.DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-getfunc")
+	opts.DirPath = dir
+	opts.DataFileSize = 64 * 1024
+	opts.MMapSealedFiles = true
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	values := make(map[int][]byte)
+	for i := 0; i < 1000; i++ {
+		values[i] = utils.GetTestValue(128)
+		err := db.Put(utils.GetTestKey(i), values[i])
+		assert.Nil(t, err)
+	}
+	// 发生了文件切换，旧数据文件使用 mmap 读取
+	assert.True(t, len(db.OlderFiles) > 0)
+
+	check := func(db *DB) {
+		for i := 0; i < 1000; i++ {
+			err := db.GetFunc(utils.GetTestKey(i), func(value []byte) error {
+				assert.Equal(t, values[i], value)
+				return nil
+			})
+			assert.Nil(t, err)
+		}
+		err := db.GetFunc([]byte("unknown key"), func(value []byte) error {
+			return nil
+		})
+		assert.Equal(t, errs.ErrKeyNotFound, err)
+
+		iter, err := db.NewUserIterator(conf.DefaultIteratorOptions)
+		assert.Nil(t, err)
+		defer iter.Close()
+		for iter.Rewind(); iter.Valid(); iter.Next() {
+			err := iter.ValueFunc(func(value []byte) error {
+				assert.NotEmpty(t, value)
+				return nil
+			})
+			assert.Nil(t, err)
+		}
+	}
+	check(db)
+
+	// 重启之后旧数据文件仍然使用 mmap
+	assert.Nil(t, db.Close())
+	db2, err := Open(opts)
+	defer destroyDB(db2)
+	assert.Nil(t, err)
+	check(db2)
+
+	// fn 返回的错误会透传给调用方
+	err = db2.GetFunc(utils.GetTestKey(1), func(value []byte) error {
+		return errs.ErrValueIsNull
+	})
+	assert.Equal(t, errs.ErrValueIsNull, err)
+}
+
+func TestDB_MultiGet(t *testing.T) {
+	opts := conf.DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-multi-get")
+	opts.DirPath = dir
+	opts.DataFileSize = 16 * 1024
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	values := make(map[int][]byte)
+	for i := 0; i < 500; i++ {
+		values[i] = utils.GetTestValue(128)
+		assert.Nil(t, db.Put(utils.GetTestKey(i), values[i]))
+	}
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, db.Delete(utils.GetTestKey(i)))
+	}
+	assert.True(t, len(db.OlderFiles) > 0)
+
+	// 倒序传入，结果需要和传入的顺序一致
+	var keys [][]byte
+	for i := 499; i >= 0; i-- {
+		keys = append(keys, utils.GetTestKey(i))
+	}
+	keys = append(keys, nil, utils.GetTestKey(1000))
+	vals, errList := db.MultiGet(keys)
+	assert.Equal(t, len(keys), len(vals))
+	assert.Equal(t, len(keys), len(errList))
+	for n, i := 0, 499; i >= 0; n, i = n+1, i-1 {
+		if i < 100 {
+			assert.Equal(t, errs.ErrKeyNotFound, errList[n])
+			assert.Nil(t, vals[n])
+		} else {
+			assert.Nil(t, errList[n])
+			assert.Equal(t, values[i], vals[n])
+		}
+	}
+	assert.Equal(t, errs.ErrKeyIsEmpty, errList[500])
+	assert.Equal(t, errs.ErrKeyNotFound, errList[501])
+
+	vals, errList = db.MultiGet(nil)
+	assert.Equal(t, 0, len(vals))
+	assert.Equal(t, 0, len(errList))
+}
+
+func TestDB_MaxOpenFiles(t *testing.T) {
+	opts := conf.DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-max-open-files")
+	opts.DirPath = dir
+	opts.DataFileSize = 16 * 1024
+	opts.MaxOpenFiles = 2
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	values := make(map[int][]byte)
+	for i := 0; i < 1000; i++ {
+		values[i] = utils.GetTestValue(128)
+		assert.Nil(t, db.Put(utils.GetTestKey(i), values[i]))
+	}
+	assert.True(t, len(db.OlderFiles) > 2)
+
+	check := func(db *DB) {
+		for i := 0; i < 1000; i++ {
+			val, err := db.Get(utils.GetTestKey(i))
+			assert.Nil(t, err)
+			assert.Equal(t, values[i], val)
+		}
+		iter, err := db.NewUserIterator(conf.DefaultIteratorOptions)
+		assert.Nil(t, err)
+		count := 0
+		for iter.Rewind(); iter.Valid(); iter.Next() {
+			_, err := iter.Value()
+			assert.Nil(t, err)
+			count++
+		}
+		assert.Equal(t, 1000, count)
+		assert.Nil(t, iter.Close())
+
+		stat := mustStat(t, db)
+		assert.True(t, stat.OpenFiles <= 2)
+		assert.True(t, stat.FileEvictions > 0)
+	}
+	check(db)
+
+	assert.Nil(t, db.Close())
+	db2, err := Open(opts)
+	defer destroyDB(db2)
+	assert.Nil(t, err)
+	check(db2)
+}
+
+func TestDB_BPTreeBloomFilter(t *testing.T) {
+	opts := conf.DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-bloom")
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	opts.DirPath = filepath.Join(dir, "db")
+	opts.IndexType = index.BPTree
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	err = db.Put(utils.GetTestKey(1), utils.GetTestValue(24))
+	assert.Nil(t, err)
+
+	// 不存在的 key 由布隆过滤器直接判断
+	_, err = db.Get(utils.GetTestKey(2))
+	assert.Equal(t, errs.ErrKeyNotFound, err)
+	err = db.Delete(utils.GetTestKey(2))
+	assert.Equal(t, errs.ErrKeyNotFound, err)
+
+	wb := db.NewWriteBatch(&conf.DefaultWriteBatchOptions)
+	assert.Nil(t, wb.Delete(utils.GetTestKey(2)))
+	assert.Nil(t, wb.Delete(utils.GetTestKey(1)))
+	assert.Nil(t, wb.Commit())
+	_, err = db.Get(utils.GetTestKey(1))
+	assert.Equal(t, errs.ErrKeyNotFound, err)
+}
+
+func TestDB_HashIndex(t *testing.T) {
+	opts := conf.DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-hash")
+	opts.DirPath = dir
+	opts.DataFileSize = 64 * 1024
+	opts.IndexType = index.Hash
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	for i := 0; i < 1000; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.GetTestValue(128))
+		assert.Nil(t, err)
+	}
+	val1 := utils.GetTestValue(128)
+	err = db.Put(utils.GetTestKey(1), val1)
+	assert.Nil(t, err)
+	err = db.Delete(utils.GetTestKey(2))
+	assert.Nil(t, err)
+
+	check := func(db *DB) {
+		val, err := db.Get(utils.GetTestKey(1))
+		assert.Nil(t, err)
+		assert.Equal(t, val1, val)
+		_, err = db.Get(utils.GetTestKey(2))
+		assert.Equal(t, errs.ErrKeyNotFound, err)
+		_, err = db.Get([]byte("unknown key"))
+		assert.Equal(t, errs.ErrKeyNotFound, err)
+		assert.Equal(t, uint(999), mustStat(t, db).KeyNum)
+	}
+	check(db)
+
+	// 哈希索引不支持有序遍历
+	_, err = db.NewUserIterator(conf.DefaultIteratorOptions)
+	assert.Equal(t, errs.ErrIteratorNotSupported, err)
+	_, err = db.ListKeys()
+	assert.Equal(t, errs.ErrIteratorNotSupported, err)
+	err = db.Fold(func(key, value []byte) bool { return true })
+	assert.Equal(t, errs.ErrIteratorNotSupported, err)
+
+	// 重启之后从数据文件重建索引
+	assert.Nil(t, db.Close())
+	db2, err := Open(opts)
+	defer destroyDB(db2)
+	assert.Nil(t, err)
+	check(db2)
+}
+
+func TestDB_BufferedWrite(t *testing.T) {
+	opts := conf.DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-buffered-write")
+	opts.DirPath = dir
+	opts.DataFileSize = 64 * 1024
+	opts.BufferedWrite = true
+	db, err := Open(opts)
+	assert.Nil(t, err)
+
+	values := make(map[int][]byte)
+	for i := 0; i < 2000; i++ {
+		values[i] = utils.GetTestValue(64)
+		assert.Nil(t, db.Put(utils.GetTestKey(i), values[i]))
+	}
+	// 轮转时旧的活跃文件已经写入磁盘
+	assert.True(t, len(db.OlderFiles) > 0)
+	for _, file := range db.OlderFiles {
+		info, err := os.Stat(data.GetDataFileName(dir, file.FileId))
+		assert.Nil(t, err)
+		assert.Equal(t, file.WriteOffset, info.Size())
+	}
+	check := func(db *DB) {
+		for i := 0; i < 2000; i++ {
+			val, err := db.Get(utils.GetTestKey(i))
+			assert.Nil(t, err)
+			assert.Equal(t, values[i], val)
+		}
+	}
+	// 缓冲区中的数据同样可以读取
+	check(db)
+
+	// 备份时包含缓冲区中的数据
+	backupDir, _ := os.MkdirTemp("", "bitcask-go-buffered-write-backup")
+	assert.Nil(t, db.BackUp(backupDir))
+	backupOpts := opts
+	backupOpts.DirPath = backupDir
+	backupDB, err := Open(backupOpts)
+	assert.Nil(t, err)
+	check(backupDB)
+	destroyDB(backupDB)
+
+	// 关闭时写入缓冲区中的数据
+	assert.Nil(t, db.Close())
+	db2, err := Open(opts)
+	assert.Nil(t, err)
+	check(db2)
+
+	// 开启 SyncWrite 时每次写入都会写入磁盘
+	assert.Nil(t, db2.Close())
+	opts.SyncWrite = true
+	db3, err := Open(opts)
+	defer destroyDB(db3)
+	assert.Nil(t, err)
+	assert.Nil(t, db3.Put(utils.GetTestKey(1), []byte("synced")))
+	info, err := os.Stat(data.GetDataFileName(dir, db3.ActiveFile.FileId))
+	assert.Nil(t, err)
+	assert.Equal(t, db3.ActiveFile.WriteOffset, info.Size())
+}
+
+func TestDB_MMapWrite(t *testing.T) {
+	for _, indexType := range []index.IndexType{index.Btree, index.BPTree} {
+		opts := conf.DefaultOptions
+		dir, _ := os.MkdirTemp("", "bitcask-go-mmap-write")
+		opts.DirPath = dir
+		opts.IndexType = indexType
+		opts.DataFileSize = 64 * 1024
+		opts.MMapWrite = true
+		db, err := Open(opts)
+		assert.Nil(t, err)
+
+		values := make(map[int][]byte)
+		for i := 0; i < 2000; i++ {
+			values[i] = utils.GetTestValue(64)
+			assert.Nil(t, db.Put(utils.GetTestKey(i), values[i]))
+		}
+		// 轮转时截掉预分配的空间
+		assert.True(t, len(db.OlderFiles) > 0)
+		for _, file := range db.OlderFiles {
+			info, err := os.Stat(data.GetDataFileName(dir, file.FileId))
+			assert.Nil(t, err)
+			assert.Equal(t, file.WriteOffset, info.Size())
+		}
+		info, err := os.Stat(data.GetDataFileName(dir, db.ActiveFile.FileId))
+		assert.Nil(t, err)
+		assert.Equal(t, opts.DataFileSize, info.Size())
+		check := func(db *DB) {
+			for i := 0; i < 2000; i++ {
+				val, err := db.Get(utils.GetTestKey(i))
+				assert.Nil(t, err)
+				assert.Equal(t, values[i], val)
+			}
+		}
+		check(db)
+
+		// 备份的活跃文件带有预分配的空间，和没有正常关闭时一样，打开时截断到最后一条记录之后
+		backupDir, _ := os.MkdirTemp("", "bitcask-go-mmap-write-backup")
+		assert.Nil(t, db.BackUp(backupDir))
+		backupOpts := opts
+		backupOpts.DirPath = backupDir
+		backupOpts.MMapWrite = false
+		backupDB, err := Open(backupOpts)
+		assert.Nil(t, err)
+		check(backupDB)
+		assert.Equal(t, db.ActiveFile.WriteOffset, backupDB.ActiveFile.WriteOffset)
+		assert.Nil(t, backupDB.Put(utils.GetTestKey(1), []byte("backup")))
+		assert.Nil(t, backupDB.Close())
+		backupDB, err = Open(backupOpts)
+		assert.Nil(t, err)
+		val, err := backupDB.Get(utils.GetTestKey(1))
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("backup"), val)
+		destroyDB(backupDB)
+
+		// 关闭时截掉预分配的空间
+		activeFileId, writeOffset := db.ActiveFile.FileId, db.ActiveFile.WriteOffset
+		assert.Nil(t, db.Close())
+		info, err = os.Stat(data.GetDataFileName(dir, activeFileId))
+		assert.Nil(t, err)
+		assert.Equal(t, writeOffset, info.Size())
+		db2, err := Open(opts)
+		assert.Nil(t, err)
+		check(db2)
+		destroyDB(db2)
+	}
+}
+
+func TestDB_MemFileSystem(t *testing.T) {
+	fsys := fio.NewMemFileSystem()
+	opts := conf.DefaultOptions
+	opts.DirPath = filepath.Join(os.TempDir(), "bitcask-go-mem-fs")
+	opts.DataFileSize = 64 * 1024
+	opts.DataFileMergeRatio = 0
+	opts.FileSystem = fsys
+	db, err := Open(opts)
+	assert.Nil(t, err)
+
+	// 同一个目录只能被一个实例打开
+	_, err = Open(opts)
+	assert.Equal(t, errs.ErrDatabaseIsUsing, err)
+
+	values := make(map[int][]byte)
+	for i := 0; i < 2000; i++ {
+		values[i] = utils.GetTestValue(64)
+		assert.Nil(t, db.Put(utils.GetTestKey(i), values[i]))
+	}
+	for i := 0; i < 1000; i++ {
+		assert.Nil(t, db.Delete(utils.GetTestKey(i)))
+	}
+	assert.True(t, len(db.OlderFiles) > 0)
+	check := func(db *DB) {
+		for i := 0; i < 2000; i++ {
+			val, err := db.Get(utils.GetTestKey(i))
+			if i < 1000 {
+				assert.Equal(t, errs.ErrKeyNotFound, err)
+			} else {
+				assert.Nil(t, err)
+				assert.Equal(t, values[i], val)
+			}
+		}
+	}
+	check(db)
+	assert.Nil(t, db.Merge())
+	check(db)
+	stat := mustStat(t, db)
+	assert.Equal(t, uint(1000), stat.KeyNum)
+	assert.True(t, stat.DiskSize > 0)
+
+	backupOpts := opts
+	backupOpts.DirPath = filepath.Join(os.TempDir(), "bitcask-go-mem-fs-backup")
+	assert.Nil(t, db.BackUp(backupOpts.DirPath))
+	backupDB, err := Open(backupOpts)
+	assert.Nil(t, err)
+	check(backupDB)
+	assert.Nil(t, backupDB.Close())
+
+	// 使用同一个内存文件系统重新打开，数据仍然存在
+	assert.Nil(t, db.Close())
+	db2, err := Open(opts)
+	assert.Nil(t, err)
+	check(db2)
+	assert.Nil(t, db2.Close())
+
+	// 所有数据都保存在内存中，没有写入磁盘
+	_, err = os.Stat(opts.DirPath)
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(backupOpts.DirPath)
+	assert.True(t, os.IsNotExist(err))
+
+	// B+ 树索引需要真实的文件
+	opts.IndexType = index.BPTree
+	_, err = Open(opts)
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,201 @@
+package db
+
+import (
+	"bytes"
+	"hash/fnv"
+	"io"
+	"kv_projects/conf"
+	"kv_projects/dump"
+	"kv_projects/errs"
+	"sync"
+)
+
+/**
+ * Export
+ * @Description: 将满足条件的 key/value 按照 key 的顺序导出到 w，导出的格式和数据文件的格式无关，
+ * 可以导入到其他版本或者其他索引类型的数据库中。导出期间的并发写入不一定包含在导出的数据中
+ * @receiver db
+ * @param w
+ * @param opts
+ * @return error
+ */
+func (db *DB) Export(w io.Writer, opts conf.ExportOptions) error {
+	writer, err := dump.NewWriter(w, opts.Format)
+	if err != nil {
+		return err
+	}
+	iter, err := db.NewUserIterator(conf.IteratorOptions{Prefix: opts.Prefix})
+	if err != nil {
+		return err
+	}
+	defer iter.Close()
+
+	if len(opts.Start) > 0 {
+		iter.Seek(opts.Start)
+	} else {
+		iter.Rewind()
+	}
+	for ; iter.Valid(); iter.Next() {
+		key := iter.Key()
+		if len(opts.End) > 0 && bytes.Compare(key, opts.End) >= 0 {
+			break
+		}
+		// 拷贝出 value 之后再写出，写出期间不持有数据库的锁
+		value, err := iter.Value()
+		if err == errs.ErrKeyNotFound {
+			// 导出期间被删除
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if err := writer.Write(key, value); err != nil {
+			return err
+		}
+	}
+	return writer.Close()
+}
+
+/**
+ * Import
+ * @Description: 从 r 中读取 Export 导出的数据并写入数据库，记录通过 WriteBatch 分批并行提交。
+ * 导入不是原子的，出错时已经提交的批次会保留，剩下的批次不会提交
+ * @receiver db
+ * @param r
+ * @param opts
+ * @return error 二进制格式的数据损坏时返回 errs.ErrDumpCorrupted，数据不完整时返回 io.ErrUnexpectedEOF
+ */
+func (db *DB) Import(r io.Reader, opts conf.ImportOptions) error {
+	reader, err := dump.NewReader(r, opts.Format)
+	if err != nil {
+		return err
+	}
+	batchNum := opts.BatchNum
+	if batchNum == 0 {
+		batchNum = conf.DefaultImportOptions.BatchNum
+	}
+	loader := newBulkLoader(db, max(opts.Parallelism, 1), &conf.WriteBatchOptions{
+		MaxBatchNum: batchNum,
+		SyncWrites:  opts.SyncWrites,
+	})
+	for {
+		key, value, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			loader.fail(err)
+			break
+		}
+		if !keyInRange(key, opts.Prefix, opts.Start, opts.End) {
+			continue
+		}
+		if err := loader.put(key, value); err != nil {
+			break
+		}
+	}
+	return loader.wait()
+}
+
+// 判断 key 是否有指定的前缀并且在 [start, end) 范围内，为空的条件不做限制
+func keyInRange(key, prefix, start, end []byte) bool {
+	if !bytes.HasPrefix(key, prefix) {
+		return false
+	}
+	if len(start) > 0 && bytes.Compare(key, start) < 0 {
+		return false
+	}
+	return len(end) == 0 || bytes.Compare(key, end) < 0
+}
+
+// bulkLoader
+// @Description: 并行批量写入，按照 key 的哈希值分配给固定的协程，每个协程攒满一个批次后通过 WriteBatch 提交，
+// 相同 key 的写入顺序和调用 put 的顺序一致
+type bulkLoader struct {
+	queues []chan bulkRecord
+	wg     sync.WaitGroup
+
+	once   sync.Once
+	failed chan struct{} // 出错时关闭，之后不再提交新的批次
+	err    error
+}
+
+type bulkRecord struct {
+	key   []byte
+	value []byte
+}
+
+func newBulkLoader(db *DB, parallelism int, opts *conf.WriteBatchOptions) *bulkLoader {
+	loader := &bulkLoader{
+		queues: make([]chan bulkRecord, parallelism),
+		failed: make(chan struct{}),
+	}
+	for i := range loader.queues {
+		loader.queues[i] = make(chan bulkRecord, opts.MaxBatchNum)
+		loader.wg.Add(1)
+		go loader.run(db.NewWriteBatch(opts), loader.queues[i])
+	}
+	return loader
+}
+
+// 将记录交给 key 对应的协程，已经出错时返回第一个错误
+func (l *bulkLoader) put(key, value []byte) error {
+	h := fnv.New32a()
+	h.Write(key)
+	select {
+	case l.queues[h.Sum32()%uint32(len(l.queues))] <- bulkRecord{key: key, value: value}:
+		return nil
+	case <-l.failed:
+		return l.err
+	}
+}
+
+func (l *bulkLoader) run(batch *WriteBatch, queue <-chan bulkRecord) {
+	defer l.wg.Done()
+	for record := range queue {
+		if l.isFailed() {
+			// 继续消费队列，避免 put 阻塞
+			continue
+		}
+		if err := batch.Put(record.key, record.value); err != nil {
+			l.fail(err)
+			continue
+		}
+		if uint(batch.Len()) >= batch.options.MaxBatchNum {
+			if err := batch.Commit(); err != nil {
+				l.fail(err)
+			}
+		}
+	}
+	if !l.isFailed() {
+		if err := batch.Commit(); err != nil {
+			l.fail(err)
+		}
+	}
+}
+
+// 记录第一个错误，并通知所有协程停止提交
+func (l *bulkLoader) fail(err error) {
+	l.once.Do(func() {
+		l.err = err
+		close(l.failed)
+	})
+}
+
+func (l *bulkLoader) isFailed() bool {
+	select {
+	case <-l.failed:
+		return true
+	default:
+		return false
+	}
+}
+
+// 等待所有协程提交完剩下的批次，返回第一个错误
+func (l *bulkLoader) wait() error {
+	for _, queue := range l.queues {
+		close(queue)
+	}
+	l.wg.Wait()
+	return l.err
+}
@@ -0,0 +1,185 @@
+package db
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"kv_projects/conf"
+	"kv_projects/dump"
+	"kv_projects/errs"
+	"kv_projects/index"
+	"kv_projects/utils"
+	"os"
+	"testing"
+)
+
+func openDumpTestDB(t *testing.T, indexType index.IndexType) *DB {
+	opts := conf.DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-dump")
+	opts.DirPath = dir
+	opts.IndexType = indexType
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+	return db
+}
+
+func TestDB_ExportImport(t *testing.T) {
+	src := openDumpTestDB(t, index.Btree)
+	defer destroyDB(src)
+	values := make(map[string][]byte)
+	for i := 0; i < 1000; i++ {
+		key, value := utils.GetTestKey(i), utils.GetTestValue(64)
+		assert.Nil(t, src.Put(key, value))
+		values[string(key)] = value
+	}
+	// 被删除和被覆盖的数据
+	assert.Nil(t, src.Delete(utils.GetTestKey(1)))
+	delete(values, string(utils.GetTestKey(1)))
+	assert.Nil(t, src.Put(utils.GetTestKey(2), []byte("new")))
+	values[string(utils.GetTestKey(2))] = []byte("new")
+
+	for _, format := range []dump.Format{dump.Binary, dump.JSONLines, dump.CSV} {
+		var buf bytes.Buffer
+		exportOpts := conf.DefaultExportOptions
+		exportOpts.Format = format
+		assert.Nil(t, src.Export(&buf, exportOpts))
+		out := buf.Bytes()
+
+		// 导入到不同索引类型的数据库中
+		for _, indexType := range []index.IndexType{index.ART, index.BPTree, index.Hash, index.SkipList} {
+			t.Run(fmt.Sprintf("format-%d-index-%d", format, indexType), func(t *testing.T) {
+				dst := openDumpTestDB(t, indexType)
+				defer destroyDB(dst)
+				importOpts := conf.DefaultImportOptions
+				importOpts.Format = format
+				importOpts.BatchNum = 64
+				assert.Nil(t, dst.Import(bytes.NewReader(out), importOpts))
+
+				stat, err := dst.Stat()
+				assert.Nil(t, err)
+				assert.Equal(t, uint(len(values)), stat.KeyNum)
+				for key, value := range values {
+					got, err := dst.Get([]byte(key))
+					assert.Nil(t, err)
+					assert.Equal(t, value, got)
+				}
+				_, err = dst.Get(utils.GetTestKey(1))
+				assert.Equal(t, errs.ErrKeyNotFound, err)
+			})
+		}
+	}
+}
+
+func TestDB_ExportImportFilter(t *testing.T) {
+	src := openDumpTestDB(t, index.Btree)
+	defer destroyDB(src)
+	for _, key := range []string{"a1", "a2", "a3", "b1", "b2", "c1"} {
+		assert.Nil(t, src.Put([]byte(key), []byte("v-"+key)))
+	}
+
+	exportKeys := func(opts conf.ExportOptions) []string {
+		var buf bytes.Buffer
+		assert.Nil(t, src.Export(&buf, opts))
+		r, err := dump.NewReader(&buf, opts.Format)
+		assert.Nil(t, err)
+		var keys []string
+		for {
+			key, value, err := r.Read()
+			if err == io.EOF {
+				return keys
+			}
+			assert.Nil(t, err)
+			assert.Equal(t, "v-"+string(key), string(value))
+			keys = append(keys, string(key))
+		}
+	}
+	opts := conf.DefaultExportOptions
+	assert.Equal(t, []string{"a1", "a2", "a3", "b1", "b2", "c1"}, exportKeys(opts))
+	opts.Prefix = []byte("a")
+	assert.Equal(t, []string{"a1", "a2", "a3"}, exportKeys(opts))
+	opts.Start = []byte("a2")
+	assert.Equal(t, []string{"a2", "a3"}, exportKeys(opts))
+	opts.Prefix = nil
+	opts.End = []byte("b2")
+	assert.Equal(t, []string{"a2", "a3", "b1"}, exportKeys(opts))
+
+	// 导入时过滤
+	var buf bytes.Buffer
+	assert.Nil(t, src.Export(&buf, conf.DefaultExportOptions))
+	dst := openDumpTestDB(t, index.Btree)
+	defer destroyDB(dst)
+	importOpts := conf.DefaultImportOptions
+	importOpts.Prefix = []byte("b")
+	assert.Nil(t, dst.Import(&buf, importOpts))
+	keys, err := dst.ListKeys()
+	assert.Nil(t, err)
+	assert.Equal(t, [][]byte{[]byte("b1"), []byte("b2")}, keys)
+}
+
+func TestDB_ImportDuplicateKeys(t *testing.T) {
+	// 相同 key 的多条记录按照顺序写入，最后一条生效
+	var buf bytes.Buffer
+	w, err := dump.NewWriter(&buf, dump.JSONLines)
+	assert.Nil(t, err)
+	for i := 0; i < 100; i++ {
+		for j := 0; j < 10; j++ {
+			assert.Nil(t, w.Write(utils.GetTestKey(j), []byte(fmt.Sprint(i))))
+		}
+	}
+	assert.Nil(t, w.Close())
+
+	db := openDumpTestDB(t, index.Btree)
+	defer destroyDB(db)
+	opts := conf.DefaultImportOptions
+	opts.Format = dump.JSONLines
+	opts.BatchNum = 7
+	opts.Parallelism = 3
+	assert.Nil(t, db.Import(&buf, opts))
+	for j := 0; j < 10; j++ {
+		val, err := db.Get(utils.GetTestKey(j))
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("99"), val)
+	}
+}
+
+func TestDB_ImportCorrupted(t *testing.T) {
+	src := openDumpTestDB(t, index.Btree)
+	defer destroyDB(src)
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, src.Put(utils.GetTestKey(i), utils.GetTestValue(64)))
+	}
+	var buf bytes.Buffer
+	assert.Nil(t, src.Export(&buf, conf.DefaultExportOptions))
+	out := buf.Bytes()
+
+	// 数据被截断
+	dst := openDumpTestDB(t, index.Btree)
+	defer destroyDB(dst)
+	opts := conf.DefaultImportOptions
+	opts.BatchNum = 10
+	err := dst.Import(bytes.NewReader(out[:len(out)/2]), opts)
+	assert.Equal(t, io.ErrUnexpectedEOF, err)
+
+	// 数据损坏
+	corrupted := append([]byte(nil), out...)
+	corrupted[len(corrupted)-20] ^= 0xff
+	err = dst.Import(bytes.NewReader(corrupted), opts)
+	assert.ErrorIs(t, err, errs.ErrDumpCorrupted)
+
+	// 格式不对
+	err = dst.Import(bytes.NewReader(out), conf.ImportOptions{Format: dump.CSV})
+	assert.ErrorIs(t, err, errs.ErrInvalidDumpFormat)
+	err = dst.Import(bytes.NewReader(out), conf.ImportOptions{Format: dump.JSONLines})
+	assert.ErrorIs(t, err, errs.ErrInvalidDumpFormat)
+
+	// 空 key
+	buf.Reset()
+	w, err := dump.NewWriter(&buf, dump.Binary)
+	assert.Nil(t, err)
+	assert.Nil(t, w.Write(nil, []byte("v")))
+	assert.Nil(t, w.Close())
+	err = dst.Import(&buf, opts)
+	assert.Equal(t, errs.ErrKeyIsEmpty, err)
+}
@@ -3,6 +3,8 @@ package db
 import (
 	"bytes"
 	"kv_projects/conf"
+	"kv_projects/data"
+	"kv_projects/errs"
 	"kv_projects/index"
 )
 
@@ -12,6 +14,8 @@ type Iterator struct {
 	IndexIter index.Iterator       // 索引迭代器
 	Db        *DB                  // 需要根据 pos 取出数据，所以要包含 DB
 	Options   conf.IteratorOptions //迭代器配置项
+
+	files map[uint32]*data.DataFile // 迭代器引用的数据文件，关闭迭代器时释放
 }
 
 // 实现迭代器接口
@@ -69,19 +73,78 @@ func (it *Iterator) Key() []byte {
 func (it *Iterator) Value() ([]byte, error) {
 	it.Db.Mutex.RLock()
 	defer it.Db.Mutex.RUnlock()
-	valueByPosition, err := it.Db.GetValueByPosition(it.IndexIter.Value())
+	dataFile, pos, err := it.locate()
+	if err != nil {
+		return nil, err
+	}
+	valueByPosition, err := it.Db.readValue(dataFile, pos)
 	if err != nil {
 		return nil, err
 	}
 	return valueByPosition, nil
 }
 
+/**
+ * ValueFunc
+ * @Description:将当前遍历位置的 Value 数据交给 fn 处理，旧数据文件使用 mmap 时不进行内存拷贝
+ * value 只在 fn 执行期间有效，fn 返回后不能再持有，也不能修改 value 的内容
+ * @param fn
+ * @return error
+ */
+func (it *Iterator) ValueFunc(fn func(value []byte) error) error {
+	it.Db.Mutex.RLock()
+	defer it.Db.Mutex.RUnlock()
+	dataFile, pos, err := it.locate()
+	if err != nil {
+		return err
+	}
+	return it.Db.viewValue(dataFile, pos, fn)
+}
+
+/**
+ * locate
+ * @Description: 找到当前位置的数据所在的文件，调用方需要持有读锁。
+ * 优先使用迭代器引用的文件，其次是数据库当前的文件（索引迭代器在遍历过程中可能读到 merge 之后的新位置），
+ * 找到后增加引用；都找不到说明数据在读取索引之后又被 merge 移动过，重新从索引中获取当前的位置
+ * @receiver it
+ * @return *data.DataFile
+ * @return *data.LogRecordPos
+ * @return error
+ */
+func (it *Iterator) locate() (*data.DataFile, *data.LogRecordPos, error) {
+	pos := it.IndexIter.Value()
+	if dataFile, ok := it.files[pos.Fid]; ok {
+		return dataFile, pos, nil
+	}
+	if dataFile := it.Db.getDataFile(pos.Fid); dataFile != nil {
+		dataFile.Ref()
+		it.files[pos.Fid] = dataFile
+		return dataFile, pos, nil
+	}
+	pos, err := it.Db.Index.Get(it.IndexIter.Key())
+	if err != nil {
+		return nil, nil, err
+	}
+	if pos == nil {
+		return nil, nil, errs.ErrKeyNotFound
+	}
+	return it.Db.getDataFile(pos.Fid), pos, nil
+}
+
 /**
  * Close
  * @Description:关闭迭代器，释放相应资源
+ * @return error
  */
-func (it *Iterator) Close() {
-	it.IndexIter.Close()
+func (it *Iterator) Close() error {
+	err := it.IndexIter.Close()
+	for _, dataFile := range it.files {
+		if unrefErr := dataFile.Unref(); unrefErr != nil && err == nil {
+			err = unrefErr
+		}
+	}
+	it.files = nil
+	return err
 }
 
 // 用户可能会配置从指定前缀的 key 开始遍历
@@ -17,7 +17,8 @@ func TestDB_NewUserIterator(t *testing.T) {
 	assert.Nil(t, err)
 	assert.NotNil(t, db)
 
-	userIterator := db.NewUserIterator(conf.DefaultIteratorOptions)
+	userIterator, err := db.NewUserIterator(conf.DefaultIteratorOptions)
+	assert.Nil(t, err)
 	assert.NotNil(t, userIterator)
 	assert.False(t, userIterator.Valid())
 }
@@ -34,7 +35,8 @@ func TestDB_UserIterator_One_Value(t *testing.T) {
 	err = db.Put(utils.GetTestKey(10), utils.GetTestValue(3))
 	assert.Nil(t, err)
 
-	userIterator := db.NewUserIterator(conf.DefaultIteratorOptions)
+	userIterator, err := db.NewUserIterator(conf.DefaultIteratorOptions)
+	assert.Nil(t, err)
 	assert.NotNil(t, userIterator)
 	assert.True(t, userIterator.Valid())
 
@@ -61,7 +63,8 @@ func TestDB_UserIterator_Multi_Value(t *testing.T) {
 	assert.Nil(t, err)
 
 	// 正向迭代
-	userIterator := db.NewUserIterator(conf.DefaultIteratorOptions)
+	userIterator, err := db.NewUserIterator(conf.DefaultIteratorOptions)
+	assert.Nil(t, err)
 	assert.NotNil(t, userIterator)
 	assert.True(t, userIterator.Valid())
 
@@ -75,7 +78,8 @@ func TestDB_UserIterator_Multi_Value(t *testing.T) {
 
 	// 反向迭代
 	conf.DefaultIteratorOptions.Reverse = true
-	userIterator2 := db.NewUserIterator(conf.DefaultIteratorOptions)
+	userIterator2, err := db.NewUserIterator(conf.DefaultIteratorOptions)
+	assert.Nil(t, err)
 	assert.NotNil(t, userIterator2)
 	assert.True(t, userIterator2.Valid())
 
@@ -90,7 +94,8 @@ func TestDB_UserIterator_Multi_Value(t *testing.T) {
 	// 指定 key 前缀 测试
 	opt1 := conf.DefaultIteratorOptions
 	opt1.Prefix = []byte("c")
-	userIterator3 := db.NewUserIterator(opt1)
+	userIterator3, err := db.NewUserIterator(opt1)
+	assert.Nil(t, err)
 	assert.NotNil(t, userIterator3)
 	assert.True(t, userIterator3.Valid())
 	for userIterator3.Rewind(); userIterator3.Valid(); userIterator3.Next() {
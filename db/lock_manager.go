@@ -0,0 +1,245 @@
+package db
+
+import (
+	"context"
+	"kv_projects/errs"
+	"sort"
+	"sync"
+)
+
+// LockMode key 锁的模式
+type LockMode uint8
+
+const (
+	LockShared    LockMode = iota + 1 // 共享锁，多个持有者可以同时持有
+	LockExclusive                     // 排他锁，同一时刻只有一个持有者
+)
+
+// LockManager
+// @Description: 事务使用的 key 级别悲观锁，支持共享和排他两种模式。
+// 等待锁时进行死锁检测，形成等待环的一方返回 errs.ErrDeadlock，也可以通过 ctx 设置等待的超时时间
+type LockManager struct {
+	mu    sync.Mutex
+	locks map[string]*keyLock
+}
+
+// 一个 key 上的锁
+type keyLock struct {
+	exclusive *lockOwner              // 排他锁的持有者
+	shared    map[*lockOwner]struct{} // 共享锁的持有者
+	waiters   int                     // 正在等待的数量，没有持有者和等待者时从 LockManager 中删除
+	changed   chan struct{}           // 有持有者释放锁时关闭，唤醒所有等待者重新尝试
+}
+
+// 锁的持有者，一个持有者对应一个事务
+type lockOwner struct {
+	held     map[string]LockMode // 已经持有的锁
+	waitKey  string              // 正在等待的 key，没有等待时为空，用于死锁检测
+	waitMode LockMode
+}
+
+// KeyLocks
+// @Description: 一个持有者获取的所有 key 锁，通过 Unlock 一起释放。同一个 KeyLocks 不能在多个协程中同时等待锁
+type KeyLocks struct {
+	lm    *LockManager
+	owner *lockOwner
+}
+
+func NewLockManager() *LockManager {
+	return &LockManager{locks: make(map[string]*keyLock)}
+}
+
+// NewKeyLocks 创建一个新的持有者
+func (lm *LockManager) NewKeyLocks() *KeyLocks {
+	return &KeyLocks{
+		lm:    lm,
+		owner: &lockOwner{held: make(map[string]LockMode)},
+	}
+}
+
+/**
+ * LockKeys
+ * @Description: 获取一组 key 的排他锁，按照 key 的顺序依次获取，获取失败时释放已经获取的锁
+ * @receiver db
+ * @param ctx 取消或超时时停止等待，返回 ctx.Err()
+ * @param keys
+ * @return *KeyLocks
+ * @return error
+ */
+func (db *DB) LockKeys(ctx context.Context, keys ...[]byte) (*KeyLocks, error) {
+	return db.lockKeys(ctx, LockExclusive, keys)
+}
+
+// RLockKeys 获取一组 key 的共享锁，其他规则和 LockKeys 相同
+func (db *DB) RLockKeys(ctx context.Context, keys ...[]byte) (*KeyLocks, error) {
+	return db.lockKeys(ctx, LockShared, keys)
+}
+
+func (db *DB) lockKeys(ctx context.Context, mode LockMode, keys [][]byte) (*KeyLocks, error) {
+	locks := db.LockManager.NewKeyLocks()
+	if err := locks.lock(ctx, mode, keys); err != nil {
+		locks.Unlock()
+		return nil, err
+	}
+	return locks, nil
+}
+
+/**
+ * Lock
+ * @Description: 继续获取一组 key 的排他锁，已经持有共享锁的 key 会升级为排他锁。
+ * 获取失败时，本次已经获取的锁不会释放，随 Unlock 一起释放
+ * @receiver l
+ * @param ctx
+ * @param keys
+ * @return error 形成死锁时返回 errs.ErrDeadlock，调用方应该释放所有锁之后重试
+ */
+func (l *KeyLocks) Lock(ctx context.Context, keys ...[]byte) error {
+	return l.lock(ctx, LockExclusive, keys)
+}
+
+// RLock 继续获取一组 key 的共享锁，已经持有排他锁的 key 保持不变
+func (l *KeyLocks) RLock(ctx context.Context, keys ...[]byte) error {
+	return l.lock(ctx, LockShared, keys)
+}
+
+// Unlock 释放持有的所有锁，之后 KeyLocks 可以继续使用
+func (l *KeyLocks) Unlock() {
+	l.lm.release(l.owner)
+}
+
+func (l *KeyLocks) lock(ctx context.Context, mode LockMode, keys [][]byte) error {
+	// 所有持有者按照相同的顺序获取锁，一次性获取的锁之间不会形成死锁
+	sortedKeys := make([]string, 0, len(keys))
+	for _, key := range keys {
+		if len(key) == 0 {
+			return errs.ErrKeyIsEmpty
+		}
+		sortedKeys = append(sortedKeys, string(key))
+	}
+	sort.Strings(sortedKeys)
+	for i, key := range sortedKeys {
+		if i > 0 && key == sortedKeys[i-1] {
+			continue
+		}
+		if err := l.lm.acquire(ctx, l.owner, key, mode); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 获取一个 key 的锁，不能获取时等待其他持有者释放
+func (lm *LockManager) acquire(ctx context.Context, owner *lockOwner, key string, mode LockMode) error {
+	lm.mu.Lock()
+	defer lm.mu.Unlock()
+	if held, ok := owner.held[key]; ok && (held == LockExclusive || mode == LockShared) {
+		return nil
+	}
+	kl, ok := lm.locks[key]
+	if !ok {
+		kl = &keyLock{
+			shared:  make(map[*lockOwner]struct{}),
+			changed: make(chan struct{}),
+		}
+		lm.locks[key] = kl
+	}
+
+	kl.waiters++
+	defer func() {
+		kl.waiters--
+		owner.waitKey = ""
+		lm.removeIfIdle(key, kl)
+	}()
+	for {
+		if len(kl.blockers(owner, mode)) == 0 {
+			if mode == LockExclusive {
+				kl.exclusive = owner
+				delete(kl.shared, owner)
+			} else {
+				kl.shared[owner] = struct{}{}
+			}
+			owner.held[key] = mode
+			return nil
+		}
+		if lm.deadlocked(owner, kl, mode) {
+			return errs.ErrDeadlock
+		}
+		owner.waitKey, owner.waitMode = key, mode
+		changed := kl.changed
+		lm.mu.Unlock()
+		select {
+		case <-changed:
+			lm.mu.Lock()
+		case <-ctx.Done():
+			lm.mu.Lock()
+			return ctx.Err()
+		}
+	}
+}
+
+// 阻止 owner 以 mode 模式获取锁的其他持有者
+func (kl *keyLock) blockers(owner *lockOwner, mode LockMode) []*lockOwner {
+	var blockers []*lockOwner
+	if kl.exclusive != nil && kl.exclusive != owner {
+		blockers = append(blockers, kl.exclusive)
+	}
+	if mode == LockExclusive {
+		for holder := range kl.shared {
+			if holder != owner {
+				blockers = append(blockers, holder)
+			}
+		}
+	}
+	return blockers
+}
+
+/**
+ * deadlocked
+ * @Description: 沿着等待关系查找，如果阻止 owner 的持有者最终在等待 owner 持有的锁，说明形成了死锁，调用方必须持有锁
+ * @receiver lm
+ * @param owner
+ * @param kl owner 将要等待的锁
+ * @param mode
+ * @return bool
+ */
+func (lm *LockManager) deadlocked(owner *lockOwner, kl *keyLock, mode LockMode) bool {
+	visited := make(map[*lockOwner]bool)
+	stack := kl.blockers(owner, mode)
+	for len(stack) > 0 {
+		blocker := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if blocker == owner {
+			return true
+		}
+		if visited[blocker] || blocker.waitKey == "" {
+			continue
+		}
+		visited[blocker] = true
+		stack = append(stack, lm.locks[blocker.waitKey].blockers(blocker, blocker.waitMode)...)
+	}
+	return false
+}
+
+// 释放 owner 持有的所有锁，并唤醒等待者
+func (lm *LockManager) release(owner *lockOwner) {
+	lm.mu.Lock()
+	defer lm.mu.Unlock()
+	for key := range owner.held {
+		kl := lm.locks[key]
+		if kl.exclusive == owner {
+			kl.exclusive = nil
+		}
+		delete(kl.shared, owner)
+		close(kl.changed)
+		kl.changed = make(chan struct{})
+		lm.removeIfIdle(key, kl)
+	}
+	owner.held = make(map[string]LockMode)
+}
+
+// 没有持有者和等待者时删除 key 对应的锁，调用方必须持有锁
+func (lm *LockManager) removeIfIdle(key string, kl *keyLock) {
+	if kl.exclusive == nil && len(kl.shared) == 0 && kl.waiters == 0 {
+		delete(lm.locks, key)
+	}
+}
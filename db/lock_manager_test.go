@@ -0,0 +1,209 @@
+package db
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"kv_projects/conf"
+	"kv_projects/errs"
+	"kv_projects/utils"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLockManager_SharedAndExclusive(t *testing.T) {
+	lm := NewLockManager()
+	ctx := context.Background()
+	key := utils.GetTestKey(1)
+
+	// 多个持有者可以同时持有共享锁
+	l1 := lm.NewKeyLocks()
+	l2 := lm.NewKeyLocks()
+	assert.Nil(t, l1.RLock(ctx, key))
+	assert.Nil(t, l2.RLock(ctx, key))
+
+	// 排他锁需要等待所有共享锁释放
+	l3 := lm.NewKeyLocks()
+	timeoutCtx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, l3.Lock(timeoutCtx, key))
+
+	acquired := make(chan error)
+	go func() {
+		acquired <- l3.Lock(ctx, key)
+	}()
+	l1.Unlock()
+	select {
+	case <-acquired:
+		t.Fatal("exclusive lock acquired while a shared lock is held")
+	case <-time.After(50 * time.Millisecond):
+	}
+	l2.Unlock()
+	assert.Nil(t, <-acquired)
+
+	// 持有排他锁时，其他持有者不能获取共享锁
+	timeoutCtx2, cancel2 := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel2()
+	assert.Equal(t, context.DeadlineExceeded, l1.RLock(timeoutCtx2, key))
+	// 持有者自己重复获取不会阻塞
+	assert.Nil(t, l3.RLock(ctx, key))
+	assert.Nil(t, l3.Lock(ctx, key, key))
+	l3.Unlock()
+
+	// 只有一个共享锁持有者时可以升级为排他锁
+	assert.Nil(t, l1.RLock(ctx, key))
+	assert.Nil(t, l1.Lock(ctx, key))
+	l1.Unlock()
+	assert.Equal(t, 0, len(lm.locks))
+
+	assert.Equal(t, errs.ErrKeyIsEmpty, l1.Lock(ctx, nil))
+}
+
+func TestLockManager_Deadlock(t *testing.T) {
+	lm := NewLockManager()
+	ctx := context.Background()
+	key1, key2 := utils.GetTestKey(1), utils.GetTestKey(2)
+
+	l1 := lm.NewKeyLocks()
+	l2 := lm.NewKeyLocks()
+	assert.Nil(t, l1.Lock(ctx, key1))
+	assert.Nil(t, l2.Lock(ctx, key2))
+
+	waitErr := make(chan error)
+	go func() {
+		waitErr <- l1.Lock(ctx, key2)
+	}()
+	// 等待 l1 进入等待状态
+	for {
+		lm.mu.Lock()
+		waiting := l1.owner.waitKey != ""
+		lm.mu.Unlock()
+		if waiting {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	// l2 等待 l1 持有的锁形成等待环
+	assert.Equal(t, errs.ErrDeadlock, l2.Lock(ctx, key1))
+	l2.Unlock()
+	assert.Nil(t, <-waitErr)
+	l1.Unlock()
+
+	// 两个共享锁持有者同时升级也会形成死锁
+	assert.Nil(t, l1.RLock(ctx, key1))
+	assert.Nil(t, l2.RLock(ctx, key1))
+	go func() {
+		waitErr <- l1.Lock(ctx, key1)
+	}()
+	for {
+		lm.mu.Lock()
+		waiting := l1.owner.waitKey != ""
+		lm.mu.Unlock()
+		if waiting {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	assert.Equal(t, errs.ErrDeadlock, l2.Lock(ctx, key1))
+	l2.Unlock()
+	assert.Nil(t, <-waitErr)
+	l1.Unlock()
+}
+
+func TestDB_LockKeys(t *testing.T) {
+	opts := conf.DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-lock-keys")
+	opts.DirPath = dir
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	ctx := context.Background()
+	key := utils.GetTestKey(1)
+	assert.Nil(t, db.Put(key, []byte("0")))
+
+	// 多个批次并发对同一个 key 做读改写，持有排他锁时不会丢失更新
+	wg := new(sync.WaitGroup)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				wb := db.NewWriteBatch(&conf.DefaultWriteBatchOptions)
+				assert.Nil(t, wb.LockKeys(ctx, key))
+				val, err := db.Get(key)
+				assert.Nil(t, err)
+				n, err := strconv.Atoi(string(val))
+				assert.Nil(t, err)
+				assert.Nil(t, wb.Put(key, []byte(strconv.Itoa(n+1))))
+				assert.Nil(t, wb.Commit())
+			}
+		}()
+	}
+	wg.Wait()
+	val, err := db.Get(key)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("200"), val)
+
+	// 批次回滚时释放锁
+	wb := db.NewWriteBatch(&conf.DefaultWriteBatchOptions)
+	assert.Nil(t, wb.LockKeys(ctx, key))
+	timeoutCtx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	_, err = db.RLockKeys(timeoutCtx, key)
+	assert.Equal(t, context.DeadlineExceeded, err)
+	wb.Rollback()
+	locks, err := db.RLockKeys(ctx, key, utils.GetTestKey(2))
+	assert.Nil(t, err)
+	locks.Unlock()
+	assert.Equal(t, 0, len(db.LockManager.locks))
+}
+
+func TestWriteBatch_UnlockOnCommitError(t *testing.T) {
+	opts := conf.DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-unlock-on-error")
+	opts.DirPath = dir
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	ctx := context.Background()
+	key1, key2 := utils.GetTestKey(1), utils.GetTestKey(2)
+	batchOpts := conf.DefaultWriteBatchOptions
+	batchOpts.MaxBatchNum = 1
+
+	// 提交失败时释放锁，其他批次可以立即获取
+	wb := db.NewWriteBatch(&batchOpts)
+	assert.Nil(t, wb.LockKeys(ctx, key1))
+	assert.Nil(t, wb.RLockKeys(ctx, key2))
+	assert.Nil(t, wb.Put(key1, []byte("v1")))
+	assert.Nil(t, wb.Put(key2, []byte("v2")))
+	assert.Equal(t, errs.ErrExceedMaxBatchNum, wb.Commit())
+
+	other := db.NewWriteBatch(&conf.DefaultWriteBatchOptions)
+	timeoutCtx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	assert.Nil(t, other.LockKeys(timeoutCtx, key1, key2))
+	assert.Nil(t, other.Put(key1, []byte("other")))
+	assert.Nil(t, other.Commit())
+	assert.Equal(t, 0, len(db.LockManager.locks))
+
+	// 暂存的数据保留，重新加锁之后可以继续提交
+	assert.Nil(t, wb.Delete(key2))
+	assert.Nil(t, wb.LockKeys(ctx, key1))
+	assert.Nil(t, wb.Commit())
+	val, err := db.Get(key1)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("v1"), val)
+	assert.Equal(t, 0, len(db.LockManager.locks))
+
+	// 准备失败时同样释放锁
+	assert.Nil(t, wb.LockKeys(ctx, key1))
+	assert.Nil(t, wb.Put(key1, []byte("v1")))
+	assert.Nil(t, wb.Put(key2, []byte("v2")))
+	assert.Equal(t, errs.ErrExceedMaxBatchNum, wb.Prepare(1))
+	locks, err := db.LockKeys(timeoutCtx, key1)
+	assert.Nil(t, err)
+	locks.Unlock()
+	assert.Equal(t, 0, len(db.LockManager.locks))
+}
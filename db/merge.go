@@ -1,105 +1,164 @@
 package db
 
 import (
+	"errors"
 	"io"
+	"kv_projects/conf"
 	"kv_projects/data"
 	"kv_projects/errs"
+	"kv_projects/fio"
+	"kv_projects/index"
 	"kv_projects/utils"
 	"os"
 	"path"
 	"path/filepath"
 	"sort"
 	"strconv"
+	"strings"
+	"sync/atomic"
 )
 
 const (
 	MergeDirName     = "-merge"
 	MergeFinishedKey = "merge-finished"
+	MergeBaseKey     = "merge-base"
 )
 
+/**
+ * Merge
+ * @Description: 重写有效数据，清理无效数据。merge 完成后直接在线安装新的数据文件，不需要重启；
+ * 被替换的旧文件在所有引用（例如迭代器）释放之后才会被删除
+ * @receiver db
+ * @return error
+ */
 func (db *DB) Merge() error {
 	// 如果数据库为空，直接返回
 	if db.ActiveFile == nil {
 		return nil
 	}
-	db.Mutex.Lock()
+	db.lock()
 	// 保证只有一个 merge 在进行，如果已经在merge则返回相应的错误
 	if db.IsMerging {
-		db.Mutex.Unlock()
+		db.unlock()
 		return errs.ErrMergeIsProgress
 	}
+	// 已准备事务的数据不在索引中，merge 时会被丢弃
+	if len(db.preparedTxns) > 0 {
+		db.unlock()
+		return errs.ErrPreparedTxnPending
+	}
 
 	// 获取当前 db 实例所在文件夹的大小
-	totalSize, err := utils.DirSize(db.Options.DirPath)
+	totalSize, err := utils.DirSize(db.Options.FileSystem, db.Options.DirPath)
 	if err != nil {
-		db.Mutex.Unlock()
+		db.unlock()
 		return err
 	}
 	// 判断是否到达设置的 merge 阈值
-	if float32(db.ReclaimSize)/float32(totalSize) < db.Options.DataFileMergeRatio {
-		db.Mutex.Unlock()
+	reclaimSize := atomic.LoadInt64(&db.ReclaimSize)
+	if float32(reclaimSize)/float32(totalSize) < db.Options.DataFileMergeRatio {
+		db.unlock()
 		return errs.ErrMergeRatioUnreached
 	}
 
-	// 判断磁盘剩余空间是否可以容纳 merge 之后的数据
-	availableDiskSize, err := utils.AvailableDiskSize()
-	if err != nil {
-		db.Mutex.Unlock()
-		return err
-	}
-	if totalSize-uint64(db.ReclaimSize) >= availableDiskSize {
-		db.Mutex.Unlock()
-		return errs.ErrNotEnoughSpaceForMerge
+	// 判断数据目录所在磁盘的剩余空间是否可以容纳 merge 之后的数据，平台不支持或者不在磁盘上时跳过检查
+	if db.onOSFileSystem() {
+		availableDiskSize, err := utils.AvailableDiskSize(db.Options.DirPath)
+		if err != nil && !errors.Is(err, errors.ErrUnsupported) {
+			db.unlock()
+			return err
+		}
+		if err == nil && totalSize-uint64(reclaimSize) >= availableDiskSize {
+			db.unlock()
+			return errs.ErrNotEnoughSpaceForMerge
+		}
 	}
 
 	db.IsMerging = true
 	defer func() {
+		db.Mutex.Lock()
 		db.IsMerging = false
+		db.Mutex.Unlock()
 	}()
 	// merge 基本流程
 	/*
 		1. 打开新的活跃文件
 		2. 对之前的全部文件执行merge操作
+		3. 安装 merge 生成的文件，替换旧文件
 	*/
-	// 持久化当前活跃文件
-	err = db.ActiveFile.Sync()
+	// 持久化当前活跃文件，并将当前活跃文件转为旧文件
+	err = db.sealActiveFile()
 	if err != nil {
-		db.Mutex.Unlock()
+		db.unlock()
 		return err
 	}
-	// 将当前活跃文件转为旧文件
-	db.OlderFiles[db.ActiveFile.FileId] = db.ActiveFile
 
-	// 打开新的活跃文件
-	err = db.setActivateDataFile()
+	// 取出所有需要 merge 的文件，增加引用保证 merge 期间文件不会被关闭
+	var mergeFiles []*data.DataFile
+	var mergeSize int64
+	for _, file := range db.OlderFiles {
+		size, err := file.Size()
+		if err != nil {
+			db.unlock()
+			return err
+		}
+		mergeSize += size
+		mergeFiles = append(mergeFiles, file)
+	}
+	for _, file := range mergeFiles {
+		file.Ref()
+	}
+	defer func() {
+		for _, file := range mergeFiles {
+			_ = file.Unref()
+		}
+	}()
+
+	// merge 生成的文件使用新的 id，不复用旧文件的 id，旧文件被迭代器引用时，同一个 id 不会对应两个不同的文件。
+	// 新的活跃文件跳过为 merge 预留的 id：merge 按顺序写满一个文件再写下一个，相邻两个文件的数据量之和大于 DataFileSize，
+	// 超过 DataFileSize 的单条记录最多额外占用一个空文件，所以预留 3*mergeSize/DataFileSize+2 个 id 一定够用
+	mergeBaseFileId := db.ActiveFile.FileId + 1
+	reservedFileIds := uint32(3*mergeSize/db.Options.DataFileSize + 2)
+	err = db.openActiveDataFile(mergeBaseFileId + reservedFileIds)
 	if err != nil {
-		db.Mutex.Unlock()
+		db.unlock()
 		return err
 	}
 	// 记录当前没有被 merge 的文件id
 	noMergeFileId := db.ActiveFile.FileId
-
-	// 取出所有需要 merge 的文件
-	var mergeFiles []*data.DataFile
-	for _, file := range db.OlderFiles {
-		mergeFiles = append(mergeFiles, file)
-	}
-	db.Mutex.Unlock()
+	db.unlock()
 
 	// 待 merge 的文件从小到大排序依次 merge
 	sort.Slice(mergeFiles, func(i, j int) bool {
 		return mergeFiles[i].FileId < mergeFiles[j].FileId
 	})
 	mergePath := db.getMergePath()
+	if err := db.writeMergeFiles(mergePath, mergeFiles, mergeBaseFileId, noMergeFileId); err != nil {
+		return err
+	}
+	return db.installMergeFiles(mergePath, mergeFiles, mergeBaseFileId)
+}
+
+/**
+ * writeMergeFiles
+ * @Description: 将旧文件中的有效数据重写到 merge 目录，生成 hint 文件，最后写入 merge 完成的标识
+ * @receiver db
+ * @param mergePath
+ * @param mergeFiles 按 id 从小到大排序的旧文件
+ * @param mergeBaseFileId merge 生成的第一个文件的 id
+ * @param noMergeFileId 没有参与 merge 的第一个文件 id
+ * @return error
+ */
+func (db *DB) writeMergeFiles(mergePath string, mergeFiles []*data.DataFile, mergeBaseFileId, noMergeFileId uint32) error {
 	// 如果 mergePath 存在说明发生过merge，将原merge目录删除
-	_, err = os.Stat(mergePath)
+	_, err := db.Options.FileSystem.Stat(mergePath)
 	if err == nil {
-		if err = os.RemoveAll(mergePath); err != nil {
+		if err = db.Options.FileSystem.RemoveAll(mergePath); err != nil {
 			return err
 		}
 	}
 	// 新建一个 merge 目录
-	err = os.MkdirAll(mergePath, os.ModePerm)
+	err = db.Options.FileSystem.MkdirAll(mergePath, os.ModePerm)
 	if err != nil {
 		return err
 	}
@@ -110,6 +169,13 @@ func (db *DB) Merge() error {
 
 	// 落盘设为false，手动控制落盘，防止merge过程出错
 	mergeOptions.SyncWrite = false
+	// merge 写入的新文件同样不经过页缓存
+	if db.useDirectIO(conf.DirectIOMerge) {
+		mergeOptions.DirectIO = conf.DirectIOAll
+		mergeOptions.BufferedWrite = false
+		mergeOptions.MMapWrite = false
+		mergeOptions.MMapSealedFiles = false
+	}
 	mergeDB, err := Open(mergeOptions)
 	if err != nil {
 		return err
@@ -117,9 +183,13 @@ func (db *DB) Merge() error {
 	defer func() {
 		_ = mergeDB.Close()
 	}()
+	// merge 生成的文件从预留的第一个 id 开始
+	if err := mergeDB.openActiveDataFile(mergeBaseFileId); err != nil {
+		return err
+	}
 
 	// 打开 hint 文件存储索引
-	hintFile, err := data.OpenHintFile(mergePath)
+	hintFile, err := data.OpenHintFile(db.Options.FileSystem, mergePath)
 	if err != nil {
 		return err
 	}
@@ -129,33 +199,8 @@ func (db *DB) Merge() error {
 
 	// 遍历处理每一个文件
 	for _, file := range mergeFiles {
-		var offset int64 = 0
-		for {
-			logRecord, size, err := file.ReadLogRecord(offset)
-			if err != nil {
-				if err == io.EOF {
-					break
-				}
-				return err
-			}
-			//解析拿到实际的 key（不带事务序列号）
-			realKey, _ := parseLogRecordKey(logRecord.Key)
-			// 拿到key对应的内存索引信息
-			logRecordPos := db.Index.Get(realKey)
-			//判断数据是否需要重写
-			if logRecordPos != nil && logRecordPos.Fid == file.FileId && logRecordPos.Offset == offset {
-				//	merge时确定该数据有效，不在需要加入事务序列号
-				logRecord.Key = logRecordKeyWithSeq(realKey, nonTransactionSeqNo)
-				newLogRecordPos, err := mergeDB.appendLogRecordWithLock(logRecord)
-				if err != nil {
-					return err
-				}
-				// 将新的索引位置信息添加进 Hint(索引)文件中
-				if err := hintFile.WriteHintFile(realKey, newLogRecordPos); err != nil {
-					return err
-				}
-			}
-			offset += size
+		if err := db.rewriteMergeFile(mergeDB, hintFile, file, noMergeFileId); err != nil {
+			return err
 		}
 	}
 
@@ -168,30 +213,171 @@ func (db *DB) Merge() error {
 	}
 
 	// 增加一个标识 merge
-	mergeFinishedFile, err := data.OpenMergeFinishedFile(mergePath)
-	if err != nil {
-		return err
+	// 第一条记录为没有参与 merge 的文件 id，第二条为 merge 生成的第一个文件 id，id 小于它的都是被替换的旧文件
+	var content []byte
+	for _, record := range []*data.LogRecord{
+		{Key: []byte(MergeFinishedKey), Value: []byte(strconv.Itoa(int(noMergeFileId)))},
+		{Key: []byte(MergeBaseKey), Value: []byte(strconv.Itoa(int(mergeBaseFileId)))},
+	} {
+		encoderLogRecord, _ := data.EncoderLogRecord(record)
+		content = append(content, encoderLogRecord...)
+	}
+	// 标识存在就认为 merge 已经完成，所以不能出现只写入一部分的标识
+	return db.writeFileAtomic(filepath.Join(mergePath, data.MergeFinishedFileName), content)
+}
+
+/**
+ * rewriteMergeFile
+ * @Description: 将一个旧文件中仍然有效的记录写入 merge 实例，并记录到 hint 文件中
+ * @receiver db
+ * @param mergeDB
+ * @param hintFile
+ * @param file
+ * @param noMergeFileId
+ * @return error
+ */
+func (db *DB) rewriteMergeFile(mergeDB *DB, hintFile *data.DataFile, file *data.DataFile, noMergeFileId uint32) error {
+	// merge 顺序读取整个文件，只有 merge 使用直接 IO 时单独打开一份，不经过页缓存，也不占用句柄表；
+	// 所有文件都使用直接 IO 时直接读取即可
+	reader := file
+	if db.Options.DirectIO&(conf.DirectIOMerge|conf.DirectIOAll) == conf.DirectIOMerge {
+		directFile, err := data.OpenDataFile(db.Options.FileSystem, db.Options.DirPath, file.FileId, fio.DirectIoManager)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			_ = directFile.Close()
+		}()
+		reader = directFile
+	}
+
+	var offset int64 = 0
+	for {
+		// 先只读取 key，判断数据有效之后再读取 value
+		logRecord, size, err := reader.ReadLogRecordKey(offset)
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return err
+		}
+		//解析拿到实际的 key（不带事务序列号）
+		realKey, _ := parseLogRecordKey(logRecord.Key)
+		// 拿到key对应的内存索引信息，哈希索引校验 key 时会读取数据文件，需要持有读锁
+		db.Mutex.RLock()
+		logRecordPos, err := db.Index.Get(realKey)
+		db.Mutex.RUnlock()
+		if err != nil {
+			return err
+		}
+		//判断数据是否需要重写
+		if logRecordPos != nil && logRecordPos.Fid == file.FileId && logRecordPos.Offset == offset {
+			//	merge时确定该数据有效，不在需要加入事务序列号
+			key := logRecordKeyWithSeq(realKey, nonTransactionSeqNo)
+			var newLogRecordPos *data.LogRecordPos
+			if size > data.StreamChunkSize {
+				// 大的 value 分块复制，不需要整体读入内存
+				newLogRecordPos, err = mergeDB.appendStreamFromWithLock(key, reader, offset)
+			} else {
+				newLogRecordPos, err = mergeDB.appendLogRecordFromWithLock(key, reader, offset)
+			}
+			if err != nil {
+				return err
+			}
+			if newLogRecordPos.Fid >= noMergeFileId {
+				return errors.New("merge files exceed the reserved file ids")
+			}
+			// 将新的索引位置信息添加进 Hint(索引)文件中
+			if err := hintFile.WriteHintFile(realKey, newLogRecordPos); err != nil {
+				return err
+			}
+		}
+		offset += size
 	}
-	//defer func() {
-	//	_ = mergeFinishedFile.Close()
-	//}()
+	return nil
+}
 
-	mergeFinRecord := &data.LogRecord{
-		Key:   []byte(MergeFinishedKey),
-		Value: []byte(strconv.Itoa(int(noMergeFileId))),
+// 读取 src 中 offset 位置的记录，替换为新的 key 之后写入活跃文件
+func (db *DB) appendLogRecordFromWithLock(key []byte, src *data.DataFile, offset int64) (*data.LogRecordPos, error) {
+	logRecord, _, err := src.ReadLogRecord(offset)
+	if err != nil {
+		return nil, err
 	}
-	encoderLogRecord, _ := data.EncoderLogRecord(mergeFinRecord)
-	err = mergeFinishedFile.Write(encoderLogRecord)
+	logRecord.Key = key
+	return db.appendLogRecordWithLock(logRecord)
+}
+
+/**
+ * installMergeFiles
+ * @Description: 在线安装 merge 生成的文件，整个过程持有写锁。
+ * 安装顺序和重启时的 loadMergeFiles 保持一致，任何一步崩溃后重启都可以继续完成：
+ *  1. 将新的数据文件移动到数据目录并打开，它们的 id 是新的，不会覆盖旧文件
+ *  2. 用 merge 目录中的 hint 文件更新索引，只更新仍然指向旧文件的 key
+ *  3. 移动 hint 文件，最后移动 merge 完成的标识，作为安装完成的标志
+ *  4. 旧文件从数据库中移除，最后一个引用释放时删除
+ * @receiver db
+ * @param mergePath
+ * @param mergeFiles 被替换的旧文件
+ * @param mergeBaseFileId
+ * @return error
+ */
+func (db *DB) installMergeFiles(mergePath string, mergeFiles []*data.DataFile, mergeBaseFileId uint32) error {
+	db.lock()
+	defer db.unlock()
+
+	mergeFileNames, err := getMergeFileNames(db.Options.FileSystem, mergePath)
 	if err != nil {
 		return err
 	}
-	if err := mergeFinishedFile.Sync(); err != nil {
+	for _, fileName := range mergeFileNames {
+		if !strings.HasSuffix(fileName, data.DataFileNameSuffix) {
+			continue
+		}
+		fileId, err := strconv.Atoi(strings.TrimSuffix(fileName, data.DataFileNameSuffix))
+		if err != nil {
+			return errs.ErrDataDirectoryCorrupted
+		}
+		if err := db.Options.FileSystem.Rename(filepath.Join(mergePath, fileName), filepath.Join(db.Options.DirPath, fileName)); err != nil {
+			return err
+		}
+		db.OlderFiles[uint32(fileId)] = data.OpenSealedDataFile(db.Options.FileSystem, db.Options.DirPath, uint32(fileId), db.sealedFileIOType(), db.FileTable)
+	}
+
+	liveSize, staleSize, err := db.applyHintFile(mergePath, mergeBaseFileId)
+	if err != nil {
 		return err
 	}
-	if err := mergeFinishedFile.Close(); err != nil {
+	// 索引快照中的位置信息指向旧文件，已经失效
+	if err := db.removeIndexSnapshot(); err != nil {
 		return err
 	}
-	return nil
+	for _, fileName := range []string{data.HintFileName, data.MergeFinishedFileName} {
+		srcPath := filepath.Join(mergePath, fileName)
+		if _, err := db.Options.FileSystem.Stat(srcPath); os.IsNotExist(err) {
+			continue
+		}
+		if err := db.Options.FileSystem.Rename(srcPath, filepath.Join(db.Options.DirPath, fileName)); err != nil {
+			return err
+		}
+	}
+
+	// 旧文件中除了被重写的有效数据以外都是无效数据，随旧文件一起被回收；
+	// merge 期间被覆盖写或删除的 key 在新文件中的数据成为新的无效数据
+	var oldSize int64
+	for _, file := range mergeFiles {
+		size, err := file.Size()
+		if err != nil {
+			return err
+		}
+		oldSize += size
+		delete(db.OlderFiles, file.FileId)
+		file.MarkObsolete()
+		if err := file.Unref(); err != nil {
+			return err
+		}
+	}
+	db.addReclaimSize(staleSize - (oldSize - liveSize))
+	return db.Options.FileSystem.RemoveAll(mergePath)
 }
 
 /**
@@ -207,92 +393,262 @@ func (db *DB) getMergePath() string {
 	return path.Join(dir, base+MergeDirName)
 }
 
-// 加载数据目录
+// 获取 merge 目录下需要移动到数据目录的文件，merge 实例自己的索引、事务序列号等文件不需要
+func getMergeFileNames(fsys fio.FileSystem, mergePath string) ([]string, error) {
+	dirEntries, err := fsys.ReadDir(mergePath)
+	if err != nil {
+		return nil, err
+	}
+	var mergeFileNames []string
+	for _, entry := range dirEntries {
+		switch entry.Name() {
+		// 将保存事务序列号的文件和文件锁跳过
+		case data.SeqNoFileName, FileLockName:
+		// merge 目录中的索引快照对应的是 merge 实例自己的索引
+		case data.IndexSnapshotFileName:
+		// merge 目录中的 B+ 树索引只包含 merge 时的数据，不能覆盖原目录的，原目录的索引通过 hint 文件更新
+		case index.BtreeIndexFileName, index.BloomFilterFileName:
+		default:
+			// 崩溃时遗留的临时文件
+			if strings.HasSuffix(entry.Name(), ".tmp") {
+				continue
+			}
+			mergeFileNames = append(mergeFileNames, entry.Name())
+		}
+	}
+	return mergeFileNames, nil
+}
+
+/**
+ * loadMergeFiles
+ * @Description: 启动时完成上次没有安装完的 merge，并删除已经被替换但还没来得及删除的旧文件
+ * @receiver db
+ * @return error
+ */
 func (db *DB) loadMergeFiles() error {
+	if err := db.installMergeDir(); err != nil {
+		return err
+	}
+	return db.removeObsoleteFiles()
+}
+
+// 加载 merge 目录，将 merge 后的新文件替换原来的旧文件
+func (db *DB) installMergeDir() error {
 	mergePath := db.getMergePath()
 	//merge 目录不存在直接返回
-	if _, err := os.Stat(mergePath); os.IsNotExist(err) {
+	if _, err := db.Options.FileSystem.Stat(mergePath); os.IsNotExist(err) {
 		return nil
 	}
-	defer func() {
-		_ = os.RemoveAll(mergePath)
-	}()
 
-	// 获取 merge 目录下的所有文件
-	dirEntries, err := os.ReadDir(mergePath)
+	// 获取 merge 目录下的所有文件，同时查找标识 merge 完成的文件，判断 merge 是否完成
+	mergeFileNames, err := getMergeFileNames(db.Options.FileSystem, mergePath)
 	if err != nil {
 		return err
 	}
-
-	// 查找标识 merge 完成的文件，判断 merge 是否完成，同时将merge后的文件名保存
 	var mergeFinished bool
-	var mergeFileNames []string
-	for _, entry := range dirEntries {
-		if entry.Name() == data.MergeFinishedFileName {
+	for _, fileName := range mergeFileNames {
+		if fileName == data.MergeFinishedFileName {
 			mergeFinished = true
 		}
-		// 将保存事务序列号的文件跳过
-		if entry.Name() == data.SeqNoFileName {
-			continue
-		}
-		if entry.Name() == FileLockName {
-			continue
-		}
-		mergeFileNames = append(mergeFileNames, entry.Name())
 	}
 
-	// 如果 merge 没有完成，直接返回
+	// 如果 merge 没有完成，直接删除 merge 目录
 	if !mergeFinished {
-		return nil
+		return db.Options.FileSystem.RemoveAll(mergePath)
 	}
 
-	// 获取没有被 merge 的文件 id
-	noMergeFileId, err := db.getNoMergeFileId(mergePath)
+	// id 小于 obsoleteFileId 的都是被 merge 替换的旧文件
+	obsoleteFileId, err := db.getObsoleteFileId(mergePath)
 	if err != nil {
 		return err
 	}
 
-	//在原本目录下删除已经执行完 merge 的文件
-	var fileId uint32 = 0
-	for ; fileId < noMergeFileId; fileId++ {
-		fileName := data.GetDataFileName(db.Options.DirPath, fileId)
-		if _, err = os.Stat(fileName); err == nil {
-			err := os.RemoveAll(fileName)
-			if err != nil {
-				return err
-			}
+	// 数据文件即将被替换，原来的索引快照中的位置信息会失效
+	if err := db.removeIndexSnapshot(); err != nil {
+		return err
+	}
+
+	// B+ 树索引持久化在磁盘上，打开时不会从 hint 文件加载，需要在替换数据文件之前更新
+	if db.Options.IndexType == index.BPTree {
+		if _, _, err := db.applyHintFile(mergePath, obsoleteFileId); err != nil {
+			return err
 		}
 	}
 
-	// 将 merge 之后的文件移动过来,移动完成后源文件路径整体会被删除
+	//在原本目录下删除已经执行完 merge 的文件
+	if err := db.removeDataFilesBefore(obsoleteFileId); err != nil {
+		return err
+	}
+
+	// 将 merge 之后的文件移动过来，标识 merge 完成的文件最后移动
+	sort.SliceStable(mergeFileNames, func(i, j int) bool {
+		return mergeFileNames[j] == data.MergeFinishedFileName
+	})
 	for _, fileName := range mergeFileNames {
 		srcPath := filepath.Join(mergePath, fileName)
 		destPath := filepath.Join(db.Options.DirPath, fileName)
 		// 将 srcpath 重命名（移动）为 destpath
-		err := os.Rename(srcPath, destPath)
+		err := db.Options.FileSystem.Rename(srcPath, destPath)
 		if err != nil {
 			return err
 		}
 	}
-	return nil
+	// 全部移动完成之后才删除 merge 目录，中途失败时下次启动可以继续
+	return db.Options.FileSystem.RemoveAll(mergePath)
+}
 
+// 数据目录中已经安装过 merge 时，删除被替换但是还没有删除的旧文件（例如旧文件还被迭代器引用时进程退出了）
+func (db *DB) removeObsoleteFiles() error {
+	if _, err := db.Options.FileSystem.Stat(filepath.Join(db.Options.DirPath, data.MergeFinishedFileName)); os.IsNotExist(err) {
+		return nil
+	}
+	_, mergeBaseFileId, err := db.getMergeFileIds(db.Options.DirPath)
+	if err != nil {
+		return err
+	}
+	return db.removeDataFilesBefore(mergeBaseFileId)
+}
+
+// 删除 id 小于 fileId 的数据文件
+func (db *DB) removeDataFilesBefore(fileId uint32) error {
+	var fid uint32 = 0
+	for ; fid < fileId; fid++ {
+		fileName := data.GetDataFileName(db.Options.DirPath, fid)
+		if _, err := db.Options.FileSystem.Stat(fileName); err == nil {
+			if err := db.Options.FileSystem.Remove(fileName); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
 }
 
 // 获取没有被 merge 的文件id
 func (db *DB) getNoMergeFileId(dirPath string) (uint32, error) {
-	mergeFinishedFile, err := data.OpenMergeFinishedFile(dirPath)
+	noMergeFileId, _, err := db.getMergeFileIds(dirPath)
+	return noMergeFileId, err
+}
+
+/**
+ * getMergeFileIds
+ * @Description: 读取 merge 完成标识中的文件 id
+ * @receiver db
+ * @param dirPath
+ * @return uint32 没有参与 merge 的第一个文件 id
+ * @return uint32 merge 生成的第一个文件 id，旧版本的 merge 生成的文件复用旧文件的 id，没有这条记录，返回 0
+ * @return error
+ */
+func (db *DB) getMergeFileIds(dirPath string) (uint32, uint32, error) {
+	mergeFinishedFile, err := data.OpenMergeFinishedFile(db.Options.FileSystem, dirPath)
 	if err != nil {
-		return 0, err
+		return 0, 0, err
 	}
 	defer func() {
 		_ = mergeFinishedFile.Close()
 	}()
-	record, _, err := mergeFinishedFile.ReadLogRecord(0)
+	record, size, err := mergeFinishedFile.ReadLogRecord(0)
 	if err != nil {
-		return 0, err
+		return 0, 0, err
 	}
 	noMergeFileId, err := strconv.Atoi(string(record.Value))
-	return uint32((noMergeFileId)), nil
+	if err != nil {
+		return 0, 0, err
+	}
+	record, _, err = mergeFinishedFile.ReadLogRecord(size)
+	if err == io.EOF {
+		return uint32(noMergeFileId), 0, nil
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+	mergeBaseFileId, err := strconv.Atoi(string(record.Value))
+	if err != nil {
+		return 0, 0, err
+	}
+	return uint32(noMergeFileId), uint32(mergeBaseFileId), nil
+}
+
+// id 小于返回值的文件都是被 merge 替换的旧文件，旧版本的 merge 生成的文件复用了旧文件的 id，所以是没有参与 merge 的文件 id
+func (db *DB) getObsoleteFileId(mergePath string) (uint32, error) {
+	noMergeFileId, mergeBaseFileId, err := db.getMergeFileIds(mergePath)
+	if err != nil {
+		return 0, err
+	}
+	if mergeBaseFileId == 0 {
+		return noMergeFileId, nil
+	}
+	return mergeBaseFileId, nil
+}
+
+/**
+ * applyHintFile
+ * @Description: 用 merge 目录中的 hint 文件更新索引，只更新仍然指向旧文件（id 小于 obsoleteFileId）的 key，
+ * merge 之后被重新写入或删除的 key 保持不变。B+ 树索引在一个 bbolt 事务中完成更新，
+ * 如果在替换数据文件的过程中崩溃，下次启动时会重新执行，已经更新过的 key 会被写入相同的位置，不影响结果
+ * @receiver db
+ * @param mergePath
+ * @param obsoleteFileId
+ * @return int64 被更新的 key 在旧文件中的数据大小
+ * @return int64 没有被更新的 key 在新文件中的数据大小，这些数据已经无效
+ * @return error
+ */
+func (db *DB) applyHintFile(mergePath string, obsoleteFileId uint32) (int64, int64, error) {
+	if _, err := db.Options.FileSystem.Stat(filepath.Join(mergePath, data.HintFileName)); os.IsNotExist(err) {
+		return 0, 0, nil
+	}
+	hintFile, err := data.OpenHintFile(db.Options.FileSystem, mergePath)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer func() {
+		_ = hintFile.Close()
+	}()
+
+	var liveSize, staleSize int64
+	forEachHint := func(get func(key []byte) (*data.LogRecordPos, error), put func(key []byte, pos *data.LogRecordPos) error) error {
+		liveSize, staleSize = 0, 0
+		var offset int64 = 0
+		for {
+			logRecord, size, err := hintFile.ReadLogRecord(offset)
+			if err != nil {
+				if err == io.EOF {
+					return nil
+				}
+				return err
+			}
+			pos := data.DecoderLogRecordPos(logRecord.Value)
+			oldPos, err := get(logRecord.Key)
+			if err != nil {
+				return err
+			}
+			if oldPos != nil && oldPos.Fid < obsoleteFileId {
+				if err := put(logRecord.Key, pos); err != nil {
+					return err
+				}
+				liveSize += int64(oldPos.Size)
+			} else {
+				staleSize += int64(pos.Size)
+			}
+			offset += size
+		}
+	}
+
+	if bpt, ok := db.Index.(*index.BPlusTree); ok {
+		err = bpt.Update(func(txn *index.BPTreeTxn) error {
+			return forEachHint(func(key []byte) (*data.LogRecordPos, error) {
+				return txn.Get(key), nil
+			}, txn.Put)
+		})
+	} else {
+		err = forEachHint(db.Index.Get, func(key []byte, pos *data.LogRecordPos) error {
+			_, err := db.Index.Put(key, pos)
+			return err
+		})
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+	return liveSize, staleSize, nil
 }
 
 /**
@@ -304,11 +660,11 @@ func (db *DB) getNoMergeFileId(dirPath string) (uint32, error) {
 func (db *DB) loadIndexFromHintFile() error {
 	// 判断 hint 文件是否存在
 	hintFileName := filepath.Join(db.Options.DirPath, data.HintFileName)
-	if _, err := os.Stat(hintFileName); os.IsNotExist(err) {
+	if _, err := db.Options.FileSystem.Stat(hintFileName); os.IsNotExist(err) {
 		return nil
 	}
 	// 打开 hint 索引文件
-	hintFile, err := data.OpenHintFile(db.Options.DirPath)
+	hintFile, err := data.OpenHintFile(db.Options.FileSystem, db.Options.DirPath)
 	if err != nil {
 		return err
 	}
@@ -328,7 +684,9 @@ func (db *DB) loadIndexFromHintFile() error {
 		}
 		// 解码拿到内存索引
 		pos := data.DecoderLogRecordPos(logRecord.Value)
-		db.Index.Put(logRecord.Key, pos)
+		if _, err := db.Index.Put(logRecord.Key, pos); err != nil {
+			return err
+		}
 		offset += size
 	}
 	return nil
@@ -3,8 +3,11 @@ package db
 import (
 	"github.com/stretchr/testify/assert"
 	"kv_projects/conf"
+	"kv_projects/data"
 	"kv_projects/errs"
+	"kv_projects/index"
 	"kv_projects/utils"
+	"os"
 	"path/filepath"
 	"sync"
 	"testing"
@@ -54,7 +57,8 @@ func TestDB_Merge2(t *testing.T) {
 		_ = db2.Close()
 	}()
 	assert.Nil(t, err)
-	keys := db2.ListKeys()
+	keys, err := db2.ListKeys()
+	assert.Nil(t, err)
 	t.Log(len(keys))
 	assert.Equal(t, 50000, len(keys))
 
@@ -105,7 +109,8 @@ func TestDB_Merge3(t *testing.T) {
 		_ = db2.Close()
 	}()
 	assert.Nil(t, err)
-	keys := db2.ListKeys()
+	keys, err := db2.ListKeys()
+	assert.Nil(t, err)
 	assert.Equal(t, 40000, len(keys))
 
 	for i := 0; i < 10000; i++ {
@@ -152,7 +157,8 @@ func TestDB_Merge4(t *testing.T) {
 		_ = db2.Close()
 	}()
 	assert.Nil(t, err)
-	keys := db2.ListKeys()
+	keys, err := db2.ListKeys()
+	assert.Nil(t, err)
 	assert.Equal(t, 0, len(keys))
 }
 
@@ -199,7 +205,8 @@ func TestDB_Merge5(t *testing.T) {
 		_ = db2.Close()
 	}()
 	assert.Nil(t, err)
-	keys := db2.ListKeys()
+	keys, err := db2.ListKeys()
+	assert.Nil(t, err)
 	assert.Equal(t, 10000, len(keys))
 
 	for i := 60000; i < 70000; i++ {
@@ -208,3 +215,242 @@ func TestDB_Merge5(t *testing.T) {
 		assert.NotNil(t, val)
 	}
 }
+
+// B+ 树索引 merge 之后重启，索引需要指向 merge 之后的新文件
+func TestDB_MergeBPTree(t *testing.T) {
+	opts := conf.DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-merge-bptree")
+	opts.DirPath = dir
+	opts.DataFileSize = 256 * 1024
+	opts.DataFileMergeRatio = 0
+	opts.IndexType = index.BPTree
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	for i := 0; i < 5000; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.GetTestValue(128)))
+	}
+	for i := 0; i < 1000; i++ {
+		assert.Nil(t, db.Delete(utils.GetTestKey(i)))
+	}
+	overwritten := make(map[int][]byte)
+	for i := 1000; i < 2000; i++ {
+		overwritten[i] = utils.GetTestValue(128)
+		assert.Nil(t, db.Put(utils.GetTestKey(i), overwritten[i]))
+	}
+	expected := make(map[int][]byte)
+	for i := 1000; i < 5000; i++ {
+		val, err := db.Get(utils.GetTestKey(i))
+		assert.Nil(t, err)
+		expected[i] = val
+	}
+
+	assert.Nil(t, db.Merge())
+	// merge 过程中以及之后的写入在新的文件中，不能被 merge 的结果覆盖
+	for i := 4000; i < 4500; i++ {
+		expected[i] = utils.GetTestValue(128)
+		assert.Nil(t, db.Put(utils.GetTestKey(i), expected[i]))
+	}
+	for i := 4500; i < 5000; i++ {
+		assert.Nil(t, db.Delete(utils.GetTestKey(i)))
+		delete(expected, i)
+	}
+	fileNum := mustStat(t, db).DataFileNum
+	assert.Nil(t, db.Close())
+
+	check := func(db *DB) {
+		for i := 0; i < 5000; i++ {
+			val, err := db.Get(utils.GetTestKey(i))
+			if expectedVal, ok := expected[i]; ok {
+				assert.Nil(t, err)
+				assert.Equal(t, expectedVal, val)
+			} else {
+				assert.Equal(t, errs.ErrKeyNotFound, err)
+			}
+		}
+		assert.Equal(t, uint(len(expected)), mustStat(t, db).KeyNum)
+	}
+
+	db2, err := Open(opts)
+	assert.Nil(t, err)
+	check(db2)
+	// merge 结果已经在线安装，重启时不需要再替换文件
+	assert.Equal(t, fileNum, mustStat(t, db2).DataFileNum)
+	_, err = os.Stat(db2.getMergePath())
+	assert.True(t, os.IsNotExist(err))
+	assert.Nil(t, db2.Close())
+
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	check(db)
+}
+
+// merge 在线安装，迭代器引用的旧文件在迭代器关闭之后才被删除
+func TestDB_MergeWithIterator(t *testing.T) {
+	opts := conf.DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-merge-iterator")
+	opts.DirPath = dir
+	opts.DataFileSize = 32 * 1024
+	opts.DataFileMergeRatio = 0
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	values := make(map[int][]byte)
+	for i := 0; i < 1000; i++ {
+		values[i] = utils.GetTestValue(64)
+		assert.Nil(t, db.Put(utils.GetTestKey(i), values[i]))
+	}
+	for i := 0; i < 500; i++ {
+		assert.Nil(t, db.Delete(utils.GetTestKey(i)))
+	}
+	oldFileName := data.GetDataFileName(dir, 0)
+
+	iter, err := db.NewUserIterator(conf.DefaultIteratorOptions)
+	assert.Nil(t, err)
+	assert.Nil(t, db.Merge())
+
+	// 旧文件还被迭代器引用，不会被删除
+	_, err = os.Stat(oldFileName)
+	assert.Nil(t, err)
+	count := 0
+	for iter.Rewind(); iter.Valid(); iter.Next() {
+		val, err := iter.Value()
+		assert.Nil(t, err)
+		assert.Equal(t, values[count+500], val)
+		count++
+	}
+	assert.Equal(t, 500, count)
+	assert.Nil(t, iter.Close())
+	_, err = os.Stat(oldFileName)
+	assert.True(t, os.IsNotExist(err))
+
+	// 不需要重启就可以读取 merge 之后的数据
+	for i := 0; i < 1000; i++ {
+		val, err := db.Get(utils.GetTestKey(i))
+		if i < 500 {
+			assert.Equal(t, errs.ErrKeyNotFound, err)
+		} else {
+			assert.Nil(t, err)
+			assert.Equal(t, values[i], val)
+		}
+	}
+	assert.Nil(t, db.Close())
+
+	db2, err := Open(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, uint(500), mustStat(t, db2).KeyNum)
+	for i := 500; i < 1000; i++ {
+		val, err := db2.Get(utils.GetTestKey(i))
+		assert.Nil(t, err)
+		assert.Equal(t, values[i], val)
+	}
+	assert.Nil(t, db2.Close())
+}
+
+// 旧文件被引用时进程退出，重启时删除残留的旧文件
+func TestDB_MergeObsoleteFilesAfterCrash(t *testing.T) {
+	opts := conf.DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-merge-obsolete")
+	opts.DirPath = dir
+	opts.DataFileSize = 32 * 1024
+	opts.DataFileMergeRatio = 0
+	db, err := Open(opts)
+	assert.Nil(t, err)
+
+	for i := 0; i < 1000; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.GetTestValue(64)))
+	}
+	for i := 0; i < 500; i++ {
+		assert.Nil(t, db.Delete(utils.GetTestKey(i)))
+	}
+	iter, err := db.NewUserIterator(conf.DefaultIteratorOptions)
+	assert.Nil(t, err)
+	assert.Nil(t, db.Merge())
+	_, mergeBaseFileId, err := db.getMergeFileIds(dir)
+	assert.Nil(t, err)
+	assert.True(t, mergeBaseFileId > 0)
+
+	// 模拟进程退出：迭代器没有关闭，旧文件仍然留在磁盘上
+	assert.Nil(t, db.Close())
+	_, err = os.Stat(data.GetDataFileName(dir, 0))
+	assert.Nil(t, err)
+
+	db2, err := Open(opts)
+	defer destroyDB(db2)
+	assert.Nil(t, err)
+	for fid := uint32(0); fid < mergeBaseFileId; fid++ {
+		_, err := os.Stat(data.GetDataFileName(dir, fid))
+		assert.True(t, os.IsNotExist(err))
+	}
+	assert.Equal(t, uint(500), mustStat(t, db2).KeyNum)
+	for i := 0; i < 1000; i++ {
+		_, err := db2.Get(utils.GetTestKey(i))
+		if i < 500 {
+			assert.Equal(t, errs.ErrKeyNotFound, err)
+		} else {
+			assert.Nil(t, err)
+		}
+	}
+	_ = iter
+}
+
+// merge、备份以及所有文件使用直接 IO
+func TestDB_MergeDirectIO(t *testing.T) {
+	for _, usage := range []conf.DirectIOUsage{conf.DirectIOMerge, conf.DirectIOBackup | conf.DirectIOMerge, conf.DirectIOAll} {
+		opts := conf.DefaultOptions
+		dir, _ := os.MkdirTemp("", "bitcask-go-merge-direct-io")
+		opts.DirPath = dir
+		opts.DataFileSize = 64 * 1024
+		opts.DataFileMergeRatio = 0
+		opts.DirectIO = usage
+		db, err := Open(opts)
+		assert.Nil(t, err)
+
+		values := make(map[int][]byte)
+		for i := 0; i < 2000; i++ {
+			values[i] = utils.GetTestValue(64)
+			assert.Nil(t, db.Put(utils.GetTestKey(i), values[i]))
+		}
+		for i := 0; i < 1000; i++ {
+			assert.Nil(t, db.Delete(utils.GetTestKey(i)))
+			delete(values, i)
+		}
+		check := func(db *DB) {
+			for i := 0; i < 2000; i++ {
+				val, err := db.Get(utils.GetTestKey(i))
+				if expected, ok := values[i]; ok {
+					assert.Nil(t, err)
+					assert.Equal(t, expected, val)
+				} else {
+					assert.Equal(t, errs.ErrKeyNotFound, err)
+				}
+			}
+		}
+		assert.Nil(t, db.Merge())
+		check(db)
+
+		backupDir, _ := os.MkdirTemp("", "bitcask-go-direct-io-backup")
+		assert.Nil(t, db.BackUp(backupDir))
+		backupOpts := opts
+		backupOpts.DirPath = backupDir
+		backupDB, err := Open(backupOpts)
+		assert.Nil(t, err)
+		check(backupDB)
+		destroyDB(backupDB)
+
+		assert.Nil(t, db.Close())
+		db2, err := Open(opts)
+		assert.Nil(t, err)
+		check(db2)
+		destroyDB(db2)
+	}
+
+	// 所有文件使用直接 IO 时不能使用 mmap 和写缓冲区
+	opts := conf.DefaultOptions
+	opts.DirectIO = conf.DirectIOAll
+	opts.MMapSealedFiles = true
+	_, err := Open(opts)
+	assert.NotNil(t, err)
+}
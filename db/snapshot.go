@@ -0,0 +1,257 @@
+package db
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"kv_projects/data"
+	"kv_projects/errs"
+	"kv_projects/fio"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+)
+
+// 索引快照文件格式：
+//
+//	header:  magic(8) | version(1) | fid(4) | offset(8) | seqNo(8) | reclaimSize(8)
+//	entries: keySize+1(uvarint) | key | fid(uvarint) | offset(varint) | size(uvarint)，最后以一个 0 字节结尾
+//	trailer: crc32(4)，校验前面所有的内容
+//
+// fid 和 offset 表示快照覆盖到的数据文件位置，打开数据库时只需要重放这个位置之后追加的记录
+const (
+	indexSnapshotMagic   = "KVIDXSNP"
+	indexSnapshotVersion = 1
+	indexSnapshotHeader  = len(indexSnapshotMagic) + 1 + 4 + 8 + 8 + 8
+)
+
+var errIndexSnapshotCorrupted = errors.New("index snapshot is corrupted")
+
+// 快照覆盖到的位置及当时的统计信息
+type indexSnapshotMeta struct {
+	fid         uint32
+	offset      int64
+	seqNo       uint64
+	reclaimSize int64
+}
+
+func (db *DB) indexSnapshotPath() string {
+	return filepath.Join(db.Options.DirPath, data.IndexSnapshotFileName)
+}
+
+/**
+ * removeIndexSnapshot
+ * @Description: 删除索引快照，数据文件被 merge 重写后快照中的位置信息就失效了
+ * @receiver db
+ * @return error
+ */
+func (db *DB) removeIndexSnapshot() error {
+	if err := db.Options.FileSystem.Remove(db.indexSnapshotPath()); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+/**
+ * writeIndexSnapshot
+ * @Description: 将内存索引的内容写入快照文件，调用方需要持有写锁。先写入临时文件再重命名，保证快照文件要么完整要么不存在
+ * @receiver db
+ * @return error
+ */
+func (db *DB) writeIndexSnapshot() error {
+	iter, err := db.Index.Iterator(false)
+	if err == errs.ErrIteratorNotSupported {
+		// 不支持遍历的索引无法生成快照，旧的快照也不能再使用
+		return db.removeIndexSnapshot()
+	}
+	if err != nil {
+		return err
+	}
+	defer iter.Close()
+
+	tmpPath := db.indexSnapshotPath() + ".tmp"
+	file, err := db.Options.FileSystem.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = file.Close()
+		_ = db.Options.FileSystem.Remove(tmpPath)
+	}()
+
+	crc := crc32.NewIEEE()
+	writer := bufio.NewWriterSize(io.MultiWriter(file, crc), 64*1024)
+
+	header := make([]byte, indexSnapshotHeader)
+	n := copy(header, indexSnapshotMagic)
+	header[n] = indexSnapshotVersion
+	n++
+	binary.LittleEndian.PutUint32(header[n:], db.ActiveFile.FileId)
+	n += 4
+	binary.LittleEndian.PutUint64(header[n:], uint64(db.ActiveFile.WriteOffset))
+	n += 8
+	binary.LittleEndian.PutUint64(header[n:], db.SeqNo)
+	n += 8
+	binary.LittleEndian.PutUint64(header[n:], uint64(atomic.LoadInt64(&db.ReclaimSize)))
+	if _, err := writer.Write(header); err != nil {
+		return err
+	}
+
+	buf := make([]byte, 3*binary.MaxVarintLen64)
+	for iter.Rewind(); iter.Valid(); iter.Next() {
+		key, pos := iter.Key(), iter.Value()
+		// 长度为 0 的 key 和结束标记区分开，长度统一加 1
+		n := binary.PutUvarint(buf, uint64(len(key))+1)
+		if _, err := writer.Write(buf[:n]); err != nil {
+			return err
+		}
+		if _, err := writer.Write(key); err != nil {
+			return err
+		}
+		n = binary.PutUvarint(buf, uint64(pos.Fid))
+		n += binary.PutVarint(buf[n:], pos.Offset)
+		n += binary.PutUvarint(buf[n:], uint64(pos.Size))
+		if _, err := writer.Write(buf[:n]); err != nil {
+			return err
+		}
+	}
+	if err := writer.WriteByte(0); err != nil {
+		return err
+	}
+	if err := writer.Flush(); err != nil {
+		return err
+	}
+
+	trailer := make([]byte, 4)
+	binary.LittleEndian.PutUint32(trailer, crc.Sum32())
+	if _, err := file.Write(trailer); err != nil {
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return db.Options.FileSystem.Rename(tmpPath, db.indexSnapshotPath())
+}
+
+/**
+ * loadIndexSnapshot
+ * @Description: 从快照文件加载内存索引。快照不存在、损坏或者和数据文件对不上时返回 nil，由调用方走原来的重建流程
+ * @receiver db
+ * @return *indexSnapshotMeta 快照覆盖到的位置
+ * @return error
+ */
+func (db *DB) loadIndexSnapshot() (*indexSnapshotMeta, error) {
+	file, err := db.Options.FileSystem.OpenFile(db.indexSnapshotPath(), os.O_RDONLY, 0)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+
+	meta, err := db.decodeIndexSnapshot(file)
+	if err == nil && !db.indexSnapshotMatchesFiles(meta) {
+		err = errIndexSnapshotCorrupted
+	}
+	if err != nil {
+		// 快照中的部分数据可能已经写入索引，重新创建一个空的索引
+		_ = db.Index.Close()
+		if db.Index, err = db.newIndexer(); err != nil {
+			return nil, err
+		}
+		return nil, nil
+	}
+	return meta, nil
+}
+
+// 解析快照内容并写入索引
+func (db *DB) decodeIndexSnapshot(file fio.File) (*indexSnapshotMeta, error) {
+	stat, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if stat.Size() < int64(indexSnapshotHeader)+1+4 {
+		return nil, errIndexSnapshotCorrupted
+	}
+	crc := crc32.NewIEEE()
+	// 最后 4 个字节是校验值，不参与计算，其余内容在读取的同时计算校验值
+	reader := bufio.NewReaderSize(io.TeeReader(io.LimitReader(file, stat.Size()-4), crc), 64*1024)
+
+	header := make([]byte, indexSnapshotHeader)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return nil, errIndexSnapshotCorrupted
+	}
+	n := len(indexSnapshotMagic)
+	if string(header[:n]) != indexSnapshotMagic || header[n] != indexSnapshotVersion {
+		return nil, errIndexSnapshotCorrupted
+	}
+	n++
+	meta := &indexSnapshotMeta{}
+	meta.fid = binary.LittleEndian.Uint32(header[n:])
+	n += 4
+	meta.offset = int64(binary.LittleEndian.Uint64(header[n:]))
+	n += 8
+	meta.seqNo = binary.LittleEndian.Uint64(header[n:])
+	n += 8
+	meta.reclaimSize = int64(binary.LittleEndian.Uint64(header[n:]))
+
+	for {
+		keySize, err := binary.ReadUvarint(reader)
+		if err != nil {
+			return nil, errIndexSnapshotCorrupted
+		}
+		if keySize == 0 {
+			break
+		}
+		key := make([]byte, keySize-1)
+		if _, err := io.ReadFull(reader, key); err != nil {
+			return nil, errIndexSnapshotCorrupted
+		}
+		fid, err1 := binary.ReadUvarint(reader)
+		offset, err2 := binary.ReadVarint(reader)
+		size, err3 := binary.ReadUvarint(reader)
+		if err1 != nil || err2 != nil || err3 != nil {
+			return nil, errIndexSnapshotCorrupted
+		}
+		if _, err := db.Index.Put(key, &data.LogRecordPos{Fid: uint32(fid), Offset: offset, Size: uint32(size)}); err != nil {
+			return nil, err
+		}
+	}
+	// 结束标记之后不应该还有数据
+	if _, err := reader.ReadByte(); err != io.EOF {
+		return nil, errIndexSnapshotCorrupted
+	}
+
+	trailer := make([]byte, 4)
+	if _, err := file.ReadAt(trailer, stat.Size()-4); err != nil {
+		return nil, errIndexSnapshotCorrupted
+	}
+	if binary.LittleEndian.Uint32(trailer) != crc.Sum32() {
+		return nil, errIndexSnapshotCorrupted
+	}
+	return meta, nil
+}
+
+// 快照覆盖到的文件必须还存在，并且没有被截断，否则说明快照已经过期
+func (db *DB) indexSnapshotMatchesFiles(meta *indexSnapshotMeta) bool {
+	if len(db.FileIds) == 0 {
+		return false
+	}
+	dataFile := db.getDataFile(meta.fid)
+	if dataFile == nil {
+		return false
+	}
+	size, err := dataFile.Size()
+	if err != nil {
+		return false
+	}
+	return size >= meta.offset
+}
@@ -0,0 +1,139 @@
+package db
+
+import (
+	"github.com/stretchr/testify/assert"
+	"kv_projects/conf"
+	"kv_projects/data"
+	"kv_projects/errs"
+	"kv_projects/index"
+	"kv_projects/utils"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// 模拟进程崩溃：不调用 Close，直接释放文件句柄和文件锁
+func crashDB(db *DB) {
+	_ = db.ActiveFile.Close()
+	for _, file := range db.OlderFiles {
+		_ = file.Close()
+	}
+	_ = db.Index.Close()
+	_ = db.FileLock.Unlock()
+}
+
+// 修改文件中指定位置的一个字节
+func flipByte(t *testing.T, path string, offset int64) {
+	file, err := os.OpenFile(path, os.O_RDWR, 0644)
+	assert.Nil(t, err)
+	defer file.Close()
+	b := make([]byte, 1)
+	_, err = file.ReadAt(b, offset)
+	assert.Nil(t, err)
+	b[0] ^= 0xff
+	_, err = file.WriteAt(b, offset)
+	assert.Nil(t, err)
+}
+
+func TestDB_IndexSnapshot(t *testing.T) {
+	for _, tp := range []index.IndexType{index.Btree, index.ART, index.SkipList} {
+		opts := conf.DefaultOptions
+		dir, _ := os.MkdirTemp("", "bitcask-go-snapshot")
+		opts.DirPath = dir
+		opts.DataFileSize = 32 * 1024
+		opts.IndexType = tp
+		db, err := Open(opts)
+		assert.Nil(t, err)
+
+		for i := 0; i < 1000; i++ {
+			assert.Nil(t, db.Put(utils.GetTestKey(i), utils.GetTestValue(64)))
+		}
+		for i := 0; i < 100; i++ {
+			assert.Nil(t, db.Delete(utils.GetTestKey(i)))
+		}
+		val, err := db.Get(utils.GetTestKey(500))
+		assert.Nil(t, err)
+		reclaimSize := mustStat(t, db).ReclaimSize
+		assert.Nil(t, db.Close())
+		_, err = os.Stat(filepath.Join(dir, data.IndexSnapshotFileName))
+		assert.Nil(t, err)
+
+		// 破坏第一个数据文件中的第一条记录，重新遍历数据文件会因为校验失败而报错，
+		// 能正常打开说明索引是从快照加载的
+		flipByte(t, data.GetDataFileName(dir, 0), 20)
+		db2, err := Open(opts)
+		assert.Nil(t, err)
+		assert.Equal(t, uint(900), mustStat(t, db2).KeyNum)
+		assert.Equal(t, reclaimSize, mustStat(t, db2).ReclaimSize)
+		val2, err := db2.Get(utils.GetTestKey(500))
+		assert.Nil(t, err)
+		assert.Equal(t, val, val2)
+		_, err = db2.Get(utils.GetTestKey(50))
+		assert.Equal(t, errs.ErrKeyNotFound, err)
+		flipByte(t, data.GetDataFileName(dir, 0), 20)
+
+		// 快照之后追加的记录在下次打开时重放，即使没有正常关闭
+		for i := 1000; i < 1100; i++ {
+			assert.Nil(t, db2.Put(utils.GetTestKey(i), utils.GetTestValue(64)))
+		}
+		assert.Nil(t, db2.Delete(utils.GetTestKey(500)))
+		wb := db2.NewWriteBatch(&conf.DefaultWriteBatchOptions)
+		assert.Nil(t, wb.Put([]byte("txn-key"), []byte("txn-value")))
+		assert.Nil(t, wb.Commit())
+		seqNo := db2.SeqNo
+		crashDB(db2)
+
+		db3, err := Open(opts)
+		assert.Nil(t, err)
+		assert.Equal(t, uint(1000), mustStat(t, db3).KeyNum)
+		assert.Equal(t, seqNo, db3.SeqNo)
+		_, err = db3.Get(utils.GetTestKey(500))
+		assert.Equal(t, errs.ErrKeyNotFound, err)
+		val3, err := db3.Get([]byte("txn-key"))
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("txn-value"), val3)
+		assert.Nil(t, db3.Close())
+
+		// 快照损坏时回退到遍历数据文件重建索引
+		snapshotPath := filepath.Join(dir, data.IndexSnapshotFileName)
+		flipByte(t, snapshotPath, 100)
+		db4, err := Open(opts)
+		assert.Nil(t, err)
+		assert.Equal(t, uint(1000), mustStat(t, db4).KeyNum)
+		destroyDB(db4)
+	}
+}
+
+func TestDB_IndexSnapshotAfterMerge(t *testing.T) {
+	opts := conf.DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-snapshot-merge")
+	opts.DirPath = dir
+	opts.DataFileSize = 32 * 1024
+	opts.DataFileMergeRatio = 0
+	db, err := Open(opts)
+	assert.Nil(t, err)
+
+	for i := 0; i < 1000; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.GetTestValue(64)))
+	}
+	for i := 0; i < 500; i++ {
+		assert.Nil(t, db.Delete(utils.GetTestKey(i)))
+	}
+	assert.Nil(t, db.Merge())
+	// merge 结果在线安装时丢弃旧的快照，关闭时写入的快照描述的是 merge 之后的数据文件
+	assert.Nil(t, db.Close())
+
+	db2, err := Open(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, uint(500), mustStat(t, db2).KeyNum)
+	for i := 500; i < 1000; i++ {
+		_, err := db2.Get(utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+	assert.Nil(t, db2.Close())
+
+	db3, err := Open(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, uint(500), mustStat(t, db3).KeyNum)
+	destroyDB(db3)
+}
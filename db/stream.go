@@ -0,0 +1,144 @@
+package db
+
+import (
+	"bytes"
+	"io"
+	"kv_projects/data"
+	"kv_projects/errs"
+)
+
+/**
+ * PutStream
+ * @Description: 从 r 中读取 size 字节作为 key 的 value 写入，value 分块写入数据文件，不需要一次性放在内存中。
+ * r 中的数据不足 size 时返回 io.ErrUnexpectedEOF，数据库中不会留下这条记录。
+ * 读取 r 期间其他写操作（包括 Sync、Merge、Close、BackUp）会等待 r 读完，Get、GetStream、迭代器等读操作不受影响
+ * @receiver db
+ * @param key
+ * @param r
+ * @param size value 的长度
+ * @return error key 或 value 超过记录长度上限时返回 errs.ErrKeyTooLarge 或 errs.ErrValueTooLarge
+ */
+func (db *DB) PutStream(key []byte, r io.Reader, size int64) error {
+	if len(key) == 0 {
+		return errs.ErrKeyIsEmpty
+	}
+	realKey := logRecordKeyWithSeq(key, nonTransactionSeqNo)
+	// 在读取 r 之前检查长度，超过上限的 value 不会被读取
+	if err := data.CheckLogRecordSize(int64(len(realKey)), size); err != nil {
+		return err
+	}
+
+	// 写入期间一直持有追加锁，其他写操作不会插入到这条记录中间
+	db.appendMu.Lock()
+	defer db.appendMu.Unlock()
+
+	// 切换活跃文件会替换 IO 管理器，需要持有写锁
+	recordSize := data.StreamedLogRecordSize(int64(len(realKey)), size)
+	db.Mutex.Lock()
+	err := db.prepareActiveFile(recordSize)
+	activeFile := db.ActiveFile
+	db.Mutex.Unlock()
+	if err != nil {
+		return err
+	}
+
+	// 读取 r 时不持有 Mutex，读操作可以同时进行，记录写完之前不会出现在索引中
+	writeOffset := activeFile.WriteOffset
+	if err := activeFile.WriteStream(realKey, r, size); err != nil {
+		return err
+	}
+
+	db.Mutex.Lock()
+	defer db.Mutex.Unlock()
+	pos, err := db.finishAppend(recordSize, writeOffset)
+	if err != nil {
+		return err
+	}
+	oldValue, err := db.Index.Put(key, pos)
+	if err != nil {
+		return err
+	}
+	if oldValue != nil {
+		db.addReclaimSize(int64(oldValue.Size))
+	}
+	return nil
+}
+
+/**
+ * GetStream
+ * @Description: 流式读取 key 对应的 value，读到末尾时校验整条记录，数据损坏时返回 errs.ErrInvalidCRC。
+ * 读取期间 value 所在的文件不会被 merge 删除，使用完之后需要调用 Close
+ * @receiver db
+ * @param key
+ * @return io.ReadCloser
+ * @return error
+ */
+func (db *DB) GetStream(key []byte) (io.ReadCloser, error) {
+	if len(key) == 0 {
+		return nil, errs.ErrKeyIsEmpty
+	}
+	db.Mutex.RLock()
+	defer db.Mutex.RUnlock()
+
+	logRecordPos, err := db.Index.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	if logRecordPos == nil {
+		return nil, errs.ErrKeyNotFound
+	}
+	// 缓存中的数据不能被调用方修改，所以返回拷贝
+	if db.ValueCache != nil {
+		if value, ok := db.ValueCache.Get(logRecordPos); ok {
+			return io.NopCloser(bytes.NewReader(append([]byte(nil), value...))), nil
+		}
+	}
+	dataFile := db.getDataFile(logRecordPos.Fid)
+	if dataFile == nil {
+		return nil, errs.ErrDataFileNotFound
+	}
+	valueReader, err := dataFile.OpenValueReader(logRecordPos.Offset)
+	if err != nil {
+		return nil, err
+	}
+	return &valueStream{db: db, ValueReader: valueReader}, nil
+}
+
+/**
+ * appendStreamFromWithLock
+ * @Description: 将 src 中 offset 位置记录的 value 和新的 key 分块写入活跃文件，读取时校验原来的记录，
+ * merge 复制大的 value 时使用，不需要把整个 value 读入内存
+ * @receiver db
+ * @param key
+ * @param src
+ * @param offset
+ * @return *data.LogRecordPos
+ * @return error
+ */
+func (db *DB) appendStreamFromWithLock(key []byte, src *data.DataFile, offset int64) (*data.LogRecordPos, error) {
+	valueReader, err := src.OpenValueReader(offset)
+	if err != nil {
+		return nil, err
+	}
+	defer valueReader.Close()
+
+	db.lock()
+	defer db.unlock()
+	recordSize := data.StreamedLogRecordSize(int64(len(key)), valueReader.Size())
+	return db.appendToActiveFile(recordSize, func(dataFile *data.DataFile) error {
+		return dataFile.WriteStreamFrom(key, valueReader)
+	})
+}
+
+// valueStream
+// @Description: 每次读取时持有读锁，活跃文件被封存时会替换 IO 管理器，不能和读取同时进行
+type valueStream struct {
+	db *DB
+	*data.ValueReader
+}
+
+func (s *valueStream) Read(b []byte) (int, error) {
+	s.db.Mutex.RLock()
+	defer s.db.Mutex.RUnlock()
+	return s.ValueReader.Read(b)
+}
@@ -0,0 +1,246 @@
+package db
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"kv_projects/conf"
+	"kv_projects/data"
+	"kv_projects/errs"
+	"kv_projects/utils"
+	"math/rand"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestDB_PutStream(t *testing.T) {
+	opts := conf.DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-stream")
+	opts.DirPath = dir
+	opts.DataFileSize = 256 * 1024
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	rng := rand.New(rand.NewSource(1))
+	values := make(map[string][]byte)
+	// 跨越多个块的 value，以及超过数据文件大小的 value
+	for i, size := range []int{0, 100, 100 * 1024, 600 * 1024} {
+		key := utils.GetTestKey(i)
+		value := make([]byte, size)
+		rng.Read(value)
+		err = db.PutStream(key, bytes.NewReader(value), int64(size))
+		assert.Nil(t, err)
+		values[string(key)] = value
+	}
+	err = db.Put(utils.GetTestKey(10), utils.GetTestValue(128))
+	assert.Nil(t, err)
+
+	checkValues := func(db *DB) {
+		for key, value := range values {
+			r, err := db.GetStream([]byte(key))
+			assert.Nil(t, err)
+			got, err := io.ReadAll(r)
+			assert.Nil(t, err)
+			assert.Equal(t, value, got)
+			assert.Nil(t, r.Close())
+
+			got, err = db.Get([]byte(key))
+			assert.Nil(t, err)
+			assert.Equal(t, len(value), len(got))
+		}
+		val, err := db.Get(utils.GetTestKey(10))
+		assert.Nil(t, err)
+		assert.NotNil(t, val)
+	}
+	checkValues(db)
+
+	// 数据不足时不会写入
+	err = db.PutStream(utils.GetTestKey(20), bytes.NewReader(make([]byte, 10)), 100)
+	assert.Equal(t, io.ErrUnexpectedEOF, err)
+	_, err = db.GetStream(utils.GetTestKey(20))
+	assert.Equal(t, errs.ErrKeyNotFound, err)
+	// 超过上限的 value 不会读取 r
+	err = db.PutStream(utils.GetTestKey(20), iotestErrReader{}, 1<<32)
+	assert.Equal(t, errs.ErrValueTooLarge, err)
+	err = db.PutStream(nil, bytes.NewReader(nil), 0)
+	assert.Equal(t, errs.ErrKeyIsEmpty, err)
+
+	// 重启之后
+	err = db.Close()
+	assert.Nil(t, err)
+	db2, err := Open(opts)
+	defer destroyDB(db2)
+	assert.Nil(t, err)
+	checkValues(db2)
+
+	// 覆盖最大的 value 之后 merge
+	err = db2.PutStream(utils.GetTestKey(3), bytes.NewReader([]byte("new")), 3)
+	assert.Nil(t, err)
+	values[string(utils.GetTestKey(3))] = []byte("new")
+	err = db2.Merge()
+	assert.Nil(t, err)
+	checkValues(db2)
+}
+
+func TestDB_PutStreamConcurrentRead(t *testing.T) {
+	opts := conf.DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-stream-read")
+	opts.DirPath = dir
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+	assert.Nil(t, db.Put(utils.GetTestKey(1), []byte("value")))
+
+	// r 读完第一块之后阻塞
+	value := make([]byte, 3*data.StreamChunkSize)
+	rand.New(rand.NewSource(3)).Read(value)
+	pr, pw := io.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		done <- db.PutStream(utils.GetTestKey(2), pr, int64(len(value)))
+	}()
+	_, err = pw.Write(value[:data.StreamChunkSize])
+	assert.Nil(t, err)
+
+	// 读操作不需要等待 PutStream，还没有写完的 key 读取不到
+	type result struct {
+		value []byte
+		err   error
+	}
+	reads := make(chan result, 2)
+	go func() {
+		for _, key := range [][]byte{utils.GetTestKey(1), utils.GetTestKey(2)} {
+			val, err := db.Get(key)
+			reads <- result{val, err}
+		}
+	}()
+	for _, expected := range []result{{[]byte("value"), nil}, {nil, errs.ErrKeyNotFound}} {
+		select {
+		case res := <-reads:
+			assert.Equal(t, expected, res)
+		case <-time.After(5 * time.Second):
+			t.Fatal("Get is blocked by PutStream")
+		}
+	}
+
+	_, err = pw.Write(value[data.StreamChunkSize:])
+	assert.Nil(t, err)
+	assert.Nil(t, <-done)
+	got, err := db.Get(utils.GetTestKey(2))
+	assert.Nil(t, err)
+	assert.Equal(t, value, got)
+}
+
+func TestDB_MergeLargeValues(t *testing.T) {
+	for _, mmapAtStartUp := range []bool{true, false} {
+		opts := conf.DefaultOptions
+		dir, _ := os.MkdirTemp("", "bitcask-go-merge-large")
+		opts.DirPath = dir
+		opts.DataFileSize = 512 * 1024
+		opts.MMapAtStartUp = mmapAtStartUp
+		db, err := Open(opts)
+		assert.Nil(t, err)
+		assert.NotNil(t, db)
+
+		rng := rand.New(rand.NewSource(2))
+		values := make(map[string][]byte)
+		// 大于读取块大小的 value，分别通过 PutStream 和 Put 写入
+		for i, size := range []int{3*data.StreamChunkSize + 1, 2 * data.StreamChunkSize, 128} {
+			value := make([]byte, size)
+			rng.Read(value)
+			assert.Nil(t, db.PutStream(utils.GetTestKey(i), bytes.NewReader(value), int64(size)))
+			values[string(utils.GetTestKey(i))] = value
+			value = append([]byte(nil), value...)
+			value[0]++
+			assert.Nil(t, db.Put(utils.GetTestKey(i+10), value))
+			values[string(utils.GetTestKey(i+10))] = value
+		}
+		// 产生足够多的无效数据
+		for i := 0; i < 4; i++ {
+			assert.Nil(t, db.PutStream(utils.GetTestKey(20), bytes.NewReader(make([]byte, 300*1024)), 300*1024))
+		}
+		assert.Nil(t, db.Delete(utils.GetTestKey(20)))
+
+		checkValues := func(db *DB) {
+			for key, value := range values {
+				got, err := db.Get([]byte(key))
+				assert.Nil(t, err)
+				assert.Equal(t, value, got)
+			}
+			_, err := db.Get(utils.GetTestKey(20))
+			assert.Equal(t, errs.ErrKeyNotFound, err)
+		}
+		assert.Nil(t, db.Merge())
+		checkValues(db)
+
+		// 重启之后从 hint 文件和数据文件重建索引
+		assert.Nil(t, db.Close())
+		db2, err := Open(opts)
+		assert.Nil(t, err)
+		checkValues(db2)
+		// 再次 merge 和重启，复制的是 merge 流式写入的记录
+		assert.Nil(t, db2.Put(utils.GetTestKey(0), []byte("new")))
+		values[string(utils.GetTestKey(0))] = []byte("new")
+		for i := 0; i < 4; i++ {
+			assert.Nil(t, db2.Put(utils.GetTestKey(21), utils.GetTestValue(200*1024)))
+		}
+		assert.Nil(t, db2.Delete(utils.GetTestKey(21)))
+		assert.Nil(t, db2.Merge())
+		checkValues(db2)
+		assert.Nil(t, db2.Close())
+		db3, err := Open(opts)
+		assert.Nil(t, err)
+		checkValues(db3)
+		destroyDB(db3)
+	}
+}
+
+func TestDB_GetStream(t *testing.T) {
+	opts := conf.DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-getstream")
+	opts.DirPath = dir
+	opts.ValueCacheSize = 1024 * 1024
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	_, err = db.GetStream(utils.GetTestKey(1))
+	assert.Equal(t, errs.ErrKeyNotFound, err)
+	_, err = db.GetStream(nil)
+	assert.Equal(t, errs.ErrKeyIsEmpty, err)
+
+	val := utils.GetTestValue(128)
+	err = db.Put(utils.GetTestKey(1), val)
+	assert.Nil(t, err)
+	// 第二次从缓存中读取
+	for i := 0; i < 2; i++ {
+		r, err := db.GetStream(utils.GetTestKey(1))
+		assert.Nil(t, err)
+		got, err := io.ReadAll(r)
+		assert.Nil(t, err)
+		assert.Equal(t, val, got)
+		assert.Nil(t, r.Close())
+		_, _ = db.Get(utils.GetTestKey(1))
+	}
+
+	// 读取期间写入新的数据
+	r, err := db.GetStream(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	err = db.Put(utils.GetTestKey(1), utils.GetTestValue(128))
+	assert.Nil(t, err)
+	got, err := io.ReadAll(r)
+	assert.Nil(t, err)
+	assert.Equal(t, val, got)
+	assert.Nil(t, r.Close())
+}
+
+type iotestErrReader struct{}
+
+func (iotestErrReader) Read([]byte) (int, error) {
+	panic("should not read")
+}
@@ -0,0 +1,328 @@
+package db
+
+import (
+	"encoding/binary"
+	"io"
+	"kv_projects/data"
+	"kv_projects/errs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync/atomic"
+)
+
+// 两阶段提交参与者的流程：
+//  1. Prepare：事务数据带上事务序列号写入数据文件，但不写入事务完成的标志，数据落盘后在 txn-prepared 文件中记录准备信息
+//  2. CommitPrepared：写入事务完成的标志并更新索引；AbortPrepared：不写标志，数据在重启时被忽略
+//  3. 两种情况最后都在 txn-prepared 文件中记录事务已经结束
+// 重启时 txn-prepared 中没有结束的事务由协调者日志决定提交还是回滚
+
+// 已经准备、等待提交或回滚的事务
+type preparedTxn struct {
+	seqNo   uint64
+	records []*data.TransactionLogRecord // 已经写入数据文件的数据及其位置
+	locks   *KeyLocks                    // 批次持有的 key 锁，事务结束时释放
+}
+
+/**
+ * Prepare
+ * @Description: 两阶段提交的准备阶段，将暂存的数据写入数据文件并落盘，但是数据在 CommitPrepared 之前不可见。
+ * 准备成功后暂存区被清空，批次持有的 key 锁转交给准备的事务，在提交或回滚时释放；准备失败时和 Commit 一样释放 key 锁
+ * @receiver wt
+ * @param txnId 全局事务 id，由协调者分配，同一个数据库中同时只能有一个相同 id 的事务
+ * @return error
+ */
+func (wt *WriteBatch) Prepare(txnId uint64) (err error) {
+	wt.mu.Lock()
+	defer wt.mu.Unlock()
+	defer func() {
+		if err != nil {
+			wt.unlockKeys()
+		}
+	}()
+	if uint(len(wt.pendingWrites)) > wt.options.MaxBatchNum {
+		return errs.ErrExceedMaxBatchNum
+	}
+
+	wt.db.lock()
+	defer wt.db.unlock()
+	if _, ok := wt.db.preparedTxns[txnId]; ok {
+		return errs.ErrTxnAlreadyPrepared
+	}
+
+	seqNo := atomic.AddUint64(&wt.db.SeqNo, 1)
+	records, err := wt.appendPendingWrites(seqNo)
+	if err != nil {
+		return err
+	}
+	// 准备阶段的数据必须在记录准备信息之前落盘
+	if wt.db.ActiveFile != nil {
+		if err := wt.db.ActiveFile.Sync(); err != nil {
+			return err
+		}
+	}
+	if err := wt.db.writePreparedTxnRecord(txnId, data.LogRecordNormal, encodePreparedTxn(seqNo, records)); err != nil {
+		return err
+	}
+
+	wt.db.preparedTxns[txnId] = &preparedTxn{seqNo: seqNo, records: records, locks: wt.locks}
+	wt.locks = nil
+	wt.reset()
+	return nil
+}
+
+/**
+ * CommitPrepared
+ * @Description: 提交已经准备的事务，写入事务完成的标志并更新索引。失败时事务仍然处于准备状态，可以重试
+ * @receiver db
+ * @param txnId
+ * @return error
+ */
+func (db *DB) CommitPrepared(txnId uint64) error {
+	db.lock()
+	defer db.unlock()
+	txn, ok := db.preparedTxns[txnId]
+	if !ok {
+		return errs.ErrTxnNotPrepared
+	}
+	if err := db.commitPreparedTxn(txnId, txn); err != nil {
+		return err
+	}
+	if txn.locks != nil {
+		txn.locks.Unlock()
+	}
+	return nil
+}
+
+/**
+ * AbortPrepared
+ * @Description: 回滚已经准备的事务，写入数据文件的数据没有事务完成的标志，重启时会被忽略
+ * @receiver db
+ * @param txnId
+ * @return error
+ */
+func (db *DB) AbortPrepared(txnId uint64) error {
+	db.lock()
+	defer db.unlock()
+	txn, ok := db.preparedTxns[txnId]
+	if !ok {
+		return errs.ErrTxnNotPrepared
+	}
+	if err := db.abortPreparedTxn(txnId, txn); err != nil {
+		return err
+	}
+	if txn.locks != nil {
+		txn.locks.Unlock()
+	}
+	return nil
+}
+
+// 提交已经准备的事务，调用方必须持有写锁
+func (db *DB) commitPreparedTxn(txnId uint64, txn *preparedTxn) error {
+	if err := db.appendTxnFinished(txn.seqNo); err != nil {
+		return err
+	}
+	if err := db.ActiveFile.Sync(); err != nil {
+		return err
+	}
+	if err := db.applyTxnRecords(db.SeqNo, txn.records); err != nil {
+		return err
+	}
+	// 事务结束的记录落盘之后才能有新的写入，否则重启时重新提交会覆盖之后写入的数据
+	if err := db.writePreparedTxnRecord(txnId, data.LogRecordTxnFinished, nil); err != nil {
+		return err
+	}
+	delete(db.preparedTxns, txnId)
+	return nil
+}
+
+// 回滚已经准备的事务，调用方必须持有写锁
+func (db *DB) abortPreparedTxn(txnId uint64, txn *preparedTxn) error {
+	if err := db.writePreparedTxnRecord(txnId, data.LogRecordTxnFinished, nil); err != nil {
+		return err
+	}
+	// 写入数据文件的事务数据全部成为无效数据
+	for _, record := range txn.records {
+		db.addReclaimSize(int64(record.Pos.Size))
+	}
+	delete(db.preparedTxns, txnId)
+	return nil
+}
+
+/**
+ * writePreparedTxnRecord
+ * @Description: 在 txn-prepared 文件中追加一条记录并落盘，调用方必须持有写锁
+ * @receiver db
+ * @param txnId
+ * @param recordType data.LogRecordNormal 表示事务已经准备，data.LogRecordTxnFinished 表示事务已经结束
+ * @param value 事务准备信息
+ * @return error
+ */
+func (db *DB) writePreparedTxnRecord(txnId uint64, recordType data.LogRecordType, value []byte) error {
+	if db.preparedTxnFile == nil {
+		preparedTxnFile, err := data.OpenPreparedTxnFile(db.Options.FileSystem, db.Options.DirPath)
+		if err != nil {
+			return err
+		}
+		db.preparedTxnFile = preparedTxnFile
+	}
+	record, _ := data.EncoderLogRecord(&data.LogRecord{
+		Key:   []byte(strconv.FormatUint(txnId, 10)),
+		Value: value,
+		Type:  recordType,
+	})
+	if err := db.preparedTxnFile.Write(record); err != nil {
+		return err
+	}
+	return db.preparedTxnFile.Sync()
+}
+
+// 编码事务序列号以及事务中每条数据的类型、key 和位置
+func encodePreparedTxn(seqNo uint64, records []*data.TransactionLogRecord) []byte {
+	buf := binary.AppendUvarint(nil, seqNo)
+	buf = binary.AppendUvarint(buf, uint64(len(records)))
+	for _, record := range records {
+		pos := data.EncoderLogRecordPos(record.Pos)
+		buf = append(buf, record.Record.Type)
+		buf = binary.AppendUvarint(buf, uint64(len(record.Record.Key)))
+		buf = append(buf, record.Record.Key...)
+		buf = binary.AppendUvarint(buf, uint64(len(pos)))
+		buf = append(buf, pos...)
+	}
+	return buf
+}
+
+func decodePreparedTxn(buf []byte) (*preparedTxn, error) {
+	// 读取一个长度前缀的字段
+	readBytes := func() ([]byte, bool) {
+		size, n := binary.Uvarint(buf)
+		if n <= 0 || uint64(len(buf)-n) < size {
+			return nil, false
+		}
+		b := buf[n : n+int(size)]
+		buf = buf[n+int(size):]
+		return b, true
+	}
+	seqNo, n := binary.Uvarint(buf)
+	if n <= 0 {
+		return nil, errs.ErrDataDirectoryCorrupted
+	}
+	buf = buf[n:]
+	count, n := binary.Uvarint(buf)
+	if n <= 0 {
+		return nil, errs.ErrDataDirectoryCorrupted
+	}
+	buf = buf[n:]
+
+	txn := &preparedTxn{seqNo: seqNo}
+	for i := uint64(0); i < count; i++ {
+		if len(buf) == 0 {
+			return nil, errs.ErrDataDirectoryCorrupted
+		}
+		recordType := buf[0]
+		buf = buf[1:]
+		key, ok := readBytes()
+		if !ok {
+			return nil, errs.ErrDataDirectoryCorrupted
+		}
+		pos, ok := readBytes()
+		if !ok {
+			return nil, errs.ErrDataDirectoryCorrupted
+		}
+		txn.records = append(txn.records, &data.TransactionLogRecord{
+			Record: &data.LogRecord{Key: key, Type: recordType},
+			Pos:    data.DecoderLogRecordPos(pos),
+		})
+	}
+	return txn, nil
+}
+
+/**
+ * recoverPreparedTxns
+ * @Description: 启动时处理上次没有结束的已准备事务：协调者日志中有提交决定的事务重新提交，其余的回滚。
+ * 全部处理完成后删除 txn-prepared 文件
+ * @receiver db
+ * @return error 存在未结束的事务但是没有配置协调者日志目录时返回 errs.ErrInDoubtTxn
+ */
+func (db *DB) recoverPreparedTxns() error {
+	fileName := filepath.Join(db.Options.DirPath, data.PreparedTxnFileName)
+	if _, err := db.Options.FileSystem.Stat(fileName); os.IsNotExist(err) {
+		return nil
+	}
+	preparedTxnFile, err := data.OpenPreparedTxnFile(db.Options.FileSystem, db.Options.DirPath)
+	if err != nil {
+		return err
+	}
+	db.preparedTxnFile = preparedTxnFile
+
+	var offset int64 = 0
+	for {
+		logRecord, size, err := preparedTxnFile.ReadLogRecord(offset)
+		if err != nil {
+			// 文件末尾不完整的记录是没有准备成功的事务，忽略即可
+			if err == io.EOF || err == errs.ErrInvalidCRC {
+				break
+			}
+			return err
+		}
+		offset += size
+		txnId, err := strconv.ParseUint(string(logRecord.Key), 10, 64)
+		if err != nil {
+			return errs.ErrDataDirectoryCorrupted
+		}
+		if logRecord.Type == data.LogRecordTxnFinished {
+			delete(db.preparedTxns, txnId)
+			continue
+		}
+		txn, err := decodePreparedTxn(logRecord.Value)
+		if err != nil {
+			return err
+		}
+		db.preparedTxns[txnId] = txn
+		// B+ 树索引没有保存已准备事务的序列号
+		if txn.seqNo > db.SeqNo {
+			db.SeqNo = txn.seqNo
+		}
+	}
+	// 截掉末尾不完整的记录，之后追加的记录才能被读到
+	if err := db.Options.FileSystem.Truncate(fileName, offset); err != nil {
+		return err
+	}
+	preparedTxnFile.WriteOffset = offset
+
+	if len(db.preparedTxns) > 0 {
+		if db.Options.TxnCoordinatorDir == "" {
+			return errs.ErrInDoubtTxn
+		}
+		committed, err := readCoordinatorDecisions(db.Options.FileSystem, db.Options.TxnCoordinatorDir)
+		if err != nil {
+			return err
+		}
+		// 按照准备的顺序处理
+		txnIds := make([]uint64, 0, len(db.preparedTxns))
+		for txnId := range db.preparedTxns {
+			txnIds = append(txnIds, txnId)
+		}
+		sort.Slice(txnIds, func(i, j int) bool {
+			return db.preparedTxns[txnIds[i]].seqNo < db.preparedTxns[txnIds[j]].seqNo
+		})
+		for _, txnId := range txnIds {
+			txn := db.preparedTxns[txnId]
+			if committed[txnId] {
+				err = db.commitPreparedTxn(txnId, txn)
+			} else {
+				err = db.abortPreparedTxn(txnId, txn)
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := preparedTxnFile.Close(); err != nil {
+		return err
+	}
+	db.preparedTxnFile = nil
+	return db.Options.FileSystem.Remove(fileName)
+}
@@ -0,0 +1,157 @@
+package db
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"kv_projects/conf"
+	"kv_projects/errs"
+	"kv_projects/index"
+	"kv_projects/utils"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestWriteBatch_Prepare(t *testing.T) {
+	for _, indexType := range []index.IndexType{index.Btree, index.BPTree} {
+		opts := conf.DefaultOptions
+		dir, _ := os.MkdirTemp("", "bitcask-go-prepare")
+		opts.DirPath = dir
+		opts.IndexType = indexType
+		opts.DataFileMergeRatio = 0
+		db, err := Open(opts)
+		assert.Nil(t, err)
+		assert.Nil(t, db.Put(utils.GetTestKey(0), []byte("value-0")))
+
+		// 准备之后数据不可见
+		wb := db.NewWriteBatch(&conf.DefaultWriteBatchOptions)
+		assert.Nil(t, wb.Put(utils.GetTestKey(1), []byte("value-1")))
+		assert.Nil(t, wb.Delete(utils.GetTestKey(0)))
+		assert.Nil(t, wb.Prepare(1))
+		assert.Equal(t, 0, wb.Len())
+		_, err = db.Get(utils.GetTestKey(1))
+		assert.Equal(t, errs.ErrKeyNotFound, err)
+		_, err = db.Get(utils.GetTestKey(0))
+		assert.Nil(t, err)
+		assert.Equal(t, errs.ErrTxnAlreadyPrepared, db.NewWriteBatch(&conf.DefaultWriteBatchOptions).Prepare(1))
+		// 已准备的事务没有结束之前不能 merge
+		assert.Equal(t, errs.ErrPreparedTxnPending, db.Merge())
+
+		// 提交之后可见
+		assert.Nil(t, db.CommitPrepared(1))
+		assert.Equal(t, errs.ErrTxnNotPrepared, db.CommitPrepared(1))
+		val, err := db.Get(utils.GetTestKey(1))
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("value-1"), val)
+		_, err = db.Get(utils.GetTestKey(0))
+		assert.Equal(t, errs.ErrKeyNotFound, err)
+
+		// 回滚之后不可见
+		wb2 := db.NewWriteBatch(&conf.DefaultWriteBatchOptions)
+		assert.Nil(t, wb2.Put(utils.GetTestKey(2), []byte("value-2")))
+		assert.Nil(t, wb2.Prepare(2))
+		assert.Nil(t, db.AbortPrepared(2))
+		assert.Equal(t, errs.ErrTxnNotPrepared, db.AbortPrepared(2))
+		_, err = db.Get(utils.GetTestKey(2))
+		assert.Equal(t, errs.ErrKeyNotFound, err)
+		assert.Nil(t, db.Merge())
+
+		// 重启之后结果不变，事务全部结束时不需要协调者日志
+		assert.Nil(t, db.Close())
+		db2, err := Open(opts)
+		assert.Nil(t, err)
+		val, err = db2.Get(utils.GetTestKey(1))
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("value-1"), val)
+		_, err = db2.Get(utils.GetTestKey(0))
+		assert.Equal(t, errs.ErrKeyNotFound, err)
+		_, err = db2.Get(utils.GetTestKey(2))
+		assert.Equal(t, errs.ErrKeyNotFound, err)
+		destroyDB(db2)
+	}
+}
+
+// 准备的事务持有批次的 key 锁，直到提交
+func TestWriteBatch_PrepareHoldsLocks(t *testing.T) {
+	opts := conf.DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-prepare-locks")
+	opts.DirPath = dir
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	ctx := context.Background()
+	wb := db.NewWriteBatch(&conf.DefaultWriteBatchOptions)
+	assert.Nil(t, wb.LockKeys(ctx, utils.GetTestKey(1)))
+	assert.Nil(t, wb.Put(utils.GetTestKey(1), []byte("value-1")))
+	assert.Nil(t, wb.Prepare(1))
+
+	timeoutCtx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	_, err = db.LockKeys(timeoutCtx, utils.GetTestKey(1))
+	assert.Equal(t, context.DeadlineExceeded, err)
+
+	assert.Nil(t, db.CommitPrepared(1))
+	locks, err := db.LockKeys(ctx, utils.GetTestKey(1))
+	assert.Nil(t, err)
+	locks.Unlock()
+}
+
+// 准备之后进程退出，重启时根据协调者日志提交或回滚
+func TestDB_RecoverPreparedTxns(t *testing.T) {
+	for _, indexType := range []index.IndexType{index.Btree, index.BPTree} {
+		opts := conf.DefaultOptions
+		dir, _ := os.MkdirTemp("", "bitcask-go-recover-prepared")
+		coordinatorDir, _ := os.MkdirTemp("", "bitcask-go-coordinator")
+		opts.DirPath = dir
+		opts.IndexType = indexType
+		db, err := Open(opts)
+		assert.Nil(t, err)
+		assert.Nil(t, db.Put(utils.GetTestKey(0), []byte("value-0")))
+
+		coordinator, err := OpenCoordinator(nil, coordinatorDir)
+		assert.Nil(t, err)
+		// 事务 1 已经决定提交，事务 2 没有决定
+		wb := db.NewWriteBatch(&conf.DefaultWriteBatchOptions)
+		assert.Nil(t, wb.Put(utils.GetTestKey(1), []byte("value-1")))
+		assert.Nil(t, wb.Delete(utils.GetTestKey(0)))
+		assert.Nil(t, wb.Prepare(1))
+		assert.Nil(t, coordinator.logDecision(1))
+		assert.Nil(t, wb.Put(utils.GetTestKey(2), []byte("value-2")))
+		assert.Nil(t, wb.Prepare(2))
+		assert.Nil(t, db.Put(utils.GetTestKey(3), []byte("value-3")))
+		assert.Nil(t, coordinator.Close())
+		crashDB(db)
+
+		// 没有配置协调者日志时无法决定
+		_, err = Open(opts)
+		assert.Equal(t, errs.ErrInDoubtTxn, err)
+
+		opts.TxnCoordinatorDir = coordinatorDir
+		check := func(db *DB) {
+			val, err := db.Get(utils.GetTestKey(1))
+			assert.Nil(t, err)
+			assert.Equal(t, []byte("value-1"), val)
+			_, err = db.Get(utils.GetTestKey(0))
+			assert.Equal(t, errs.ErrKeyNotFound, err)
+			_, err = db.Get(utils.GetTestKey(2))
+			assert.Equal(t, errs.ErrKeyNotFound, err)
+			val, err = db.Get(utils.GetTestKey(3))
+			assert.Nil(t, err)
+			assert.Equal(t, []byte("value-3"), val)
+		}
+		db2, err := Open(opts)
+		assert.Nil(t, err)
+		check(db2)
+		assert.True(t, db2.SeqNo >= 2)
+		assert.Nil(t, db2.Close())
+
+		// 事务已经处理完成，不再需要协调者日志
+		opts.TxnCoordinatorDir = ""
+		db3, err := Open(opts)
+		assert.Nil(t, err)
+		check(db3)
+		destroyDB(db3)
+		_ = os.RemoveAll(coordinatorDir)
+	}
+}
@@ -0,0 +1,239 @@
+package dump
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"hash"
+	"hash/crc32"
+	"io"
+	"kv_projects/errs"
+	"math"
+)
+
+// 二进制格式：
+//
+//	header: magic(6) | version(2)
+//	entry:  tag(1)=entryTag | varint keySize | varint valueSize | key | value | crc(4)
+//	footer: tag(1)=footerTag | varint count | crc(4)
+//
+// entry 的 crc 校验这条记录，footer 的 crc 校验 footer 之前的整个数据流，没有 footer 说明数据流被截断
+const (
+	binaryVersion uint16 = 1
+
+	entryTag  byte = 1
+	footerTag byte = 2
+
+	// 记录长度超过该值时，边读取边分配内存，避免损坏的长度导致一次性分配过大的内存
+	maxPreallocSize = 1024 * 1024
+)
+
+var binaryMagic = []byte("KVDUMP")
+
+type binaryWriter struct {
+	w      *bufio.Writer
+	crc    hash.Hash32 // 整个数据流的校验值
+	count  uint64
+	header []byte
+}
+
+func newBinaryWriter(w io.Writer) (*binaryWriter, error) {
+	bw := &binaryWriter{
+		w:      bufio.NewWriter(w),
+		crc:    crc32.NewIEEE(),
+		header: make([]byte, 1+2*binary.MaxVarintLen64),
+	}
+	header := binary.LittleEndian.AppendUint16(append([]byte(nil), binaryMagic...), binaryVersion)
+	if err := bw.write(header); err != nil {
+		return nil, err
+	}
+	return bw, nil
+}
+
+func (bw *binaryWriter) Write(key, value []byte) error {
+	bw.header[0] = entryTag
+	n := 1
+	n += binary.PutUvarint(bw.header[n:], uint64(len(key)))
+	n += binary.PutUvarint(bw.header[n:], uint64(len(value)))
+
+	entryCRC := crc32.NewIEEE()
+	for _, b := range [][]byte{bw.header[:n], key, value} {
+		entryCRC.Write(b)
+		if err := bw.write(b); err != nil {
+			return err
+		}
+	}
+	if err := bw.write(binary.LittleEndian.AppendUint32(nil, entryCRC.Sum32())); err != nil {
+		return err
+	}
+	bw.count++
+	return nil
+}
+
+func (bw *binaryWriter) Close() error {
+	footer := binary.AppendUvarint([]byte{footerTag}, bw.count)
+	if err := bw.write(footer); err != nil {
+		return err
+	}
+	if _, err := bw.w.Write(binary.LittleEndian.AppendUint32(nil, bw.crc.Sum32())); err != nil {
+		return err
+	}
+	return bw.w.Flush()
+}
+
+// 写出数据并累加到整个数据流的校验值中
+func (bw *binaryWriter) write(b []byte) error {
+	bw.crc.Write(b)
+	_, err := bw.w.Write(b)
+	return err
+}
+
+type binaryReader struct {
+	r     *bufio.Reader
+	crc   hash.Hash32
+	count uint64
+	done  bool
+}
+
+func newBinaryReader(r io.Reader) (*binaryReader, error) {
+	br := &binaryReader{
+		r:   bufio.NewReader(r),
+		crc: crc32.NewIEEE(),
+	}
+	header := make([]byte, len(binaryMagic)+2)
+	if _, err := io.ReadFull(br.r, header); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil, errs.ErrInvalidDumpFormat
+		}
+		return nil, err
+	}
+	if !bytes.Equal(header[:len(binaryMagic)], binaryMagic) {
+		return nil, errs.ErrInvalidDumpFormat
+	}
+	if binary.LittleEndian.Uint16(header[len(binaryMagic):]) != binaryVersion {
+		return nil, errs.ErrUnsupportedDumpVersion
+	}
+	br.crc.Write(header)
+	return br, nil
+}
+
+func (br *binaryReader) Read() ([]byte, []byte, error) {
+	if br.done {
+		return nil, nil, io.EOF
+	}
+	entryCRC := crc32.NewIEEE()
+	tag, err := br.r.ReadByte()
+	if err != nil {
+		return nil, nil, unexpectedEOF(err)
+	}
+	entryCRC.Write([]byte{tag})
+	switch tag {
+	case entryTag:
+	case footerTag:
+		return nil, nil, br.readFooter()
+	default:
+		return nil, nil, errs.ErrDumpCorrupted
+	}
+
+	keySize, err := br.readUvarint(entryCRC)
+	if err != nil {
+		return nil, nil, err
+	}
+	valueSize, err := br.readUvarint(entryCRC)
+	if err != nil {
+		return nil, nil, err
+	}
+	if keySize > math.MaxUint32 || valueSize > math.MaxUint32 {
+		return nil, nil, errs.ErrDumpCorrupted
+	}
+	key, err := readBytes(br.r, keySize)
+	if err != nil {
+		return nil, nil, err
+	}
+	value, err := readBytes(br.r, valueSize)
+	if err != nil {
+		return nil, nil, err
+	}
+	entryCRC.Write(key)
+	entryCRC.Write(value)
+	crc, err := br.readCRC()
+	if err != nil {
+		return nil, nil, err
+	}
+	if crc != entryCRC.Sum32() {
+		return nil, nil, errs.ErrDumpCorrupted
+	}
+
+	br.crc.Write([]byte{tag})
+	br.crc.Write(binary.AppendUvarint(nil, keySize))
+	br.crc.Write(binary.AppendUvarint(nil, valueSize))
+	br.crc.Write(key)
+	br.crc.Write(value)
+	br.crc.Write(binary.LittleEndian.AppendUint32(nil, crc))
+	br.count++
+	return key, value, nil
+}
+
+// 读取 footer，校验记录条数和整个数据流的校验值，通过时返回 io.EOF
+func (br *binaryReader) readFooter() error {
+	br.crc.Write([]byte{footerTag})
+	count, err := br.readUvarint(br.crc)
+	if err != nil {
+		return err
+	}
+	crc, err := br.readCRC()
+	if err != nil {
+		return err
+	}
+	if count != br.count || crc != br.crc.Sum32() {
+		return errs.ErrDumpCorrupted
+	}
+	br.done = true
+	return io.EOF
+}
+
+// 读取一个 varint 并累加到 crc 中
+func (br *binaryReader) readUvarint(crc hash.Hash32) (uint64, error) {
+	x, err := binary.ReadUvarint(br.r)
+	if err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return 0, io.ErrUnexpectedEOF
+		}
+		// varint 溢出
+		return 0, errs.ErrDumpCorrupted
+	}
+	crc.Write(binary.AppendUvarint(nil, x))
+	return x, nil
+}
+
+func (br *binaryReader) readCRC() (uint32, error) {
+	buf := make([]byte, crc32.Size)
+	if _, err := io.ReadFull(br.r, buf); err != nil {
+		return 0, unexpectedEOF(err)
+	}
+	return binary.LittleEndian.Uint32(buf), nil
+}
+
+// 读取 n 个字节，n 较大时随着读取逐步分配内存
+func readBytes(r io.Reader, n uint64) ([]byte, error) {
+	if n <= maxPreallocSize {
+		buf := make([]byte, n)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, unexpectedEOF(err)
+		}
+		return buf, nil
+	}
+	buf := bytes.NewBuffer(make([]byte, 0, maxPreallocSize))
+	if _, err := io.CopyN(buf, r, int64(n)); err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	return buf.Bytes(), nil
+}
+
+// 记录中间遇到的 EOF 说明数据流被截断
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
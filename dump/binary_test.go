@@ -0,0 +1,61 @@
+package dump
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"kv_projects/errs"
+	"testing"
+)
+
+func TestBinary_Header(t *testing.T) {
+	_, err := NewReader(bytes.NewReader(nil), Binary)
+	assert.ErrorIs(t, err, errs.ErrInvalidDumpFormat)
+	_, err = NewReader(bytes.NewReader([]byte("not a dump file")), Binary)
+	assert.ErrorIs(t, err, errs.ErrInvalidDumpFormat)
+
+	out := writeAll(t, Binary, nil)
+	binary.LittleEndian.PutUint16(out[len(binaryMagic):], binaryVersion+1)
+	_, err = NewReader(bytes.NewReader(out), Binary)
+	assert.ErrorIs(t, err, errs.ErrUnsupportedDumpVersion)
+}
+
+func TestBinary_Truncated(t *testing.T) {
+	records := testRecords()[:3]
+	out := writeAll(t, Binary, records)
+	headerSize := len(binaryMagic) + 2
+	// 在 header 之后的任意位置截断，都不能被当作完整的数据读完
+	for n := headerSize; n < len(out); n++ {
+		r, err := NewReader(bytes.NewReader(out[:n]), Binary)
+		assert.Nil(t, err)
+		got, err := readAll(r)
+		assert.Equal(t, io.ErrUnexpectedEOF, err, "truncated at %d", n)
+		assert.LessOrEqual(t, len(got), len(records))
+	}
+}
+
+func TestBinary_Corrupted(t *testing.T) {
+	records := testRecords()[:3]
+	out := writeAll(t, Binary, records)
+	headerSize := len(binaryMagic) + 2
+	// 修改 header 之后的任意一个字节，都能发现数据损坏
+	for i := headerSize; i < len(out); i++ {
+		corrupted := append([]byte(nil), out...)
+		corrupted[i] ^= 0x40
+		r, err := NewReader(bytes.NewReader(corrupted), Binary)
+		assert.Nil(t, err)
+		_, err = readAll(r)
+		assert.NotNil(t, err, "corrupted at %d", i)
+	}
+
+	// 删除一整条记录，每条记录的校验值仍然正确，但 footer 中的校验值不一致
+	first := writeAll(t, Binary, records[:1])
+	entrySize := len(first) - len(writeAll(t, Binary, nil))
+	dropped := append(append([]byte(nil), out[:headerSize]...), out[headerSize+entrySize:]...)
+	r, err := NewReader(bytes.NewReader(dropped), Binary)
+	assert.Nil(t, err)
+	got, err := readAll(r)
+	assert.ErrorIs(t, err, errs.ErrDumpCorrupted)
+	assert.Equal(t, len(records)-1, len(got))
+}
@@ -0,0 +1,77 @@
+package dump
+
+import (
+	"io"
+	"kv_projects/errs"
+)
+
+// 导出数据的格式，和数据文件的格式无关，可以在不同版本、不同索引类型的数据库之间迁移数据
+type Format = uint8
+
+const (
+	// 二进制格式，带有格式版本号，每条记录和整个数据流都有校验值
+	Binary Format = iota
+
+	// 每行一个 JSON 对象 {"key": ..., "value": ...}，key 和 value 使用 base64 编码
+	JSONLines
+
+	// 第一行为表头 key,value，key 和 value 使用 base64 编码
+	CSV
+)
+
+// Writer 将 key/value 记录按照指定格式写出
+type Writer interface {
+	// Write 写出一条记录
+	Write(key, value []byte) error
+
+	// Close 写出格式的结尾并刷新缓冲区，不会关闭底层的 io.Writer
+	Close() error
+}
+
+// Reader 按照指定格式读取 key/value 记录
+type Reader interface {
+	// Read 读取下一条记录，全部读完时返回 io.EOF，数据不完整时返回 io.ErrUnexpectedEOF
+	Read() (key, value []byte, err error)
+}
+
+/**
+ * NewWriter
+ * @Description: 创建指定格式的 Writer，二进制格式会立即写出文件头
+ * @param w
+ * @param format
+ * @return Writer
+ * @return error 未知的格式返回 errs.ErrUnsupportedDumpFormat
+ */
+func NewWriter(w io.Writer, format Format) (Writer, error) {
+	switch format {
+	case Binary:
+		return newBinaryWriter(w)
+	case JSONLines:
+		return newJSONLinesWriter(w), nil
+	case CSV:
+		return newCSVWriter(w)
+	default:
+		return nil, errs.ErrUnsupportedDumpFormat
+	}
+}
+
+/**
+ * NewReader
+ * @Description: 创建指定格式的 Reader，二进制格式和 CSV 会立即读取并校验文件头
+ * @param r
+ * @param format
+ * @return Reader
+ * @return error 未知的格式返回 errs.ErrUnsupportedDumpFormat
+ */
+func NewReader(r io.Reader, format Format) (Reader, error) {
+	switch format {
+	case Binary:
+		return newBinaryReader(r)
+	case JSONLines:
+		return newJSONLinesReader(r), nil
+	case CSV:
+		return newCSVReader(r)
+	default:
+		return nil, errs.ErrUnsupportedDumpFormat
+	}
+}
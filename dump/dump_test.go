@@ -0,0 +1,87 @@
+package dump
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"kv_projects/errs"
+	"testing"
+)
+
+type testRecord struct {
+	key   []byte
+	value []byte
+}
+
+func testRecords() []testRecord {
+	return []testRecord{
+		{key: []byte("a"), value: []byte("1")},
+		{key: []byte("b"), value: nil},
+		{key: []byte("c,\"\n"), value: []byte{0, 1, 2, 255}},
+		{key: []byte("d"), value: bytes.Repeat([]byte("v"), 2*maxPreallocSize+1)},
+	}
+}
+
+func writeAll(t *testing.T, format Format, records []testRecord) []byte {
+	var buf bytes.Buffer
+	w, err := NewWriter(&buf, format)
+	assert.Nil(t, err)
+	for _, record := range records {
+		assert.Nil(t, w.Write(record.key, record.value))
+	}
+	assert.Nil(t, w.Close())
+	return buf.Bytes()
+}
+
+func readAll(r Reader) ([]testRecord, error) {
+	var records []testRecord
+	for {
+		key, value, err := r.Read()
+		if err == io.EOF {
+			return records, nil
+		}
+		if err != nil {
+			return records, err
+		}
+		records = append(records, testRecord{key: key, value: value})
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	for _, format := range []Format{Binary, JSONLines, CSV} {
+		t.Run(fmt.Sprint(format), func(t *testing.T) {
+			records := testRecords()
+			out := writeAll(t, format, records)
+
+			r, err := NewReader(bytes.NewReader(out), format)
+			assert.Nil(t, err)
+			got, err := readAll(r)
+			assert.Nil(t, err)
+			assert.Equal(t, len(records), len(got))
+			for i := range records {
+				assert.Equal(t, records[i].key, got[i].key)
+				assert.Equal(t, len(records[i].value), len(got[i].value))
+				assert.True(t, bytes.Equal(records[i].value, got[i].value))
+			}
+			// 读完之后一直返回 io.EOF
+			_, _, err = r.Read()
+			assert.Equal(t, io.EOF, err)
+
+			// 没有记录
+			out = writeAll(t, format, nil)
+			r, err = NewReader(bytes.NewReader(out), format)
+			assert.Nil(t, err)
+			got, err = readAll(r)
+			assert.Nil(t, err)
+			assert.Empty(t, got)
+		})
+	}
+}
+
+func TestUnsupportedFormat(t *testing.T) {
+	_, err := NewWriter(io.Discard, 100)
+	assert.ErrorIs(t, err, errs.ErrUnsupportedDumpFormat)
+	_, err = NewReader(bytes.NewReader(nil), 100)
+	assert.ErrorIs(t, err, errs.ErrUnsupportedDumpFormat)
+}
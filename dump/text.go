@@ -0,0 +1,126 @@
+package dump
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"kv_projects/errs"
+)
+
+// JSON Lines 中的一行，[]byte 字段由 encoding/json 编码为 base64
+type jsonRecord struct {
+	Key   []byte `json:"key"`
+	Value []byte `json:"value"`
+}
+
+type jsonLinesWriter struct {
+	w   *bufio.Writer
+	enc *json.Encoder
+}
+
+func newJSONLinesWriter(w io.Writer) *jsonLinesWriter {
+	bw := bufio.NewWriter(w)
+	return &jsonLinesWriter{w: bw, enc: json.NewEncoder(bw)}
+}
+
+func (jw *jsonLinesWriter) Write(key, value []byte) error {
+	// Encode 会在每个对象后面追加换行符
+	return jw.enc.Encode(jsonRecord{Key: key, Value: value})
+}
+
+func (jw *jsonLinesWriter) Close() error {
+	return jw.w.Flush()
+}
+
+type jsonLinesReader struct {
+	dec  *json.Decoder
+	line int
+}
+
+func newJSONLinesReader(r io.Reader) *jsonLinesReader {
+	dec := json.NewDecoder(r)
+	dec.DisallowUnknownFields()
+	return &jsonLinesReader{dec: dec}
+}
+
+func (jr *jsonLinesReader) Read() ([]byte, []byte, error) {
+	var record jsonRecord
+	if err := jr.dec.Decode(&record); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil, nil, err
+		}
+		return nil, nil, fmt.Errorf("%w: record %d: %v", errs.ErrInvalidDumpFormat, jr.line+1, err)
+	}
+	jr.line++
+	return record.Key, record.Value, nil
+}
+
+var csvHeader = []string{"key", "value"}
+
+type csvWriter struct {
+	w *csv.Writer
+}
+
+func newCSVWriter(w io.Writer) (*csvWriter, error) {
+	cw := &csvWriter{w: csv.NewWriter(w)}
+	if err := cw.w.Write(csvHeader); err != nil {
+		return nil, err
+	}
+	return cw, nil
+}
+
+func (cw *csvWriter) Write(key, value []byte) error {
+	return cw.w.Write([]string{
+		base64.StdEncoding.EncodeToString(key),
+		base64.StdEncoding.EncodeToString(value),
+	})
+}
+
+func (cw *csvWriter) Close() error {
+	cw.w.Flush()
+	return cw.w.Error()
+}
+
+type csvReader struct {
+	r *csv.Reader
+}
+
+func newCSVReader(r io.Reader) (*csvReader, error) {
+	cr := &csvReader{r: csv.NewReader(r)}
+	cr.r.FieldsPerRecord = len(csvHeader)
+	cr.r.ReuseRecord = true
+	header, err := cr.r.Read()
+	if err != nil {
+		if err == io.EOF {
+			return nil, errs.ErrInvalidDumpFormat
+		}
+		return nil, fmt.Errorf("%w: %v", errs.ErrInvalidDumpFormat, err)
+	}
+	if header[0] != csvHeader[0] || header[1] != csvHeader[1] {
+		return nil, errs.ErrInvalidDumpFormat
+	}
+	return cr, nil
+}
+
+func (cr *csvReader) Read() ([]byte, []byte, error) {
+	record, err := cr.r.Read()
+	if err == io.EOF {
+		return nil, nil, err
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: %v", errs.ErrInvalidDumpFormat, err)
+	}
+	line, _ := cr.r.FieldPos(0)
+	key, err := base64.StdEncoding.DecodeString(record[0])
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: line %d: %v", errs.ErrInvalidDumpFormat, line, err)
+	}
+	value, err := base64.StdEncoding.DecodeString(record[1])
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: line %d: %v", errs.ErrInvalidDumpFormat, line, err)
+	}
+	return key, value, nil
+}
@@ -0,0 +1,52 @@
+package dump
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io"
+	"kv_projects/errs"
+	"strings"
+	"testing"
+)
+
+func TestJSONLines_Format(t *testing.T) {
+	out := writeAll(t, JSONLines, []testRecord{{key: []byte("k1"), value: []byte("v1")}})
+	assert.Equal(t, "{\"key\":\"azE=\",\"value\":\"djE=\"}\n", string(out))
+
+	// 未知字段和格式错误
+	r, err := NewReader(strings.NewReader("{\"key\":\"azE=\",\"val\":\"djE=\"}\n"), JSONLines)
+	assert.Nil(t, err)
+	_, _, err = r.Read()
+	assert.ErrorIs(t, err, errs.ErrInvalidDumpFormat)
+
+	r, err = NewReader(strings.NewReader("{\"key\":\"azE=\",\"value\":\"djE=\"}\n{\"key\":\"a"), JSONLines)
+	assert.Nil(t, err)
+	key, _, err := r.Read()
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("k1"), key)
+	_, _, err = r.Read()
+	assert.Equal(t, io.ErrUnexpectedEOF, err)
+}
+
+func TestCSV_Format(t *testing.T) {
+	out := writeAll(t, CSV, []testRecord{{key: []byte("k1"), value: []byte("v1")}})
+	assert.Equal(t, "key,value\nazE=,djE=\n", string(out))
+
+	_, err := NewReader(strings.NewReader(""), CSV)
+	assert.ErrorIs(t, err, errs.ErrInvalidDumpFormat)
+	_, err = NewReader(strings.NewReader("k,v\n"), CSV)
+	assert.ErrorIs(t, err, errs.ErrInvalidDumpFormat)
+
+	r, err := NewReader(strings.NewReader("key,value\nazE=,djE=\nnot base64,djE=\n"), CSV)
+	assert.Nil(t, err)
+	key, value, err := r.Read()
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("k1"), key)
+	assert.Equal(t, []byte("v1"), value)
+	_, _, err = r.Read()
+	assert.ErrorIs(t, err, errs.ErrInvalidDumpFormat)
+
+	r, err = NewReader(strings.NewReader("key,value\nazE=\n"), CSV)
+	assert.Nil(t, err)
+	_, _, err = r.Read()
+	assert.ErrorIs(t, err, errs.ErrInvalidDumpFormat)
+}
@@ -1,6 +1,9 @@
 package errs
 
-import "errors"
+import (
+	"errors"
+	"fmt"
+)
 
 var (
 	ErrKeyIsEmpty             = errors.New("the key is empty")
@@ -11,6 +14,14 @@ var (
 	ErrDataDirectoryCorrupted = errors.New("the database directory maybe corrupted")
 	ErrInvalidCRC             = errors.New("invalid crc value, logRecord maybe corrupted")
 	ErrExceedMaxBatchNum      = errors.New("exceed the max batch num")
+	ErrExceedMaxBatchSize     = errors.New("exceed the max batch size")
+	ErrInvalidSavepoint       = errors.New("the savepoint is no longer valid")
+	ErrDeadlock               = errors.New("deadlock detected while waiting for key lock")
+	ErrTxnNotPrepared         = errors.New("the transaction is not prepared")
+	ErrTxnAlreadyPrepared     = errors.New("the transaction is already prepared")
+	ErrPreparedTxnPending     = errors.New("there are prepared transactions waiting for commit, try again later")
+	ErrInDoubtTxn             = errors.New("in-doubt prepared transactions found but no coordinator dir is configured")
+	ErrCoordinatorClosed      = errors.New("the coordinator is closed")
 	ErrMergeIsProgress        = errors.New("merge is in progress, try again later")
 	ErrDatabaseIsUsing        = errors.New("the database directory is used by another process")
 	ErrMergeRatioUnreached    = errors.New("the merge ratio do not reach option ratio")
@@ -18,4 +29,30 @@ var (
 	ErrWrongOperationType     = errors.New("WRONGTYPE Operation against a key holding the wrong kind of value")
 	ErrDataExpired            = errors.New("data is expired")
 	ErrValueIsNull            = errors.New("Value is NULL")
+	ErrIteratorNotSupported   = errors.New("the index type does not support ordered iteration")
+	ErrUnsupportedIndexType   = errors.New("unsupported index type")
+	ErrUnsupportedIOType      = errors.New("unsupported io type")
+	ErrReadOnlyIOManager      = errors.New("the io manager is read only")
+	ErrInjectedFault          = errors.New("injected io fault")
+	ErrKeyTooLarge            = errors.New("the key is too large")
+	ErrValueTooLarge          = errors.New("the value is too large")
+	ErrValueReaderClosed      = errors.New("the value reader is closed")
+	ErrUnsupportedDumpFormat  = errors.New("unsupported dump format")
+	ErrInvalidDumpFormat      = errors.New("the input is not in the expected dump format")
+	ErrUnsupportedDumpVersion = errors.New("unsupported dump version")
+	ErrDumpCorrupted          = errors.New("the dump is corrupted")
 )
+
+// IndexError 索引底层存储（如 bbolt）操作失败时返回，Op 为失败的操作，可以通过 errors.Unwrap 取得原始错误
+type IndexError struct {
+	Op  string
+	Err error
+}
+
+func (e *IndexError) Error() string {
+	return fmt.Sprintf("index %s failed: %v", e.Op, e.Err)
+}
+
+func (e *IndexError) Unwrap() error {
+	return e.Err
+}
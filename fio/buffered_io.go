@@ -0,0 +1,149 @@
+package fio
+
+import (
+	"io"
+	"os"
+	"sync"
+)
+
+// 写缓冲区的默认大小，缓冲的数据超过该大小时写入文件
+const DefaultWriteBufferSize = 64 * 1024
+
+// BufferedFileIO
+// @Description: 带用户态写缓冲区的文件 IO，追加的数据先写入缓冲区，在缓冲区满、Sync 和 Close 时一次性写入文件。
+// 读取时缓冲区中还没有写入文件的数据同样可以读到。进程崩溃时缓冲区中的数据会丢失，需要持久化时调用 Sync
+type BufferedFileIO struct {
+	mu      sync.RWMutex
+	fd      *os.File
+	buf     []byte // 还没有写入文件的数据
+	flushed int64  // 已经写入文件的数据大小，即缓冲区数据在文件中的起始位置
+}
+
+/**
+ * NewBufferedFileIOManager
+ * @Description: 打开带写缓冲区的文件 IO
+ * @param fileName
+ * @param bufferSize 缓冲区大小，小于等于 0 时使用 DefaultWriteBufferSize
+ * @return *BufferedFileIO
+ * @return error
+ */
+func NewBufferedFileIOManager(fileName string, bufferSize int) (*BufferedFileIO, error) {
+	if bufferSize <= 0 {
+		bufferSize = DefaultWriteBufferSize
+	}
+	fd, err := os.OpenFile(
+		fileName,
+		os.O_CREATE|os.O_APPEND|os.O_RDWR, DataFilePerm)
+	if err != nil {
+		return nil, err
+	}
+	stat, err := fd.Stat()
+	if err != nil {
+		_ = fd.Close()
+		return nil, err
+	}
+	return &BufferedFileIO{
+		fd:      fd,
+		buf:     make([]byte, 0, bufferSize),
+		flushed: stat.Size(),
+	}, nil
+}
+
+// Read 从 offset 位置读取 len(b) 个字节，跨越文件和缓冲区时分别读取后拼接
+func (bio *BufferedFileIO) Read(b []byte, offset int64) (int, error) {
+	bio.mu.RLock()
+	defer bio.mu.RUnlock()
+	n := 0
+	if offset < bio.flushed {
+		diskBytes := b
+		if int64(len(b)) > bio.flushed-offset {
+			diskBytes = b[:bio.flushed-offset]
+		}
+		var err error
+		n, err = bio.fd.ReadAt(diskBytes, offset)
+		if err != nil {
+			return n, err
+		}
+	}
+	if n < len(b) {
+		bufOffset := offset + int64(n) - bio.flushed
+		if bufOffset < int64(len(bio.buf)) {
+			n += copy(b[n:], bio.buf[bufOffset:])
+		}
+	}
+	if n < len(b) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// Write 将数据追加到缓冲区，缓冲区放不下时先写入文件，超过缓冲区大小的数据直接写入文件
+func (bio *BufferedFileIO) Write(b []byte) (int, error) {
+	bio.mu.Lock()
+	defer bio.mu.Unlock()
+	if len(bio.buf)+len(b) > cap(bio.buf) {
+		if err := bio.flush(); err != nil {
+			return 0, err
+		}
+	}
+	if len(b) >= cap(bio.buf) {
+		n, err := bio.fd.Write(b)
+		bio.flushed += int64(n)
+		return n, err
+	}
+	bio.buf = append(bio.buf, b...)
+	return len(b), nil
+}
+
+// Sync 将缓冲区的数据写入文件并持久化
+func (bio *BufferedFileIO) Sync() error {
+	bio.mu.Lock()
+	defer bio.mu.Unlock()
+	if err := bio.flush(); err != nil {
+		return err
+	}
+	return bio.fd.Sync()
+}
+
+// Close 将缓冲区的数据写入文件后关闭文件，写入失败时同样关闭文件，并返回写入的错误
+func (bio *BufferedFileIO) Close() error {
+	bio.mu.Lock()
+	defer bio.mu.Unlock()
+	flushErr := bio.flush()
+	if err := bio.fd.Close(); err != nil && flushErr == nil {
+		return err
+	}
+	return flushErr
+}
+
+// Truncate 先将缓冲区的数据写入文件，再丢弃 size 之后的数据
+func (bio *BufferedFileIO) Truncate(size int64) error {
+	bio.mu.Lock()
+	defer bio.mu.Unlock()
+	if err := bio.flush(); err != nil {
+		return err
+	}
+	if err := bio.fd.Truncate(size); err != nil {
+		return err
+	}
+	bio.flushed = size
+	return nil
+}
+
+// Size 返回包括缓冲区在内的文件大小
+func (bio *BufferedFileIO) Size() (int64, error) {
+	bio.mu.RLock()
+	defer bio.mu.RUnlock()
+	return bio.flushed + int64(len(bio.buf)), nil
+}
+
+// 将缓冲区的数据写入文件，部分写入时保留没有写入的数据，调用方必须持有锁
+func (bio *BufferedFileIO) flush() error {
+	if len(bio.buf) == 0 {
+		return nil
+	}
+	n, err := bio.fd.Write(bio.buf)
+	bio.flushed += int64(n)
+	bio.buf = bio.buf[:copy(bio.buf, bio.buf[n:])]
+	return err
+}
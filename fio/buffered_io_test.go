@@ -0,0 +1,80 @@
+package fio
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestBufferedFileIO_ReadWrite(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "buffered-io")
+	defer destroyFile(dir)
+	path := filepath.Join(dir, "a.data")
+
+	bio, err := NewBufferedFileIOManager(path, 8)
+	assert.Nil(t, err)
+	_, err = bio.Write([]byte("aaaa"))
+	assert.Nil(t, err)
+	_, err = bio.Write([]byte("bbbb"))
+	assert.Nil(t, err)
+	size, err := bio.Size()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(8), size)
+	// 数据还在缓冲区中，没有写入文件
+	stat, _ := os.Stat(path)
+	assert.Equal(t, int64(0), stat.Size())
+
+	// 缓冲区放不下时先写入文件
+	_, err = bio.Write([]byte("cc"))
+	assert.Nil(t, err)
+	stat, _ = os.Stat(path)
+	assert.Equal(t, int64(8), stat.Size())
+
+	// 读取跨越文件和缓冲区
+	b := make([]byte, 4)
+	n, err := bio.Read(b, 6)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("bbcc"), b[:n])
+	// 超出文件末尾时返回 io.EOF
+	n, err = bio.Read(b, 8)
+	assert.Equal(t, 2, n)
+	assert.Equal(t, io.EOF, err)
+	b = make([]byte, 10)
+	n, err = bio.Read(b, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("aaaabbbbcc"), b[:n])
+	n, err = bio.Read(b, 10)
+	assert.Equal(t, 0, n)
+	assert.Equal(t, io.EOF, err)
+
+	// 超过缓冲区大小的数据直接写入文件
+	_, err = bio.Write([]byte("dddddddddd"))
+	assert.Nil(t, err)
+	stat, _ = os.Stat(path)
+	assert.Equal(t, int64(20), stat.Size())
+	n, err = bio.Read(b, 10)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("dddddddddd"), b[:n])
+
+	// Sync 和 Close 时写入文件
+	_, err = bio.Write([]byte("ee"))
+	assert.Nil(t, err)
+	assert.Nil(t, bio.Sync())
+	stat, _ = os.Stat(path)
+	assert.Equal(t, int64(22), stat.Size())
+	_, err = bio.Write([]byte("ff"))
+	assert.Nil(t, err)
+	assert.Nil(t, bio.Close())
+	stat, _ = os.Stat(path)
+	assert.Equal(t, int64(24), stat.Size())
+
+	// 重新打开后从文件末尾继续追加
+	bio2, err := NewIOManager(OSFileSystem{}, path, BufferedIoManager, 0)
+	assert.Nil(t, err)
+	size, err = bio2.Size()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(24), size)
+	assert.Nil(t, bio2.Close())
+}
@@ -0,0 +1,21 @@
+//go:build darwin
+
+package fio
+
+import (
+	"os"
+	"syscall"
+)
+
+// macOS 没有 O_DIRECT，通过 F_NOCACHE 关闭文件的页缓存
+func openDirect(fileName string, flag int) (*os.File, error) {
+	fd, err := os.OpenFile(fileName, flag, DataFilePerm)
+	if err != nil {
+		return nil, err
+	}
+	if _, _, errno := syscall.Syscall(syscall.SYS_FCNTL, fd.Fd(), syscall.F_NOCACHE, 1); errno != 0 {
+		_ = fd.Close()
+		return nil, errDirectIONotSupported
+	}
+	return fd, nil
+}
@@ -0,0 +1,237 @@
+package fio
+
+import (
+	"errors"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+	"unsafe"
+)
+
+const (
+	// 直接 IO 要求读写的文件偏移、长度和内存地址按块对齐
+	directIOAlignment = 4096
+	// 每次从磁盘读取的最小字节数，顺序遍历文件时大部分读取直接从预读的数据中返回
+	directIOReadAhead = 256 * 1024
+)
+
+// 当前平台或文件系统不支持直接 IO
+var errDirectIONotSupported = errors.New("direct io is not supported")
+
+// DirectIO
+// @Description: 不经过页缓存的文件 IO，读写都按块对齐。追加的数据和最后一个不完整的块一起写入，
+// 末尾用 0 填充到整块，Close 时截断为实际写入的大小；进程崩溃时末尾的填充由上层调用 Truncate 去掉
+type DirectIO struct {
+	mu        sync.RWMutex
+	fd        *os.File
+	size      int64                     // 实际写入的数据大小
+	tail      []byte                    // 最后一个不完整块中的数据
+	modified  bool                      // 打开之后是否写入或截断过，只读使用时关闭不需要截断
+	readAhead atomic.Pointer[readAhead] // 最近一次从磁盘读取的数据
+}
+
+// 从磁盘读取的一段数据，追加写入不会修改已有的数据，所以在截断之前一直有效
+type readAhead struct {
+	offset int64
+	data   []byte
+}
+
+/**
+ * NewDirectIOManager
+ * @Description: 使用直接 IO 打开文件，平台或文件系统不支持时退化为标准文件 IO
+ * @param fileName
+ * @return IOManager
+ * @return error
+ */
+func NewDirectIOManager(fileName string) (IOManager, error) {
+	fd, err := openDirect(fileName, os.O_CREATE|os.O_RDWR)
+	if errors.Is(err, errDirectIONotSupported) {
+		return NewFileIOManager(fileName)
+	}
+	if err != nil {
+		return nil, err
+	}
+	stat, err := fd.Stat()
+	if err != nil {
+		_ = fd.Close()
+		return nil, err
+	}
+	dio := &DirectIO{fd: fd, size: stat.Size(), tail: make([]byte, 0, directIOAlignment)}
+	if err := dio.loadTail(); err != nil {
+		_ = fd.Close()
+		return nil, err
+	}
+	return dio, nil
+}
+
+/**
+ * ReadFileDirect
+ * @Description: 使用直接 IO 读取整个文件，不支持时退化为 os.ReadFile
+ * @param fileName
+ * @return []byte
+ * @return error
+ */
+func ReadFileDirect(fileName string) ([]byte, error) {
+	fd, err := openDirect(fileName, os.O_RDONLY)
+	if errors.Is(err, errDirectIONotSupported) {
+		return os.ReadFile(fileName)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = fd.Close()
+	}()
+	stat, err := fd.Stat()
+	if err != nil {
+		return nil, err
+	}
+	size := stat.Size()
+	buf := alignedBuffer(alignUp(size))
+	n, err := fd.ReadAt(buf, 0)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	if int64(n) < size {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return buf[:size], nil
+}
+
+// Read 从 offset 位置读取 len(b) 个字节，不在预读数据中时按块对齐从磁盘读取
+func (dio *DirectIO) Read(b []byte, offset int64) (int, error) {
+	dio.mu.RLock()
+	defer dio.mu.RUnlock()
+	if offset < 0 {
+		return 0, errors.New("direct io: invalid read offset")
+	}
+	end := min(offset+int64(len(b)), dio.size)
+	if offset >= end {
+		if len(b) == 0 {
+			return 0, nil
+		}
+		return 0, io.EOF
+	}
+
+	ra := dio.readAhead.Load()
+	if ra == nil || offset < ra.offset || end > ra.offset+int64(len(ra.data)) {
+		start := offset &^ (directIOAlignment - 1)
+		readEnd := min(alignUp(max(end, start+directIOReadAhead)), alignUp(dio.size))
+		buf := alignedBuffer(readEnd - start)
+		n, err := dio.fd.ReadAt(buf, start)
+		if err != nil && err != io.EOF {
+			return 0, err
+		}
+		if start+int64(n) < end {
+			return 0, io.ErrUnexpectedEOF
+		}
+		// 只缓存已经写入的数据，末尾的填充不能被读到
+		ra = &readAhead{offset: start, data: buf[:min(int64(n), dio.size-start)]}
+		dio.readAhead.Store(ra)
+	}
+	n := copy(b, ra.data[offset-ra.offset:end-ra.offset])
+	if n < len(b) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// Write 将最后一个不完整的块和新数据拼接后按整块写入，末尾用 0 填充
+func (dio *DirectIO) Write(b []byte) (int, error) {
+	dio.mu.Lock()
+	defer dio.mu.Unlock()
+	total := len(dio.tail) + len(b)
+	buf := alignedBuffer(alignUp(int64(total)))
+	copy(buf, dio.tail)
+	copy(buf[len(dio.tail):], b)
+	if _, err := dio.fd.WriteAt(buf, dio.size-int64(len(dio.tail))); err != nil {
+		return 0, err
+	}
+	dio.modified = true
+	dio.size += int64(len(b))
+	dio.tail = append(dio.tail[:0], buf[total-total%directIOAlignment:total]...)
+	return len(b), nil
+}
+
+// Sync 直接 IO 的数据已经写入磁盘，还需要持久化文件的元数据
+func (dio *DirectIO) Sync() error {
+	return dio.fd.Sync()
+}
+
+/**
+ * Truncate
+ * @Description: 丢弃 size 之后的数据，之后的写入从 size 位置开始
+ * @receiver dio
+ * @param size
+ * @return error
+ */
+func (dio *DirectIO) Truncate(size int64) error {
+	dio.mu.Lock()
+	defer dio.mu.Unlock()
+	if size < 0 || size > dio.size {
+		return errors.New("direct io: invalid truncate size")
+	}
+	if err := dio.fd.Truncate(size); err != nil {
+		return err
+	}
+	dio.modified = true
+	dio.size = size
+	dio.readAhead.Store(nil)
+	return dio.loadTail()
+}
+
+// Close 写入过数据时先截掉末尾的填充，再关闭文件
+func (dio *DirectIO) Close() error {
+	dio.mu.Lock()
+	defer dio.mu.Unlock()
+	var err error
+	if dio.modified {
+		err = dio.fd.Truncate(dio.size)
+	}
+	if closeErr := dio.fd.Close(); closeErr != nil && err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// Size 返回实际写入的数据大小，不包括末尾的填充
+func (dio *DirectIO) Size() (int64, error) {
+	dio.mu.RLock()
+	defer dio.mu.RUnlock()
+	return dio.size, nil
+}
+
+// 从磁盘读取最后一个不完整块中的数据，调用方必须持有锁
+func (dio *DirectIO) loadTail() error {
+	dio.tail = dio.tail[:0]
+	rem := dio.size % directIOAlignment
+	if rem == 0 {
+		return nil
+	}
+	buf := alignedBuffer(directIOAlignment)
+	n, err := dio.fd.ReadAt(buf, dio.size-rem)
+	if err != nil && err != io.EOF {
+		return err
+	}
+	if int64(n) < rem {
+		return io.ErrUnexpectedEOF
+	}
+	dio.tail = append(dio.tail, buf[:rem]...)
+	return nil
+}
+
+// 向上对齐到整块
+func alignUp(n int64) int64 {
+	return (n + directIOAlignment - 1) &^ (directIOAlignment - 1)
+}
+
+// 分配起始地址按块对齐的内存
+func alignedBuffer(n int64) []byte {
+	buf := make([]byte, n+directIOAlignment)
+	shift := int64(uintptr(unsafe.Pointer(&buf[0])) & (directIOAlignment - 1))
+	if shift != 0 {
+		shift = directIOAlignment - shift
+	}
+	return buf[shift : shift+n : shift+n]
+}
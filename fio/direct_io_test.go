@@ -0,0 +1,77 @@
+package fio
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDirectIO_ReadWrite(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "direct-io")
+	defer destroyFile(dir)
+	path := filepath.Join(dir, "a.data")
+
+	// 文件系统不支持直接 IO 时退化为标准文件 IO，下面的行为相同
+	dio, err := NewIOManager(OSFileSystem{}, path, DirectIoManager, 0)
+	assert.Nil(t, err)
+	_, direct := dio.(*DirectIO)
+	t.Logf("direct io supported: %v", direct)
+
+	var expected []byte
+	for i := 0; i < 100; i++ {
+		record := bytes.Repeat([]byte{byte('a' + i%26)}, 100+i)
+		n, err := dio.Write(record)
+		assert.Nil(t, err)
+		assert.Equal(t, len(record), n)
+		expected = append(expected, record...)
+	}
+	size, err := dio.Size()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(len(expected)), size)
+	if direct {
+		// 末尾填充到整块
+		stat, _ := os.Stat(path)
+		assert.Equal(t, alignUp(size), stat.Size())
+	}
+
+	// 跨块读取，超出末尾时返回 io.EOF
+	b := make([]byte, 5000)
+	n, err := dio.Read(b, 3000)
+	assert.Nil(t, err)
+	assert.Equal(t, expected[3000:8000], b[:n])
+	n, err = dio.Read(b, size-10)
+	assert.Equal(t, 10, n)
+	assert.Equal(t, io.EOF, err)
+	assert.Equal(t, expected[size-10:], b[:n])
+	assert.Nil(t, dio.Sync())
+
+	// 截断之后从新的位置继续写入
+	assert.Nil(t, dio.(Truncater).Truncate(5000))
+	_, err = dio.Write([]byte("tail"))
+	assert.Nil(t, err)
+	expected = append(expected[:5000:5000], []byte("tail")...)
+	b = make([]byte, 8)
+	n, err = dio.Read(b, 4996)
+	assert.Nil(t, err)
+	assert.Equal(t, expected[4996:], b[:n])
+
+	// 关闭时截掉末尾的填充
+	assert.Nil(t, dio.Close())
+	content, err := os.ReadFile(path)
+	assert.Nil(t, err)
+	assert.Equal(t, expected, content)
+
+	// 重新打开后从最后一个不完整的块继续追加
+	dio2, err := NewDirectIOManager(path)
+	assert.Nil(t, err)
+	_, err = dio2.Write([]byte("more"))
+	assert.Nil(t, err)
+	expected = append(expected, []byte("more")...)
+	assert.Nil(t, dio2.Close())
+	content, err = ReadFileDirect(path)
+	assert.Nil(t, err)
+	assert.Equal(t, expected, content)
+}
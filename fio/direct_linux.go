@@ -0,0 +1,18 @@
+//go:build linux
+
+package fio
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// 使用 O_DIRECT 打开文件，文件系统不支持（如 tmpfs）时返回 errDirectIONotSupported
+func openDirect(fileName string, flag int) (*os.File, error) {
+	fd, err := os.OpenFile(fileName, flag|syscall.O_DIRECT, DataFilePerm)
+	if errors.Is(err, syscall.EINVAL) {
+		return nil, errDirectIONotSupported
+	}
+	return fd, err
+}
@@ -0,0 +1,10 @@
+//go:build !linux && !darwin
+
+package fio
+
+import "os"
+
+// 当前平台不支持直接 IO
+func openDirect(string, int) (*os.File, error) {
+	return nil, errDirectIONotSupported
+}
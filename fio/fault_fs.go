@@ -0,0 +1,374 @@
+package fio
+
+import (
+	"kv_projects/errs"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// FaultFileSystem
+// @Description: 用于测试的故障注入文件系统，包装另一个文件系统（一般是 MemFileSystem），可以让指定的写入失败或者只写入一部分、
+// 让指定的重命名失败、模拟断电丢弃没有持久化的数据，以及修改文件中指定位置的内容。
+// 创建文件、重命名、删除等元数据操作视为立即持久化，Crash 只会影响文件内容
+type FaultFileSystem struct {
+	FileSystem
+
+	mu         sync.Mutex
+	writes     int                         // 已经执行的写入次数
+	failAt     int                         // 第 failAt 次写入失败，为 0 时不注入
+	shortWrite bool                        // 失败的写入是否先写入一部分数据
+	renames    int                         // 已经执行的重命名次数
+	renameAt   int                         // 第 renameAt 次重命名失败，为 0 时不注入
+	files      map[string]*faultFileState  // 通过该文件系统打开过的文件
+	locks      map[*faultFileLock]struct{} // 当前持有的文件锁
+	generation int                         // 每次 Crash 后加一，之前打开的文件全部失效
+}
+
+// 文件的持久化状态，重命名后跟随文件移动
+type faultFileState struct {
+	path       string
+	syncedSize int64 // 最后一次持久化时的文件大小
+	dirty      bool  // 是否有没有持久化的数据
+}
+
+func NewFaultFileSystem(fsys FileSystem) *FaultFileSystem {
+	return &FaultFileSystem{
+		FileSystem: fsys,
+		files:      make(map[string]*faultFileState),
+		locks:      make(map[*faultFileLock]struct{}),
+	}
+}
+
+/**
+ * FailWrite
+ * @Description: 从现在开始的第 n 次写入返回 errs.ErrInjectedFault，之后的写入恢复正常
+ * @receiver f
+ * @param n 从 1 开始，为 0 时取消注入
+ * @param short 为 true 时失败的写入先写入前一半的数据，模拟只写入了一部分
+ */
+func (f *FaultFileSystem) FailWrite(n int, short bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.failAt = 0
+	if n > 0 {
+		f.failAt = f.writes + n
+	}
+	f.shortWrite = short
+}
+
+/**
+ * FailRename
+ * @Description: 从现在开始的第 n 次重命名返回 errs.ErrInjectedFault，文件保持原来的名字，之后的重命名恢复正常
+ * @receiver f
+ * @param n 从 1 开始，为 0 时取消注入
+ */
+func (f *FaultFileSystem) FailRename(n int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.renameAt = 0
+	if n > 0 {
+		f.renameAt = f.renames + n
+	}
+}
+
+// Unwrap 返回被包装的文件系统
+func (f *FaultFileSystem) Unwrap() FileSystem {
+	return f.FileSystem
+}
+
+// Writes 返回目前为止执行的写入次数
+func (f *FaultFileSystem) Writes() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.writes
+}
+
+/**
+ * Crash
+ * @Description: 模拟断电，丢弃所有文件中没有持久化的数据，之前打开的文件和获取的文件锁全部失效
+ * @receiver f
+ * @param rng 为 nil 时丢弃全部没有持久化的数据；否则每个文件随机保留一部分，模拟断电前部分页已经写回磁盘
+ * @return error
+ */
+func (f *FaultFileSystem) Crash(rng *rand.Rand) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, state := range f.files {
+		if !state.dirty {
+			continue
+		}
+		size := state.syncedSize
+		if rng != nil {
+			info, err := f.FileSystem.Stat(state.path)
+			if err != nil {
+				return err
+			}
+			if info.Size() > size {
+				size += rng.Int63n(info.Size() - size + 1)
+			}
+		}
+		if err := f.FileSystem.Truncate(state.path, size); err != nil {
+			return err
+		}
+		state.syncedSize = size
+		state.dirty = false
+	}
+	for lock := range f.locks {
+		if err := lock.FileLock.Unlock(); err != nil {
+			return err
+		}
+	}
+	clear(f.locks)
+	f.failAt = 0
+	f.renameAt = 0
+	f.generation++
+	return nil
+}
+
+/**
+ * Corrupt
+ * @Description: 将文件 offset 位置的字节按位取反，模拟磁盘上的数据损坏，修改直接持久化
+ * @receiver f
+ * @param name
+ * @param offset
+ * @return error
+ */
+func (f *FaultFileSystem) Corrupt(name string, offset int64) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	data, err := ReadFile(f.FileSystem, name)
+	if err != nil {
+		return err
+	}
+	if offset < 0 || offset >= int64(len(data)) {
+		return &os.PathError{Op: "corrupt", Path: name, Err: os.ErrInvalid}
+	}
+	data[offset] = ^data[offset]
+	return WriteFile(f.FileSystem, name, data, DataFilePerm)
+}
+
+func (f *FaultFileSystem) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	file, err := f.FileSystem.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	name = filepath.Clean(name)
+	state, ok := f.files[name]
+	if !ok {
+		info, err := file.Stat()
+		if err != nil {
+			_ = file.Close()
+			return nil, err
+		}
+		state = &faultFileState{path: name, syncedSize: info.Size()}
+		f.files[name] = state
+	}
+	if flag&os.O_TRUNC != 0 && flag&(os.O_WRONLY|os.O_RDWR) != 0 {
+		state.syncedSize = 0
+	}
+	return &faultFile{File: file, fs: f, state: state, generation: f.generation}, nil
+}
+
+func (f *FaultFileSystem) Rename(oldPath, newPath string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.renames++
+	if f.renames == f.renameAt {
+		return errs.ErrInjectedFault
+	}
+	if err := f.FileSystem.Rename(oldPath, newPath); err != nil {
+		return err
+	}
+	oldPath, newPath = filepath.Clean(oldPath), filepath.Clean(newPath)
+	f.forget(newPath)
+	// 目录连同其中的文件一起移动
+	prefix := oldPath + string(filepath.Separator)
+	for path, state := range f.files {
+		if path == oldPath || strings.HasPrefix(path, prefix) {
+			delete(f.files, path)
+			state.path = newPath + path[len(oldPath):]
+			f.files[state.path] = state
+		}
+	}
+	return nil
+}
+
+func (f *FaultFileSystem) Remove(name string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.FileSystem.Remove(name); err != nil {
+		return err
+	}
+	f.forget(filepath.Clean(name))
+	return nil
+}
+
+func (f *FaultFileSystem) RemoveAll(path string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.FileSystem.RemoveAll(path); err != nil {
+		return err
+	}
+	f.forget(filepath.Clean(path))
+	return nil
+}
+
+func (f *FaultFileSystem) Truncate(name string, size int64) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.FileSystem.Truncate(name, size); err != nil {
+		return err
+	}
+	if state, ok := f.files[filepath.Clean(name)]; ok {
+		state.syncedSize = min(state.syncedSize, size)
+	}
+	return nil
+}
+
+func (f *FaultFileSystem) TryLock(name string) (FileLock, bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	lock, hold, err := f.FileSystem.TryLock(name)
+	if err != nil || !hold {
+		return nil, hold, err
+	}
+	faultLock := &faultFileLock{FileLock: lock, fs: f}
+	f.locks[faultLock] = struct{}{}
+	return faultLock, true, nil
+}
+
+// 不再跟踪 path 以及其下的所有文件，调用方必须持有锁
+func (f *FaultFileSystem) forget(path string) {
+	prefix := path + string(filepath.Separator)
+	for p, state := range f.files {
+		if p == path || strings.HasPrefix(p, prefix) {
+			// 文件已经删除，之前打开的句柄写入的数据不需要再处理
+			state.dirty = false
+			delete(f.files, p)
+		}
+	}
+}
+
+// 故障注入文件系统打开的文件
+type faultFile struct {
+	File
+	fs         *FaultFileSystem
+	state      *faultFileState
+	generation int
+}
+
+// 文件是否在 Crash 之前打开，调用方必须持有锁
+func (f *faultFile) crashed() bool {
+	return f.generation != f.fs.generation
+}
+
+func (f *faultFile) Read(b []byte) (int, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if f.crashed() {
+		return 0, errs.ErrInjectedFault
+	}
+	return f.File.Read(b)
+}
+
+func (f *faultFile) ReadAt(b []byte, offset int64) (int, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if f.crashed() {
+		return 0, errs.ErrInjectedFault
+	}
+	return f.File.ReadAt(b, offset)
+}
+
+func (f *faultFile) Write(b []byte) (int, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if f.crashed() {
+		return 0, errs.ErrInjectedFault
+	}
+	f.fs.writes++
+	if f.fs.writes == f.fs.failAt {
+		if !f.fs.shortWrite || len(b) < 2 {
+			return 0, errs.ErrInjectedFault
+		}
+		n, err := f.File.Write(b[:len(b)/2])
+		if n > 0 {
+			f.state.dirty = true
+		}
+		if err != nil {
+			return n, err
+		}
+		return n, errs.ErrInjectedFault
+	}
+	n, err := f.File.Write(b)
+	if n > 0 {
+		f.state.dirty = true
+	}
+	return n, err
+}
+
+func (f *faultFile) Sync() error {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if f.crashed() {
+		return errs.ErrInjectedFault
+	}
+	if err := f.File.Sync(); err != nil {
+		return err
+	}
+	info, err := f.File.Stat()
+	if err != nil {
+		return err
+	}
+	f.state.syncedSize = info.Size()
+	f.state.dirty = false
+	return nil
+}
+
+func (f *faultFile) Truncate(size int64) error {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if f.crashed() {
+		return errs.ErrInjectedFault
+	}
+	if err := f.File.Truncate(size); err != nil {
+		return err
+	}
+	f.state.syncedSize = min(f.state.syncedSize, size)
+	return nil
+}
+
+func (f *faultFile) Stat() (os.FileInfo, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if f.crashed() {
+		return nil, errs.ErrInjectedFault
+	}
+	return f.File.Stat()
+}
+
+// Close Crash 之前打开的文件同样可以关闭，释放底层文件系统的资源
+func (f *faultFile) Close() error {
+	return f.File.Close()
+}
+
+type faultFileLock struct {
+	FileLock
+	fs *FaultFileSystem
+}
+
+// Unlock Crash 时已经释放的锁不需要再次释放
+func (l *faultFileLock) Unlock() error {
+	l.fs.mu.Lock()
+	defer l.fs.mu.Unlock()
+	if _, ok := l.fs.locks[l]; !ok {
+		return nil
+	}
+	delete(l.fs.locks, l)
+	return l.FileLock.Unlock()
+}
@@ -0,0 +1,123 @@
+package fio
+
+import (
+	"github.com/stretchr/testify/assert"
+	"kv_projects/errs"
+	"math/rand"
+	"os"
+	"testing"
+)
+
+func TestFaultFileSystem_FailWrite(t *testing.T) {
+	fsys := NewFaultFileSystem(NewMemFileSystem())
+	file, err := fsys.OpenFile("a.data", os.O_CREATE|os.O_APPEND|os.O_RDWR, DataFilePerm)
+	assert.Nil(t, err)
+
+	fsys.FailWrite(2, false)
+	_, err = file.Write([]byte("aaaa"))
+	assert.Nil(t, err)
+	n, err := file.Write([]byte("bbbb"))
+	assert.Equal(t, errs.ErrInjectedFault, err)
+	assert.Equal(t, 0, n)
+	// 只有指定的一次写入失败
+	_, err = file.Write([]byte("cccc"))
+	assert.Nil(t, err)
+
+	fsys.FailWrite(1, true)
+	n, err = file.Write([]byte("dddd"))
+	assert.Equal(t, errs.ErrInjectedFault, err)
+	assert.Equal(t, 2, n)
+	assert.Equal(t, 4, fsys.Writes())
+
+	content, err := ReadFile(fsys, "a.data")
+	assert.Nil(t, err)
+	assert.Equal(t, "aaaaccccdd", string(content))
+}
+
+func TestFaultFileSystem_Crash(t *testing.T) {
+	fsys := NewFaultFileSystem(NewMemFileSystem())
+	lock, hold, err := fsys.TryLock("flock")
+	assert.Nil(t, err)
+	assert.True(t, hold)
+
+	file, err := fsys.OpenFile("a.data", os.O_CREATE|os.O_APPEND|os.O_RDWR, DataFilePerm)
+	assert.Nil(t, err)
+	_, err = file.Write([]byte("aaaa"))
+	assert.Nil(t, err)
+	assert.Nil(t, file.Sync())
+	_, err = file.Write([]byte("bbbb"))
+	assert.Nil(t, err)
+	// 持久化之后重命名的文件，之后的写入同样会丢失
+	tmp, err := fsys.OpenFile("b.tmp", os.O_CREATE|os.O_WRONLY, DataFilePerm)
+	assert.Nil(t, err)
+	_, err = tmp.Write([]byte("cccc"))
+	assert.Nil(t, err)
+	assert.Nil(t, tmp.Sync())
+	_, err = tmp.Write([]byte("dddd"))
+	assert.Nil(t, err)
+	assert.Nil(t, fsys.Rename("b.tmp", "b.data"))
+
+	assert.Nil(t, fsys.Crash(nil))
+	content, err := ReadFile(fsys, "a.data")
+	assert.Nil(t, err)
+	assert.Equal(t, "aaaa", string(content))
+	content, err = ReadFile(fsys, "b.data")
+	assert.Nil(t, err)
+	assert.Equal(t, "cccc", string(content))
+
+	// 之前打开的文件不能再使用，文件锁已经释放
+	_, err = file.Write([]byte("eeee"))
+	assert.Equal(t, errs.ErrInjectedFault, err)
+	assert.Equal(t, errs.ErrInjectedFault, file.Sync())
+	assert.Nil(t, lock.Unlock())
+	lock, hold, err = fsys.TryLock("flock")
+	assert.Nil(t, err)
+	assert.True(t, hold)
+	assert.Nil(t, lock.Unlock())
+
+	// 随机保留一部分没有持久化的数据
+	file, err = fsys.OpenFile("a.data", os.O_APPEND|os.O_RDWR, DataFilePerm)
+	assert.Nil(t, err)
+	_, err = file.Write([]byte("ffffffff"))
+	assert.Nil(t, err)
+	assert.Nil(t, fsys.Crash(rand.New(rand.NewSource(1))))
+	content, err = ReadFile(fsys, "a.data")
+	assert.Nil(t, err)
+	assert.True(t, len(content) >= 4 && len(content) <= 12)
+	assert.Equal(t, "aaaa", string(content[:4]))
+}
+
+func TestFaultFileSystem_Corrupt(t *testing.T) {
+	fsys := NewFaultFileSystem(NewMemFileSystem())
+	assert.Nil(t, WriteFile(fsys, "a.data", []byte{0x01, 0x02, 0x03}, DataFilePerm))
+	assert.Nil(t, fsys.Corrupt("a.data", 1))
+	content, err := ReadFile(fsys, "a.data")
+	assert.Nil(t, err)
+	assert.Equal(t, []byte{0x01, 0xfd, 0x03}, content)
+	assert.NotNil(t, fsys.Corrupt("a.data", 3))
+	assert.True(t, os.IsNotExist(fsys.Corrupt("b.data", 0)))
+}
+
+func TestFaultFileSystem_FailRename(t *testing.T) {
+	fsys := NewFaultFileSystem(NewMemFileSystem())
+	assert.Nil(t, WriteFile(fsys, "a.tmp", []byte("aaaa"), DataFilePerm))
+
+	fsys.FailRename(1)
+	assert.Equal(t, errs.ErrInjectedFault, fsys.Rename("a.tmp", "a.data"))
+	_, err := fsys.Stat("a.tmp")
+	assert.Nil(t, err)
+	_, err = fsys.Stat("a.data")
+	assert.True(t, os.IsNotExist(err))
+	// 只有指定的一次重命名失败
+	assert.Nil(t, fsys.Rename("a.tmp", "a.data"))
+	content, err := ReadFile(fsys, "a.data")
+	assert.Nil(t, err)
+	assert.Equal(t, "aaaa", string(content))
+}
+
+func TestOnDisk(t *testing.T) {
+	assert.True(t, OnDisk(OSFileSystem{}))
+	assert.True(t, OnDisk(NewFaultFileSystem(OSFileSystem{})))
+	assert.False(t, OnDisk(NewMemFileSystem()))
+	assert.False(t, OnDisk(NewFaultFileSystem(NewMemFileSystem())))
+}
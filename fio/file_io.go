@@ -3,9 +3,9 @@ package fio
 import "os"
 
 // FileIO
-// @Description: 对go标准库文件io的封装
+// @Description: 对go标准库文件io的封装，也可以用于其他 FileSystem 打开的文件
 type FileIO struct {
-	fd *os.File //系统文件描述符
+	fd File //系统文件描述符
 }
 
 /**
@@ -16,7 +16,19 @@ type FileIO struct {
  * @return errs
  */
 func NewFileIOManager(fileName string) (*FileIO, error) {
-	fd, err := os.OpenFile(
+	return NewFSFileIOManager(OSFileSystem{}, fileName)
+}
+
+/**
+ * NewFSFileIOManager
+ * @Description: 通过给定的文件系统打开文件IO
+ * @param fsys
+ * @param fileName
+ * @return *FileIO
+ * @return error
+ */
+func NewFSFileIOManager(fsys FileSystem, fileName string) (*FileIO, error) {
+	fd, err := fsys.OpenFile(
 		fileName,
 		os.O_CREATE|os.O_APPEND|os.O_RDWR, DataFilePerm)
 	if err != nil {
@@ -44,6 +56,11 @@ func (fio *FileIO) Close() error {
 	return fio.fd.Close()
 }
 
+// 丢弃 size 之后的数据，文件以追加模式打开，之后的写入从新的末尾开始
+func (fio *FileIO) Truncate(size int64) error {
+	return fio.fd.Truncate(size)
+}
+
 // 获取当前打开文件的大小
 func (fio *FileIO) Size() (int64, error) {
 	stat, err := fio.fd.Stat()
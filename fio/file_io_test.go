@@ -88,3 +88,23 @@ func TestFileIO_Sync(t *testing.T) {
 	err = fio.Close()
 	assert.Nil(t, err)
 }
+
+func TestFileIO_Truncate(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "fio-truncate")
+	defer destroyFile(dir)
+
+	for _, ioType := range []FileIOType{StandardIoManager, BufferedIoManager} {
+		path := filepath.Join(dir, "a.data")
+		ioManager, err := NewIOManager(OSFileSystem{}, path, ioType, 0)
+		assert.Nil(t, err)
+		_, err = ioManager.Write([]byte("aaaabbbb"))
+		assert.Nil(t, err)
+		assert.Nil(t, ioManager.(Truncater).Truncate(4))
+		_, err = ioManager.Write([]byte("cc"))
+		assert.Nil(t, err)
+		assert.Nil(t, ioManager.Close())
+		content, _ := os.ReadFile(path)
+		assert.Equal(t, []byte("aaaacc"), content)
+		destroyFile(path)
+	}
+}
@@ -0,0 +1,153 @@
+package fio
+
+import (
+	"io"
+	"os"
+
+	"github.com/gofrs/flock"
+)
+
+// FileSystem
+// @Description: 数据库使用的文件系统操作，默认为 OSFileSystem，也可以使用 MemFileSystem 将数据全部保存在内存中
+type FileSystem interface {
+	// OpenFile 按照 os.OpenFile 的语义打开文件
+	OpenFile(name string, flag int, perm os.FileMode) (File, error)
+	// ReadDir 返回目录下的所有文件和子目录，按名称排序
+	ReadDir(name string) ([]os.DirEntry, error)
+	// Stat 返回文件信息，文件不存在时返回的错误满足 os.IsNotExist
+	Stat(name string) (os.FileInfo, error)
+	MkdirAll(path string, perm os.FileMode) error
+	Rename(oldPath, newPath string) error
+	Remove(name string) error
+	RemoveAll(path string) error
+	Truncate(name string, size int64) error
+	/**
+	 * TryLock
+	 * @Description: 尝试获取文件锁，保证同一个目录只能被一个数据库实例打开
+	 * @param name 锁文件的路径
+	 * @return FileLock
+	 * @return bool 锁已经被其他实例持有时返回 false
+	 * @return error
+	 */
+	TryLock(name string) (FileLock, bool, error)
+}
+
+// File 文件系统打开的文件
+type File interface {
+	io.Reader
+	io.ReaderAt
+	io.Writer
+	io.Closer
+	Stat() (os.FileInfo, error)
+	Sync() error
+	Truncate(size int64) error
+}
+
+// FileLock 已经获取的文件锁
+type FileLock interface {
+	Unlock() error
+}
+
+// OSFileSystem 操作系统的文件系统，可以使用 mmap、直接 IO 等依赖真实文件的 IOManager
+type OSFileSystem struct{}
+
+func (OSFileSystem) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	return os.OpenFile(name, flag, perm)
+}
+
+func (OSFileSystem) ReadDir(name string) ([]os.DirEntry, error) {
+	return os.ReadDir(name)
+}
+
+func (OSFileSystem) Stat(name string) (os.FileInfo, error) {
+	return os.Stat(name)
+}
+
+func (OSFileSystem) MkdirAll(path string, perm os.FileMode) error {
+	return os.MkdirAll(path, perm)
+}
+
+func (OSFileSystem) Rename(oldPath, newPath string) error {
+	return os.Rename(oldPath, newPath)
+}
+
+func (OSFileSystem) Remove(name string) error {
+	return os.Remove(name)
+}
+
+func (OSFileSystem) RemoveAll(path string) error {
+	return os.RemoveAll(path)
+}
+
+func (OSFileSystem) Truncate(name string, size int64) error {
+	return os.Truncate(name, size)
+}
+
+func (OSFileSystem) TryLock(name string) (FileLock, bool, error) {
+	fileLock := flock.New(name)
+	hold, err := fileLock.TryLock()
+	if err != nil || !hold {
+		return nil, hold, err
+	}
+	return fileLock, true, nil
+}
+
+/**
+ * OnDisk
+ * @Description: 文件系统中的路径是否就是操作系统中的文件，bbolt 等不经过 FileSystem 的组件只能在这样的文件系统上使用。
+ * 包装其他文件系统的实现（如 FaultFileSystem）通过 Unwrap 方法返回被包装的文件系统
+ * @param fsys
+ * @return bool
+ */
+func OnDisk(fsys FileSystem) bool {
+	for {
+		switch f := fsys.(type) {
+		case OSFileSystem:
+			return true
+		case interface{ Unwrap() FileSystem }:
+			fsys = f.Unwrap()
+		default:
+			return false
+		}
+	}
+}
+
+/**
+ * ReadFile
+ * @Description: 读取文件的全部内容
+ * @param fsys
+ * @param name
+ * @return []byte
+ * @return error
+ */
+func ReadFile(fsys FileSystem, name string) ([]byte, error) {
+	file, err := fsys.OpenFile(name, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+	return io.ReadAll(file)
+}
+
+/**
+ * WriteFile
+ * @Description: 将 data 写入文件，文件已经存在时覆盖原来的内容
+ * @param fsys
+ * @param name
+ * @param data
+ * @param perm
+ * @return error
+ */
+func WriteFile(fsys FileSystem, name string, data []byte, perm os.FileMode) error {
+	file, err := fsys.OpenFile(name, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(data); err != nil {
+		_ = file.Close()
+		return err
+	}
+	return file.Close()
+}
@@ -1,5 +1,7 @@
 package fio
 
+import "kv_projects/errs"
+
 // 即用户具有读写权限，组用户和其它用户具有只读权限；
 const DataFilePerm = 0644
 
@@ -9,11 +11,20 @@ const (
 	StandardIoManager FileIOType = iota
 
 	MMapIoManager
+
+	// 带写缓冲区的标准文件 IO，用于活跃文件的小记录写入
+	BufferedIoManager
+
+	// 可读写的 mmap，预先分配文件空间，用于活跃文件
+	MMapWriteIoManager
+
+	// 不经过页缓存的直接 IO，不支持时退化为标准文件 IO
+	DirectIoManager
 )
 
 /**
  * IOManager
- * @Description: 抽象 IO 管理接口，可以接入不同IO类型，目前仅支持标准文件IO
+ * @Description: 抽象 IO 管理接口，可以接入不同IO类型，目前支持标准文件IO、带写缓冲区的文件IO、只读和可读写的 mmap 以及直接 IO
  */
 type IOManager interface {
 	/**
@@ -58,20 +69,64 @@ type IOManager interface {
 	Size() (int64, error)
 }
 
+/**
+ * SliceReader
+ * @Description: 可以直接返回底层内存切片的 IOManager（如 mmap），读取时不需要额外分配内存
+ */
+type SliceReader interface {
+	/**
+	 * Slice
+	 * @Description: 返回 [offset, offset+n) 范围内容的切片，不足 n 个字节时返回 io.EOF
+	 * 切片在 IOManager 关闭前有效，调用方不能修改其内容
+	 * @param n
+	 * @param offset
+	 * @return []byte
+	 * @return error
+	 */
+	Slice(n int64, offset int64) ([]byte, error)
+}
+
+/**
+ * Truncater
+ * @Description: 可以丢弃文件末尾数据的 IOManager，用于启动时截掉活跃文件末尾无效的部分
+ */
+type Truncater interface {
+	/**
+	 * Truncate
+	 * @Description: 丢弃 size 之后的数据，之后的写入从 size 位置开始
+	 * @param size 不能超过当前的文件大小
+	 * @return error
+	 */
+	Truncate(size int64) error
+}
+
 /**
  * NewIOManager
  * @Description: 初始化IOManager，后续添加标准可以做一个判断初始化不同的io类型
+ * 除 OSFileSystem 以外的文件系统没有真实的文件，所有 io 类型都使用标准文件IO
+ * @param fsys
  * @param fileName
+ * @param ioType
+ * @param preallocSize 文件预先分配的大小，只有可读写的 mmap 使用
  * @return IOManager
  * @return error
  */
-func NewIOManager(fileName string, ioType FileIOType) (IOManager, error) {
+func NewIOManager(fsys FileSystem, fileName string, ioType FileIOType, preallocSize int64) (IOManager, error) {
+	if _, ok := fsys.(OSFileSystem); !ok && ioType <= DirectIoManager {
+		return NewFSFileIOManager(fsys, fileName)
+	}
 	switch ioType {
 	case StandardIoManager:
 		return NewFileIOManager(fileName)
 	case MMapIoManager:
 		return NewMMapIOManager(fileName)
+	case BufferedIoManager:
+		return NewBufferedFileIOManager(fileName, DefaultWriteBufferSize)
+	case MMapWriteIoManager:
+		return NewWritableMMapIOManager(fileName, preallocSize)
+	case DirectIoManager:
+		return NewDirectIOManager(fileName)
 	default:
-		panic("unsupported io type")
+		return nil, errs.ErrUnsupportedIOType
 	}
 }
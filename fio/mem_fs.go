@@ -0,0 +1,401 @@
+package fio
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	errMemIsDir       = errors.New("is a directory")
+	errMemNotDir      = errors.New("not a directory")
+	errMemDirNotEmpty = errors.New("directory not empty")
+	errMemReadOnly    = errors.New("file is not opened for writing")
+)
+
+// MemFileSystem
+// @Description: 内存文件系统，所有数据只保存在内存中，进程退出后丢失。
+// 数据库关闭后使用同一个 MemFileSystem 重新打开，之前写入的数据仍然存在
+type MemFileSystem struct {
+	mu    sync.Mutex
+	nodes map[string]*memNode // 以清理后的路径为 key，根目录和 "." 不在其中，总是存在
+	locks map[string]bool     // 已经被持有的文件锁
+}
+
+// 内存文件系统中的文件或目录
+type memNode struct {
+	mu      sync.RWMutex // 保护文件内容
+	dir     bool
+	data    []byte
+	mode    os.FileMode
+	modTime time.Time
+}
+
+func NewMemFileSystem() *MemFileSystem {
+	return &MemFileSystem{
+		nodes: make(map[string]*memNode),
+		locks: make(map[string]bool),
+	}
+}
+
+func (m *MemFileSystem) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	name = filepath.Clean(name)
+	node, ok := m.nodes[name]
+	switch {
+	case ok && node.dir, !ok && isMemRoot(name):
+		return nil, &os.PathError{Op: "open", Path: name, Err: errMemIsDir}
+	case ok && flag&(os.O_CREATE|os.O_EXCL) == os.O_CREATE|os.O_EXCL:
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrExist}
+	case !ok && flag&os.O_CREATE == 0:
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+	case !ok:
+		if err := m.checkParent("open", name); err != nil {
+			return nil, err
+		}
+		node = &memNode{mode: perm, modTime: time.Now()}
+		m.nodes[name] = node
+	}
+	writable := flag&(os.O_WRONLY|os.O_RDWR) != 0
+	if writable && flag&os.O_TRUNC != 0 {
+		node.mu.Lock()
+		node.data = nil
+		node.mu.Unlock()
+	}
+	return &memFile{
+		node:     node,
+		name:     name,
+		writable: writable,
+		append:   flag&os.O_APPEND != 0,
+	}, nil
+}
+
+func (m *MemFileSystem) ReadDir(name string) ([]os.DirEntry, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	name = filepath.Clean(name)
+	if !m.isDir(name) {
+		if _, ok := m.nodes[name]; ok {
+			return nil, &os.PathError{Op: "readdir", Path: name, Err: errMemNotDir}
+		}
+		return nil, &os.PathError{Op: "readdir", Path: name, Err: os.ErrNotExist}
+	}
+	var entries []os.DirEntry
+	for path, node := range m.nodes {
+		if filepath.Dir(path) == name && path != name {
+			entries = append(entries, fs.FileInfoToDirEntry(node.stat(path)))
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Name() < entries[j].Name()
+	})
+	return entries, nil
+}
+
+func (m *MemFileSystem) Stat(name string) (os.FileInfo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	name = filepath.Clean(name)
+	if node, ok := m.nodes[name]; ok {
+		return node.stat(name), nil
+	}
+	if isMemRoot(name) {
+		return (&memNode{dir: true}).stat(name), nil
+	}
+	return nil, &os.PathError{Op: "stat", Path: name, Err: os.ErrNotExist}
+}
+
+func (m *MemFileSystem) MkdirAll(path string, perm os.FileMode) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	path = filepath.Clean(path)
+	// 从最上层开始依次创建
+	var missing []string
+	for p := path; !m.isDir(p); p = filepath.Dir(p) {
+		if _, ok := m.nodes[p]; ok {
+			return &os.PathError{Op: "mkdir", Path: p, Err: errMemNotDir}
+		}
+		missing = append(missing, p)
+	}
+	for i := len(missing) - 1; i >= 0; i-- {
+		m.nodes[missing[i]] = &memNode{dir: true, mode: perm | os.ModeDir, modTime: time.Now()}
+	}
+	return nil
+}
+
+func (m *MemFileSystem) Rename(oldPath, newPath string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	oldPath, newPath = filepath.Clean(oldPath), filepath.Clean(newPath)
+	node, ok := m.nodes[oldPath]
+	if !ok {
+		return &os.LinkError{Op: "rename", Old: oldPath, New: newPath, Err: os.ErrNotExist}
+	}
+	if oldPath == newPath {
+		return nil
+	}
+	if err := m.checkParent("rename", newPath); err != nil {
+		return err
+	}
+	if target, ok := m.nodes[newPath]; ok {
+		if target.dir != node.dir {
+			return &os.LinkError{Op: "rename", Old: oldPath, New: newPath, Err: errMemIsDir}
+		}
+		if target.dir && m.hasChildren(newPath) {
+			return &os.LinkError{Op: "rename", Old: oldPath, New: newPath, Err: errMemDirNotEmpty}
+		}
+	}
+	// 目录需要连同其中的内容一起移动
+	prefix := oldPath + string(filepath.Separator)
+	for path, child := range m.nodes {
+		if strings.HasPrefix(path, prefix) {
+			delete(m.nodes, path)
+			m.nodes[newPath+string(filepath.Separator)+path[len(prefix):]] = child
+		}
+	}
+	delete(m.nodes, oldPath)
+	m.nodes[newPath] = node
+	return nil
+}
+
+func (m *MemFileSystem) Remove(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	name = filepath.Clean(name)
+	node, ok := m.nodes[name]
+	if !ok {
+		return &os.PathError{Op: "remove", Path: name, Err: os.ErrNotExist}
+	}
+	if node.dir && m.hasChildren(name) {
+		return &os.PathError{Op: "remove", Path: name, Err: errMemDirNotEmpty}
+	}
+	delete(m.nodes, name)
+	return nil
+}
+
+func (m *MemFileSystem) RemoveAll(path string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	path = filepath.Clean(path)
+	prefix := path + string(filepath.Separator)
+	for p := range m.nodes {
+		if p == path || strings.HasPrefix(p, prefix) {
+			delete(m.nodes, p)
+		}
+	}
+	return nil
+}
+
+func (m *MemFileSystem) Truncate(name string, size int64) error {
+	file, err := m.OpenFile(name, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+	return file.Truncate(size)
+}
+
+func (m *MemFileSystem) TryLock(name string) (FileLock, bool, error) {
+	file, err := m.OpenFile(name, os.O_CREATE|os.O_RDWR, DataFilePerm)
+	if err != nil {
+		return nil, false, err
+	}
+	_ = file.Close()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	name = filepath.Clean(name)
+	if m.locks[name] {
+		return nil, false, nil
+	}
+	m.locks[name] = true
+	return &memFileLock{fs: m, name: name}, true, nil
+}
+
+// 路径是否为目录，调用方必须持有锁
+func (m *MemFileSystem) isDir(name string) bool {
+	if node, ok := m.nodes[name]; ok {
+		return node.dir
+	}
+	return isMemRoot(name)
+}
+
+// 目录下是否还有内容，调用方必须持有锁
+func (m *MemFileSystem) hasChildren(name string) bool {
+	prefix := name + string(filepath.Separator)
+	for path := range m.nodes {
+		if strings.HasPrefix(path, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// 检查父目录是否存在，调用方必须持有锁
+func (m *MemFileSystem) checkParent(op, name string) error {
+	if !m.isDir(filepath.Dir(name)) {
+		return &os.PathError{Op: op, Path: name, Err: os.ErrNotExist}
+	}
+	return nil
+}
+
+// 根目录、卷的根目录和当前目录总是存在
+func isMemRoot(name string) bool {
+	return filepath.Dir(name) == name
+}
+
+func (n *memNode) stat(name string) os.FileInfo {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	mode := n.mode
+	if n.dir {
+		mode |= os.ModeDir
+	}
+	return &memFileInfo{
+		name:    filepath.Base(name),
+		size:    int64(len(n.data)),
+		mode:    mode,
+		modTime: n.modTime,
+	}
+}
+
+// 打开的内存文件
+type memFile struct {
+	node     *memNode
+	name     string
+	offset   int64 // Read 和非追加模式 Write 的位置
+	writable bool
+	append   bool
+	closed   bool
+}
+
+func (f *memFile) Read(b []byte) (int, error) {
+	if f.closed {
+		return 0, os.ErrClosed
+	}
+	n, err := f.ReadAt(b, f.offset)
+	f.offset += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+func (f *memFile) ReadAt(b []byte, offset int64) (int, error) {
+	if f.closed {
+		return 0, os.ErrClosed
+	}
+	if offset < 0 {
+		return 0, &os.PathError{Op: "readat", Path: f.name, Err: errors.New("negative offset")}
+	}
+	f.node.mu.RLock()
+	defer f.node.mu.RUnlock()
+	if offset >= int64(len(f.node.data)) {
+		if len(b) == 0 {
+			return 0, nil
+		}
+		return 0, io.EOF
+	}
+	n := copy(b, f.node.data[offset:])
+	if n < len(b) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (f *memFile) Write(b []byte) (int, error) {
+	if f.closed {
+		return 0, os.ErrClosed
+	}
+	if !f.writable {
+		return 0, &os.PathError{Op: "write", Path: f.name, Err: errMemReadOnly}
+	}
+	f.node.mu.Lock()
+	defer f.node.mu.Unlock()
+	if f.append {
+		f.offset = int64(len(f.node.data))
+	}
+	end := f.offset + int64(len(b))
+	if end > int64(len(f.node.data)) {
+		f.node.data = append(f.node.data, make([]byte, end-int64(len(f.node.data)))...)
+	}
+	copy(f.node.data[f.offset:], b)
+	f.offset = end
+	f.node.modTime = time.Now()
+	return len(b), nil
+}
+
+func (f *memFile) Close() error {
+	if f.closed {
+		return os.ErrClosed
+	}
+	f.closed = true
+	return nil
+}
+
+func (f *memFile) Stat() (os.FileInfo, error) {
+	if f.closed {
+		return nil, os.ErrClosed
+	}
+	return f.node.stat(f.name), nil
+}
+
+// Sync 内存文件不需要持久化
+func (f *memFile) Sync() error {
+	if f.closed {
+		return os.ErrClosed
+	}
+	return nil
+}
+
+func (f *memFile) Truncate(size int64) error {
+	if f.closed {
+		return os.ErrClosed
+	}
+	if !f.writable {
+		return &os.PathError{Op: "truncate", Path: f.name, Err: errMemReadOnly}
+	}
+	f.node.mu.Lock()
+	defer f.node.mu.Unlock()
+	if size < int64(len(f.node.data)) {
+		f.node.data = f.node.data[:size:size]
+	} else {
+		f.node.data = append(f.node.data, make([]byte, size-int64(len(f.node.data)))...)
+	}
+	f.node.modTime = time.Now()
+	return nil
+}
+
+type memFileInfo struct {
+	name    string
+	size    int64
+	mode    os.FileMode
+	modTime time.Time
+}
+
+func (fi *memFileInfo) Name() string       { return fi.name }
+func (fi *memFileInfo) Size() int64        { return fi.size }
+func (fi *memFileInfo) Mode() os.FileMode  { return fi.mode }
+func (fi *memFileInfo) ModTime() time.Time { return fi.modTime }
+func (fi *memFileInfo) IsDir() bool        { return fi.mode.IsDir() }
+func (fi *memFileInfo) Sys() any           { return nil }
+
+type memFileLock struct {
+	fs   *MemFileSystem
+	name string
+}
+
+func (l *memFileLock) Unlock() error {
+	l.fs.mu.Lock()
+	defer l.fs.mu.Unlock()
+	delete(l.fs.locks, l.name)
+	return nil
+}
@@ -0,0 +1,148 @@
+package fio
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMemFileSystem_File(t *testing.T) {
+	fsys := NewMemFileSystem()
+	dir := filepath.Join("mem", "db")
+	path := filepath.Join(dir, "a.data")
+
+	// 父目录不存在时不能创建文件
+	_, err := fsys.OpenFile(path, os.O_CREATE|os.O_RDWR, DataFilePerm)
+	assert.True(t, os.IsNotExist(err))
+	assert.Nil(t, fsys.MkdirAll(dir, os.ModePerm))
+
+	file, err := fsys.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_RDWR, DataFilePerm)
+	assert.Nil(t, err)
+	_, err = file.Write([]byte("hello"))
+	assert.Nil(t, err)
+	_, err = file.Write([]byte(" world"))
+	assert.Nil(t, err)
+
+	b := make([]byte, 5)
+	n, err := file.ReadAt(b, 6)
+	assert.Nil(t, err)
+	assert.Equal(t, "world", string(b[:n]))
+	n, err = file.ReadAt(b, 8)
+	assert.Equal(t, io.EOF, err)
+	assert.Equal(t, "rld", string(b[:n]))
+
+	assert.Nil(t, file.Truncate(5))
+	info, err := file.Stat()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(5), info.Size())
+	assert.Nil(t, file.Close())
+	_, err = file.Write([]byte("x"))
+	assert.Equal(t, os.ErrClosed, err)
+
+	content, err := ReadFile(fsys, path)
+	assert.Nil(t, err)
+	assert.Equal(t, "hello", string(content))
+
+	// 只读打开的文件不能写入
+	file, err = fsys.OpenFile(path, os.O_RDONLY, 0)
+	assert.Nil(t, err)
+	_, err = file.Write([]byte("x"))
+	assert.NotNil(t, err)
+	assert.Nil(t, file.Close())
+
+	assert.Nil(t, WriteFile(fsys, path, []byte("new"), DataFilePerm))
+	content, err = ReadFile(fsys, path)
+	assert.Nil(t, err)
+	assert.Equal(t, "new", string(content))
+
+	// 内存文件系统上的所有 io 类型都使用标准文件IO
+	ioManager, err := NewIOManager(fsys, path, MMapIoManager, 0)
+	assert.Nil(t, err)
+	_, ok := ioManager.(*FileIO)
+	assert.True(t, ok)
+	_, err = ioManager.Write([]byte("!"))
+	assert.Nil(t, err)
+	size, err := ioManager.Size()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(4), size)
+	assert.Nil(t, ioManager.Close())
+	_, err = NewIOManager(fsys, path, FileIOType(100), 0)
+	assert.NotNil(t, err)
+
+	// 数据没有写入磁盘
+	_, err = os.Stat(path)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestMemFileSystem_Dir(t *testing.T) {
+	fsys := NewMemFileSystem()
+	assert.Nil(t, fsys.MkdirAll(filepath.Join("a", "b", "c"), os.ModePerm))
+	assert.Nil(t, WriteFile(fsys, filepath.Join("a", "2.data"), []byte("2"), DataFilePerm))
+	assert.Nil(t, WriteFile(fsys, filepath.Join("a", "1.data"), []byte("1"), DataFilePerm))
+	assert.Nil(t, WriteFile(fsys, filepath.Join("a", "b", "c", "3.data"), []byte("3"), DataFilePerm))
+
+	entries, err := fsys.ReadDir("a")
+	assert.Nil(t, err)
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	assert.Equal(t, []string{"1.data", "2.data", "b"}, names)
+	assert.True(t, entries[2].IsDir())
+	_, err = fsys.ReadDir("not-exist")
+	assert.True(t, os.IsNotExist(err))
+
+	info, err := fsys.Stat(filepath.Join("a", "b"))
+	assert.Nil(t, err)
+	assert.True(t, info.IsDir())
+
+	// 非空目录不能直接删除
+	assert.NotNil(t, fsys.Remove(filepath.Join("a", "b")))
+	// 重命名目录时连同其中的内容一起移动
+	assert.Nil(t, fsys.Rename(filepath.Join("a", "b"), filepath.Join("a", "d")))
+	content, err := ReadFile(fsys, filepath.Join("a", "d", "c", "3.data"))
+	assert.Nil(t, err)
+	assert.Equal(t, "3", string(content))
+	_, err = fsys.Stat(filepath.Join("a", "b", "c"))
+	assert.True(t, os.IsNotExist(err))
+
+	assert.Nil(t, fsys.Rename(filepath.Join("a", "1.data"), filepath.Join("a", "2.data")))
+	content, err = ReadFile(fsys, filepath.Join("a", "2.data"))
+	assert.Nil(t, err)
+	assert.Equal(t, "1", string(content))
+	assert.Nil(t, fsys.Truncate(filepath.Join("a", "2.data"), 0))
+	info, err = fsys.Stat(filepath.Join("a", "2.data"))
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), info.Size())
+
+	assert.Nil(t, fsys.Remove(filepath.Join("a", "2.data")))
+	assert.True(t, os.IsNotExist(fsys.Remove(filepath.Join("a", "2.data"))))
+	assert.Nil(t, fsys.RemoveAll("a"))
+	assert.Nil(t, fsys.RemoveAll("a"))
+	_, err = fsys.Stat(filepath.Join("a", "d", "c", "3.data"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestMemFileSystem_TryLock(t *testing.T) {
+	fsys := NewMemFileSystem()
+	lock, hold, err := fsys.TryLock("flock")
+	assert.Nil(t, err)
+	assert.True(t, hold)
+
+	_, hold, err = fsys.TryLock("flock")
+	assert.Nil(t, err)
+	assert.False(t, hold)
+
+	// 另一个内存文件系统中的锁互不影响
+	_, hold, err = NewMemFileSystem().TryLock("flock")
+	assert.Nil(t, err)
+	assert.True(t, hold)
+
+	assert.Nil(t, lock.Unlock())
+	lock, hold, err = fsys.TryLock("flock")
+	assert.Nil(t, err)
+	assert.True(t, hold)
+	assert.Nil(t, lock.Unlock())
+}
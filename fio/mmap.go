@@ -1,28 +1,45 @@
 package fio
 
 import (
-	"golang.org/x/exp/mmap"
+	"errors"
+	"io"
+	"kv_projects/errs"
 	"os"
 )
 
+// MMap
+// @Description: 只读的内存映射文件，映射的内容在 Close 之前一直有效
 type MMap struct {
-	readerAt *mmap.ReaderAt
+	data []byte // 映射到内存中的文件内容
 }
 
 func NewMMapIOManager(filename string) (*MMap, error) {
 	// 文件不存在则创建
-	f, err := os.OpenFile(filename, os.O_CREATE, 0744)
+	f, err := os.OpenFile(filename, os.O_CREATE|os.O_RDONLY, DataFilePerm)
+	if err != nil {
+		return nil, err
+	}
+	// 映射完成后文件描述符就可以关闭了，映射的内容不受影响
 	defer func() {
 		_ = f.Close()
 	}()
+	stat, err := f.Stat()
 	if err != nil {
 		return nil, err
 	}
-	readAt, err := mmap.Open(filename)
+	size := stat.Size()
+	// 空文件无法映射，直接返回
+	if size == 0 {
+		return &MMap{}, nil
+	}
+	if size != int64(int(size)) {
+		return nil, errors.New("mmap: file is too large")
+	}
+	data, err := mmapFile(f, int(size))
 	if err != nil {
 		return nil, err
 	}
-	return &MMap{readerAt: readAt}, nil
+	return &MMap{data: data}, nil
 }
 
 /**
@@ -34,36 +51,67 @@ func NewMMapIOManager(filename string) (*MMap, error) {
  * @return errs
  */
 func (m *MMap) Read(b []byte, offset int64) (int, error) {
-	return m.readerAt.ReadAt(b, offset)
+	if offset < 0 || int64(len(m.data)) < offset {
+		return 0, errors.New("mmap: invalid read offset")
+	}
+	n := copy(b, m.data[offset:])
+	if n < len(b) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+/**
+ * Slice
+ * @Description: 直接返回映射内存中 [offset, offset+n) 的切片，不进行拷贝
+ * 返回的切片在 Close 之后失效，调用方不能修改其内容
+ * @param n
+ * @param offset
+ * @return []byte
+ * @return error
+ */
+func (m *MMap) Slice(n int64, offset int64) ([]byte, error) {
+	if offset < 0 || n < 0 || int64(len(m.data)) < offset {
+		return nil, errors.New("mmap: invalid read offset")
+	}
+	if offset+n > int64(len(m.data)) {
+		return m.data[offset:], io.EOF
+	}
+	return m.data[offset : offset+n : offset+n], nil
 }
 
 /**
  * Write
- * @Description: 不使用mmap进行写操作
+ * @Description: 不使用mmap进行写操作，返回 errs.ErrReadOnlyIOManager
  * @param []byte
  * @return int
  * @return errs
  */
 func (m *MMap) Write([]byte) (int, error) {
-	panic("not implement")
+	return 0, errs.ErrReadOnlyIOManager
 }
 
 /**
  * Sync
- * @Description: 持久化数据，将内存缓冲区的数据持久化到内存当中
+ * @Description: 只读的映射没有需要持久化的数据
  * @return errs
  */
 func (m *MMap) Sync() error {
-	panic("not implement")
+	return nil
 }
 
 /**
  * Close
- * @Description: 关闭文件
+ * @Description: 关闭文件，解除内存映射
  * @return errs
  */
 func (m *MMap) Close() error {
-	return m.readerAt.Close()
+	if m.data == nil {
+		return nil
+	}
+	data := m.data
+	m.data = nil
+	return munmapFile(data)
 }
 
 /**
@@ -73,5 +121,5 @@ func (m *MMap) Close() error {
  * @return error
  */
 func (m *MMap) Size() (int64, error) {
-	return int64(m.readerAt.Len()), nil
+	return int64(len(m.data)), nil
 }
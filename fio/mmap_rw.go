@@ -0,0 +1,166 @@
+package fio
+
+import (
+	"errors"
+	"io"
+	"os"
+	"sync"
+)
+
+// WritableMMap
+// @Description: 可读写的内存映射文件，用于活跃文件。打开时预先分配 capacity 大小的空间并整体映射，
+// 写入直接拷贝到映射的内存中，Sync 时通过 msync 落盘，Close 时将文件截断为实际写入的大小。
+// 进程崩溃时文件末尾会留下预分配的 0，重启时由上层找到最后一条记录并调用 Truncate
+type WritableMMap struct {
+	mu   sync.RWMutex
+	fd   *os.File
+	data []byte // 映射的整个预分配空间
+	size int64  // 实际写入的数据大小
+}
+
+/**
+ * NewWritableMMapIOManager
+ * @Description: 打开可写的内存映射文件，文件已有的内容全部视为有效数据
+ * @param fileName
+ * @param capacity 预分配的大小，小于文件大小时使用文件大小，写满之后按两倍扩容
+ * @return *WritableMMap
+ * @return error
+ */
+func NewWritableMMapIOManager(fileName string, capacity int64) (*WritableMMap, error) {
+	fd, err := os.OpenFile(fileName, os.O_CREATE|os.O_RDWR, DataFilePerm)
+	if err != nil {
+		return nil, err
+	}
+	stat, err := fd.Stat()
+	if err != nil {
+		_ = fd.Close()
+		return nil, err
+	}
+	m := &WritableMMap{fd: fd, size: stat.Size()}
+	if capacity < m.size {
+		capacity = m.size
+	}
+	if err := m.remap(capacity); err != nil {
+		_ = fd.Close()
+		return nil, err
+	}
+	return m, nil
+}
+
+// Read 从 offset 位置读取 len(b) 个字节，只能读取已经写入的数据
+func (m *WritableMMap) Read(b []byte, offset int64) (int, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if offset < 0 || m.size < offset {
+		return 0, errors.New("mmap: invalid read offset")
+	}
+	n := copy(b, m.data[offset:m.size])
+	if n < len(b) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// Write 将数据追加到映射的内存中，预分配的空间不够时扩容
+func (m *WritableMMap) Write(b []byte) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if need := m.size + int64(len(b)); need > int64(len(m.data)) {
+		capacity := 2 * int64(len(m.data))
+		if capacity < need {
+			capacity = need
+		}
+		if err := m.remap(capacity); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(m.data[m.size:], b)
+	m.size += int64(n)
+	return n, nil
+}
+
+// Sync 将映射内存中修改的数据落盘
+func (m *WritableMMap) Sync() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.size == 0 {
+		return nil
+	}
+	// 已经关闭，映射已经解除
+	if m.data == nil {
+		return os.ErrClosed
+	}
+	return msyncFile(m.fd, m.data[:m.size])
+}
+
+/**
+ * Truncate
+ * @Description: 丢弃 size 之后的数据，丢弃的部分重新填充为 0，预分配的空间保持不变
+ * @receiver m
+ * @param size
+ * @return error
+ */
+func (m *WritableMMap) Truncate(size int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if size < 0 || size > m.size {
+		return errors.New("mmap: invalid truncate size")
+	}
+	clear(m.data[size:m.size])
+	m.size = size
+	return nil
+}
+
+// Close 解除映射，将文件截断为实际写入的大小后关闭
+func (m *WritableMMap) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var err error
+	if m.data != nil {
+		err = munmapFile(m.data)
+		m.data = nil
+	}
+	if truncateErr := m.fd.Truncate(m.size); truncateErr != nil && err == nil {
+		err = truncateErr
+	}
+	if closeErr := m.fd.Close(); closeErr != nil && err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// Size 返回实际写入的数据大小，不包括预分配的空间
+func (m *WritableMMap) Size() (int64, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.size, nil
+}
+
+// 预分配 capacity 大小的空间并重新映射，调用方必须持有锁
+func (m *WritableMMap) remap(capacity int64) error {
+	if capacity != int64(int(capacity)) {
+		return errors.New("mmap: file is too large")
+	}
+	if m.data != nil {
+		if err := munmapFile(m.data); err != nil {
+			return err
+		}
+		m.data = nil
+	}
+	if capacity == 0 {
+		return nil
+	}
+	if err := preallocateFile(m.fd, capacity); err != nil {
+		return err
+	}
+	// 预分配改变了文件的大小，需要落盘一次，之后 msync 只需要同步数据
+	if err := m.fd.Sync(); err != nil {
+		return err
+	}
+	data, err := mmapFileRW(m.fd, int(capacity))
+	if err != nil {
+		return err
+	}
+	m.data = data
+	return nil
+}
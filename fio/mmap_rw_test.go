@@ -0,0 +1,71 @@
+package fio
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWritableMMap_ReadWrite(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "mmap-rw")
+	defer destroyFile(dir)
+	path := filepath.Join(dir, "a.data")
+
+	m, err := NewWritableMMapIOManager(path, 16)
+	assert.Nil(t, err)
+	// 打开时预分配空间，Size 只返回写入的大小
+	stat, _ := os.Stat(path)
+	assert.Equal(t, int64(16), stat.Size())
+	size, err := m.Size()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), size)
+
+	_, err = m.Write([]byte("aaaabbbb"))
+	assert.Nil(t, err)
+	b := make([]byte, 4)
+	n, err := m.Read(b, 4)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("bbbb"), b[:n])
+	n, err = m.Read(b, 6)
+	assert.Equal(t, 2, n)
+	assert.Equal(t, io.EOF, err)
+
+	// 预分配的空间写满后扩容
+	_, err = m.Write([]byte("cccccccccccc"))
+	assert.Nil(t, err)
+	size, _ = m.Size()
+	assert.Equal(t, int64(20), size)
+	stat, _ = os.Stat(path)
+	assert.Equal(t, int64(32), stat.Size())
+	assert.Nil(t, m.Sync())
+
+	// 截断之后从新的位置继续写入，丢弃的部分重新填充为 0
+	assert.Nil(t, m.Truncate(12))
+	assert.NotNil(t, m.Truncate(13))
+	_, err = m.Write([]byte("dd"))
+	assert.Nil(t, err)
+	b = make([]byte, 14)
+	n, err = m.Read(b, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("aaaabbbbccccdd"), b[:n])
+
+	// 关闭时截断为实际写入的大小
+	assert.Nil(t, m.Close())
+	assert.Equal(t, os.ErrClosed, m.Sync())
+	content, err := os.ReadFile(path)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("aaaabbbbccccdd"), content)
+
+	// 重新打开时已有内容全部有效，从末尾继续写入
+	m2, err := NewIOManager(OSFileSystem{}, path, MMapWriteIoManager, 8)
+	assert.Nil(t, err)
+	size, _ = m2.Size()
+	assert.Equal(t, int64(14), size)
+	_, err = m2.Write([]byte("ee"))
+	assert.Nil(t, err)
+	assert.Nil(t, m2.Close())
+	content, _ = os.ReadFile(path)
+	assert.Equal(t, []byte("aaaabbbbccccddee"), content)
+}
@@ -3,6 +3,8 @@ package fio
 import (
 	"github.com/stretchr/testify/assert"
 	"io"
+	"kv_projects/errs"
+	"os"
 	"path/filepath"
 	"testing"
 )
@@ -46,3 +48,50 @@ func TestMMap_Read(t *testing.T) {
 	assert.Nil(t, err)
 	assert.Equal(t, 2, n2)
 }
+
+func TestMMap_Slice(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "mmap-slice")
+	defer destroyFile(dir)
+	path := filepath.Join(dir, "mmap-b.data")
+
+	fio, err := NewFileIOManager(path)
+	assert.Nil(t, err)
+	_, err = fio.Write([]byte("aabbcc"))
+	assert.Nil(t, err)
+	assert.Nil(t, fio.Close())
+
+	mmapIO, err := NewMMapIOManager(path)
+	assert.Nil(t, err)
+	defer func() {
+		_ = mmapIO.Close()
+	}()
+
+	b, err := mmapIO.Slice(2, 2)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("bb"), b)
+
+	// 超出文件末尾时返回剩余的内容和 EOF
+	b, err = mmapIO.Slice(10, 4)
+	assert.Equal(t, io.EOF, err)
+	assert.Equal(t, []byte("cc"), b)
+
+	_, err = mmapIO.Slice(1, 7)
+	assert.NotNil(t, err)
+}
+
+func TestMMap_ReadOnly(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "mmap-readonly")
+	defer destroyFile(dir)
+
+	mmapIO, err := NewIOManager(OSFileSystem{}, filepath.Join(dir, "mmap-c.data"), MMapIoManager, 0)
+	assert.Nil(t, err)
+	defer func() {
+		_ = mmapIO.Close()
+	}()
+	_, err = mmapIO.Write([]byte("aa"))
+	assert.Equal(t, errs.ErrReadOnlyIOManager, err)
+	assert.Nil(t, mmapIO.Sync())
+
+	_, err = NewIOManager(OSFileSystem{}, filepath.Join(dir, "mmap-d.data"), FileIOType(100), 0)
+	assert.Equal(t, errs.ErrUnsupportedIOType, err)
+}
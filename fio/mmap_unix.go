@@ -0,0 +1,23 @@
+//go:build !windows
+
+package fio
+
+import (
+	"os"
+	"syscall"
+)
+
+// 将文件的前 size 个字节以只读方式映射到内存
+func mmapFile(f *os.File, size int) ([]byte, error) {
+	return syscall.Mmap(int(f.Fd()), 0, size, syscall.PROT_READ, syscall.MAP_SHARED)
+}
+
+// 解除内存映射
+func munmapFile(data []byte) error {
+	return syscall.Munmap(data)
+}
+
+// 将文件的前 size 个字节以读写方式映射到内存，修改会写回文件
+func mmapFileRW(f *os.File, size int) ([]byte, error) {
+	return syscall.Mmap(int(f.Fd()), 0, size, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
+}
@@ -0,0 +1,57 @@
+//go:build windows
+
+package fio
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// 将文件的前 size 个字节以只读方式映射到内存
+func mmapFile(f *os.File, size int) ([]byte, error) {
+	h, err := syscall.CreateFileMapping(syscall.Handle(f.Fd()), nil, syscall.PAGE_READONLY,
+		uint32(uint64(size)>>32), uint32(size), nil)
+	if err != nil {
+		return nil, err
+	}
+	// 映射视图会持有文件映射对象的引用，句柄可以直接关闭
+	defer func() {
+		_ = syscall.CloseHandle(h)
+	}()
+	addr, err := syscall.MapViewOfFile(h, syscall.FILE_MAP_READ, 0, 0, uintptr(size))
+	if err != nil {
+		return nil, err
+	}
+	return unsafe.Slice((*byte)(unsafe.Pointer(addr)), size), nil
+}
+
+// 解除内存映射
+func munmapFile(data []byte) error {
+	return syscall.UnmapViewOfFile(uintptr(unsafe.Pointer(&data[0])))
+}
+
+// 将文件的前 size 个字节以读写方式映射到内存，修改会写回文件，文件不足 size 时会被扩大
+func mmapFileRW(f *os.File, size int) ([]byte, error) {
+	h, err := syscall.CreateFileMapping(syscall.Handle(f.Fd()), nil, syscall.PAGE_READWRITE,
+		uint32(uint64(size)>>32), uint32(size), nil)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = syscall.CloseHandle(h)
+	}()
+	addr, err := syscall.MapViewOfFile(h, syscall.FILE_MAP_WRITE, 0, 0, uintptr(size))
+	if err != nil {
+		return nil, err
+	}
+	return unsafe.Slice((*byte)(unsafe.Pointer(addr)), size), nil
+}
+
+// 将映射内存中修改的数据写回文件，再刷新文件的磁盘缓存
+func msyncFile(f *os.File, data []byte) error {
+	if err := syscall.FlushViewOfFile(uintptr(unsafe.Pointer(&data[0])), uintptr(len(data))); err != nil {
+		return err
+	}
+	return f.Sync()
+}
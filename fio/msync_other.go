@@ -0,0 +1,10 @@
+//go:build !linux && !darwin && !freebsd && !dragonfly && !openbsd && !windows
+
+package fio
+
+import "os"
+
+// 标准库没有提供当前平台的 msync，映射和文件共用页缓存，通过 fsync 落盘
+func msyncFile(f *os.File, _ []byte) error {
+	return f.Sync()
+}
@@ -0,0 +1,18 @@
+//go:build linux || darwin || freebsd || dragonfly || openbsd
+
+package fio
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// 将映射内存中修改的数据同步写回磁盘
+func msyncFile(_ *os.File, data []byte) error {
+	_, _, errno := syscall.Syscall(syscall.SYS_MSYNC, uintptr(unsafe.Pointer(&data[0])), uintptr(len(data)), syscall.MS_SYNC)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
@@ -0,0 +1,17 @@
+//go:build !linux
+
+package fio
+
+import "os"
+
+// 当前平台没有 fallocate，扩展文件大小，磁盘空间在写入时才分配
+func preallocateFile(f *os.File, size int64) error {
+	stat, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if stat.Size() >= size {
+		return nil
+	}
+	return f.Truncate(size)
+}
@@ -84,7 +84,11 @@ func handleListKeys(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "method not be allowed", http.StatusMethodNotAllowed)
 		return
 	}
-	listKeys := Db.ListKeys()
+	listKeys, err := Db.ListKeys()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
 	w.Header().Set("Content-Type", "application/json")
 	var result []string
 	for _, v := range listKeys {
@@ -98,7 +102,11 @@ func handleStat(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "method not be allowed", http.StatusMethodNotAllowed)
 		return
 	}
-	stat := Db.Stat()
+	stat, err := Db.Stat()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
 	w.Header().Set("Content-Type", "application/json")
 	_ = json.NewEncoder(w).Encode(stat)
 }
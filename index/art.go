@@ -4,7 +4,7 @@ import (
 	"bytes"
 	goart "github.com/plar/go-adaptive-radix-tree"
 	"kv_projects/data"
-	"sort"
+	"math"
 	"sync"
 )
 
@@ -22,159 +22,176 @@ func NewART() *AdaptiveRadixTree {
 	}
 }
 
-func (art *AdaptiveRadixTree) Put(key []byte, pos *data.LogRecordPos) *data.LogRecordPos {
+func (art *AdaptiveRadixTree) Put(key []byte, pos *data.LogRecordPos) (*data.LogRecordPos, error) {
 	art.mutex.Lock()
 	oldValue, _ := art.tree.Insert(key, pos)
 	art.mutex.Unlock()
 	if oldValue == nil {
-		return nil
+		return nil, nil
 	}
-	return oldValue.(*data.LogRecordPos)
+	return oldValue.(*data.LogRecordPos), nil
 }
 
-func (art *AdaptiveRadixTree) Get(key []byte) *data.LogRecordPos {
+func (art *AdaptiveRadixTree) Get(key []byte) (*data.LogRecordPos, error) {
 	art.mutex.RLock()
 	defer art.mutex.RUnlock()
 	value, found := art.tree.Search(key)
 	if !found {
-		return nil
+		return nil, nil
 	}
-	return value.(*data.LogRecordPos)
+	return value.(*data.LogRecordPos), nil
 }
 
-func (art *AdaptiveRadixTree) Delete(key []byte) (*data.LogRecordPos, bool) {
+func (art *AdaptiveRadixTree) Delete(key []byte) (*data.LogRecordPos, bool, error) {
 	art.mutex.Lock()
 	defer art.mutex.Unlock()
 	oldValue, deleted := art.tree.Delete(key)
 	if oldValue == nil {
-		return nil, deleted
+		return nil, deleted, nil
 	}
-	return oldValue.(*data.LogRecordPos), deleted
+	return oldValue.(*data.LogRecordPos), deleted, nil
 }
 
-func (art *AdaptiveRadixTree) Iterator(reverse bool) Iterator {
-	art.mutex.Lock()
-	defer art.mutex.Unlock()
-	return newARTIterator(art.tree, reverse)
+/**
+ * Iterator
+ * @Description: 返回游标式的迭代器，遍历过程中不持有锁，也不会复制整棵树。
+ * 基数树本身只支持从小到大遍历，反向遍历需要按前缀逐层拆分，速度比正向遍历慢
+ * @receiver art
+ * @param reverse
+ * @return Iterator
+ * @return error
+ */
+func (art *AdaptiveRadixTree) Iterator(reverse bool) (Iterator, error) {
+	return newBatchIterator(func(pivot []byte, hasPivot, inclusive bool, fn func(key []byte, pos *data.LogRecordPos) bool) {
+		art.mutex.RLock()
+		defer art.mutex.RUnlock()
+		if reverse {
+			art.descend(pivot, hasPivot, inclusive, fn)
+		} else {
+			art.ascend(pivot, hasPivot, inclusive, fn)
+		}
+	}), nil
 }
-func (art *AdaptiveRadixTree) Size() int {
+
+func (art *AdaptiveRadixTree) Size() (int, error) {
 	art.mutex.RLock()
 	size := art.tree.Size()
 	art.mutex.RUnlock()
-	return size
+	return size, nil
 }
 
 func (art *AdaptiveRadixTree) Close() error {
 	return nil
 }
 
-type ARTIterator struct {
-	currIndex int         //当前遍历位置的下标
-	reverse   bool        // 是否是反向遍历
-	values    []*ItemSelf // key和其对应内容的位置信息
-}
-
-func newARTIterator(art goart.Tree, reverse bool) *ARTIterator {
-	Index := 0
-	if reverse {
-		Index = art.Size() - 1
-	}
-	// 将节点取出存放到数组然后实现迭代器方法，会占用大量内存
-	values := make([]*ItemSelf, art.Size())
-
-	saveValues := func(node goart.Node) bool {
-		item := &ItemSelf{
-			key: node.Key(),
-			pos: node.Value().(*data.LogRecordPos),
+/**
+ * ascend
+ * @Description: 从小到大遍历大于（等于）pivot 的 key
+ * 基数树没有提供定位到任意 key 的接口，所以把"大于 pivot"拆分成若干个按顺序排列的前缀：
+ * 以 pivot 为前缀的 key，然后从 pivot 的最后一个字节往前，依次是 pivot[:i] 加上一个比 pivot[i] 大的字节
+ */
+func (art *AdaptiveRadixTree) ascend(pivot []byte, hasPivot, inclusive bool, fn func(key []byte, pos *data.LogRecordPos) bool) {
+	stopped := false
+	visit := func(node goart.Node) bool {
+		// ForEachPrefix 在某些情况下也会访问内部节点，需要跳过
+		if node.Kind() != goart.Leaf {
+			return true
 		}
-		values[Index] = item
-		if reverse {
-			Index--
-		} else {
-			Index++
+		key := node.Key()
+		if hasPivot && !inclusive && bytes.Equal(key, pivot) {
+			return true
 		}
-		return true
+		if !fn(key, node.Value().(*data.LogRecordPos)) {
+			stopped = true
+		}
+		return !stopped
 	}
-
-	art.ForEach(saveValues)
-
-	return &ARTIterator{
-		currIndex: 0,
-		reverse:   reverse,
-		values:    values,
+	if !hasPivot {
+		art.tree.ForEach(visit)
+		return
 	}
 
-}
-
-// BTree 实现索引器接口
-/**
- * Rewind
- * @Description:重新回到迭代器的起点，即第一个数据
- */
-func (ai *ARTIterator) Rewind() {
-	ai.currIndex = 0
-}
-
-/**
- * Seek
- * @Description:根据传入的 key 查找到第一个大于（或小于）等于的目标 key，根据从这个 key 开始遍历
- * @param key
- */
-func (ai *ARTIterator) Seek(key []byte) {
-	// btree 本身有序，取出后存放在数组也是有序的
-	if ai.reverse {
-		// 从大到小排列，找到小于等于key
-		ai.currIndex = sort.Search(len(ai.values), func(i int) bool {
-			return bytes.Compare(ai.values[i].key, key) <= 0
-		})
-	} else {
-		// 从小到大排列，找到大于等于key
-		ai.currIndex = sort.Search(len(ai.values), func(i int) bool {
-			return bytes.Compare(ai.values[i].key, key) >= 0
-		})
+	// 注意 ForEachPrefix 不能传 nil，空前缀需要使用空切片
+	prefix := make([]byte, len(pivot))
+	copy(prefix, pivot)
+	art.tree.ForEachPrefix(prefix, visit)
+	for i := len(pivot) - 1; i >= 0 && !stopped; i-- {
+		for c := int(pivot[i]) + 1; c <= math.MaxUint8 && !stopped; c++ {
+			prefix[i] = byte(c)
+			art.tree.ForEachPrefix(prefix[:i+1], visit)
+		}
 	}
 }
 
 /**
- * Next
- * @Description:跳转到下一个 key
- */
-func (ai *ARTIterator) Next() {
-	ai.currIndex += 1
-}
-
-/**
- * Valid
- * @Description:是否有效，即是否已经遍历完了所有的 key，用于退出遍历
- * @return bool
- */
-func (ai *ARTIterator) Valid() bool {
-	return ai.currIndex < len(ai.values)
-}
-
-/**
- * Key
- * @Description:当前遍历位置的 Key 数据
- * @return []byte
+ * descend
+ * @Description: 从大到小遍历小于（等于）pivot 的 key，拆分方式和 ascend 相反，
+ * 依次是 pivot[:i] 加上一个比 pivot[i] 小的字节，以及 pivot[:i] 本身
  */
-func (ai *ARTIterator) Key() []byte {
-	return ai.values[ai.currIndex].key
+func (art *AdaptiveRadixTree) descend(pivot []byte, hasPivot, inclusive bool, fn func(key []byte, pos *data.LogRecordPos) bool) {
+	if !hasPivot {
+		art.descendPrefix([]byte{}, fn)
+		return
+	}
+	if inclusive {
+		if value, found := art.tree.Search(pivot); found && !fn(pivot, value.(*data.LogRecordPos)) {
+			return
+		}
+	}
+	prefix := make([]byte, len(pivot))
+	copy(prefix, pivot)
+	for i := len(pivot) - 1; i >= 0; i-- {
+		for c := int(pivot[i]) - 1; c >= 0; c-- {
+			prefix[i] = byte(c)
+			if !art.descendPrefix(prefix[:i+1], fn) {
+				return
+			}
+		}
+		if value, found := art.tree.Search(pivot[:i]); found && !fn(pivot[:i:i], value.(*data.LogRecordPos)) {
+			return
+		}
+	}
 }
 
 /**
- * Value
- * @Description:当前遍历位置的 Value 数据
- * @return *data.LogRecordPos
+ * descendPrefix
+ * @Description: 从大到小遍历以 prefix 为前缀的所有 key，fn 返回 false 时停止并返回 false
+ * 基数树只能从小到大遍历，key 较少时先取出再倒序访问；key 较多时按下一个字节从大到小拆分成更小的前缀，
+ * 这样需要暂存的 key 数量不会超过一个批次
  */
-func (ai *ARTIterator) Value() *data.LogRecordPos {
-	return ai.values[ai.currIndex].pos
-}
+func (art *AdaptiveRadixTree) descendPrefix(prefix []byte, fn func(key []byte, pos *data.LogRecordPos) bool) bool {
+	nodes := make([]goart.Node, 0, iteratorBatchSize)
+	tooMany := false
+	art.tree.ForEachPrefix(prefix, func(node goart.Node) bool {
+		if node.Kind() != goart.Leaf {
+			return true
+		}
+		if len(nodes) == iteratorBatchSize {
+			tooMany = true
+			return false
+		}
+		nodes = append(nodes, node)
+		return true
+	})
+	if !tooMany {
+		for i := len(nodes) - 1; i >= 0; i-- {
+			if !fn(nodes[i].Key(), nodes[i].Value().(*data.LogRecordPos)) {
+				return false
+			}
+		}
+		return true
+	}
 
-/**
- * Close
- * @Description:关闭迭代器，释放相应资源
- */
-func (ai *ARTIterator) Close() {
-	// 清楚临时数组
-	ai.values = nil
+	child := make([]byte, len(prefix)+1)
+	copy(child, prefix)
+	for c := math.MaxUint8; c >= 0; c-- {
+		child[len(prefix)] = byte(c)
+		if !art.descendPrefix(child, fn) {
+			return false
+		}
+	}
+	if value, found := art.tree.Search(prefix); found {
+		return fn(child[:len(prefix):len(prefix)], value.(*data.LogRecordPos))
+	}
+	return true
 }
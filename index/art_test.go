@@ -8,14 +8,18 @@ import (
 
 func TestAdaptiveRadixTree_Put(t *testing.T) {
 	art := NewART()
-	res1 := art.Put([]byte("key-1"), &data.LogRecordPos{Fid: 1, Offset: 12})
+	res1, err := art.Put([]byte("key-1"), &data.LogRecordPos{Fid: 1, Offset: 12})
+	assert.Nil(t, err)
 	assert.Nil(t, res1)
-	res2 := art.Put([]byte("key-2"), &data.LogRecordPos{Fid: 1, Offset: 12})
+	res2, err := art.Put([]byte("key-2"), &data.LogRecordPos{Fid: 1, Offset: 12})
+	assert.Nil(t, err)
 	assert.Nil(t, res2)
-	res3 := art.Put([]byte("key-3"), &data.LogRecordPos{Fid: 1, Offset: 12})
+	res3, err := art.Put([]byte("key-3"), &data.LogRecordPos{Fid: 1, Offset: 12})
+	assert.Nil(t, err)
 	assert.Nil(t, res3)
 
-	res4 := art.Put([]byte("key-3"), &data.LogRecordPos{Fid: 99, Offset: 88})
+	res4, err := art.Put([]byte("key-3"), &data.LogRecordPos{Fid: 99, Offset: 88})
+	assert.Nil(t, err)
 	assert.Equal(t, uint32(1), res4.Fid)
 	assert.Equal(t, int64(12), res4.Offset)
 }
@@ -23,43 +27,49 @@ func TestAdaptiveRadixTree_Put(t *testing.T) {
 func TestAdaptiveRadixTree_Get(t *testing.T) {
 	art := NewART()
 	art.Put([]byte("key-1"), &data.LogRecordPos{Fid: 1, Offset: 12})
-	pos := art.Get([]byte("key-1"))
+	pos, err := art.Get([]byte("key-1"))
+	assert.Nil(t, err)
 	assert.NotNil(t, pos)
 
-	pos1 := art.Get([]byte("not exist"))
+	pos1, err := art.Get([]byte("not exist"))
+	assert.Nil(t, err)
 	assert.Nil(t, pos1)
 
 	art.Put([]byte("key-1"), &data.LogRecordPos{Fid: 1123, Offset: 990})
-	pos2 := art.Get([]byte("key-1"))
+	pos2, err := art.Get([]byte("key-1"))
+	assert.Nil(t, err)
 	assert.NotNil(t, pos2)
 }
 
 func TestAdaptiveRadixTree_Delete(t *testing.T) {
 	art := NewART()
 
-	res1, ok1 := art.Delete([]byte("not exist"))
+	res1, ok1, err := art.Delete([]byte("not exist"))
+	assert.Nil(t, err)
 	assert.Nil(t, res1)
 	assert.False(t, ok1)
 
 	art.Put([]byte("key-1"), &data.LogRecordPos{Fid: 1, Offset: 12})
-	res2, ok2 := art.Delete([]byte("key-1"))
+	res2, ok2, err := art.Delete([]byte("key-1"))
+	assert.Nil(t, err)
 	assert.True(t, ok2)
 	assert.Equal(t, uint32(1), res2.Fid)
 	assert.Equal(t, int64(12), res2.Offset)
 
-	pos := art.Get([]byte("key-1"))
+	pos, err := art.Get([]byte("key-1"))
+	assert.Nil(t, err)
 	assert.Nil(t, pos)
 }
 
 func TestAdaptiveRadixTree_Size(t *testing.T) {
 	art := NewART()
 
-	assert.Equal(t, 0, art.Size())
+	assert.Equal(t, 0, mustSize(t, art))
 
 	art.Put([]byte("key-1"), &data.LogRecordPos{Fid: 1, Offset: 12})
 	art.Put([]byte("key-2"), &data.LogRecordPos{Fid: 1, Offset: 12})
 	art.Put([]byte("key-1"), &data.LogRecordPos{Fid: 1, Offset: 12})
-	assert.Equal(t, 2, art.Size())
+	assert.Equal(t, 2, mustSize(t, art))
 }
 
 func TestAdaptiveRadixTree_Iterator(t *testing.T) {
@@ -70,7 +80,8 @@ func TestAdaptiveRadixTree_Iterator(t *testing.T) {
 	art.Put([]byte("bbde"), &data.LogRecordPos{Fid: 1, Offset: 12})
 	art.Put([]byte("bade"), &data.LogRecordPos{Fid: 1, Offset: 12})
 
-	iter := art.Iterator(true)
+	iter, err := art.Iterator(true)
+	assert.Nil(t, err)
 	for iter.Rewind(); iter.Valid(); iter.Next() {
 		assert.NotNil(t, iter.Key())
 		assert.NotNil(t, iter.Value())
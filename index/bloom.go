@@ -0,0 +1,158 @@
+package index
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"hash/fnv"
+	"math"
+	"sync/atomic"
+)
+
+// 持久化布隆过滤器时使用的魔数，用于校验文件格式
+const bloomFileMagic uint32 = 0x626c6f6d
+
+// 布隆过滤器 header 长度: magic(4) + k(4) + m(8) + count(8) + capacity(8) + fpRate(8)
+const bloomHeaderSize = 40
+
+// 布隆过滤器最少可以容纳的 key 数量，避免数据很少时频繁重建
+const minBloomCapacity = 1 << 10
+
+var errBloomCorrupted = errors.New("bloom filter file is corrupted")
+
+// BloomFilter
+// @Description: 布隆过滤器，用于快速判断 key 一定不存在，位数组通过原子操作更新，可以并发读写
+type BloomFilter struct {
+	bits     []uint64 // 位数组
+	m        uint64   // 位数组的长度
+	k        uint32   // 哈希函数的个数
+	count    uint64   // 已经添加的 key 数量
+	capacity uint64   // 在 fpRate 的误判率下可以容纳的 key 数量
+	fpRate   float64  // 期望的误判率
+}
+
+/**
+ * NewBloomFilter
+ * @Description: 根据预计的 key 数量和误判率初始化布隆过滤器
+ * @param capacity
+ * @param fpRate
+ * @return *BloomFilter
+ */
+func NewBloomFilter(capacity uint64, fpRate float64) *BloomFilter {
+	if capacity < minBloomCapacity {
+		capacity = minBloomCapacity
+	}
+	// m = -n*ln(p) / (ln2)^2, k = m/n * ln2
+	m := uint64(math.Ceil(-float64(capacity) * math.Log(fpRate) / (math.Ln2 * math.Ln2)))
+	m = (m + 63) / 64 * 64
+	k := uint32(math.Round(float64(m) / float64(capacity) * math.Ln2))
+	if k < 1 {
+		k = 1
+	}
+	return &BloomFilter{
+		bits:     make([]uint64, m/64),
+		m:        m,
+		k:        k,
+		capacity: capacity,
+		fpRate:   fpRate,
+	}
+}
+
+// 使用两个哈希值模拟 k 个哈希函数
+func bloomHash(key []byte) (uint32, uint32) {
+	h := fnv.New64a()
+	_, _ = h.Write(key)
+	sum := h.Sum64()
+	return uint32(sum), uint32(sum>>32) | 1
+}
+
+// Add 将 key 添加到布隆过滤器中
+func (bf *BloomFilter) Add(key []byte) {
+	h1, h2 := bloomHash(key)
+	for i := uint32(0); i < bf.k; i++ {
+		bit := uint64(h1+i*h2) % bf.m
+		word, mask := &bf.bits[bit/64], uint64(1)<<(bit%64)
+		for {
+			old := atomic.LoadUint64(word)
+			if old&mask != 0 || atomic.CompareAndSwapUint64(word, old, old|mask) {
+				break
+			}
+		}
+	}
+	atomic.AddUint64(&bf.count, 1)
+}
+
+// MayContain 返回 false 时 key 一定不存在，返回 true 时 key 可能存在
+func (bf *BloomFilter) MayContain(key []byte) bool {
+	h1, h2 := bloomHash(key)
+	for i := uint32(0); i < bf.k; i++ {
+		bit := uint64(h1+i*h2) % bf.m
+		if atomic.LoadUint64(&bf.bits[bit/64])&(uint64(1)<<(bit%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Full 添加的 key 超过容量后误判率会升高，需要扩容重建
+func (bf *BloomFilter) Full() bool {
+	return atomic.LoadUint64(&bf.count) > bf.capacity
+}
+
+/**
+ * Encode
+ * @Description: 将布隆过滤器编码为字节数组，末尾带有 crc 校验值
+ * @receiver bf
+ * @return []byte
+ */
+func (bf *BloomFilter) Encode() []byte {
+	buf := make([]byte, bloomHeaderSize+len(bf.bits)*8+crc32.Size)
+	binary.LittleEndian.PutUint32(buf[0:], bloomFileMagic)
+	binary.LittleEndian.PutUint32(buf[4:], bf.k)
+	binary.LittleEndian.PutUint64(buf[8:], bf.m)
+	binary.LittleEndian.PutUint64(buf[16:], atomic.LoadUint64(&bf.count))
+	binary.LittleEndian.PutUint64(buf[24:], bf.capacity)
+	binary.LittleEndian.PutUint64(buf[32:], math.Float64bits(bf.fpRate))
+	index := bloomHeaderSize
+	for i := range bf.bits {
+		binary.LittleEndian.PutUint64(buf[index:], atomic.LoadUint64(&bf.bits[i]))
+		index += 8
+	}
+	binary.LittleEndian.PutUint32(buf[index:], crc32.ChecksumIEEE(buf[:index]))
+	return buf
+}
+
+/**
+ * DecodeBloomFilter
+ * @Description: 从字节数组中解码布隆过滤器，数据不完整或者校验失败时返回错误
+ * @param buf
+ * @return *BloomFilter
+ * @return error
+ */
+func DecodeBloomFilter(buf []byte) (*BloomFilter, error) {
+	if len(buf) < bloomHeaderSize+crc32.Size {
+		return nil, errBloomCorrupted
+	}
+	end := len(buf) - crc32.Size
+	if crc32.ChecksumIEEE(buf[:end]) != binary.LittleEndian.Uint32(buf[end:]) {
+		return nil, errBloomCorrupted
+	}
+	if binary.LittleEndian.Uint32(buf[0:]) != bloomFileMagic {
+		return nil, errBloomCorrupted
+	}
+	bf := &BloomFilter{
+		k:        binary.LittleEndian.Uint32(buf[4:]),
+		m:        binary.LittleEndian.Uint64(buf[8:]),
+		count:    binary.LittleEndian.Uint64(buf[16:]),
+		capacity: binary.LittleEndian.Uint64(buf[24:]),
+		fpRate:   math.Float64frombits(binary.LittleEndian.Uint64(buf[32:])),
+	}
+	if bf.k == 0 || bf.m == 0 || bf.m%64 != 0 || uint64(end-bloomHeaderSize) != bf.m/8 {
+		return nil, errBloomCorrupted
+	}
+	bf.bits = make([]uint64, bf.m/64)
+	for i := range bf.bits {
+		bf.bits[i] = binary.LittleEndian.Uint64(buf[bloomHeaderSize+i*8:])
+	}
+	return bf, nil
+}
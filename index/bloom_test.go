@@ -0,0 +1,50 @@
+package index
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestBloomFilter_AddMayContain(t *testing.T) {
+	bf := NewBloomFilter(10000, 0.01)
+	for i := 0; i < 10000; i++ {
+		bf.Add([]byte(fmt.Sprintf("key-%d", i)))
+	}
+	// 添加过的 key 一定不会被判断为不存在
+	for i := 0; i < 10000; i++ {
+		assert.True(t, bf.MayContain([]byte(fmt.Sprintf("key-%d", i))))
+	}
+	// 不存在的 key 误判率接近配置值
+	var falsePositive int
+	for i := 0; i < 10000; i++ {
+		if bf.MayContain([]byte(fmt.Sprintf("unknown-%d", i))) {
+			falsePositive++
+		}
+	}
+	assert.True(t, falsePositive < 300, falsePositive)
+	assert.False(t, bf.Full())
+}
+
+func TestBloomFilter_EncodeDecode(t *testing.T) {
+	bf := NewBloomFilter(100, 0.05)
+	bf.Add([]byte("aaa"))
+	bf.Add([]byte("bbb"))
+
+	buf := bf.Encode()
+	bf2, err := DecodeBloomFilter(buf)
+	assert.Nil(t, err)
+	assert.True(t, bf2.MayContain([]byte("aaa")))
+	assert.True(t, bf2.MayContain([]byte("bbb")))
+	assert.Equal(t, bf.m, bf2.m)
+	assert.Equal(t, bf.k, bf2.k)
+	assert.Equal(t, uint64(2), bf2.count)
+	assert.Equal(t, 0.05, bf2.fpRate)
+
+	// 数据被破坏时返回错误
+	buf[bloomHeaderSize] ^= 0xff
+	_, err = DecodeBloomFilter(buf)
+	assert.Equal(t, errBloomCorrupted, err)
+	_, err = DecodeBloomFilter(buf[:10])
+	assert.Equal(t, errBloomCorrupted, err)
+}
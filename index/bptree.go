@@ -1,64 +1,260 @@
 package index
 
 import (
+	"encoding/binary"
 	"go.etcd.io/bbolt"
 	"kv_projects/data"
+	"kv_projects/errs"
+	"os"
 	"path/filepath"
+	"sync"
+	"sync/atomic"
 )
 
-const BtreeIndexFileName = "bptree-index"
+const (
+	BtreeIndexFileName  = "bptree-index"
+	BloomFilterFileName = "bptree-bloom"
+)
 
-var indexBucketName = []byte("bitcask-index")
+var (
+	indexBucketName = []byte("bitcask-index")
+	// 存放数据库元信息的 bucket，和索引在同一个 bbolt 事务中更新
+	metaBucketName = []byte("bitcask-meta")
+	seqNoMetaKey   = []byte("seq-no")
+)
 
 // b+ 树索引
 type BPlusTree struct {
 	tree *bbolt.DB
+
+	// 布隆过滤器，查询不存在的 key 时不需要开启 bbolt 事务，为 nil 时不使用
+	bloom     atomic.Pointer[BloomFilter]
+	bloomMu   *sync.RWMutex // 写索引时持有读锁，重建布隆过滤器时持有写锁
+	bloomPath string
+	fpRate    float64
 }
 
 /**
  * NewBPlusTree
  * @Description: 初始化 B+ 索引
  * @param dirPath
+ * @param syncWrite
+ * @param bloomFPRate 布隆过滤器的误判率，为 0 时不使用布隆过滤器
  * @return *BPlusTree
+ * @return error
  */
-func NewBPlusTree(dirPath string, syncWrite bool) *BPlusTree {
+func NewBPlusTree(dirPath string, syncWrite bool, bloomFPRate float64) (*BPlusTree, error) {
 	// 按照需求修改相应的配置
 	options := bbolt.DefaultOptions
 	//b+ 树是否持久化的操作保持和用户传入的配置一致
 	options.NoSync = !syncWrite
 	bpTree, err := bbolt.Open(filepath.Join(dirPath, BtreeIndexFileName), 0644, options)
 	if err != nil {
-		panic("failed to open bptree")
+		return nil, &errs.IndexError{Op: "open", Err: err}
 	}
 	// bbolt 包的操作默认支持事务，每次操作都相当于开启了一个事务
 	if err := bpTree.Update(func(tx *bbolt.Tx) error {
 		// 执行操作时，需要创建一个 bucket
-		_, err := tx.CreateBucketIfNotExists(indexBucketName)
+		if _, err := tx.CreateBucketIfNotExists(indexBucketName); err != nil {
+			return err
+		}
+		_, err := tx.CreateBucketIfNotExists(metaBucketName)
 		return err
 	}); err != nil {
-		panic("failed to create bucket in bptree")
+		_ = bpTree.Close()
+		return nil, &errs.IndexError{Op: "create bucket", Err: err}
+	}
+	bpt := &BPlusTree{
+		tree:      bpTree,
+		bloomMu:   new(sync.RWMutex),
+		bloomPath: filepath.Join(dirPath, BloomFilterFileName),
+		fpRate:    bloomFPRate,
+	}
+	if bloomFPRate > 0 {
+		if err := bpt.loadBloomFilter(); err != nil {
+			_ = bpTree.Close()
+			return nil, &errs.IndexError{Op: "load bloom filter", Err: err}
+		}
+	}
+	return bpt, nil
+}
+
+/**
+ * loadBloomFilter
+ * @Description: 加载 Close 时持久化的布隆过滤器，文件不存在、损坏或者误判率配置改变时重新构建
+ * 加载完成后删除该文件，如果进程异常退出，下次启动时文件不存在，会重新构建
+ * @receiver bpt
+ * @return error
+ */
+func (bpt *BPlusTree) loadBloomFilter() error {
+	buf, err := os.ReadFile(bpt.bloomPath)
+	if err == nil {
+		if bf, err := DecodeBloomFilter(buf); err == nil && bf.fpRate == bpt.fpRate {
+			bpt.bloom.Store(bf)
+		}
+		if err := os.Remove(bpt.bloomPath); err != nil {
+			return err
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	if bpt.bloom.Load() != nil {
+		return nil
 	}
-	return &BPlusTree{tree: bpTree}
+	return bpt.rebuildBloomFilter()
 }
 
-func (bpt *BPlusTree) Put(key []byte, pos *data.LogRecordPos) *data.LogRecordPos {
+// 遍历 B+ 树中所有的 key 重新构建布隆过滤器，调用方需要保证没有并发写入
+func (bpt *BPlusTree) rebuildBloomFilter() error {
+	return bpt.tree.View(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket(indexBucketName)
+		// 预留一倍的空间，避免重建后很快又需要扩容
+		bf := NewBloomFilter(uint64(bucket.Stats().KeyN)*2, bpt.fpRate)
+		if err := bucket.ForEach(func(k, v []byte) error {
+			bf.Add(k)
+			return nil
+		}); err != nil {
+			return err
+		}
+		bpt.bloom.Store(bf)
+		return nil
+	})
+}
+
+// 写入的 key 超过布隆过滤器的容量时扩容重建
+func (bpt *BPlusTree) growBloomFilter() {
+	bpt.bloomMu.Lock()
+	defer bpt.bloomMu.Unlock()
+	// 可能已经被其他写入重建过
+	if bf := bpt.bloom.Load(); bf == nil || !bf.Full() {
+		return
+	}
+	// 重建失败时继续使用原来的布隆过滤器，只是误判率会升高，不影响正确性
+	_ = bpt.rebuildBloomFilter()
+}
+
+// key 一定不存在时返回 true
+func (bpt *BPlusTree) definitelyNotExist(key []byte) bool {
+	bf := bpt.bloom.Load()
+	return bf != nil && !bf.MayContain(key)
+}
+
+func (bpt *BPlusTree) Put(key []byte, pos *data.LogRecordPos) (*data.LogRecordPos, error) {
+	// 先添加到布隆过滤器，再提交 B+ 树的修改，保证已经写入的 key 不会被误判为不存在
+	// 重建布隆过滤器会遍历 B+ 树，所以两步操作需要在读锁内完成
+	bpt.bloomMu.RLock()
+	bf := bpt.bloom.Load()
 	var oldValue []byte
-	if err := bpt.tree.Update(func(tx *bbolt.Tx) error {
+	err := bpt.tree.Update(func(tx *bbolt.Tx) error {
 		bucket := tx.Bucket(indexBucketName)
 		oldValue = bucket.Get(key)
+		// 已经存在的 key 一定在布隆过滤器中，只添加新的 key，覆盖写不会增加计数
+		if bf != nil && oldValue == nil {
+			bf.Add(key)
+		}
 
 		// put value 为[]byte, 所以需要编码后存入
 		return bucket.Put(key, data.EncoderLogRecordPos(pos))
-	}); err != nil {
-		panic("failed to put value in bptree")
+	})
+	bpt.bloomMu.RUnlock()
+	if err != nil {
+		return nil, &errs.IndexError{Op: "put", Err: err}
+	}
+	if bf != nil && bf.Full() {
+		bpt.growBloomFilter()
 	}
 	if len(oldValue) == 0 {
+		return nil, nil
+	}
+	return data.DecoderLogRecordPos(oldValue), nil
+}
+
+// BPTreeTxn B+ 树索引的读写事务，同一个事务中的修改要么全部生效，要么全部不生效
+type BPTreeTxn struct {
+	bucket *bbolt.Bucket
+	meta   *bbolt.Bucket
+	bloom  *BloomFilter
+}
+
+func (txn *BPTreeTxn) Get(key []byte) *data.LogRecordPos {
+	value := txn.bucket.Get(key)
+	if len(value) == 0 {
 		return nil
 	}
-	return data.DecoderLogRecordPos(oldValue)
+	return data.DecoderLogRecordPos(value)
+}
+
+func (txn *BPTreeTxn) Put(key []byte, pos *data.LogRecordPos) error {
+	if txn.bloom != nil && txn.bucket.Get(key) == nil {
+		txn.bloom.Add(key)
+	}
+	return txn.bucket.Put(key, data.EncoderLogRecordPos(pos))
+}
+
+func (txn *BPTreeTxn) Delete(key []byte) (*data.LogRecordPos, error) {
+	oldPos := txn.Get(key)
+	if oldPos == nil {
+		return nil, nil
+	}
+	return oldPos, txn.bucket.Delete(key)
 }
 
-func (bpt *BPlusTree) Get(key []byte) *data.LogRecordPos {
+// SetSeqNo 保存最新的事务序列号，和索引的修改一起提交
+func (txn *BPTreeTxn) SetSeqNo(seqNo uint64) error {
+	buf := make([]byte, 8)
+	binary.LittleEndian.PutUint64(buf, seqNo)
+	return txn.meta.Put(seqNoMetaKey, buf)
+}
+
+/**
+ * SeqNo
+ * @Description: 获取和索引一起保存的事务序列号
+ * @receiver bpt
+ * @return uint64
+ * @return bool 是否保存过
+ * @return error
+ */
+func (bpt *BPlusTree) SeqNo() (uint64, bool, error) {
+	var seqNo uint64
+	var found bool
+	if err := bpt.tree.View(func(tx *bbolt.Tx) error {
+		if value := tx.Bucket(metaBucketName).Get(seqNoMetaKey); len(value) == 8 {
+			seqNo, found = binary.LittleEndian.Uint64(value), true
+		}
+		return nil
+	}); err != nil {
+		return 0, false, &errs.IndexError{Op: "get seq no", Err: err}
+	}
+	return seqNo, found, nil
+}
+
+/**
+ * Update
+ * @Description: 在一个 bbolt 事务中批量读写索引，fn 返回错误时整个事务回滚
+ * @receiver bpt
+ * @param fn
+ * @return error
+ */
+func (bpt *BPlusTree) Update(fn func(txn *BPTreeTxn) error) error {
+	bpt.bloomMu.RLock()
+	bf := bpt.bloom.Load()
+	err := bpt.tree.Update(func(tx *bbolt.Tx) error {
+		return fn(&BPTreeTxn{bucket: tx.Bucket(indexBucketName), meta: tx.Bucket(metaBucketName), bloom: bf})
+	})
+	bpt.bloomMu.RUnlock()
+	if err != nil {
+		return &errs.IndexError{Op: "update", Err: err}
+	}
+	if bf != nil && bf.Full() {
+		bpt.growBloomFilter()
+	}
+	return nil
+}
+
+func (bpt *BPlusTree) Get(key []byte) (*data.LogRecordPos, error) {
+	if bpt.definitelyNotExist(key) {
+		return nil, nil
+	}
 	var pos *data.LogRecordPos
 	// view 开启一个只读的事务
 	if err := bpt.tree.View(func(tx *bbolt.Tx) error {
@@ -69,13 +265,16 @@ func (bpt *BPlusTree) Get(key []byte) *data.LogRecordPos {
 		}
 		return nil
 	}); err != nil {
-		return nil
-		//panic("failed to get value in bptree")
+		return nil, &errs.IndexError{Op: "get", Err: err}
 	}
-	return pos
+	return pos, nil
 }
 
-func (bpt *BPlusTree) Delete(key []byte) (*data.LogRecordPos, bool) {
+func (bpt *BPlusTree) Delete(key []byte) (*data.LogRecordPos, bool, error) {
+	// 布隆过滤器不支持删除，被删除的 key 只会增加误判，不影响正确性
+	if bpt.definitelyNotExist(key) {
+		return nil, false, nil
+	}
 	var ok bool
 	var oldValue []byte
 	if err := bpt.tree.Update(func(tx *bbolt.Tx) error {
@@ -87,15 +286,15 @@ func (bpt *BPlusTree) Delete(key []byte) (*data.LogRecordPos, bool) {
 		}
 		return nil
 	}); err != nil {
-		panic("failed to delete value in bptree")
+		return nil, false, &errs.IndexError{Op: "delete", Err: err}
 	}
 	if len(oldValue) == 0 {
-		return nil, false
+		return nil, false, nil
 	}
-	return data.DecoderLogRecordPos(oldValue), ok
+	return data.DecoderLogRecordPos(oldValue), ok, nil
 }
 
-func (bpt *BPlusTree) Size() int {
+func (bpt *BPlusTree) Size() (int, error) {
 	var size int
 	if err := bpt.tree.View(func(tx *bbolt.Tx) error {
 		bucket := tx.Bucket(indexBucketName)
@@ -103,16 +302,26 @@ func (bpt *BPlusTree) Size() int {
 		size = bucket.Stats().KeyN
 		return nil
 	}); err != nil {
-		panic("failed to get size in bptree")
+		return 0, &errs.IndexError{Op: "size", Err: err}
 	}
-	return size
+	return size, nil
 }
 
 func (bpt *BPlusTree) Close() error {
+	// 持久化布隆过滤器，先写临时文件再重命名，避免留下不完整的文件
+	if bf := bpt.bloom.Load(); bf != nil {
+		tmpPath := bpt.bloomPath + ".tmp"
+		if err := os.WriteFile(tmpPath, bf.Encode(), 0644); err != nil {
+			return err
+		}
+		if err := os.Rename(tmpPath, bpt.bloomPath); err != nil {
+			return err
+		}
+	}
 	return bpt.tree.Close()
 }
 
-func (bpt *BPlusTree) Iterator(reverse bool) Iterator {
+func (bpt *BPlusTree) Iterator(reverse bool) (Iterator, error) {
 	return newBpTreeIterator(bpt.tree, reverse)
 }
 
@@ -125,11 +334,11 @@ type bpTreeIterator struct {
 	curValue []byte
 }
 
-func newBpTreeIterator(tree *bbolt.DB, reverse bool) *bpTreeIterator {
+func newBpTreeIterator(tree *bbolt.DB, reverse bool) (*bpTreeIterator, error) {
 	// writable 是否开启一个可写的事务，可写的事务只能开启一个，可读的可以开启多个
 	tx, err := tree.Begin(false)
 	if err != nil {
-		panic("failed to begin a transaction")
+		return nil, &errs.IndexError{Op: "begin transaction", Err: err}
 	}
 
 	bpi := &bpTreeIterator{
@@ -140,7 +349,7 @@ func newBpTreeIterator(tree *bbolt.DB, reverse bool) *bpTreeIterator {
 	// 初始化可能会导致 key 和 value 为空，会导致 valid 方法返回 false
 	// 所以手动调用rewind
 	bpi.Rewind()
-	return bpi
+	return bpi, nil
 }
 
 /**
@@ -206,8 +415,9 @@ func (bpi *bpTreeIterator) Value() *data.LogRecordPos {
 /**
  * Close
  * @Description:关闭迭代器，释放相应资源
+ * @return error
  */
-func (bpi *bpTreeIterator) Close() {
+func (bpi *bpTreeIterator) Close() error {
 	// 根据官方，只读事务使用RollBack，而不是Commit
-	_ = bpi.tx.Rollback()
+	return bpi.tx.Rollback()
 }
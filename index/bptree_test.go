@@ -1,8 +1,11 @@
 package index
 
 import (
+	"errors"
+	"fmt"
 	"github.com/stretchr/testify/assert"
 	"kv_projects/data"
+	"kv_projects/errs"
 	"os"
 	"path/filepath"
 	"testing"
@@ -14,16 +17,21 @@ func TestBPlusTree_Put(t *testing.T) {
 	defer func() {
 		_ = os.RemoveAll(path)
 	}()
-	tree := NewBPlusTree(path, false)
+	tree, err := NewBPlusTree(path, false, 0)
+	assert.Nil(t, err)
 
-	res1 := tree.Put([]byte("aac"), &data.LogRecordPos{Fid: 123, Offset: 999})
+	res1, err := tree.Put([]byte("aac"), &data.LogRecordPos{Fid: 123, Offset: 999})
+	assert.Nil(t, err)
 	assert.Nil(t, res1)
-	res2 := tree.Put([]byte("abc"), &data.LogRecordPos{Fid: 123, Offset: 999})
+	res2, err := tree.Put([]byte("abc"), &data.LogRecordPos{Fid: 123, Offset: 999})
+	assert.Nil(t, err)
 	assert.Nil(t, res2)
-	res3 := tree.Put([]byte("acc"), &data.LogRecordPos{Fid: 123, Offset: 999})
+	res3, err := tree.Put([]byte("acc"), &data.LogRecordPos{Fid: 123, Offset: 999})
+	assert.Nil(t, err)
 	assert.Nil(t, res3)
 
-	res4 := tree.Put([]byte("acc"), &data.LogRecordPos{Fid: 7744, Offset: 883})
+	res4, err := tree.Put([]byte("acc"), &data.LogRecordPos{Fid: 7744, Offset: 883})
+	assert.Nil(t, err)
 	assert.Equal(t, uint32(123), res4.Fid)
 	assert.Equal(t, int64(999), res4.Offset)
 }
@@ -34,17 +42,21 @@ func TestBPlusTree_Get(t *testing.T) {
 	defer func() {
 		_ = os.RemoveAll(path)
 	}()
-	tree := NewBPlusTree(path, false)
+	tree, err := NewBPlusTree(path, false, 0)
+	assert.Nil(t, err)
 
-	pos := tree.Get([]byte("not exist"))
+	pos, err := tree.Get([]byte("not exist"))
+	assert.Nil(t, err)
 	assert.Nil(t, pos)
 
 	tree.Put([]byte("aac"), &data.LogRecordPos{Fid: 123, Offset: 999})
-	pos1 := tree.Get([]byte("aac"))
+	pos1, err := tree.Get([]byte("aac"))
+	assert.Nil(t, err)
 	assert.NotNil(t, pos1)
 
 	tree.Put([]byte("aac"), &data.LogRecordPos{Fid: 9884, Offset: 1232})
-	pos2 := tree.Get([]byte("aac"))
+	pos2, err := tree.Get([]byte("aac"))
+	assert.Nil(t, err)
 	assert.NotNil(t, pos2)
 }
 
@@ -54,19 +66,23 @@ func TestBPlusTree_Delete(t *testing.T) {
 	defer func() {
 		_ = os.RemoveAll(path)
 	}()
-	tree := NewBPlusTree(path, false)
+	tree, err := NewBPlusTree(path, false, 0)
+	assert.Nil(t, err)
 
-	res1, ok1 := tree.Delete([]byte("not exist"))
+	res1, ok1, err := tree.Delete([]byte("not exist"))
+	assert.Nil(t, err)
 	assert.False(t, ok1)
 	assert.Nil(t, res1)
 
 	tree.Put([]byte("aac"), &data.LogRecordPos{Fid: 123, Offset: 999})
-	res2, ok2 := tree.Delete([]byte("aac"))
+	res2, ok2, err := tree.Delete([]byte("aac"))
+	assert.Nil(t, err)
 	assert.True(t, ok2)
 	assert.Equal(t, uint32(123), res2.Fid)
 	assert.Equal(t, int64(999), res2.Offset)
 
-	pos1 := tree.Get([]byte("aac"))
+	pos1, err := tree.Get([]byte("aac"))
+	assert.Nil(t, err)
 	assert.Nil(t, pos1)
 }
 
@@ -76,16 +92,17 @@ func TestBPlusTree_Size(t *testing.T) {
 	defer func() {
 		_ = os.RemoveAll(path)
 	}()
-	tree := NewBPlusTree(path, false)
+	tree, err := NewBPlusTree(path, false, 0)
+	assert.Nil(t, err)
 	defer tree.Close()
 
-	assert.Equal(t, 0, tree.Size())
+	assert.Equal(t, 0, mustSize(t, tree))
 
 	tree.Put([]byte("aac"), &data.LogRecordPos{Fid: 123, Offset: 999})
 	tree.Put([]byte("abc"), &data.LogRecordPos{Fid: 123, Offset: 999})
 	tree.Put([]byte("acc"), &data.LogRecordPos{Fid: 123, Offset: 999})
 
-	assert.Equal(t, 3, tree.Size())
+	assert.Equal(t, 3, mustSize(t, tree))
 }
 
 func TestBPlusTree_Iterator(t *testing.T) {
@@ -94,7 +111,8 @@ func TestBPlusTree_Iterator(t *testing.T) {
 	defer func() {
 		_ = os.RemoveAll(path)
 	}()
-	tree := NewBPlusTree(path, false)
+	tree, err := NewBPlusTree(path, false, 0)
+	assert.Nil(t, err)
 	//defer func() { _ = tree.Close() }()
 	//defer tree.Close()
 	tree.Put([]byte("caac"), &data.LogRecordPos{Fid: 123, Offset: 999})
@@ -103,9 +121,133 @@ func TestBPlusTree_Iterator(t *testing.T) {
 	tree.Put([]byte("ccec"), &data.LogRecordPos{Fid: 123, Offset: 999})
 	tree.Put([]byte("bbba"), &data.LogRecordPos{Fid: 123, Offset: 999})
 
-	iter := tree.Iterator(true)
+	iter, err := tree.Iterator(true)
+	assert.Nil(t, err)
 	for iter.Rewind(); iter.Valid(); iter.Next() {
 		assert.NotNil(t, iter.Key())
 		assert.NotNil(t, iter.Value())
 	}
 }
+
+func TestBPlusTree_BloomFilter(t *testing.T) {
+	path, _ := os.MkdirTemp("", "bptree-bloom")
+	defer func() {
+		_ = os.RemoveAll(path)
+	}()
+	tree, err := NewBPlusTree(path, false, 0.01)
+	assert.Nil(t, err)
+	assert.NotNil(t, tree.bloom.Load())
+
+	tree.Put([]byte("aac"), &data.LogRecordPos{Fid: 123, Offset: 999})
+	assert.NotNil(t, mustGet(t, tree, []byte("aac")))
+	assert.Nil(t, mustGet(t, tree, []byte("not exist")))
+	_, ok, err := tree.Delete([]byte("not exist"))
+	assert.Nil(t, err)
+	assert.False(t, ok)
+
+	// 关闭时持久化布隆过滤器，重新打开时直接加载并删除该文件
+	assert.Nil(t, tree.Close())
+	_, err = os.Stat(filepath.Join(path, BloomFilterFileName))
+	assert.Nil(t, err)
+	tree2, err := NewBPlusTree(path, false, 0.01)
+	assert.Nil(t, err)
+	_, err = os.Stat(filepath.Join(path, BloomFilterFileName))
+	assert.True(t, os.IsNotExist(err))
+	assert.NotNil(t, mustGet(t, tree2, []byte("aac")))
+	assert.Nil(t, tree2.Close())
+
+	// 布隆过滤器文件丢失时，根据 B+ 树中的数据重新构建
+	assert.Nil(t, os.Remove(filepath.Join(path, BloomFilterFileName)))
+	tree3, err := NewBPlusTree(path, false, 0.01)
+	assert.Nil(t, err)
+	assert.True(t, tree3.bloom.Load().MayContain([]byte("aac")))
+	assert.NotNil(t, mustGet(t, tree3, []byte("aac")))
+
+	// 写入的 key 超过容量时扩容重建
+	capacity := tree3.bloom.Load().capacity
+	for i := uint64(0); i <= capacity; i++ {
+		tree3.Put([]byte(fmt.Sprintf("key-%d", i)), &data.LogRecordPos{Fid: 1, Offset: int64(i)})
+	}
+	assert.True(t, tree3.bloom.Load().capacity > capacity)
+	for i := uint64(0); i <= capacity; i += 1000 {
+		assert.NotNil(t, mustGet(t, tree3, []byte(fmt.Sprintf("key-%d", i))))
+	}
+	assert.Nil(t, tree3.Close())
+}
+
+func TestBPlusTree_BloomFilterOverwrite(t *testing.T) {
+	path, _ := os.MkdirTemp("", "bptree-bloom-overwrite")
+	defer func() {
+		_ = os.RemoveAll(path)
+	}()
+	tree, err := NewBPlusTree(path, false, 0.01)
+	assert.Nil(t, err)
+	defer tree.Close()
+
+	// 反复覆盖同一个 key 不会增加计数，也不会触发扩容重建
+	bf := tree.bloom.Load()
+	for i := uint64(0); i <= 2*bf.capacity; i++ {
+		_, err := tree.Put([]byte("key"), &data.LogRecordPos{Fid: 1, Offset: int64(i)})
+		assert.Nil(t, err)
+	}
+	err = tree.Update(func(txn *BPTreeTxn) error {
+		for i := uint64(0); i <= 2*bf.capacity; i++ {
+			if err := txn.Put([]byte("key"), &data.LogRecordPos{Fid: 2, Offset: int64(i)}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	assert.Nil(t, err)
+	assert.Same(t, bf, tree.bloom.Load())
+	assert.Equal(t, uint64(1), bf.count)
+	assert.False(t, bf.Full())
+	assert.NotNil(t, mustGet(t, tree, []byte("key")))
+
+	// 删除之后重新写入的 key 按照新的 key 计数
+	_, _, err = tree.Delete([]byte("key"))
+	assert.Nil(t, err)
+	_, err = tree.Put([]byte("key"), &data.LogRecordPos{Fid: 3})
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(2), bf.count)
+	assert.NotNil(t, mustGet(t, tree, []byte("key")))
+}
+
+func TestBPlusTree_OpenError(t *testing.T) {
+	// 目录不存在时 bbolt 无法创建文件，返回错误而不是 panic
+	path := filepath.Join(os.TempDir(), "bptree-not-exist", "sub")
+	tree, err := NewBPlusTree(path, false, 0)
+	assert.Nil(t, tree)
+	var indexErr *errs.IndexError
+	assert.True(t, errors.As(err, &indexErr))
+	assert.Equal(t, "open", indexErr.Op)
+
+	_, err = NewIndexer(BPTree, path, false, 0, nil)
+	assert.True(t, errors.As(err, &indexErr))
+	_, err = NewIndexer(IndexType(100), path, false, 0, nil)
+	assert.Equal(t, errs.ErrUnsupportedIndexType, err)
+}
+
+func TestBPlusTree_ClosedError(t *testing.T) {
+	path, _ := os.MkdirTemp("", "bptree-closed")
+	defer func() {
+		_ = os.RemoveAll(path)
+	}()
+	tree, err := NewBPlusTree(path, false, 0)
+	assert.Nil(t, err)
+	_, err = tree.Put([]byte("aac"), &data.LogRecordPos{Fid: 1, Offset: 1})
+	assert.Nil(t, err)
+	assert.Nil(t, tree.Close())
+
+	// 关闭之后的操作返回错误
+	_, err = tree.Put([]byte("aac"), &data.LogRecordPos{Fid: 1, Offset: 2})
+	assert.NotNil(t, err)
+	_, err = tree.Get([]byte("aac"))
+	assert.NotNil(t, err)
+	_, _, err = tree.Delete([]byte("aac"))
+	assert.NotNil(t, err)
+	_, err = tree.Size()
+	assert.NotNil(t, err)
+	_, err = tree.Iterator(false)
+	assert.NotNil(t, err)
+}
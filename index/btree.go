@@ -4,13 +4,12 @@ import (
 	"bytes"
 	"github.com/google/btree"
 	"kv_projects/data"
-	"sort"
 	"sync"
 )
 
 // BTree 索引，封装google的btree库
 type BTree struct {
-	tree *btree.BTree // 并发写不安全，可自己加锁(put,delete需要加锁操作)。并发读安全
+	tree *btree.BTree // 并发写不安全，读写之间也需要通过 lock 互斥，读读之间可以并发
 	lock *sync.RWMutex
 }
 
@@ -34,7 +33,7 @@ func NewBtree() *BTree {
  * @param pos
  * @return bool
  */
-func (bt *BTree) Put(key []byte, pos *data.LogRecordPos) *data.LogRecordPos {
+func (bt *BTree) Put(key []byte, pos *data.LogRecordPos) (*data.LogRecordPos, error) {
 	it := &ItemSelf{
 		key: key,
 		pos: pos,
@@ -43,9 +42,9 @@ func (bt *BTree) Put(key []byte, pos *data.LogRecordPos) *data.LogRecordPos {
 	oldPos := bt.tree.ReplaceOrInsert(it)
 	bt.lock.Unlock()
 	if oldPos == nil {
-		return nil
+		return nil, nil
 	}
-	return oldPos.(*ItemSelf).pos
+	return oldPos.(*ItemSelf).pos, nil
 }
 
 /**
@@ -55,15 +54,18 @@ func (bt *BTree) Put(key []byte, pos *data.LogRecordPos) *data.LogRecordPos {
  * @param key
  * @return *data.LogRecord
  */
-func (bt *BTree) Get(key []byte) *data.LogRecordPos {
+func (bt *BTree) Get(key []byte) (*data.LogRecordPos, error) {
 	it := &ItemSelf{
 		key: key,
 	}
+	// btree 的读操作和写操作并发时不安全，读操作之间可以共享读锁
+	bt.lock.RLock()
 	btreeRes := bt.tree.Get(it)
+	bt.lock.RUnlock()
 	if btreeRes == nil {
-		return nil
+		return nil, nil
 	}
-	return btreeRes.(*ItemSelf).pos
+	return btreeRes.(*ItemSelf).pos, nil
 }
 
 /**
@@ -73,7 +75,7 @@ func (bt *BTree) Get(key []byte) *data.LogRecordPos {
  * @param key
  * @return bool
  */
-func (bt *BTree) Delete(key []byte) (*data.LogRecordPos, bool) {
+func (bt *BTree) Delete(key []byte) (*data.LogRecordPos, bool, error) {
 	it := &ItemSelf{
 		key: key,
 	}
@@ -82,129 +84,51 @@ func (bt *BTree) Delete(key []byte) (*data.LogRecordPos, bool) {
 	bt.lock.Unlock()
 	// delete会返回删除键对应的内容，如果为空代表删除失败
 	if oldItem == nil {
-		return nil, false
+		return nil, false, nil
 	} else {
-		return oldItem.(*ItemSelf).pos, true
+		return oldItem.(*ItemSelf).pos, true, nil
 	}
 }
 
-func (bt *BTree) Iterator(reverse bool) Iterator {
-	if bt.tree == nil {
-		return nil
-	}
+/**
+ * Iterator
+ * @Description: 返回游标式的迭代器，遍历过程中不持有锁，也不会复制整棵树
+ * @receiver bt
+ * @param reverse
+ * @return Iterator
+ * @return error
+ */
+func (bt *BTree) Iterator(reverse bool) (Iterator, error) {
+	return newBatchIterator(func(pivot []byte, hasPivot, inclusive bool, fn func(key []byte, pos *data.LogRecordPos) bool) {
+		visit := func(it btree.Item) bool {
+			item := it.(*ItemSelf)
+			// 跳过上一批次最后一个 key
+			if hasPivot && !inclusive && bytes.Equal(item.key, pivot) {
+				return true
+			}
+			return fn(item.key, item.pos)
+		}
+		bt.lock.RLock()
+		defer bt.lock.RUnlock()
+		switch {
+		case !hasPivot && reverse:
+			bt.tree.Descend(visit)
+		case !hasPivot:
+			bt.tree.Ascend(visit)
+		case reverse:
+			bt.tree.DescendLessOrEqual(&ItemSelf{key: pivot}, visit)
+		default:
+			bt.tree.AscendGreaterOrEqual(&ItemSelf{key: pivot}, visit)
+		}
+	}), nil
+}
+
+func (bt *BTree) Size() (int, error) {
 	bt.lock.RLock()
 	defer bt.lock.RUnlock()
-	return newBTreeIterator(bt.tree, reverse)
-}
-func (bt *BTree) Size() int {
-	return bt.tree.Len()
+	return bt.tree.Len(), nil
 }
 
 func (bt *BTree) Close() error {
 	return nil
 }
-
-type BTreeIterator struct {
-	currIndex int         //当前遍历位置的下标
-	reverse   bool        // 是否是反向遍历
-	values    []*ItemSelf // key和其对应内容的位置信息
-}
-
-func newBTreeIterator(tree *btree.BTree, reverse bool) *BTreeIterator {
-	var Index int
-	// 受限于 btree ，只能将节点取出存放到数组然后实现迭代器方法，会占用大量内存
-	values := make([]*ItemSelf, tree.Len())
-
-	// 将所有数据存放在数组中
-	saveValues := func(it btree.Item) bool {
-		values[Index] = it.(*ItemSelf)
-		Index++
-		return true
-	}
-	if reverse {
-		// 数据从大到小排列
-		tree.Descend(saveValues)
-	} else {
-		// 数据从小到大排列
-		tree.Ascend(saveValues)
-	}
-	return &BTreeIterator{
-		currIndex: 0,
-		reverse:   reverse,
-		values:    values,
-	}
-
-}
-
-// BTree 实现索引器接口
-/**
- * Rewind
- * @Description:重新回到迭代器的起点，即第一个数据
- */
-func (ai *BTreeIterator) Rewind() {
-	ai.currIndex = 0
-}
-
-/**
- * Seek
- * @Description:根据传入的 key 查找到第一个大于（或小于）等于的目标 key，根据从这个 key 开始遍历
- * @param key
- */
-func (ai *BTreeIterator) Seek(key []byte) {
-	// btree 本身有序，取出后存放在数组也是有序的
-	if ai.reverse {
-		// 从大到小排列，找到小于等于key
-		ai.currIndex = sort.Search(len(ai.values), func(i int) bool {
-			return bytes.Compare(ai.values[i].key, key) <= 0
-		})
-	} else {
-		// 从小到大排列，找到大于等于key
-		ai.currIndex = sort.Search(len(ai.values), func(i int) bool {
-			return bytes.Compare(ai.values[i].key, key) >= 0
-		})
-	}
-}
-
-/**
- * Next
- * @Description:跳转到下一个 key
- */
-func (ai *BTreeIterator) Next() {
-	ai.currIndex += 1
-}
-
-/**
- * Valid
- * @Description:是否有效，即是否已经遍历完了所有的 key，用于退出遍历
- * @return bool
- */
-func (ai *BTreeIterator) Valid() bool {
-	return ai.currIndex < len(ai.values)
-}
-
-/**
- * Key
- * @Description:当前遍历位置的 Key 数据
- * @return []byte
- */
-func (ai *BTreeIterator) Key() []byte {
-	return ai.values[ai.currIndex].key
-}
-
-/**
- * Value
- * @Description:当前遍历位置的 Value 数据
- * @return *data.LogRecordPos
- */
-func (ai *BTreeIterator) Value() *data.LogRecordPos {
-	return ai.values[ai.currIndex].pos
-}
-
-/**
- * Close
- * @Description:关闭迭代器，释放相应资源
- */
-func (ai *BTreeIterator) Close() {
-	// 清除临时数组
-	ai.values = nil
-}
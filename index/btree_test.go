@@ -1,21 +1,44 @@
 package index
 
 import (
+	"fmt"
 	"github.com/stretchr/testify/assert"
 	"kv_projects/data"
+	"sync"
 	"testing"
 )
 
+func mustPut(t *testing.T, indexer Indexer, key []byte, pos *data.LogRecordPos) *data.LogRecordPos {
+	oldPos, err := indexer.Put(key, pos)
+	assert.Nil(t, err)
+	return oldPos
+}
+
+func mustGet(t *testing.T, indexer Indexer, key []byte) *data.LogRecordPos {
+	pos, err := indexer.Get(key)
+	assert.Nil(t, err)
+	return pos
+}
+
+func mustSize(t *testing.T, indexer Indexer) int {
+	size, err := indexer.Size()
+	assert.Nil(t, err)
+	return size
+}
+
 func TestBTree_Put(t *testing.T) {
 	bt := NewBtree()
 
-	res1 := bt.Put(nil, &data.LogRecordPos{Fid: 1, Offset: 100})
+	res1, err := bt.Put(nil, &data.LogRecordPos{Fid: 1, Offset: 100})
+	assert.Nil(t, err)
 	assert.Nil(t, res1)
 
-	res2 := bt.Put([]byte("a"), &data.LogRecordPos{Fid: 1, Offset: 2})
+	res2, err := bt.Put([]byte("a"), &data.LogRecordPos{Fid: 1, Offset: 2})
+	assert.Nil(t, err)
 	assert.Nil(t, res2)
 
-	res3 := bt.Put([]byte("a"), &data.LogRecordPos{Fid: 11, Offset: 12})
+	res3, err := bt.Put([]byte("a"), &data.LogRecordPos{Fid: 11, Offset: 12})
+	assert.Nil(t, err)
 	assert.Equal(t, res3.Fid, uint32(1))
 	assert.Equal(t, res3.Offset, int64(2))
 }
@@ -23,36 +46,45 @@ func TestBTree_Put(t *testing.T) {
 func TestBTree_Get(t *testing.T) {
 	bt := NewBtree()
 
-	res1 := bt.Put(nil, &data.LogRecordPos{Fid: 1, Offset: 100})
+	res1, err := bt.Put(nil, &data.LogRecordPos{Fid: 1, Offset: 100})
+	assert.Nil(t, err)
 	assert.Nil(t, res1)
 
-	pos1 := bt.Get(nil)
+	pos1, err := bt.Get(nil)
+	assert.Nil(t, err)
 	assert.Equal(t, uint32(1), pos1.Fid)
 	assert.Equal(t, int64(100), pos1.Offset)
 
-	res2 := bt.Put([]byte("a"), &data.LogRecordPos{Fid: 1, Offset: 2})
+	res2, err := bt.Put([]byte("a"), &data.LogRecordPos{Fid: 1, Offset: 2})
+	assert.Nil(t, err)
 	assert.Nil(t, res2)
-	res3 := bt.Put([]byte("a"), &data.LogRecordPos{Fid: 1, Offset: 3})
+	res3, err := bt.Put([]byte("a"), &data.LogRecordPos{Fid: 1, Offset: 3})
+	assert.Nil(t, err)
 	assert.Equal(t, res3.Fid, uint32(1))
 	assert.Equal(t, res3.Offset, int64(2))
 
-	pos2 := bt.Get([]byte("a"))
+	pos2, err := bt.Get([]byte("a"))
+	assert.Nil(t, err)
 	assert.Equal(t, uint32(1), pos2.Fid)
 	assert.Equal(t, int64(3), pos2.Offset)
 }
 
 func TestBTree_Delete(t *testing.T) {
 	bt := NewBtree()
-	res1 := bt.Put(nil, &data.LogRecordPos{Fid: 1, Offset: 100})
+	res1, err := bt.Put(nil, &data.LogRecordPos{Fid: 1, Offset: 100})
+	assert.Nil(t, err)
 	assert.Nil(t, res1)
-	res2, ok1 := bt.Delete(nil)
+	res2, ok1, err := bt.Delete(nil)
+	assert.Nil(t, err)
 	assert.True(t, ok1)
 	assert.Equal(t, res2.Fid, uint32(1))
 	assert.Equal(t, res2.Offset, int64(100))
 
-	res3 := bt.Put([]byte("aaa"), &data.LogRecordPos{Fid: 22, Offset: 33})
+	res3, err := bt.Put([]byte("aaa"), &data.LogRecordPos{Fid: 22, Offset: 33})
+	assert.Nil(t, err)
 	assert.Nil(t, res3)
-	res4, ok2 := bt.Delete([]byte("aaa"))
+	res4, ok2, err := bt.Delete([]byte("aaa"))
+	assert.Nil(t, err)
 	assert.True(t, ok2)
 	assert.Equal(t, res4.Fid, uint32(22))
 	assert.Equal(t, res4.Offset, int64(33))
@@ -61,12 +93,14 @@ func TestBTree_Delete(t *testing.T) {
 func TestBTree_Iterator(t *testing.T) {
 	bt1 := NewBtree()
 	// 1.BTree 为空的情况
-	iter1 := bt1.Iterator(false)
+	iter1, err := bt1.Iterator(false)
+	assert.Nil(t, err)
 	assert.Equal(t, false, iter1.Valid())
 
 	//	2.BTree 有数据的情况
 	bt1.Put([]byte("ccde"), &data.LogRecordPos{Fid: 1, Offset: 10})
-	iter2 := bt1.Iterator(false)
+	iter2, err := bt1.Iterator(false)
+	assert.Nil(t, err)
 	assert.Equal(t, true, iter2.Valid())
 	assert.NotNil(t, iter2.Key())
 	assert.NotNil(t, iter2.Value())
@@ -77,25 +111,53 @@ func TestBTree_Iterator(t *testing.T) {
 	bt1.Put([]byte("acee"), &data.LogRecordPos{Fid: 1, Offset: 10})
 	bt1.Put([]byte("eede"), &data.LogRecordPos{Fid: 1, Offset: 10})
 	bt1.Put([]byte("bbcd"), &data.LogRecordPos{Fid: 1, Offset: 10})
-	iter3 := bt1.Iterator(false)
+	iter3, err := bt1.Iterator(false)
+	assert.Nil(t, err)
 	for iter3.Rewind(); iter3.Valid(); iter3.Next() {
 		assert.NotNil(t, iter3.Key())
 	}
 
-	iter4 := bt1.Iterator(true)
+	iter4, err := bt1.Iterator(true)
+	assert.Nil(t, err)
 	for iter4.Rewind(); iter4.Valid(); iter4.Next() {
 		assert.NotNil(t, iter4.Key())
 	}
 
 	// 4.测试 seek
-	iter5 := bt1.Iterator(false)
+	iter5, err := bt1.Iterator(false)
+	assert.Nil(t, err)
 	for iter5.Seek([]byte("cc")); iter5.Valid(); iter5.Next() {
 		assert.NotNil(t, iter5.Key())
 	}
 
 	// 5.反向遍历的 seek
-	iter6 := bt1.Iterator(true)
+	iter6, err := bt1.Iterator(true)
+	assert.Nil(t, err)
 	for iter6.Seek([]byte("zz")); iter6.Valid(); iter6.Next() {
 		assert.NotNil(t, iter6.Key())
 	}
 }
+
+// 并发读写，需要配合 go test -race 运行
+func TestBTree_ConcurrentPutGet(t *testing.T) {
+	bt := NewBtree()
+	var wg sync.WaitGroup
+	for g := 0; g < 4; g++ {
+		wg.Add(2)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				bt.Put([]byte(fmt.Sprintf("key-%d", i)), &data.LogRecordPos{Fid: uint32(g), Offset: int64(i)})
+			}
+		}(g)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				_, _ = bt.Get([]byte(fmt.Sprintf("key-%d", i)))
+				_, _ = bt.Size()
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, 1000, mustSize(t, bt))
+}
@@ -0,0 +1,118 @@
+package index
+
+import (
+	"kv_projects/data"
+)
+
+// 迭代器每次从索引中读取的 key 数量，迭代器占用的内存只和它有关，和索引中 key 的总数无关
+const iteratorBatchSize = 128
+
+/**
+ * scanFunc
+ * @Description: 按迭代方向从 pivot 开始遍历索引，由具体的索引在自己的读锁保护下实现，fn 返回 false 时停止遍历
+ * @param pivot 起始 key，hasPivot 为 false 时从头（反向遍历时为末尾）开始
+ * @param inclusive 是否包含 pivot 本身
+ */
+type scanFunc func(pivot []byte, hasPivot, inclusive bool, fn func(key []byte, pos *data.LogRecordPos) bool)
+
+// batchIterator 游标式的索引迭代器，BTree 和 ART 索引共用
+// 迭代器不会复制整个索引，而是记住当前位置，每次在索引的读锁下取出下一批 key，两批之间不持有锁。
+// 因此遍历期间并发的写入不会被阻塞，对应的语义是：
+//   - 每个 key 最多被访问一次，并且严格按照迭代方向有序；
+//   - 在当前位置之前发生的写入和删除不会再被看到；
+//   - 在当前位置之后发生的写入和删除可能被看到，也可能看不到，取决于它是否已经被读入当前批次；
+//   - Value 返回的是读取该批次时的位置信息，之后被覆盖写的 key 不会更新。
+type batchIterator struct {
+	scan      scanFunc
+	items     []ItemSelf
+	currIndex int
+	exhausted bool // 最近一次读取没有取满，说明后面已经没有数据
+}
+
+func newBatchIterator(scan scanFunc) *batchIterator {
+	iter := &batchIterator{
+		scan:  scan,
+		items: make([]ItemSelf, 0, iteratorBatchSize),
+	}
+	iter.Rewind()
+	return iter
+}
+
+// 从 pivot 开始重新读取一批数据
+func (bi *batchIterator) fill(pivot []byte, hasPivot, inclusive bool) {
+	bi.items = bi.items[:0]
+	bi.currIndex = 0
+	bi.scan(pivot, hasPivot, inclusive, func(key []byte, pos *data.LogRecordPos) bool {
+		bi.items = append(bi.items, ItemSelf{key: key, pos: pos})
+		return len(bi.items) < iteratorBatchSize
+	})
+	bi.exhausted = len(bi.items) < iteratorBatchSize
+}
+
+/**
+ * Rewind
+ * @Description:重新回到迭代器的起点，即第一个数据
+ */
+func (bi *batchIterator) Rewind() {
+	bi.fill(nil, false, false)
+}
+
+/**
+ * Seek
+ * @Description:根据传入的 key 查找到第一个大于（或小于）等于的目标 key，根据从这个 key 开始遍历
+ * @param key
+ */
+func (bi *batchIterator) Seek(key []byte) {
+	bi.fill(key, true, true)
+}
+
+/**
+ * Next
+ * @Description:跳转到下一个 key，当前批次遍历完后从最后一个 key 之后继续读取
+ */
+func (bi *batchIterator) Next() {
+	bi.currIndex++
+	if bi.currIndex < len(bi.items) || bi.exhausted {
+		return
+	}
+	last := bi.items[len(bi.items)-1].key
+	bi.fill(last, true, false)
+}
+
+/**
+ * Valid
+ * @Description:是否有效，即是否已经遍历完了所有的 key，用于退出遍历
+ * @return bool
+ */
+func (bi *batchIterator) Valid() bool {
+	return bi.currIndex < len(bi.items)
+}
+
+/**
+ * Key
+ * @Description:当前遍历位置的 Key 数据
+ * @return []byte
+ */
+func (bi *batchIterator) Key() []byte {
+	return bi.items[bi.currIndex].key
+}
+
+/**
+ * Value
+ * @Description:当前遍历位置的 Value 数据
+ * @return *data.LogRecordPos
+ */
+func (bi *batchIterator) Value() *data.LogRecordPos {
+	return bi.items[bi.currIndex].pos
+}
+
+/**
+ * Close
+ * @Description:关闭迭代器，释放相应资源
+ * @return error
+ */
+func (bi *batchIterator) Close() error {
+	bi.items = nil
+	bi.exhausted = true
+	return nil
+}
@@ -0,0 +1,149 @@
+package index
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"kv_projects/data"
+	"math/rand"
+	"runtime"
+	"sort"
+	"sync"
+	"testing"
+)
+
+// 生成长度不一、互相之间存在前缀关系的随机 key
+func randomIteratorKeys(n int) [][]byte {
+	r := rand.New(rand.NewSource(1))
+	seen := make(map[string]bool)
+	var keys [][]byte
+	for len(keys) < n {
+		key := make([]byte, r.Intn(6))
+		for i := range key {
+			// 字节范围较小，更容易出现公共前缀，同时覆盖 0 和 255 两个边界
+			key[i] = []byte{0, 1, 'a', 'b', 'c', 254, 255}[r.Intn(7)]
+		}
+		if seen[string(key)] {
+			continue
+		}
+		seen[string(key)] = true
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+func collectKeys(iter Iterator) []string {
+	var res []string
+	for ; iter.Valid(); iter.Next() {
+		res = append(res, string(iter.Key()))
+	}
+	return res
+}
+
+func TestBatchIterator_Order(t *testing.T) {
+	keys := randomIteratorKeys(3000)
+	var sorted []string
+	for _, key := range keys {
+		sorted = append(sorted, string(key))
+	}
+	sort.Strings(sorted)
+	reversed := make([]string, len(sorted))
+	for i := range sorted {
+		reversed[len(sorted)-1-i] = sorted[i]
+	}
+
+	for name, indexer := range map[string]Indexer{"btree": NewBtree(), "art": NewART()} {
+		for i, key := range keys {
+			indexer.Put(key, &data.LogRecordPos{Fid: 1, Offset: int64(i)})
+		}
+
+		iter, err := indexer.Iterator(false)
+		assert.Nil(t, err)
+		assert.Equal(t, sorted, collectKeys(iter), name)
+		iter.Rewind()
+		assert.Equal(t, sorted, collectKeys(iter), name)
+
+		reverseIter, err := indexer.Iterator(true)
+		assert.Nil(t, err)
+		assert.Equal(t, reversed, collectKeys(reverseIter), name)
+
+		// 随机定位，包括不存在的 key
+		r := rand.New(rand.NewSource(2))
+		for n := 0; n < 50; n++ {
+			pivot := keys[r.Intn(len(keys))]
+			if n%2 == 1 {
+				pivot = append(append([]byte(nil), pivot...), 'x')
+			}
+			start := sort.SearchStrings(sorted, string(pivot))
+			iter.Seek(pivot)
+			assert.Equal(t, sorted[start:], collectKeys(iter), name)
+
+			end := sort.Search(len(reversed), func(i int) bool { return reversed[i] <= string(pivot) })
+			reverseIter.Seek(pivot)
+			assert.Equal(t, reversed[end:], collectKeys(reverseIter), name)
+		}
+	}
+}
+
+func TestBatchIterator_ConcurrentModification(t *testing.T) {
+	for name, indexer := range map[string]Indexer{"btree": NewBtree(), "art": NewART()} {
+		for i := 0; i < 1000; i++ {
+			indexer.Put([]byte(fmt.Sprintf("key-%04d", i*2)), &data.LogRecordPos{Fid: 1, Offset: int64(i)})
+		}
+
+		iter, _ := indexer.Iterator(false)
+		stop := make(chan struct{})
+		wg := new(sync.WaitGroup)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; ; i++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				key := []byte(fmt.Sprintf("key-%04d", i%2000))
+				if i%3 == 0 {
+					indexer.Delete(key)
+				} else {
+					indexer.Put(key, &data.LogRecordPos{Fid: 2, Offset: int64(i)})
+				}
+			}
+		}()
+
+		// 遍历期间不会阻塞写入，结果保持严格有序
+		var prev []byte
+		for ; iter.Valid(); iter.Next() {
+			if prev != nil {
+				assert.True(t, bytes.Compare(prev, iter.Key()) < 0, name)
+			}
+			prev = iter.Key()
+		}
+		close(stop)
+		wg.Wait()
+		iter.Close()
+	}
+}
+
+func TestBatchIterator_Memory(t *testing.T) {
+	bt := NewBtree()
+	for i := 0; i < 100000; i++ {
+		bt.Put([]byte(fmt.Sprintf("key-%08d", i)), &data.LogRecordPos{Fid: 1, Offset: int64(i)})
+	}
+
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	iter, err := bt.Iterator(false)
+	assert.Nil(t, err)
+	runtime.ReadMemStats(&after)
+	// 创建迭代器只分配一个批次的空间，和索引中 key 的数量无关
+	assert.True(t, after.TotalAlloc-before.TotalAlloc < 64*1024)
+
+	count := 0
+	for iter.Rewind(); iter.Valid(); iter.Next() {
+		count++
+	}
+	assert.Equal(t, 100000, count)
+}
@@ -0,0 +1,193 @@
+package index
+
+import (
+	"hash/fnv"
+	"kv_projects/data"
+	"kv_projects/errs"
+	"sync"
+)
+
+const (
+	// 槽位的哈希值为 0 表示空槽位，为 1 表示被删除的槽位，真实的哈希值会避开这两个值
+	emptySlot   uint32 = 0
+	deletedSlot uint32 = 1
+
+	initialHashSlots = 1024
+	// 已使用的槽位（包括被删除的槽位）超过该比例时扩容
+	maxHashLoadFactor = 0.875
+)
+
+// 哈希表的槽位，位置信息直接内联存储，不需要为每个 key 额外分配内存，每个槽位占用 16 字节
+// offset 使用 uint32 存储，所以使用哈希索引时 DataFileSize 不能超过 4GB
+type hashSlot struct {
+	hash   uint32
+	fid    uint32
+	offset uint32
+	size   uint32
+}
+
+// HashIndex
+// @Description: 开放寻址的哈希索引，只保存 key 的哈希值和数据位置，不保存 key 本身
+// 哈希值相同时通过 KeyVerifier 读取磁盘上的 key 进行校验，所以 Get/Put/Delete 命中时可能产生一次磁盘读取
+// 不支持有序遍历，Iterator 返回 errs.ErrIteratorNotSupported，因此 ListKeys、Fold 和用户迭代器都不可用
+type HashIndex struct {
+	slots    []hashSlot
+	count    int // 有效的 key 数量
+	used     int // 已经使用的槽位数量，包括被删除的槽位
+	verifier KeyVerifier
+	lock     *sync.RWMutex
+}
+
+/**
+ * NewHashIndex
+ * @Description: 初始化哈希索引
+ * @param verifier 校验某个位置上的数据是否属于 key，为 nil 时认为哈希值相同就是同一个 key
+ * @return *HashIndex
+ */
+func NewHashIndex(verifier KeyVerifier) *HashIndex {
+	return &HashIndex{
+		slots:    make([]hashSlot, initialHashSlots),
+		verifier: verifier,
+		lock:     new(sync.RWMutex),
+	}
+}
+
+// 32 位的哈希值同时用于定位槽位和快速比较，只有同一条探测链上哈希值相同时才需要校验磁盘上的 key
+func hashKey(key []byte) uint32 {
+	h := fnv.New32a()
+	_, _ = h.Write(key)
+	sum := h.Sum32()
+	if sum <= deletedSlot {
+		sum += 2
+	}
+	return sum
+}
+
+func (s *hashSlot) pos() *data.LogRecordPos {
+	return &data.LogRecordPos{Fid: s.fid, Offset: int64(s.offset), Size: s.size}
+}
+
+// 哈希值相同时还需要校验磁盘上的 key，排除哈希冲突
+func (hi *HashIndex) matches(key []byte, h uint32, s *hashSlot) (bool, error) {
+	if s.hash != h {
+		return false, nil
+	}
+	if hi.verifier == nil {
+		return true, nil
+	}
+	return hi.verifier(key, s.pos())
+}
+
+// 查找 key 所在的槽位下标，不存在时返回 -1
+func (hi *HashIndex) find(key []byte, h uint32) (int, error) {
+	mask := uint32(len(hi.slots) - 1)
+	for i := h & mask; ; i = (i + 1) & mask {
+		s := &hi.slots[i]
+		if s.hash == emptySlot {
+			return -1, nil
+		}
+		ok, err := hi.matches(key, h, s)
+		if err != nil {
+			return -1, err
+		}
+		if ok {
+			return int(i), nil
+		}
+	}
+}
+
+func (hi *HashIndex) Put(key []byte, pos *data.LogRecordPos) (*data.LogRecordPos, error) {
+	h := hashKey(key)
+	hi.lock.Lock()
+	defer hi.lock.Unlock()
+
+	idx, err := hi.find(key, h)
+	if err != nil {
+		return nil, err
+	}
+	if idx >= 0 {
+		s := &hi.slots[idx]
+		oldPos := s.pos()
+		s.fid, s.offset, s.size = pos.Fid, uint32(pos.Offset), pos.Size
+		return oldPos, nil
+	}
+	if float64(hi.used+1) > float64(len(hi.slots))*maxHashLoadFactor {
+		hi.resize()
+	}
+	hi.insert(hashSlot{hash: h, fid: pos.Fid, offset: uint32(pos.Offset), size: pos.Size})
+	hi.count++
+	return nil, nil
+}
+
+// 插入一个新的槽位，调用方需要保证 key 不存在
+func (hi *HashIndex) insert(slot hashSlot) {
+	mask := uint32(len(hi.slots) - 1)
+	for i := slot.hash & mask; ; i = (i + 1) & mask {
+		s := &hi.slots[i]
+		if s.hash == emptySlot || s.hash == deletedSlot {
+			if s.hash == emptySlot {
+				hi.used++
+			}
+			*s = slot
+			return
+		}
+	}
+}
+
+// 扩容并清理被删除的槽位，有效 key 较少时只重新整理，不扩大容量
+func (hi *HashIndex) resize() {
+	size := len(hi.slots)
+	if float64(hi.count+1) > float64(size)*maxHashLoadFactor/2 {
+		size *= 2
+	}
+	oldSlots := hi.slots
+	hi.slots = make([]hashSlot, size)
+	hi.used = 0
+	for _, s := range oldSlots {
+		if s.hash != emptySlot && s.hash != deletedSlot {
+			hi.insert(s)
+		}
+	}
+}
+
+func (hi *HashIndex) Get(key []byte) (*data.LogRecordPos, error) {
+	h := hashKey(key)
+	hi.lock.RLock()
+	defer hi.lock.RUnlock()
+	idx, err := hi.find(key, h)
+	if err != nil || idx < 0 {
+		return nil, err
+	}
+	return hi.slots[idx].pos(), nil
+}
+
+func (hi *HashIndex) Delete(key []byte) (*data.LogRecordPos, bool, error) {
+	h := hashKey(key)
+	hi.lock.Lock()
+	defer hi.lock.Unlock()
+	idx, err := hi.find(key, h)
+	if err != nil || idx < 0 {
+		return nil, false, err
+	}
+	s := &hi.slots[idx]
+	oldPos := s.pos()
+	// 标记为被删除，不能直接置空，否则会截断后面槽位的查找链
+	*s = hashSlot{hash: deletedSlot}
+	hi.count--
+	return oldPos, true, nil
+}
+
+func (hi *HashIndex) Size() (int, error) {
+	hi.lock.RLock()
+	defer hi.lock.RUnlock()
+	return hi.count, nil
+}
+
+// Iterator 哈希索引中的数据是无序的，并且不保存 key，不支持遍历
+func (hi *HashIndex) Iterator(reverse bool) (Iterator, error) {
+	return nil, errs.ErrIteratorNotSupported
+}
+
+func (hi *HashIndex) Close() error {
+	return nil
+}
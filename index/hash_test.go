@@ -0,0 +1,120 @@
+package index
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"kv_projects/data"
+	"kv_projects/errs"
+	"runtime"
+	"testing"
+)
+
+// 模拟磁盘上的数据，根据位置取出对应的 key
+type fakeDisk map[data.LogRecordPos]string
+
+func (d fakeDisk) verifier(key []byte, pos *data.LogRecordPos) (bool, error) {
+	return d[data.LogRecordPos{Fid: pos.Fid, Offset: pos.Offset}] == string(key), nil
+}
+
+func TestHashIndex_PutGetDelete(t *testing.T) {
+	disk := make(fakeDisk)
+	hi := NewHashIndex(disk.verifier)
+
+	for i := 0; i < 10000; i++ {
+		pos := &data.LogRecordPos{Fid: 1, Offset: int64(i), Size: 10}
+		disk[data.LogRecordPos{Fid: pos.Fid, Offset: pos.Offset}] = fmt.Sprintf("key-%d", i)
+		assert.Nil(t, mustPut(t, hi, []byte(fmt.Sprintf("key-%d", i)), pos))
+	}
+	assert.Equal(t, 10000, mustSize(t, hi))
+
+	// 覆盖写返回旧的位置
+	pos := &data.LogRecordPos{Fid: 2, Offset: 1, Size: 10}
+	disk[data.LogRecordPos{Fid: 2, Offset: 1}] = "key-1"
+	oldPos, err := hi.Put([]byte("key-1"), pos)
+	assert.Nil(t, err)
+	assert.Equal(t, &data.LogRecordPos{Fid: 1, Offset: 1, Size: 10}, oldPos)
+	assert.Equal(t, pos, mustGet(t, hi, []byte("key-1")))
+	assert.Equal(t, 10000, mustSize(t, hi))
+
+	assert.Nil(t, mustGet(t, hi, []byte("not exist")))
+
+	for i := 0; i < 10000; i += 2 {
+		oldPos, ok, err := hi.Delete([]byte(fmt.Sprintf("key-%d", i)))
+		assert.Nil(t, err)
+		assert.True(t, ok)
+		assert.NotNil(t, oldPos)
+	}
+	_, ok, err := hi.Delete([]byte("key-0"))
+	assert.Nil(t, err)
+	assert.False(t, ok)
+	assert.Equal(t, 5000, mustSize(t, hi))
+	for i := 0; i < 10000; i++ {
+		if i%2 == 0 {
+			assert.Nil(t, mustGet(t, hi, []byte(fmt.Sprintf("key-%d", i))))
+		} else {
+			assert.NotNil(t, mustGet(t, hi, []byte(fmt.Sprintf("key-%d", i))))
+		}
+	}
+}
+
+func TestHashIndex_Collision(t *testing.T) {
+	disk := make(fakeDisk)
+	hi := NewHashIndex(disk.verifier)
+
+	// 构造一个哈希冲突：key-a 的数据占用了和 key-b 相同的哈希值
+	disk[data.LogRecordPos{Fid: 1, Offset: 0}] = "key-a"
+	hi.insert(hashSlot{hash: hashKey([]byte("key-b")), fid: 1, offset: 0})
+	hi.count++
+
+	// 磁盘校验之后可以发现不是同一个 key
+	assert.Nil(t, mustGet(t, hi, []byte("key-b")))
+
+	disk[data.LogRecordPos{Fid: 1, Offset: 100}] = "key-b"
+	assert.Nil(t, mustPut(t, hi, []byte("key-b"), &data.LogRecordPos{Fid: 1, Offset: 100}))
+	assert.Equal(t, 2, mustSize(t, hi))
+	assert.Equal(t, int64(100), mustGet(t, hi, []byte("key-b")).Offset)
+
+	// 删除 key-b 不会影响哈希值相同的另一条数据
+	_, ok, err := hi.Delete([]byte("key-b"))
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	assert.Nil(t, mustGet(t, hi, []byte("key-b")))
+	assert.Equal(t, 1, mustSize(t, hi))
+}
+
+func TestHashIndex_Iterator(t *testing.T) {
+	hi := NewHashIndex(nil)
+	iter, err := hi.Iterator(false)
+	assert.Nil(t, iter)
+	assert.Equal(t, errs.ErrIteratorNotSupported, err)
+}
+
+// 哈希索引每个 key 占用的内存应该远小于 BTree 索引
+func TestHashIndex_Memory(t *testing.T) {
+	const n = 200000
+	keys := make([][]byte, n)
+	for i := range keys {
+		keys[i] = []byte(fmt.Sprintf("bitcask-go-key-%09d", i))
+	}
+	measure := func(put func(key []byte, pos *data.LogRecordPos)) uint64 {
+		var before, after runtime.MemStats
+		runtime.GC()
+		runtime.ReadMemStats(&before)
+		for i, key := range keys {
+			// 和从数据文件加载索引时一样，每个 key 都是新分配的
+			put(append([]byte(nil), key...), &data.LogRecordPos{Fid: 1, Offset: int64(i), Size: 100})
+		}
+		runtime.GC()
+		runtime.ReadMemStats(&after)
+		return after.HeapAlloc - before.HeapAlloc
+	}
+
+	hi := NewHashIndex(nil)
+	hashMem := measure(func(key []byte, pos *data.LogRecordPos) { hi.Put(key, pos) })
+	bt := NewBtree()
+	btreeMem := measure(func(key []byte, pos *data.LogRecordPos) { bt.Put(key, pos) })
+	t.Logf("hash: %d bytes/key, btree: %d bytes/key", hashMem/n, btreeMem/n)
+	assert.True(t, hashMem*3 < btreeMem)
+	runtime.KeepAlive(hi)
+	runtime.KeepAlive(bt)
+}
@@ -4,24 +4,25 @@ import (
 	"bytes"
 	"github.com/google/btree"
 	"kv_projects/data"
+	"kv_projects/errs"
 )
 
 // Indexer 抽象索引接口，后续添加其他数据结构，直接实现该接口
 type Indexer interface {
-	// Put 向索引中添加key对应的数据位置信息
-	Put(key []byte, pos *data.LogRecordPos) *data.LogRecordPos
+	// Put 向索引中添加key对应的数据位置信息，返回旧的位置信息
+	Put(key []byte, pos *data.LogRecordPos) (*data.LogRecordPos, error)
 
-	// Get 获取key对应的数据位置信息
-	Get(key []byte) *data.LogRecordPos
+	// Get 获取key对应的数据位置信息，不存在时返回 nil
+	Get(key []byte) (*data.LogRecordPos, error)
 
 	// Delete 删除key对应的数据位置信息
-	Delete(key []byte) (*data.LogRecordPos, bool)
+	Delete(key []byte) (*data.LogRecordPos, bool, error)
 
 	// 获取 key 的数量
-	Size() int
+	Size() (int, error)
 
-	// 返回迭代器
-	Iterator(reverse bool) Iterator
+	// 返回迭代器，不支持有序遍历的索引返回 errs.ErrIteratorNotSupported
+	Iterator(reverse bool) (Iterator, error)
 
 	// 关闭索引,只是B+树需要使用
 	Close() error
@@ -39,26 +40,41 @@ const (
 
 	// B+树索引
 	BPTree
+
+	// 哈希索引，只支持点查，不支持有序遍历
+	Hash
+
+	// 跳表索引，读操作不加锁
+	SkipList
 )
 
+// KeyVerifier 校验 pos 位置上的数据是否属于 key，哈希索引发生哈希冲突时需要读取磁盘上的 key 进行确认
+type KeyVerifier func(key []byte, pos *data.LogRecordPos) (bool, error)
+
 /**
  * NewIndexer
  * @Description: 根据不同的类型初始化索引
  * @param tp
+ * @param bloomFPRate B+ 树索引使用的布隆过滤器误判率，为 0 时不使用布隆过滤器
+ * @param verifier 哈希索引校验 key 使用
  * @return Indexer
+ * @return error 未知的索引类型返回 errs.ErrUnsupportedIndexType
  */
-func NewIndexer(tp IndexType, dirPath string, syncWrite bool) Indexer {
+func NewIndexer(tp IndexType, dirPath string, syncWrite bool, bloomFPRate float64, verifier KeyVerifier) (Indexer, error) {
 	switch tp {
 	case Btree:
-		return NewBtree()
+		return NewBtree(), nil
 	case ART:
-		return NewART()
+		return NewART(), nil
 	case BPTree:
-		return NewBPlusTree(dirPath, syncWrite)
+		return NewBPlusTree(dirPath, syncWrite, bloomFPRate)
+	case Hash:
+		return NewHashIndex(verifier), nil
+	case SkipList:
+		return NewSkipListIndex(), nil
 	default:
-		panic("unsupported Index type")
+		return nil, errs.ErrUnsupportedIndexType
 	}
-	return nil
 }
 
 type ItemSelf struct {
@@ -117,6 +133,7 @@ type Iterator interface {
 	/**
 	 * Close
 	 * @Description:关闭迭代器，释放相应资源
+	 * @return error
 	 */
-	Close()
+	Close() error
 }
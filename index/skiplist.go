@@ -0,0 +1,396 @@
+package index
+
+import (
+	"bytes"
+	"kv_projects/data"
+	"math/rand"
+	"runtime"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	// 跳表的最大层数，每层晋升概率为 1/4，足够容纳上亿的 key
+	skipListMaxLevel = 20
+	skipListP        = 4
+)
+
+// 跳表节点
+// 节点的删除分为两步：先在节点上打删除标记（逻辑删除），再在前驱节点的锁保护下从各层链表中摘除（物理删除）
+// 被摘除的节点仍然保留自己的 next 指针，正在遍历它的读者可以继续往后走
+type skipListNode struct {
+	key         []byte
+	pos         atomic.Pointer[data.LogRecordPos]
+	next        []atomic.Pointer[skipListNode]
+	mu          sync.Mutex
+	marked      atomic.Bool // 已被逻辑删除
+	fullyLinked atomic.Bool // 所有层都已经链接完成，之后才对读者可见
+}
+
+func newSkipListNode(key []byte, pos *data.LogRecordPos, level int) *skipListNode {
+	node := &skipListNode{
+		key:  key,
+		next: make([]atomic.Pointer[skipListNode], level),
+	}
+	node.pos.Store(pos)
+	return node
+}
+
+func (n *skipListNode) topLevel() int {
+	return len(n.next) - 1
+}
+
+// 节点对读者可见：已经完整链接并且没有被删除
+func (n *skipListNode) live() bool {
+	return n.fullyLinked.Load() && !n.marked.Load()
+}
+
+// SkipListIndex 跳表索引
+// 读操作（Get、迭代器）不加锁，只通过原子指针访问；写操作只锁住需要修改的前驱节点，不同位置的写入可以并发进行
+type SkipListIndex struct {
+	head *skipListNode
+	size atomic.Int64
+}
+
+/**
+ * NewSkipListIndex
+ * @Description: 初始化跳表索引
+ * @return *SkipListIndex
+ */
+func NewSkipListIndex() *SkipListIndex {
+	head := newSkipListNode(nil, nil, skipListMaxLevel)
+	head.fullyLinked.Store(true)
+	return &SkipListIndex{head: head}
+}
+
+func randomSkipListLevel() int {
+	level := 1
+	for level < skipListMaxLevel && rand.Intn(skipListP) == 0 {
+		level++
+	}
+	return level
+}
+
+/**
+ * find
+ * @Description: 查找 key 在每一层的前驱和后继节点，不加锁
+ * @receiver sl
+ * @param key
+ * @param preds 每一层中最后一个小于 key 的节点
+ * @param succs 每一层中第一个大于等于 key 的节点
+ * @return int 找到 key 的最高层，没有找到返回 -1
+ */
+func (sl *SkipListIndex) find(key []byte, preds, succs []*skipListNode) int {
+	found := -1
+	pred := sl.head
+	for level := skipListMaxLevel - 1; level >= 0; level-- {
+		curr := pred.next[level].Load()
+		for curr != nil && bytes.Compare(curr.key, key) < 0 {
+			pred = curr
+			curr = pred.next[level].Load()
+		}
+		if found == -1 && curr != nil && bytes.Equal(curr.key, key) {
+			found = level
+		}
+		if preds != nil {
+			preds[level] = pred
+			succs[level] = curr
+		}
+	}
+	return found
+}
+
+// 解锁 preds 中 [0, highest] 层加过锁的节点，同一个节点可能出现在多层，只解锁一次
+func unlockSkipListPreds(preds []*skipListNode, highest int) {
+	var prev *skipListNode
+	for level := 0; level <= highest; level++ {
+		if preds[level] != prev {
+			preds[level].mu.Unlock()
+			prev = preds[level]
+		}
+	}
+}
+
+/**
+ * Put
+ * @Description: 跳表中插入数据，key 已经存在时更新位置信息
+ * @receiver sl
+ * @param key
+ * @param pos
+ * @return *data.LogRecordPos 旧的位置信息
+ */
+func (sl *SkipListIndex) Put(key []byte, pos *data.LogRecordPos) (*data.LogRecordPos, error) {
+	level := randomSkipListLevel()
+	var preds, succs [skipListMaxLevel]*skipListNode
+	for {
+		if found := sl.find(key, preds[:], succs[:]); found != -1 {
+			node := succs[found]
+			if node.marked.Load() {
+				// 节点正在被删除，等它被摘除后重试
+				runtime.Gosched()
+				continue
+			}
+			for !node.fullyLinked.Load() {
+				runtime.Gosched()
+			}
+			// 加锁保证更新不会和删除交叉，否则新写入的位置可能随着被删除的节点一起丢失
+			node.mu.Lock()
+			if node.marked.Load() {
+				node.mu.Unlock()
+				continue
+			}
+			oldPos := node.pos.Swap(pos)
+			node.mu.Unlock()
+			return oldPos, nil
+		}
+
+		// 从低到高锁住每一层的前驱节点，并校验前驱和后继关系没有被并发修改
+		var prev *skipListNode
+		highest := -1
+		valid := true
+		for l := 0; valid && l < level; l++ {
+			pred, succ := preds[l], succs[l]
+			if pred != prev {
+				pred.mu.Lock()
+				prev = pred
+			}
+			highest = l
+			valid = !pred.marked.Load() && (succ == nil || !succ.marked.Load()) && pred.next[l].Load() == succ
+		}
+		if !valid {
+			unlockSkipListPreds(preds[:], highest)
+			continue
+		}
+
+		node := newSkipListNode(key, pos, level)
+		for l := 0; l < level; l++ {
+			node.next[l].Store(succs[l])
+		}
+		for l := 0; l < level; l++ {
+			preds[l].next[l].Store(node)
+		}
+		node.fullyLinked.Store(true)
+		unlockSkipListPreds(preds[:], highest)
+		sl.size.Add(1)
+		return nil, nil
+	}
+}
+
+/**
+ * Get
+ * @Description: 根据 key 从跳表中取出数据，不加锁
+ * @receiver sl
+ * @param key
+ * @return *data.LogRecordPos
+ */
+func (sl *SkipListIndex) Get(key []byte) (*data.LogRecordPos, error) {
+	pred := sl.head
+	for level := skipListMaxLevel - 1; level >= 0; level-- {
+		curr := pred.next[level].Load()
+		for curr != nil && bytes.Compare(curr.key, key) < 0 {
+			pred = curr
+			curr = pred.next[level].Load()
+		}
+		if curr != nil && bytes.Equal(curr.key, key) {
+			if !curr.live() {
+				return nil, nil
+			}
+			return curr.pos.Load(), nil
+		}
+	}
+	return nil, nil
+}
+
+/**
+ * Delete
+ * @Description: 删除 key，先打删除标记再从各层链表中摘除
+ * @receiver sl
+ * @param key
+ * @return *data.LogRecordPos
+ * @return bool
+ */
+func (sl *SkipListIndex) Delete(key []byte) (*data.LogRecordPos, bool, error) {
+	var preds, succs [skipListMaxLevel]*skipListNode
+	var victim *skipListNode
+	for {
+		found := sl.find(key, preds[:], succs[:])
+		if victim == nil {
+			// 只有在节点完整链接、并且是在它的最高层找到时才能删除，否则说明节点还在插入或者正在被删除，
+			// 可以认为这次删除发生在插入之前或者另一次删除之后
+			if found == -1 {
+				return nil, false, nil
+			}
+			node := succs[found]
+			if !node.fullyLinked.Load() || node.topLevel() != found || node.marked.Load() {
+				return nil, false, nil
+			}
+			node.mu.Lock()
+			if node.marked.Load() {
+				node.mu.Unlock()
+				return nil, false, nil
+			}
+			node.marked.Store(true)
+			victim = node
+		}
+
+		// 锁住每一层的前驱节点，校验它们仍然指向被删除的节点
+		var prev *skipListNode
+		highest := -1
+		valid := true
+		for l := 0; valid && l <= victim.topLevel(); l++ {
+			pred := preds[l]
+			if pred != prev {
+				pred.mu.Lock()
+				prev = pred
+			}
+			highest = l
+			valid = !pred.marked.Load() && pred.next[l].Load() == victim
+		}
+		if !valid {
+			unlockSkipListPreds(preds[:], highest)
+			continue
+		}
+
+		for l := victim.topLevel(); l >= 0; l-- {
+			preds[l].next[l].Store(victim.next[l].Load())
+		}
+		oldPos := victim.pos.Load()
+		victim.mu.Unlock()
+		unlockSkipListPreds(preds[:], highest)
+		sl.size.Add(-1)
+		return oldPos, true, nil
+	}
+}
+
+func (sl *SkipListIndex) Size() (int, error) {
+	return int(sl.size.Load()), nil
+}
+
+func (sl *SkipListIndex) Iterator(reverse bool) (Iterator, error) {
+	iter := &SkipListIterator{list: sl, reverse: reverse}
+	iter.Rewind()
+	return iter, nil
+}
+
+func (sl *SkipListIndex) Close() error {
+	return nil
+}
+
+// 最后一个小于 key 的存活节点，key 为 nil 时返回最后一个存活节点
+func (sl *SkipListIndex) findLess(key []byte) *skipListNode {
+	pred := sl.findPred(key, key == nil)
+	// 找到的节点可能已经被删除，没有前驱指针，只能以它为界重新查找
+	for pred != sl.head && !pred.live() {
+		pred = sl.findPred(pred.key, false)
+	}
+	if pred == sl.head {
+		return nil
+	}
+	return pred
+}
+
+// 第 0 层中最后一个小于 key 的节点，不存在时返回头节点，toEnd 为 true 时返回最后一个节点
+func (sl *SkipListIndex) findPred(key []byte, toEnd bool) *skipListNode {
+	pred := sl.head
+	for level := skipListMaxLevel - 1; level >= 0; level-- {
+		curr := pred.next[level].Load()
+		for curr != nil && (toEnd || bytes.Compare(curr.key, key) < 0) {
+			pred = curr
+			curr = pred.next[level].Load()
+		}
+	}
+	return pred
+}
+
+// 第一个大于等于 key 的存活节点
+func (sl *SkipListIndex) findGreaterOrEqual(key []byte) *skipListNode {
+	return nextLiveSkipListNode(sl.findPred(key, false).next[0].Load())
+}
+
+func nextLiveSkipListNode(node *skipListNode) *skipListNode {
+	for node != nil && !node.live() {
+		node = node.next[0].Load()
+	}
+	return node
+}
+
+// SkipListIterator 跳表索引迭代器
+// 迭代器直接在跳表上移动，不复制数据，遍历期间并发写入的 key 可能会被看到，也可能看不到
+type SkipListIterator struct {
+	list    *SkipListIndex
+	reverse bool
+	curr    *skipListNode
+	pos     *data.LogRecordPos // 移动到当前节点时读取的位置信息
+}
+
+func (si *SkipListIterator) moveTo(node *skipListNode) {
+	si.curr = node
+	si.pos = nil
+	if node != nil {
+		si.pos = node.pos.Load()
+	}
+}
+
+/**
+ * Rewind
+ * @Description:重新回到迭代器的起点，即第一个数据
+ */
+func (si *SkipListIterator) Rewind() {
+	if si.reverse {
+		si.moveTo(si.list.findLess(nil))
+	} else {
+		si.moveTo(nextLiveSkipListNode(si.list.head.next[0].Load()))
+	}
+}
+
+/**
+ * Seek
+ * @Description:根据传入的 key 查找到第一个大于（或小于）等于的目标 key，根据从这个 key 开始遍历
+ * @param key
+ */
+func (si *SkipListIterator) Seek(key []byte) {
+	if !si.reverse {
+		si.moveTo(si.list.findGreaterOrEqual(key))
+		return
+	}
+	// 反向遍历时找小于等于 key 的节点
+	node := si.list.findGreaterOrEqual(key)
+	if node != nil && bytes.Equal(node.key, key) {
+		si.moveTo(node)
+		return
+	}
+	si.moveTo(si.list.findLess(key))
+}
+
+/**
+ * Next
+ * @Description:跳转到下一个 key，反向遍历时节点没有前驱指针，需要重新查找前一个 key
+ */
+func (si *SkipListIterator) Next() {
+	if si.curr == nil {
+		return
+	}
+	if si.reverse {
+		si.moveTo(si.list.findLess(si.curr.key))
+	} else {
+		si.moveTo(nextLiveSkipListNode(si.curr.next[0].Load()))
+	}
+}
+
+func (si *SkipListIterator) Valid() bool {
+	return si.curr != nil
+}
+
+func (si *SkipListIterator) Key() []byte {
+	return si.curr.key
+}
+
+func (si *SkipListIterator) Value() *data.LogRecordPos {
+	return si.pos
+}
+
+func (si *SkipListIterator) Close() error {
+	si.curr = nil
+	si.pos = nil
+	return nil
+}
@@ -0,0 +1,143 @@
+package index
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"kv_projects/data"
+	"sync"
+	"testing"
+)
+
+func TestSkipListIndex_PutGetDelete(t *testing.T) {
+	sl := NewSkipListIndex()
+
+	res1, err := sl.Put(nil, &data.LogRecordPos{Fid: 1, Offset: 100})
+	assert.Nil(t, err)
+	assert.Nil(t, res1)
+	pos1, err := sl.Get(nil)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(100), pos1.Offset)
+
+	res2, err := sl.Put([]byte("a"), &data.LogRecordPos{Fid: 1, Offset: 2})
+	assert.Nil(t, err)
+	assert.Nil(t, res2)
+	res3, err := sl.Put([]byte("a"), &data.LogRecordPos{Fid: 1, Offset: 3})
+	assert.Nil(t, err)
+	assert.Equal(t, int64(2), res3.Offset)
+	assert.Equal(t, int64(3), mustGet(t, sl, []byte("a")).Offset)
+	assert.Equal(t, 2, mustSize(t, sl))
+
+	res4, ok, err := sl.Delete([]byte("a"))
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, int64(3), res4.Offset)
+	assert.Nil(t, mustGet(t, sl, []byte("a")))
+	_, ok, err = sl.Delete([]byte("a"))
+	assert.Nil(t, err)
+	assert.False(t, ok)
+	assert.Equal(t, 1, mustSize(t, sl))
+
+	// 删除后重新写入
+	assert.Nil(t, mustPut(t, sl, []byte("a"), &data.LogRecordPos{Fid: 1, Offset: 4}))
+	assert.Equal(t, int64(4), mustGet(t, sl, []byte("a")).Offset)
+}
+
+func TestSkipListIndex_Iterator(t *testing.T) {
+	sl := NewSkipListIndex()
+	iter1, err := sl.Iterator(false)
+	assert.Nil(t, err)
+	assert.False(t, iter1.Valid())
+
+	for _, key := range []string{"ccde", "acee", "eede", "bbcd"} {
+		sl.Put([]byte(key), &data.LogRecordPos{Fid: 1, Offset: 10})
+	}
+
+	var keys []string
+	iter2, err := sl.Iterator(false)
+	assert.Nil(t, err)
+	for iter2.Rewind(); iter2.Valid(); iter2.Next() {
+		keys = append(keys, string(iter2.Key()))
+		assert.NotNil(t, iter2.Value())
+	}
+	assert.Equal(t, []string{"acee", "bbcd", "ccde", "eede"}, keys)
+
+	keys = nil
+	iter3, err := sl.Iterator(true)
+	assert.Nil(t, err)
+	for iter3.Rewind(); iter3.Valid(); iter3.Next() {
+		keys = append(keys, string(iter3.Key()))
+	}
+	assert.Equal(t, []string{"eede", "ccde", "bbcd", "acee"}, keys)
+
+	iter2.Seek([]byte("cc"))
+	assert.Equal(t, "ccde", string(iter2.Key()))
+	iter2.Seek([]byte("zz"))
+	assert.False(t, iter2.Valid())
+
+	iter3.Seek([]byte("cc"))
+	assert.Equal(t, "bbcd", string(iter3.Key()))
+	iter3.Seek([]byte("ccde"))
+	assert.Equal(t, "ccde", string(iter3.Key()))
+	iter3.Seek([]byte("a"))
+	assert.False(t, iter3.Valid())
+
+	// 迭代器遍历的是跳表本身，之后删除的 key 不会再被遍历到
+	iter2.Rewind()
+	sl.Delete([]byte("bbcd"))
+	keys = nil
+	for ; iter2.Valid(); iter2.Next() {
+		keys = append(keys, string(iter2.Key()))
+	}
+	assert.Equal(t, []string{"acee", "ccde", "eede"}, keys)
+}
+
+func TestSkipListIndex_Concurrent(t *testing.T) {
+	sl := NewSkipListIndex()
+	wg := new(sync.WaitGroup)
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 2000; i++ {
+				key := []byte(fmt.Sprintf("key-%d-%d", g, i))
+				sl.Put(key, &data.LogRecordPos{Fid: uint32(g), Offset: int64(i)})
+				pos, err := sl.Get(key)
+				assert.Nil(t, err)
+				assert.Equal(t, int64(i), pos.Offset)
+				if i%2 == 0 {
+					_, ok, err := sl.Delete(key)
+					assert.Nil(t, err)
+					assert.True(t, ok)
+				}
+			}
+		}(g)
+	}
+	// 并发写入的同时进行遍历，遍历结果必须保持有序
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for n := 0; n < 20; n++ {
+			iter, _ := sl.Iterator(n%2 == 1)
+			var prev []byte
+			for iter.Rewind(); iter.Valid(); iter.Next() {
+				if prev != nil {
+					if n%2 == 1 {
+						assert.True(t, string(prev) > string(iter.Key()))
+					} else {
+						assert.True(t, string(prev) < string(iter.Key()))
+					}
+				}
+				prev = iter.Key()
+			}
+		}
+	}()
+	wg.Wait()
+
+	assert.Equal(t, 8*1000, mustSize(t, sl))
+	iter, _ := sl.Iterator(false)
+	count := 0
+	for iter.Rewind(); iter.Valid(); iter.Next() {
+		count++
+	}
+	assert.Equal(t, 8*1000, count)
+}
@@ -1,6 +1,7 @@
 package redis
 
 import (
+	"context"
 	"encoding/binary"
 	"kv_projects/conf"
 	"kv_projects/db"
@@ -343,6 +344,12 @@ func (rds *RedisDataStructure) RPop(key []byte) ([]byte, error) {
  * @return error
  */
 func (rds *RedisDataStructure) pushInner(key, element []byte, isLeft bool) (uint32, error) {
+	// 元数据的读取和更新需要对同一个 key 串行执行，否则并发的 push/pop 会使用相同的 head/tail
+	wb := rds.db.NewWriteBatch(&conf.DefaultWriteBatchOptions)
+	defer wb.Rollback()
+	if err := wb.LockKeys(context.Background(), key); err != nil {
+		return 0, err
+	}
 	// 查找元数据
 	meta, err := rds.FindMetadata(key, List)
 	if err != nil {
@@ -362,7 +369,6 @@ func (rds *RedisDataStructure) pushInner(key, element []byte, isLeft bool) (uint
 	}
 
 	// 更新元数据和数据部分
-	wb := rds.db.NewWriteBatch(&conf.DefaultWriteBatchOptions)
 	meta.size++
 	if isLeft {
 		meta.head--
@@ -379,6 +385,11 @@ func (rds *RedisDataStructure) pushInner(key, element []byte, isLeft bool) (uint
 }
 
 func (rds *RedisDataStructure) popInner(key []byte, isLeft bool) ([]byte, error) {
+	wb := rds.db.NewWriteBatch(&conf.DefaultWriteBatchOptions)
+	defer wb.Rollback()
+	if err := wb.LockKeys(context.Background(), key); err != nil {
+		return nil, err
+	}
 	// 查找元数据
 	meta, err := rds.FindMetadata(key, List)
 	if err != nil {
@@ -414,8 +425,8 @@ func (rds *RedisDataStructure) popInner(key []byte, isLeft bool) ([]byte, error)
 		return nil, err
 	}
 	// 更新元数据
-	err = rds.db.Put(key, meta.encoderMetadata())
-	if err != nil {
+	_ = wb.Put(key, meta.encoderMetadata())
+	if err = wb.Commit(); err != nil {
 		return nil, err
 	}
 	return element, nil
@@ -7,6 +7,7 @@ import (
 	"kv_projects/errs"
 	"kv_projects/utils"
 	"os"
+	"sync"
 	"testing"
 	"time"
 )
@@ -254,6 +255,70 @@ func TestRedisDataStructure_RPop(t *testing.T) {
 	assert.NotNil(t, val)
 }
 
+// 并发 push/pop 同一个 list，元数据的更新不能丢失
+func TestRedisDataStructure_ConcurrentPushPop(t *testing.T) {
+	opts := conf.DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-redis-list")
+	opts.DirPath = dir
+	rds, err := NewRedisDataStructure(opts)
+	defer destroyDB(rds.db)
+	assert.Nil(t, err)
+
+	key := utils.GetTestKey(1)
+	wg := new(sync.WaitGroup)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				var err error
+				if i%2 == 0 {
+					_, err = rds.LPush(key, []byte("val"))
+				} else {
+					_, err = rds.RPush(key, []byte("val"))
+				}
+				assert.Nil(t, err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	popped := make(chan int, 8)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			count := 0
+			for j := 0; j < 25; j++ {
+				var val []byte
+				var err error
+				if i%2 == 0 {
+					val, err = rds.LPop(key)
+				} else {
+					val, err = rds.RPop(key)
+				}
+				assert.Nil(t, err)
+				if val != nil {
+					count++
+				}
+			}
+			popped <- count
+		}(i)
+	}
+	wg.Wait()
+	close(popped)
+	total := 0
+	for count := range popped {
+		total += count
+	}
+	assert.Equal(t, 200, total)
+
+	// push 400 次，pop 200 次，剩下 200 个元素
+	size, err := rds.RPush(key, []byte("val"))
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(201), size)
+}
+
 func TestRedisDataStructure_ZScore(t *testing.T) {
 	opts := conf.DefaultOptions
 	opts.DirPath = "./temp"
@@ -0,0 +1,19 @@
+package utils
+
+import (
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestAvailableDiskSize(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "bitcask-go-disk")
+	defer os.RemoveAll(dir)
+	size, err := AvailableDiskSize(dir)
+	assert.Nil(t, err)
+	assert.True(t, size > 0)
+
+	_, err = AvailableDiskSize(filepath.Join(dir, "not-exist"))
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,21 @@
+//go:build linux || darwin || freebsd || dragonfly
+
+package utils
+
+import "syscall"
+
+/**
+ * AvailableDiskSize
+ * @Description: 获取目录所在文件系统的剩余容量大小，只统计非特权用户可以使用的部分
+ * @param dirPath
+ * @return uint64
+ * @return error
+ */
+func AvailableDiskSize(dirPath string) (uint64, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(dirPath, &stat); err != nil {
+		return 0, err
+	}
+	// 不同平台上字段的类型不同，统一转换
+	return uint64(stat.Bavail) * uint64(stat.Bsize), nil
+}
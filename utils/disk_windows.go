@@ -0,0 +1,47 @@
+//go:build windows
+
+package utils
+
+import (
+	"path/filepath"
+	"syscall"
+	"unsafe"
+)
+
+/**
+ * AvailableDiskSize
+ * @Description: 获取目录所在磁盘的剩余容量大小，只统计当前用户可以使用的部分
+ * @param dirPath
+ * @return uint64
+ * @return error
+ */
+func AvailableDiskSize(dirPath string) (uint64, error) {
+	// GetDiskFreeSpaceExW 接受磁盘上的任意目录，相对路径先转换为绝对路径
+	absPath, err := filepath.Abs(dirPath)
+	if err != nil {
+		return 0, err
+	}
+	pathPtr, err := syscall.UTF16PtrFromString(absPath)
+	if err != nil {
+		return 0, err
+	}
+	h, err := syscall.LoadDLL("kernel32.dll")
+	if err != nil {
+		return 0, err
+	}
+	c, err := h.FindProc("GetDiskFreeSpaceExW")
+	if err != nil {
+		return 0, err
+	}
+	lpFreeBytesAvailable := uint64(0)
+	lpTotalNumberOfBytes := uint64(0)
+	lpTotalNumberOfFreeBytes := uint64(0)
+	r1, _, err := c.Call(uintptr(unsafe.Pointer(pathPtr)),
+		uintptr(unsafe.Pointer(&lpFreeBytesAvailable)),
+		uintptr(unsafe.Pointer(&lpTotalNumberOfBytes)),
+		uintptr(unsafe.Pointer(&lpTotalNumberOfFreeBytes)))
+	if r1 == 0 {
+		return 0, err
+	}
+	return lpFreeBytesAvailable, nil
+}
@@ -1,28 +1,22 @@
 package utils
 
 import (
-	"fmt"
-	"io/fs"
+	"kv_projects/fio"
 	"os"
 	"path/filepath"
-	"strings"
-	"syscall"
-	"unsafe"
 )
 
 /**
  * DirSize
  * @Description: 获取目录占用空间的大小
+ * @param fsys 目录所在的文件系统
  * @param dirPath
  * @return int64
  * @return error
  */
-func DirSize(dirPath string) (uint64, error) {
+func DirSize(fsys fio.FileSystem, dirPath string) (uint64, error) {
 	var size uint64
-	err := filepath.Walk(dirPath, func(path string, info fs.FileInfo, err error) error {
-		if err != nil {
-			return err
-		}
+	err := walk(fsys, dirPath, func(path string, info os.FileInfo) error {
 		if !info.IsDir() {
 			size += uint64(info.Size())
 		}
@@ -34,62 +28,38 @@ func DirSize(dirPath string) (uint64, error) {
 	return size, nil
 }
 
-/**
- * AvailableDiskSize
- * @Description: 获取当前磁盘剩余容量大小,适用于windows系统
- * @return uint64
- * @return error
- */
-func AvailableDiskSize() (uint64, error) {
-	// 获取当前工作目录
-	currenDir, err := syscall.Getwd()
-	if err != nil {
-		return 0, err
-	}
-	// 获取当前文件夹在那个磁盘上
-	volumeName := filepath.VolumeName(currenDir)
-	h := syscall.MustLoadDLL("kernel32.dll")
-	c := h.MustFindProc("GetDiskFreeSpaceExW")
-	lpFreeBytesAvailable := int64(0)
-	lpTotalNumberOfBytes := int64(0)
-	lpTotalNumberOfFreeBytes := int64(0)
-	r2, _, err := c.Call(uintptr(unsafe.Pointer(syscall.StringToUTF16Ptr(volumeName))),
-		uintptr(unsafe.Pointer(&lpFreeBytesAvailable)),
-		uintptr(unsafe.Pointer(&lpTotalNumberOfBytes)),
-		uintptr(unsafe.Pointer(&lpTotalNumberOfFreeBytes)))
-	if r2 == 0 {
-		fmt.Println("Syscall6 调用失败:", err)
-		return 0, err
-	} else {
-		//fmt.Printf("总空间: %.2f GB\n", float64(lpTotalNumberOfBytes)/float64(1024*1024*1024))
-		//fmt.Printf("可用空间: %.2f GB\n", float64(lpFreeBytesAvailable)/float64(1024*1024*1024))
-		//fmt.Printf("总可用空间: %.2f GB\n", float64(lpTotalNumberOfFreeBytes)/float64(1024*1024*1024))
-		// 返回剩余字节数
-		return uint64(lpTotalNumberOfFreeBytes), nil
-	}
-}
-
 /**
  * CopyDir
- * @Description: 将给出的源路径内容拷贝到目的路径
+ * @Description: 将给出的源路径内容拷贝到目的路径，源路径和目的路径都在 fsys 中
+ * @param fsys
  * @param src
  * @param dest
  * @param extends  需要排除的文件，不进行拷贝
  * @return error
  */
-func CopyDir(src, dest string, extends []string) error {
-	if _, err := os.Stat(dest); os.IsNotExist(err) {
-		err := os.MkdirAll(dest, os.ModePerm)
+func CopyDir(fsys fio.FileSystem, src, dest string, extends []string) error {
+	return CopyDirWithReader(fsys, src, dest, extends, func(name string) ([]byte, error) {
+		return fio.ReadFile(fsys, name)
+	})
+}
+
+// CopyDirWithReader 和 CopyDir 相同，源文件的内容通过 readFile 读取
+func CopyDirWithReader(fsys fio.FileSystem, src, dest string, extends []string, readFile func(name string) ([]byte, error)) error {
+	if _, err := fsys.Stat(dest); os.IsNotExist(err) {
+		err := fsys.MkdirAll(dest, os.ModePerm)
 		if err != nil {
 			return err
 		}
 	}
 	// 递归遍历源路径，复制文件夹下全部内容
-	return filepath.Walk(src, func(path string, info fs.FileInfo, err error) error {
-		// 获取文件名称
-		//例：path:/data/test/000.data  src:/data/test/,在path中将src用空替换得到000.data文件名
-		fileName := strings.Replace(path, src, "", 1)
-		if fileName == "" {
+	return walk(fsys, src, func(path string, info os.FileInfo) error {
+		// 获取相对于源路径的文件名称
+		//例：path:/data/test/000.data  src:/data/test/,得到000.data文件名
+		fileName, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		if fileName == "." {
 			return nil
 		}
 
@@ -106,13 +76,42 @@ func CopyDir(src, dest string, extends []string) error {
 
 		// 文件夹直接在备份的目录中创建
 		if info.IsDir() {
-			return os.MkdirAll(filepath.Join(dest, info.Name()), info.Mode())
+			return fsys.MkdirAll(filepath.Join(dest, fileName), info.Mode().Perm())
 		}
 
-		data, err := os.ReadFile(path)
+		data, err := readFile(path)
 		if err != nil {
 			return err
 		}
-		return os.WriteFile(filepath.Join(dest, fileName), data, info.Mode())
+		return fio.WriteFile(fsys, filepath.Join(dest, fileName), data, info.Mode().Perm())
 	})
 }
+
+// 按照名称顺序递归遍历 fsys 中 root 下的所有文件和目录，包括 root 本身
+func walk(fsys fio.FileSystem, root string, fn func(path string, info os.FileInfo) error) error {
+	info, err := fsys.Stat(root)
+	if err != nil {
+		return err
+	}
+	return walkDir(fsys, root, info, fn)
+}
+
+func walkDir(fsys fio.FileSystem, path string, info os.FileInfo, fn func(path string, info os.FileInfo) error) error {
+	if err := fn(path, info); err != nil || !info.IsDir() {
+		return err
+	}
+	entries, err := fsys.ReadDir(path)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		childInfo, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		if err := walkDir(fsys, filepath.Join(path, entry.Name()), childInfo, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}